@@ -0,0 +1,100 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type AmendOptions struct {
+	FilePath     string
+	Compat       string
+	RefcountBits int
+	Progress     bool
+}
+
+func newAmendCmd() *cobra.Command {
+
+	var opts AmendOptions
+	var cmd = &cobra.Command{
+		Use:   "amend",
+		Short: "amend the options of a qcow2 file",
+		Long:  "qcow2_utils amend <-f filename> [--compat 0.10|1.1] [--refcount-bits bits] [--progress]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.FilePath == "" || (opts.Compat == "" && opts.RefcountBits == 0) {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Compat != "" && opts.Compat != qcow2.COMPAT_V2 && opts.Compat != qcow2.COMPAT_V3 {
+				fmt.Printf("compatibility level %s is not supported\n", opts.Compat)
+				os.Exit(1)
+			}
+			amendOpts := map[string]any{}
+			if opts.Compat != "" {
+				amendOpts[qcow2.OPT_COMPAT] = opts.Compat
+			}
+			if opts.RefcountBits != 0 {
+				amendOpts[qcow2.OPT_REFCOUNT_BITS] = opts.RefcountBits
+			}
+
+			err := amendQcow2(opts.FilePath, amendOpts, opts.Progress)
+			if err != nil {
+				fmt.Printf("amend qcow2 file failed, err:%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("amend qcow2 file successfully\n")
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.FilePath, "filename", "f", "", "specify the file name")
+	flags.StringVarP(&opts.Compat, "compat", "", "", "specify the compatibility level, '0.10' (version 2) or '1.1' (version 3)")
+	flags.IntVarP(&opts.RefcountBits, "refcount-bits", "", 0, "specify the width of a refcount entry, a power of two up to 64")
+	flags.BoolVarP(&opts.Progress, "progress", "p", false, "show the progress")
+	return cmd
+}
+
+func amendQcow2(filename string, options map[string]any, progress bool) error {
+
+	var root *qcow2.BdrvChild
+	var err error
+	var progressFn qcow2.ProgressFunc
+
+	if root, err = qcow2.Blk_Open(filename,
+		map[string]any{qcow2.OPT_FMT: QCOW2_FORMAT, qcow2.OPT_FILENAME: filename}, qcow2.BDRV_O_RDWR); err != nil {
+		return fmt.Errorf("failed to open qcow2 file: %s, err: %v", filename, err)
+	}
+	defer qcow2.Blk_Close(root)
+
+	if progress {
+		progressFn = func(current uint64, total uint64) {
+			fmt.Printf("\r    (%.2f/100%%)", float64(current)*100/float64(total))
+			if current == total {
+				fmt.Println()
+			}
+		}
+	}
+	return qcow2.Blk_Amend(root, options, progressFn)
+}
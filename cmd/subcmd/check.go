@@ -0,0 +1,150 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type CheckOptions struct {
+	FilePath string
+	Repair   string
+	Output   string
+}
+
+func newCheckCmd() *cobra.Command {
+
+	var opts CheckOptions
+	var cmd = &cobra.Command{
+		Use:   "check",
+		Short: "check the consistency of the specified qcow2 file",
+		Long:  "qcow2_utils check <-f filename> [-r leaks|all|rebuild] [--output human|json]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var fix qcow2.BdrvCheckMode
+			if opts.FilePath == "" {
+				cmd.Help()
+				os.Exit(1)
+			}
+			switch opts.Repair {
+			case "":
+			case "leaks":
+				fix = qcow2.BDRV_FIX_LEAKS
+			case "all":
+				fix = qcow2.BDRV_FIX_LEAKS | qcow2.BDRV_FIX_ERRORS
+			case "rebuild":
+				fix = qcow2.BDRV_FIX_LEAKS | qcow2.BDRV_FIX_ERRORS | qcow2.BDRV_FIX_REBUILD
+			default:
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				cmd.Help()
+				os.Exit(1)
+			}
+
+			//exit with 0 if the image is consistent, 1 if the check failed, 2 on corruptions
+			//and 3 on leaks only, as qemu-img does
+			res, err := checkQcow2(opts.FilePath, fix, opts.Output)
+			if err != nil {
+				fmt.Printf("check qcow2 file failed, err:%v\n", err)
+				os.Exit(1)
+			}
+			switch {
+			case res.CheckErrors > 0:
+				os.Exit(1)
+			case res.Corruptions > 0:
+				os.Exit(2)
+			case res.Leaks > 0:
+				os.Exit(3)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.FilePath, "filename", "f", "", "specify the file name")
+	flags.StringVarP(&opts.Repair, "repair", "r", "", "repair the image, 'leaks' repairs only the leaked clusters, 'all' repairs all kinds of errors, 'rebuild' rebuilds the refcount structures from scratch")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+	return cmd
+}
+
+func checkQcow2(filename string, fix qcow2.BdrvCheckMode, output string) (*qcow2.BlockCheckResult, error) {
+
+	var root *qcow2.BdrvChild
+	var res *qcow2.BlockCheckResult
+	var err error
+	flags := qcow2.BDRV_O_CHECK
+	if fix != 0 {
+		flags |= qcow2.BDRV_O_RDWR
+	}
+	opts := make(map[string]any)
+	opts[qcow2.OPT_FMT] = "qcow2"
+	opts[qcow2.OPT_FILENAME] = filename
+
+	if root, err = qcow2.Blk_Open(filename, opts, flags); err != nil {
+		return nil, fmt.Errorf("failed to open qcow2 file: %s, err: %v", filename, err)
+	}
+	defer qcow2.Blk_Close(root)
+
+	if res, err = qcow2.Blk_Check(root, fix); err != nil {
+		return nil, err
+	}
+
+	if output == "json" {
+		bytes, _ := json.MarshalIndent(res, "", "\t")
+		fmt.Println(string(bytes))
+		return res, nil
+	}
+
+	for _, msg := range res.Messages {
+		fmt.Println(msg)
+	}
+	if res.LeaksFixed > 0 || res.CorruptionsFixed > 0 {
+		fmt.Printf("The following inconsistencies were found and repaired:\n\n"+
+			"    %d leaked clusters\n    %d corruptions\n\n", res.LeaksFixed, res.CorruptionsFixed)
+	}
+	if res.Corruptions == 0 && res.Leaks == 0 && res.CheckErrors == 0 {
+		fmt.Println("No errors were found on the image.")
+	}
+	if res.Corruptions > 0 {
+		fmt.Printf("\n%d errors were found on the image.\n"+
+			"Data may be corrupted, or further writes to the image may corrupt it.\n", res.Corruptions)
+	}
+	if res.Leaks > 0 {
+		fmt.Printf("\n%d leaked clusters were found on the image.\n"+
+			"This means waste of disk space, but no harm to data.\n", res.Leaks)
+	}
+	if res.CheckErrors > 0 {
+		fmt.Printf("\n%d internal errors have occurred during the check.\n", res.CheckErrors)
+	}
+	if res.TotalClusters > 0 && res.AllocatedClusters > 0 {
+		fmt.Printf("%d/%d = %.2f%% allocated, %.2f%% fragmented\n",
+			res.AllocatedClusters, res.TotalClusters,
+			float64(res.AllocatedClusters)*100/float64(res.TotalClusters),
+			float64(res.FragmentedClusters)*100/float64(res.AllocatedClusters))
+	}
+	fmt.Printf("Image end offset: %d\n", res.ImageEndOffset)
+	return res, nil
+}
@@ -44,6 +44,15 @@ func NewCommand() *cobra.Command {
 		newCreateCmd(),
 		newInfoCmd(),
 		newDdCmd(),
+		newStreamCmd(),
+		newCheckCmd(),
+		newCompareCmd(),
+		newMapCmd(),
+		newMeasureCmd(),
+		newConvertCmd(),
+		newAmendCmd(),
+		newCompactCmd(),
+		newSparsifyCmd(),
 	)
 	return cmd
 }
@@ -0,0 +1,140 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type CompareOptions struct {
+	FilePath1 string
+	FilePath2 string
+	Format1   string
+	Format2   string
+	Strict    bool
+	Progress  bool
+	Output    string
+}
+
+func newCompareCmd() *cobra.Command {
+
+	var opts CompareOptions
+	var cmd = &cobra.Command{
+		Use:   "compare",
+		Short: "compare the guest visible content of two images",
+		Long:  "qcow2_utils compare <-a filename1> <-b filename2> [-f format1] [-F format2] [--strict] [--progress] [--output human|json]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.FilePath1 == "" || opts.FilePath2 == "" {
+				cmd.Help()
+				os.Exit(1)
+			}
+			for _, format := range []string{opts.Format1, opts.Format2} {
+				if _, ok := qcow2.Supported_Types[format]; format != "" && !ok {
+					fmt.Printf("file format %s is not supported\n", format)
+					os.Exit(1)
+				}
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				cmd.Help()
+				os.Exit(1)
+			}
+
+			//exit with 0 if the images are identical, 1 if they differ and 2 on errors
+			identical, err := compareImages(opts)
+			if err != nil {
+				fmt.Printf("compare images failed, err:%v\n", err)
+				os.Exit(2)
+			}
+			if !identical {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.FilePath1, "filename1", "a", "", "specify the first file name")
+	flags.StringVarP(&opts.FilePath2, "filename2", "b", "", "specify the second file name")
+	flags.StringVarP(&opts.Format1, "format1", "f", "", "specify the format of the first file, it is probed if not set")
+	flags.StringVarP(&opts.Format2, "format2", "F", "", "specify the format of the second file, it is probed if not set")
+	flags.BoolVarP(&opts.Strict, "strict", "s", false, "the allocation state and the image size must match as well")
+	flags.BoolVarP(&opts.Progress, "progress", "p", false, "show the progress")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+	return cmd
+}
+
+func openCompareImage(filename string, format string) (*qcow2.BdrvChild, error) {
+
+	var root *qcow2.BdrvChild
+	var err error
+	if format == "" {
+		if format, err = qcow2.Blk_Probe(filename); err != nil {
+			return nil, err
+		}
+	}
+	if root, err = qcow2.Blk_Open(filename,
+		map[string]any{qcow2.OPT_FMT: format, qcow2.OPT_FILENAME: filename}, 0); err != nil {
+		return nil, fmt.Errorf("failed to open file: %s, err: %v", filename, err)
+	}
+	return root, nil
+}
+
+func compareImages(opts CompareOptions) (bool, error) {
+
+	var root1, root2 *qcow2.BdrvChild
+	var res *qcow2.BlockCompareResult
+	var progressFn qcow2.ProgressFunc
+	var err error
+
+	if root1, err = openCompareImage(opts.FilePath1, opts.Format1); err != nil {
+		return false, err
+	}
+	defer qcow2.Blk_Close(root1)
+	if root2, err = openCompareImage(opts.FilePath2, opts.Format2); err != nil {
+		return false, err
+	}
+	defer qcow2.Blk_Close(root2)
+
+	if opts.Progress {
+		progressFn = func(current uint64, total uint64) {
+			fmt.Printf("\r    (%.2f/100%%)", float64(current)*100/float64(total))
+		}
+	}
+	if res, err = qcow2.Blk_Compare(root1, root2, opts.Strict, progressFn); err != nil {
+		return false, err
+	}
+	if opts.Progress {
+		//the progress may stop early at the first mismatch
+		fmt.Println()
+	}
+
+	if opts.Output == "json" {
+		bytes, _ := json.MarshalIndent(res, "", "\t")
+		fmt.Println(string(bytes))
+	} else {
+		fmt.Println(res.Message)
+	}
+	return res.Identical, nil
+}
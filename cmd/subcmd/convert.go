@@ -0,0 +1,189 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type ConvertOptions struct {
+	InputFile         string
+	OutputFile        string
+	InputFormat       string
+	OutputFormat      string
+	BackingPath       string
+	BackingFileFormat string
+	SubCluster        bool
+	ClusterSize       string
+	DataFile          string
+	Compress          bool
+	Progress          bool
+	L2CacheSize       string
+	Readers           int
+	Writers           int
+	InOrder           bool
+}
+
+func newConvertCmd() *cobra.Command {
+
+	var opts ConvertOptions
+	var cmd = &cobra.Command{
+		Use:   "convert",
+		Short: "convert an image into a new image, skipping the zero ranges",
+		Long:  "qcow2_utils convert [-f inputformat] <-i inputfile> [-O outputformat] <-o outputfile> [-B backingfile] [-F backingFileFormat] [--enable-subcluster] [--cluster-size size] [-d datafile] [-c] [--progress] [--l2-cache-size=size] [--readers n] [--writers n] [--in-order]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var l2CacheSize, clusterSize uint64
+			var ok bool
+			if opts.InputFile == "" || opts.OutputFile == "" {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if _, ok := qcow2.Supported_Types[opts.InputFormat]; opts.InputFormat != "" && !ok {
+				fmt.Printf("input file format %s is not supported\n", opts.InputFormat)
+				os.Exit(1)
+			}
+			if _, ok := qcow2.Supported_Types[opts.OutputFormat]; !ok {
+				fmt.Printf("output file format %s is not supported\n", opts.OutputFormat)
+				os.Exit(1)
+			}
+			if opts.L2CacheSize != "" {
+				if l2CacheSize, ok = str2Int(opts.L2CacheSize); !ok {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.ClusterSize != "" {
+				if clusterSize, ok = str2Int(opts.ClusterSize); !ok {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.Readers < 1 || opts.Readers > qcow2.CONVERT_MAX_WORKERS ||
+				opts.Writers < 1 || opts.Writers > qcow2.CONVERT_MAX_WORKERS {
+				fmt.Printf("the number of readers and writers must be between 1 and %d\n", qcow2.CONVERT_MAX_WORKERS)
+				os.Exit(1)
+			}
+			if opts.OutputFormat != QCOW2_FORMAT &&
+				(opts.BackingPath != "" || opts.DataFile != "" || opts.SubCluster || clusterSize > 0) {
+				fmt.Printf("output file format %s doesn't support the create options\n", opts.OutputFormat)
+				os.Exit(1)
+			}
+			if opts.Compress && (opts.OutputFormat != QCOW2_FORMAT || opts.DataFile != "") {
+				fmt.Println("compression is only supported by a qcow2 output file without a data file")
+				os.Exit(1)
+			}
+
+			if err := convertImage(&opts, clusterSize, l2CacheSize); err != nil {
+				fmt.Printf("convert image failed, err:%v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("convert image successfully")
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.InputFile, "inputfile", "i", "", "specify the input file name")
+	flags.StringVarP(&opts.OutputFile, "outputfile", "o", "", "specify the output file name, it must not exist")
+	flags.StringVarP(&opts.InputFormat, "inputformat", "f", "", "specify the input file format, it is probed if not set")
+	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", QCOW2_FORMAT, "specify the output file format")
+	flags.StringVarP(&opts.BackingPath, "backing", "B", "", "specify the backing file of the output file, only the data of the input file which differs from the backing chain is copied")
+	flags.StringVarP(&opts.BackingFileFormat, "backing-file-fmt", "F", "", "specify the backing file format")
+	flags.BoolVarP(&opts.SubCluster, "enable-subcluster", "", false, "")
+	flags.StringVarP(&opts.ClusterSize, "cluster-size", "", "", "specify the cluster size of the output file, valid unit is 'k', 'm'")
+	flags.StringVarP(&opts.DataFile, "datafile", "d", "", "specify the external data file path of the output file")
+	flags.BoolVarP(&opts.Compress, "compress", "c", false, "write the data clusters of the output file compressed")
+	flags.BoolVarP(&opts.Progress, "progress", "p", false, "show the progress")
+	flags.StringVarP(&opts.L2CacheSize, "l2-cache-size", "", "", "specify the l2 cache size")
+	flags.IntVarP(&opts.Readers, "readers", "", 4, "specify the number of goroutines reading the input file")
+	flags.IntVarP(&opts.Writers, "writers", "", 4, "specify the number of goroutines writing the output file")
+	flags.BoolVarP(&opts.InOrder, "in-order", "", false, "write the output file in order by a single writer for sequential host allocation")
+	return cmd
+}
+
+func convertImage(opts *ConvertOptions, clusterSize uint64, l2CacheSize uint64) error {
+
+	var inRoot, outRoot *qcow2.BdrvChild
+	var size uint64
+	var err error
+	var progressFn qcow2.ProgressFunc
+	inputFormat := opts.InputFormat
+
+	if inputFormat == "" {
+		if inputFormat, err = qcow2.Blk_Probe(opts.InputFile); err != nil {
+			return err
+		}
+	}
+	if inRoot, err = qcow2.Blk_Open(opts.InputFile,
+		map[string]any{qcow2.OPT_FMT: inputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize}, 0); err != nil {
+		return fmt.Errorf("failed to open file: %s, err: %v", opts.InputFile, err)
+	}
+	defer qcow2.Blk_Close(inRoot)
+	if size, err = qcow2.Blk_Getlength(inRoot); err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(opts.OutputFile); !os.IsNotExist(err) {
+		return fmt.Errorf("%s exists", opts.OutputFile)
+	}
+	createOpts := map[string]any{
+		qcow2.OPT_SIZE:     size,
+		qcow2.OPT_FMT:      opts.OutputFormat,
+		qcow2.OPT_FILENAME: opts.OutputFile,
+	}
+	if opts.OutputFormat == QCOW2_FORMAT {
+		createOpts[qcow2.OPT_SUBCLUSTER] = opts.SubCluster
+		createOpts[qcow2.OPT_BACKING] = opts.BackingPath
+		createOpts[qcow2.OPT_BACKING_FILE_FMT] = opts.BackingFileFormat
+		createOpts[qcow2.OPT_DATAFILE] = opts.DataFile
+		if clusterSize > 0 {
+			createOpts[qcow2.OPT_CLUSTER_SIZE] = clusterSize
+		}
+	}
+	if err = qcow2.Blk_Create(opts.OutputFile, createOpts); err != nil {
+		return fmt.Errorf("failed to create file: %s, err: %v", opts.OutputFile, err)
+	}
+	if outRoot, err = qcow2.Blk_Open(opts.OutputFile,
+		map[string]any{qcow2.OPT_FMT: opts.OutputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize},
+		qcow2.BDRV_O_RDWR); err != nil {
+		return fmt.Errorf("failed to open file: %s, err: %v", opts.OutputFile, err)
+	}
+	defer qcow2.Blk_Close(outRoot)
+
+	if opts.Progress {
+		progressFn = func(current uint64, total uint64) {
+			fmt.Printf("\r    (%.2f/100%%)", float64(current)*100/float64(total))
+			if current == total {
+				fmt.Println()
+			}
+		}
+	}
+	return qcow2.Blk_Convert(inRoot, outRoot, &qcow2.BlockConvertOptions{
+		TargetHasBacking: opts.BackingPath != "",
+		Readers:          opts.Readers,
+		Writers:          opts.Writers,
+		InOrder:          opts.InOrder,
+		Compress:         opts.Compress,
+	}, progressFn)
+}
@@ -77,16 +77,15 @@ func newCreateCmd() *cobra.Command {
 func createQcow2(filename string, size uint64, subcluster bool, backing string, backingFileFmt string, datafile string) error {
 
 	var err error
-	opts := make(map[string]any)
-	opts[qcow2.OPT_SIZE] = size
-	opts[qcow2.OPT_FMT] = "qcow2"
-	opts[qcow2.OPT_FILENAME] = filename
-	opts[qcow2.OPT_SUBCLUSTER] = subcluster
-	opts[qcow2.OPT_BACKING] = backing
-	opts[qcow2.OPT_BACKING_FILE_FMT] = backingFileFmt
-	opts[qcow2.OPT_DATAFILE] = datafile
+	opts := &qcow2.CreateOptions{
+		Size:          size,
+		Subcluster:    subcluster,
+		BackingFile:   backing,
+		BackingFormat: backingFileFmt,
+		DataFile:      datafile,
+	}
 
-	if err = qcow2.Blk_Create(filename, opts); err != nil {
+	if err = qcow2.Blk_Create_Opts(filename, opts); err != nil {
 		fmt.Printf("failed to create qcow2 file: %s, err: %v\n", filename, err)
 	}
 	return err
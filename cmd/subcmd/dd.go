@@ -44,6 +44,7 @@ type DdOptions struct {
 	InputFormat  string
 	OutputFormat string
 	L2CacheSize  string
+	DetectZeroes string
 }
 
 func newDdCmd() *cobra.Command {
@@ -52,7 +53,7 @@ func newDdCmd() *cobra.Command {
 	var cmd = &cobra.Command{
 		Use:   "dd",
 		Short: "convert and copy from or to qcow2 files",
-		Long:  "qcow2_utils dd [-f inputformat] <-i inputfile> <-O outputformat> <-o outputfile> [--l2-cache-size=size]",
+		Long:  "qcow2_utils dd [-f inputformat] <-i inputfile> <-O outputformat> <-o outputfile> [--l2-cache-size=size] [--detect-zeroes off|on|unmap]",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			var l2CacheSize uint64
 			var ok bool
@@ -91,22 +92,28 @@ func newDdCmd() *cobra.Command {
 	flags.StringVarP(&opts.InputFormat, "inputformat", "f", "", "specify the input file format")
 	flags.StringVarP(&opts.OutputFormat, "outputformat", "O", "", "specify the output file format")
 	flags.StringVarP(&opts.L2CacheSize, "l2-cache-size", "", "", "specify the l2 cache size")
+	flags.StringVarP(&opts.DetectZeroes, "detect-zeroes", "", qcow2.DETECT_ZEROES_OFF, "turn the writes of zeroes to the output into zero writes, 'off', 'on' or 'unmap'")
 
 	return cmd
 }
 
 func runDD(opts DdOptions, l2CacheSize uint64) (err error) {
-	return execDD(opts.InputFile, opts.InputFormat, opts.OutputFile, opts.OutputFormat, l2CacheSize)
+	return execDD(opts.InputFile, opts.InputFormat, opts.OutputFile, opts.OutputFormat, l2CacheSize, opts.DetectZeroes)
 }
 
 // begin to copy data from raw file to qcow2 file
-func execDD(inputFile string, inputFormat string, outputFile string, outputFormat string, l2CacheSize uint64) (err error) {
+func execDD(inputFile string, inputFormat string, outputFile string, outputFormat string, l2CacheSize uint64,
+	detectZeroes string) (err error) {
 
 	var inRoot, outRoot *qcow2.BdrvChild
 	var size uint64
 	var outPos, inPos, blockCount uint64
 	var inRet, outRet uint64
 	buf := make([]uint8, BLOCK_SIZE)
+	outFlags := qcow2.BDRV_O_RDWR
+	if detectZeroes == qcow2.DETECT_ZEROES_UNMAP {
+		outFlags |= qcow2.BDRV_O_UNMAP
+	}
 
 	if inputFormat == "" {
 		if inputFormat, err = qcow2.Blk_Probe(inputFile); err != nil {
@@ -140,8 +147,8 @@ func execDD(inputFile string, inputFormat string, outputFile string, outputForma
 		return fmt.Errorf("%s exists", outputFile)
 	}
 	if outRoot, err = qcow2.Blk_Open(outputFile,
-		map[string]any{qcow2.OPT_FMT: outputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize},
-		qcow2.BDRV_O_RDWR); err != nil {
+		map[string]any{qcow2.OPT_FMT: outputFormat, qcow2.OPT_L2CACHESIZE: l2CacheSize,
+			qcow2.OPT_DETECT_ZEROES: detectZeroes}, outFlags); err != nil {
 		return err
 	}
 	for outPos = 0; inPos < size; blockCount++ {
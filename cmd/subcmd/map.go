@@ -0,0 +1,107 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type MapOptions struct {
+	FilePath string
+	Format   string
+	Output   string
+}
+
+func newMapCmd() *cobra.Command {
+
+	var opts MapOptions
+	var cmd = &cobra.Command{
+		Use:   "map",
+		Short: "dump the allocation map of the image and its backing chain",
+		Long:  "qcow2_utils map <-f filename> [-F format] [--output human|json]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.FilePath == "" {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if _, ok := qcow2.Supported_Types[opts.Format]; opts.Format != "" && !ok {
+				fmt.Printf("file format %s is not supported\n", opts.Format)
+				os.Exit(1)
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				cmd.Help()
+				os.Exit(1)
+			}
+
+			if err := mapImage(opts.FilePath, opts.Format, opts.Output); err != nil {
+				fmt.Printf("map image failed, err:%v\n", err)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.FilePath, "filename", "f", "", "specify the file name")
+	flags.StringVarP(&opts.Format, "format", "F", "", "specify the file format, it is probed if not set")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+	return cmd
+}
+
+func mapImage(filename string, format string, output string) error {
+
+	var root *qcow2.BdrvChild
+	var entries []qcow2.BlockMapEntry
+	var err error
+
+	if format == "" {
+		if format, err = qcow2.Blk_Probe(filename); err != nil {
+			return err
+		}
+	}
+	if root, err = qcow2.Blk_Open(filename,
+		map[string]any{qcow2.OPT_FMT: format, qcow2.OPT_FILENAME: filename}, 0); err != nil {
+		return fmt.Errorf("failed to open file: %s, err: %v", filename, err)
+	}
+	defer qcow2.Blk_Close(root)
+
+	if entries, err = qcow2.Blk_Map(root, 0, 0); err != nil {
+		return err
+	}
+
+	if output == "json" {
+		bytes, _ := json.MarshalIndent(entries, "", "\t")
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	//only the ranges holding data are shown
+	fmt.Printf("%-16s%-16s%-16s%s\n", "Offset", "Length", "Mapped to", "File")
+	for _, e := range entries {
+		if e.Data && !e.Zero {
+			fmt.Printf("%#-16x%#-16x%#-16x%s\n", e.Start, e.Length, e.Offset, e.Filename)
+		}
+	}
+	return nil
+}
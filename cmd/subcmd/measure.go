@@ -0,0 +1,149 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type MeasureOptions struct {
+	Size        string
+	FilePath    string
+	Format      string
+	OutFormat   string
+	SubCluster  bool
+	ClusterSize string
+	Prealloc    string
+	BackingPath string
+	Output      string
+}
+
+func newMeasureCmd() *cobra.Command {
+
+	var opts MeasureOptions
+	var cmd = &cobra.Command{
+		Use:   "measure",
+		Short: "measure the host size required by a new image or a converted image",
+		Long:  "qcow2_utils measure <-s size | -f filename> [-F format] [-O outputFormat] [-b backingfile] [--enable-subcluster] [--cluster-size size] [--preallocation off|metadata|falloc|full] [--output human|json]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var size, clusterSize uint64
+			var success bool
+
+			if (opts.Size == "") == (opts.FilePath == "") {
+				cmd.Help()
+				os.Exit(1)
+			}
+			if opts.Size != "" {
+				if size, success = str2Int(opts.Size); !success {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if opts.ClusterSize != "" {
+				if clusterSize, success = str2Int(opts.ClusterSize); !success {
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if _, ok := qcow2.Supported_Types[opts.Format]; opts.Format != "" && !ok {
+				fmt.Printf("file format %s is not supported\n", opts.Format)
+				os.Exit(1)
+			}
+			if _, ok := qcow2.Supported_Types[opts.OutFormat]; !ok {
+				fmt.Printf("file format %s is not supported\n", opts.OutFormat)
+				os.Exit(1)
+			}
+			if opts.Output != "human" && opts.Output != "json" {
+				cmd.Help()
+				os.Exit(1)
+			}
+
+			if err := measureImage(&opts, size, clusterSize); err != nil {
+				fmt.Printf("measure image failed, err:%v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.Size, "size", "s", "", "specify the virtual size of the new image, valid unit is 'k', 'm', 'g', 't'")
+	flags.StringVarP(&opts.FilePath, "filename", "f", "", "specify the image to be converted")
+	flags.StringVarP(&opts.Format, "format", "F", "", "specify the format of the image to be converted, it is probed if not set")
+	flags.StringVarP(&opts.OutFormat, "output-format", "O", "qcow2", "specify the format of the new image")
+	flags.StringVarP(&opts.BackingPath, "backing", "b", "", "specify the backing file path of the new image")
+	flags.BoolVarP(&opts.SubCluster, "enable-subcluster", "", false, "")
+	flags.StringVarP(&opts.ClusterSize, "cluster-size", "", "", "specify the cluster size of the new image, valid unit is 'k', 'm'")
+	flags.StringVarP(&opts.Prealloc, "preallocation", "", qcow2.PREALLOC_MODE_OFF, "specify the preallocation mode, 'off', 'metadata', 'falloc' or 'full'")
+	flags.StringVarP(&opts.Output, "output", "", "human", "specify the output format, 'human' or 'json'")
+	return cmd
+}
+
+func measureImage(opts *MeasureOptions, size uint64, clusterSize uint64) error {
+
+	var root *qcow2.BdrvChild
+	var info *qcow2.BlockMeasureInfo
+	var err error
+
+	measureOpts := map[string]any{
+		qcow2.OPT_FMT:        opts.OutFormat,
+		qcow2.OPT_SUBCLUSTER: opts.SubCluster,
+		qcow2.OPT_PREALLOC:   opts.Prealloc,
+		qcow2.OPT_BACKING:    opts.BackingPath,
+	}
+	if size > 0 {
+		measureOpts[qcow2.OPT_SIZE] = size
+	}
+	if clusterSize > 0 {
+		measureOpts[qcow2.OPT_CLUSTER_SIZE] = clusterSize
+	}
+
+	if opts.FilePath != "" {
+		format := opts.Format
+		if format == "" {
+			if format, err = qcow2.Blk_Probe(opts.FilePath); err != nil {
+				return err
+			}
+		}
+		if root, err = qcow2.Blk_Open(opts.FilePath,
+			map[string]any{qcow2.OPT_FMT: format, qcow2.OPT_FILENAME: opts.FilePath}, 0); err != nil {
+			return fmt.Errorf("failed to open file: %s, err: %v", opts.FilePath, err)
+		}
+		defer qcow2.Blk_Close(root)
+	}
+
+	if info, err = qcow2.Blk_Measure(measureOpts, root); err != nil {
+		return err
+	}
+
+	if opts.Output == "json" {
+		bytes, _ := json.MarshalIndent(info, "", "\t")
+		fmt.Println(string(bytes))
+		return nil
+	}
+	fmt.Printf("required size: %d\n", info.Required)
+	fmt.Printf("fully allocated size: %d\n", info.FullyAllocated)
+	return nil
+}
@@ -0,0 +1,89 @@
+package subcmd
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dypflying/go-qcow2lib/qcow2"
+	"github.com/spf13/cobra"
+)
+
+type StreamOptions struct {
+	FilePath string
+	Base     string
+	Progress bool
+}
+
+func newStreamCmd() *cobra.Command {
+
+	var opts StreamOptions
+	var cmd = &cobra.Command{
+		Use:   "stream",
+		Short: "pull the data from the backing chain into the qcow2 file",
+		Long:  "qcow2_utils stream <-f filename> [-b base] [--progress]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.FilePath == "" {
+				cmd.Help()
+				os.Exit(1)
+			}
+
+			err := streamQcow2(opts.FilePath, opts.Base, opts.Progress)
+			if err != nil {
+				fmt.Printf("stream qcow2 file failed, err:%v\n", err)
+			} else {
+				fmt.Printf("stream qcow2 file successfully\n")
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.FilePath, "filename", "f", "", "specify the file name")
+	flags.StringVarP(&opts.Base, "base", "b", "", "specify the base file which remains the backing file, the whole chain is pulled if not set")
+	flags.BoolVarP(&opts.Progress, "progress", "p", false, "show the progress")
+	return cmd
+}
+
+func streamQcow2(filename string, base string, progress bool) error {
+
+	var root *qcow2.BdrvChild
+	var err error
+	var progressFn qcow2.ProgressFunc
+	opts := make(map[string]any)
+	opts[qcow2.OPT_FMT] = "qcow2"
+	opts[qcow2.OPT_FILENAME] = filename
+
+	if root, err = qcow2.Blk_Open(filename, opts, qcow2.BDRV_O_RDWR); err != nil {
+		return fmt.Errorf("failed to open qcow2 file: %s, err: %v", filename, err)
+	}
+	defer qcow2.Blk_Close(root)
+
+	if progress {
+		progressFn = func(current uint64, total uint64) {
+			fmt.Printf("\r    (%.2f/100%%)", float64(current)*100/float64(total))
+			if current == total {
+				fmt.Println()
+			}
+		}
+	}
+	return qcow2.Blk_Stream(root, base, progressFn)
+}
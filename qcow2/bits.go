@@ -89,11 +89,11 @@ func qcow_oflag_sub_zero_range(x, y uint32) uint64 {
 	return qcow_oflag_sub_alloc_range(x, y) << 32
 }
 
-func qcow_oflag_sub_alloc(x uint32) int {
+func qcow_oflag_sub_alloc(x uint32) uint64 {
 	return 1 << x
 }
 
 /* The subcluster X [0..31] reads as zeroes */
-func qcow_oflag_sub_zero(x uint32) int {
+func qcow_oflag_sub_zero(x uint32) uint64 {
 	return qcow_oflag_sub_alloc(x) << 32
 }
@@ -21,6 +21,7 @@ SOFTWARE.
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"math"
 	"os"
@@ -29,6 +30,9 @@ import (
 
 func Blk_Create(filename string, options map[string]any) error {
 	var err error
+	if err = bdrv_validate_options(options); err != nil {
+		return err
+	}
 	if err = bdrv_create(filename, options); err != nil {
 		return err
 	}
@@ -69,21 +73,85 @@ func Blk_Open(filename string, options map[string]any, flags int) (*BdrvChild, e
 	var err error
 	var format string
 
+	if err = bdrv_validate_options(options); err != nil {
+		return nil, err
+	}
 	if val, ok := options[OPT_FMT]; !ok {
 		return nil, Err_IncompleteParameters
 	} else {
 		format = val.(string)
 	}
 
+	detectZeroes := DETECT_ZEROES_OFF
+	if val, ok := options[OPT_DETECT_ZEROES]; ok {
+		if detectZeroes, err = bdrv_parse_detect_zeroes(val.(string), flags); err != nil {
+			return nil, err
+		}
+	}
+
+	if val, ok := options[OPT_AIO]; ok {
+		if flags, err = bdrv_parse_aio(val.(string), flags); err != nil {
+			return nil, err
+		}
+	}
+
 	if child, err = bdrv_open_child(filename, format, options, flags); err != nil {
 		return nil, err
 	} else {
 		bdrv_set_perm(child, PERM_ALL)
 	}
+	child.bs.DetectZeroes = detectZeroes
 
 	return child, err
 }
 
+// Blk_Create_Opts creates the image with the typed options, which are validated first
+func Blk_Create_Opts(filename string, opts *CreateOptions) error {
+	if opts == nil {
+		return Err_IncompleteParameters
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	options := opts.ToMap()
+	options[OPT_FILENAME] = filename
+	return Blk_Create(filename, options)
+}
+
+// Blk_Open_Opts opens the image with the typed options, nil opens a qcow2 image with the defaults
+func Blk_Open_Opts(filename string, opts *OpenOptions, flags int) (*BdrvChild, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	options := opts.ToMap()
+	options[OPT_FILENAME] = filename
+	return Blk_Open(filename, options, flags)
+}
+
+// Blk_Open_Ctx doesn't open the image if the context is done, the image is closed again if the context
+// is done while opening
+func Blk_Open_Ctx(ctx context.Context, filename string, options map[string]any, flags int) (*BdrvChild, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	child, err := Blk_Open(filename, options, flags)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		Blk_Close(child)
+		return nil, err
+	}
+	return child, nil
+}
+
+/*
+* close the image, the requests in flight are waited for and the image is flushed,
+* afterwards the requests on the handle fail with Err_Closed.
+ */
 func Blk_Close(child *BdrvChild) {
 	if child == nil || child.bs == nil {
 		return
@@ -91,16 +159,89 @@ func Blk_Close(child *BdrvChild) {
 	bdrv_close(child.bs)
 }
 
+// the handle must be valid and not closed
+func blk_check_child(child *BdrvChild) error {
+	if child == nil || child.bs == nil {
+		return Err_NullObject
+	}
+	if bdrv_is_closed(child.bs) {
+		return Err_Closed
+	}
+	return nil
+}
+
+// count a request on the handle, it waits while the image is drained or paused
+func blk_inc_in_flight(ctx context.Context, child *BdrvChild) error {
+	if child == nil || child.bs == nil {
+		return Err_NullObject
+	}
+	return bdrv_inc_in_flight_queued(ctx, child.bs)
+}
+
+func blk_dec_in_flight(child *BdrvChild) {
+	bdrv_dec_in_flight(child.bs)
+}
+
+/*
+* wait for the requests in flight and flush the image, the requests started
+* meanwhile wait until the drain is done.
+ */
+func Blk_Drain(child *BdrvChild) error {
+	if err := blk_check_child(child); err != nil {
+		return err
+	}
+	if err := bdrv_drained_begin(child.bs); err != nil {
+		return err
+	}
+	defer bdrv_drained_end(child.bs)
+	return bdrv_do_flush(child.bs)
+}
+
+/*
+* drain the image and keep the new requests waiting until Blk_Resume, the image file is
+* consistent meanwhile, e.g. for an external snapshot or a backup copy of it. The requests
+* of the goroutine which paused the image wait as well. Pauses nest, each Blk_Pause
+* needs its Blk_Resume.
+ */
+func Blk_Pause(child *BdrvChild) error {
+	var err error
+	if err = blk_check_child(child); err != nil {
+		return err
+	}
+	if err = bdrv_drained_begin(child.bs); err != nil {
+		return err
+	}
+	if err = bdrv_do_flush(child.bs); err != nil {
+		bdrv_drained_end(child.bs)
+		return err
+	}
+	return nil
+}
+
+// resume the requests of a paused image, Err_NotPaused if the image is not paused
+func Blk_Resume(child *BdrvChild) error {
+	if child == nil || child.bs == nil {
+		return Err_NullObject
+	}
+	return bdrv_drained_end(child.bs)
+}
+
 func Blk_Pread(root *BdrvChild, offset uint64, buf []uint8, bytes uint64) (uint64, error) {
+	return Blk_Pread_Ctx(context.Background(), root, offset, buf, bytes)
+}
+
+// Blk_Pread_Ctx is Blk_Pread which stops with the context's error once the context is done
+func Blk_Pread_Ctx(ctx context.Context, root *BdrvChild, offset uint64, buf []uint8, bytes uint64) (uint64, error) {
 
 	var qiov QEMUIOVector
 	var err error
-	if root == nil || root.bs == nil {
-		return 0, Err_NullObject
+	if err = blk_inc_in_flight(ctx, root); err != nil {
+		return 0, err
 	}
+	defer blk_dec_in_flight(root)
 
 	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
-	if err = bdrv_preadv_part(root, offset, bytes, &qiov, 0, 0); err != nil {
+	if err = bdrv_preadv_part(ctx, root, offset, bytes, &qiov, 0, 0); err != nil {
 		return 0, err
 	}
 	return bytes, nil
@@ -134,19 +275,28 @@ func Blk_Pread_Object(child *BdrvChild, offset uint64, object any, size uint64)
  */
 func Blk_Pwrite(root *BdrvChild, offset uint64, buf []uint8,
 	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
+	return Blk_Pwrite_Ctx(context.Background(), root, offset, buf, bytes, flags)
+}
+
+/*
+* Blk_Pwrite_Ctx is Blk_Pwrite which stops with the context's error once the context is done,
+* the clusters allocated for the parts not written yet are released, so that the metadata stays
+* consistent, the range may be partially written though.
+ */
+func Blk_Pwrite_Ctx(ctx context.Context, root *BdrvChild, offset uint64, buf []uint8,
+	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
 
-	Assert(root != nil)
-	bs := root.bs
 	var qiov QEMUIOVector
 	var err error
-	if root == nil {
-		return 0, Err_NullObject
+	if err = blk_inc_in_flight(ctx, root); err != nil {
+		return 0, err
 	}
-	if (bs.OpenFlags & BDRV_REQ_FUA) > 0 {
+	defer blk_dec_in_flight(root)
+	if (root.bs.OpenFlags & BDRV_REQ_FUA) > 0 {
 		flags |= BDRV_REQ_FUA
 	}
 	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
-	if err = bdrv_pwritev_part(root, offset, bytes, &qiov, 0, flags); err != nil {
+	if err = bdrv_pwritev_part(ctx, root, offset, bytes, &qiov, 0, flags); err != nil {
 		return 0, err
 	}
 	return bytes, nil
@@ -154,19 +304,23 @@ func Blk_Pwrite(root *BdrvChild, offset uint64, buf []uint8,
 
 func Blk_Pwrite_Zeroes(root *BdrvChild, offset uint64,
 	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
+	return Blk_Pwrite_Zeroes_Ctx(context.Background(), root, offset, bytes, flags)
+}
+
+func Blk_Pwrite_Zeroes_Ctx(ctx context.Context, root *BdrvChild, offset uint64,
+	bytes uint64, flags BdrvRequestFlags) (uint64, error) {
 
-	Assert(root != nil)
-	bs := root.bs
 	var qiov QEMUIOVector
 	var err error
-	if root == nil {
-		return 0, Err_NullObject
+	if err = blk_inc_in_flight(ctx, root); err != nil {
+		return 0, err
 	}
-	if (bs.OpenFlags & BDRV_REQ_FUA) > 0 {
+	defer blk_dec_in_flight(root)
+	if (root.bs.OpenFlags & BDRV_REQ_FUA) > 0 {
 		flags |= BDRV_REQ_FUA
 	}
 	qemu_iovec_init_buf(&qiov, nil, bytes)
-	if err = bdrv_pwritev_part(root, offset, bytes, &qiov, 0, flags|BDRV_REQ_ZERO_WRITE); err != nil {
+	if err = bdrv_pwritev_part(ctx, root, offset, bytes, &qiov, 0, flags|BDRV_REQ_ZERO_WRITE); err != nil {
 		return 0, err
 	}
 	return bytes, nil
@@ -198,6 +352,9 @@ func Blk_Pwrite_Object(child *BdrvChild, offset uint64, object any, size uint64)
 */
 func Blk_Getlength(child *BdrvChild) (uint64, error) {
 
+	if err := blk_check_child(child); err != nil {
+		return 0, err
+	}
 	bs := child.bs
 	//equal to has_variable_length
 	if bs.Drv != nil && bs.Drv.bdrv_getlength != nil {
@@ -211,26 +368,146 @@ func Blk_Getlength(child *BdrvChild) (uint64, error) {
 }
 
 func Blk_Discard(child *BdrvChild, offset uint64, bytes uint64) error {
-	return bdrv_pdiscard(child, offset, bytes)
+	return Blk_Discard_Ctx(context.Background(), child, offset, bytes)
+}
+
+func Blk_Discard_Ctx(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64) error {
+	if err := blk_inc_in_flight(ctx, child); err != nil {
+		return err
+	}
+	defer blk_dec_in_flight(child)
+	return bdrv_pdiscard(ctx, child, offset, bytes)
 }
 
 func Blk_Flush(child *BdrvChild) error {
-	Assert(child != nil)
+	return Blk_Flush_Ctx(context.Background(), child)
+}
+
+// Blk_Flush_Ctx doesn't start the flush if the context is done, a started flush is not interrupted
+func Blk_Flush_Ctx(ctx context.Context, child *BdrvChild) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := blk_inc_in_flight(ctx, child); err != nil {
+		return err
+	}
+	defer blk_dec_in_flight(child)
 	return bdrv_flush(child.bs)
 }
 
 func Blk_Info(child *BdrvChild, detail bool, pretty bool) string {
+	if blk_check_child(child) != nil {
+		return ""
+	}
 	bs := child.bs
 	return bs.Info(detail, pretty)
 }
 
-func get_driver(fmt string) *BlockDriver {
-	switch fmt {
-	case "raw":
-		return newRawDriver()
-	case "qcow2":
-		return newQcow2Driver()
-	default:
-		return nil
+/*
+* check the consistency of the image, the detected inconsistencies are
+* repaired according to the fix mode (BDRV_FIX_LEAKS | BDRV_FIX_ERRORS)
+ */
+func Blk_Check(child *BdrvChild, fix BdrvCheckMode) (*BlockCheckResult, error) {
+	if child == nil || child.bs == nil {
+		return nil, Err_NullObject
+	}
+	//closing the image waits for the check
+	if err := blk_inc_in_flight(context.Background(), child); err != nil {
+		return nil, err
+	}
+	defer blk_dec_in_flight(child)
+	res := &BlockCheckResult{}
+	err := bdrv_check(child.bs, res, fix)
+	return res, err
+}
+
+/*
+* amend the options of an opened image, so far the compat level and the refcount
+* width can be changed, the image must be opened read/write.
+ */
+func Blk_Amend(child *BdrvChild, options map[string]any, progress ProgressFunc) error {
+	if child == nil || child.bs == nil {
+		return Err_NullObject
+	}
+	if child.bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return Err_NoWritePerm
+	}
+	if err := bdrv_validate_options(options); err != nil {
+		return err
+	}
+	if err := blk_inc_in_flight(context.Background(), child); err != nil {
+		return err
+	}
+	defer blk_dec_in_flight(child)
+	return bdrv_amend_options(child.bs, options, progress)
+}
+
+/*
+* compact the image by moving the clusters at the tail of the image file into
+* the free clusters before them, then the image file is truncated.
+ */
+func Blk_Compact(child *BdrvChild, opts *BlockCompactOptions, progress ProgressFunc) (*BlockCompactResult, error) {
+	if child == nil || child.bs == nil {
+		return nil, Err_NullObject
+	}
+	if child.bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return nil, Err_NoWritePerm
+	}
+	//the clusters are moved and freed, the writes in flight must complete first
+	if err := bdrv_drained_begin_exclusive(child.bs); err != nil {
+		return nil, err
+	}
+	defer bdrv_drained_end_exclusive(child.bs)
+	return bdrv_compact(child.bs, opts, progress)
+}
+
+/*
+* sparsify the image by turning the data clusters and subclusters which are
+* all zeroes into zero clusters and subclusters, their host clusters are freed.
+ */
+func Blk_Sparsify(child *BdrvChild, progress ProgressFunc) (*BlockSparsifyResult, error) {
+	if child == nil || child.bs == nil {
+		return nil, Err_NullObject
+	}
+	if child.bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return nil, Err_NoWritePerm
+	}
+	//the zeroed clusters are discarded, a write in flight could fill one meanwhile
+	if err := bdrv_drained_begin_exclusive(child.bs); err != nil {
+		return nil, err
+	}
+	defer bdrv_drained_end_exclusive(child.bs)
+	return bdrv_sparsify(child.bs, progress)
+}
+
+/*
+* measure the host size needed by a new image created with the options, the
+* virtual size is taken from the options or from the input image which is
+* going to be converted into the new image.
+ */
+func Blk_Measure(options map[string]any, in *BdrvChild) (*BlockMeasureInfo, error) {
+
+	var format string
+	var inBs *BlockDriverState
+	if err := bdrv_validate_options(options); err != nil {
+		return nil, err
+	}
+	if val, ok := options[OPT_FMT]; !ok {
+		return nil, Err_IncompleteParameters
+	} else {
+		format = val.(string)
+	}
+	if in != nil {
+		if err := blk_check_child(in); err != nil {
+			return nil, err
+		}
+		inBs = in.bs
+	} else if _, ok := options[OPT_SIZE]; !ok {
+		return nil, Err_IncompleteParameters
+	}
+	drv := get_driver(format)
+	if drv == nil {
+		return nil, Err_NoDriverFound
 	}
+	return bdrv_measure(drv, options, inBs)
 }
@@ -1,8 +1,14 @@
 package qcow2
 
 import (
+	"bytes"
+	"context"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,13 +51,13 @@ func Test_block_simple(t *testing.T) {
 	//check cache
 	cluster1Ref, err := qcow2_get_refcount(bs, 0)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster1Ref, uint16(1))
+	assert.Equal(t, cluster1Ref, uint64(1))
 	cluster4Ref, err := qcow2_get_refcount(bs, 3)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster4Ref, uint16(1))
+	assert.Equal(t, cluster4Ref, uint64(1))
 	cluster5Ref, err := qcow2_get_refcount(bs, 4)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster5Ref, uint16(0))
+	assert.Equal(t, cluster5Ref, uint64(0))
 	Blk_Close(root)
 
 }
@@ -96,6 +102,74 @@ func Test_block_read_write(t *testing.T) {
 
 }
 
+func Test_block_cluster_size(t *testing.T) {
+	var basefile = "/tmp/test_cluster_size_base.qcow2"
+	var filename = "/tmp/test_cluster_size.qcow2"
+
+	for _, clusterSize := range []uint64{512, 4096, 16384, 2 * 1048576} {
+		os.Remove(basefile)
+		os.Remove(filename)
+		err := Blk_Create(basefile, map[string]any{
+			OPT_SIZE:         32 * 1048576,
+			OPT_FMT:          "qcow2",
+			OPT_CLUSTER_SIZE: clusterSize,
+		})
+		assert.Nil(t, err)
+		base, err := Blk_Open(basefile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(base, 0, bytes.Repeat([]byte{0x11}, 1048576), 1048576, 0)
+		assert.Nil(t, err)
+		Blk_Close(base)
+
+		//the overlay needs more than a refcount table cluster with the small clusters
+		err = Blk_Create(filename, map[string]any{
+			OPT_SIZE:             32 * 1048576,
+			OPT_FMT:              "qcow2",
+			OPT_CLUSTER_SIZE:     clusterSize,
+			OPT_SUBCLUSTER:       clusterSize >= 16384,
+			OPT_BACKING:          basefile,
+			OPT_BACKING_FILE_FMT: "qcow2",
+		})
+		assert.Nil(t, err)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		s := root.bs.opaque.(*BDRVQcow2State)
+		assert.Equal(t, uint32(clusterSize), s.ClusterSize)
+		assert.Equal(t, clusterSize, s.RefcountTableOffset)
+		assert.Equal(t, 3*clusterSize, s.L1TableOffset)
+		_, err = Blk_Pwrite(root, 1000, bytes.Repeat([]byte{0x22}, 100), 100, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 16*1048576-1000, bytes.Repeat([]byte{0x33}, 10*1048576), 10*1048576, 0)
+		assert.Nil(t, err)
+		Blk_Close(root)
+
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		expected := make([]byte, 32*1048576)
+		copy(expected, bytes.Repeat([]byte{0x11}, 1048576))
+		copy(expected[1000:], bytes.Repeat([]byte{0x22}, 100))
+		copy(expected[16*1048576-1000:], bytes.Repeat([]byte{0x33}, 10*1048576))
+		buf := make([]byte, len(expected))
+		_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(expected, buf), "cluster size %d", clusterSize)
+		res, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, res.Corruptions+res.Leaks+res.CheckErrors, "cluster size %d", clusterSize)
+		Blk_Close(root)
+	}
+
+	//the same limits as qemu
+	assert.NotNil(t, Blk_Create(filename, map[string]any{OPT_SIZE: 1048576, OPT_FMT: "qcow2", OPT_CLUSTER_SIZE: 4097}))
+	assert.NotNil(t, Blk_Create(filename, map[string]any{OPT_SIZE: 1048576, OPT_FMT: "qcow2", OPT_CLUSTER_SIZE: 4 * 1048576}))
+	assert.NotNil(t, Blk_Create(filename, map[string]any{OPT_SIZE: 1048576, OPT_FMT: "qcow2",
+		OPT_CLUSTER_SIZE: 4096, OPT_SUBCLUSTER: true}))
+	assert.NotNil(t, Blk_Create(filename, map[string]any{OPT_SIZE: 1 << 40, OPT_FMT: "qcow2", OPT_CLUSTER_SIZE: 512}))
+
+	os.Remove(basefile)
+	os.Remove(filename)
+}
+
 func Test_block_backing(t *testing.T) {
 	var err error
 	var basefile = "/tmp/base.qcow2"
@@ -314,6 +388,88 @@ func Test_block_zeros(t *testing.T) {
 	os.Remove(filename)
 }
 
+func Test_block_detect_zeroes(t *testing.T) {
+
+	var filename = "/tmp/test_detect_zeroes.qcow2"
+	zeroes := make([]byte, 65536)
+	buf := bytes.Repeat([]byte{0x5a}, 65536)
+
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{
+		OPT_SIZE:     1048576,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	})
+	assert.Nil(t, err)
+
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: "yes"}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: DETECT_ZEROES_UNMAP}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+
+	for _, mode := range []string{DETECT_ZEROES_OFF, DETECT_ZEROES_ON, DETECT_ZEROES_UNMAP} {
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: mode},
+			BDRV_O_RDWR|BDRV_O_UNMAP)
+		assert.Nil(t, err)
+		//cluster 0 is written with zeroes, cluster 1 with data which is overwritten with zeroes
+		_, err = Blk_Pwrite(root, 0, zeroes, 65536, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 65536, buf, 65536, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 65536, zeroes, 65536, 0)
+		assert.Nil(t, err)
+
+		entries, err := Blk_Map(root, 0, 2*65536)
+		assert.Nil(t, err)
+		switch mode {
+		case DETECT_ZEROES_OFF:
+			assert.Equal(t, 1, len(entries))
+			assert.True(t, entries[0].Data)
+		case DETECT_ZEROES_ON:
+			//the host cluster of cluster 1 is kept
+			assert.Equal(t, 2, len(entries))
+			assert.True(t, entries[0].Zero)
+			assert.False(t, entries[0].HasOffset)
+			assert.True(t, entries[1].Zero)
+			assert.True(t, entries[1].HasOffset)
+		case DETECT_ZEROES_UNMAP:
+			assert.Equal(t, 1, len(entries))
+			assert.True(t, entries[0].Zero)
+			assert.False(t, entries[0].HasOffset)
+		}
+
+		readBuf := make([]byte, 2*65536)
+		_, err = Blk_Pread(root, 0, readBuf, 2*65536)
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 2*65536), readBuf)
+		Blk_Discard(root, 0, 1048576)
+		Blk_Close(root)
+	}
+	os.Remove(filename)
+
+	//small zero writes on an image with subclusters, including the last subcluster of a cluster
+	err = Blk_Create(filename, map[string]any{
+		OPT_SIZE:       1048576,
+		OPT_FILENAME:   filename,
+		OPT_FMT:        "qcow2",
+		OPT_SUBCLUSTER: true,
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_DETECT_ZEROES: DETECT_ZEROES_ON},
+		BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	for off := uint64(0); off < 2*65536; off += 512 {
+		_, err = Blk_Pwrite(root, off, zeroes[:512], 512, 0)
+		assert.Nil(t, err)
+	}
+	readBuf := make([]byte, 2*65536)
+	_, err = Blk_Pread(root, 0, readBuf, 2*65536)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 2*65536), readBuf)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
 func Test_Discard(t *testing.T) {
 	var err error
 	var filename = "/tmp/test_discard.qcow2"
@@ -417,3 +573,190 @@ func Test_data_file(t *testing.T) {
 	os.Remove(filename)
 	os.Remove(datafile)
 }
+
+func Test_block_close(t *testing.T) {
+	var filename = "/tmp/test_block_close.qcow2"
+	os.Remove(filename)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	err := Blk_Create_Opts(filename, &CreateOptions{Size: 4 * 1048576})
+	assert.Nil(t, err)
+
+	//a request split into several host ranges starts the workers
+	openAndSplit := func() *BdrvChild {
+		root, err := Blk_Open_Opts(filename, &OpenOptions{Workers: 4}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		for i := 3; i >= 0; i-- {
+			buf := bytes.Repeat([]byte{byte(i + 1)}, DEFAULT_CLUSTER_SIZE)
+			_, err = Blk_Pwrite(root, uint64(i*2*DEFAULT_CLUSTER_SIZE), buf, DEFAULT_CLUSTER_SIZE, 0)
+			assert.Nil(t, err)
+		}
+		buf := make([]byte, 8*DEFAULT_CLUSTER_SIZE)
+		_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		return root
+	}
+	Blk_Close(openAndSplit())
+
+	//the workers are stopped on close, no goroutine is left behind
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		Blk_Close(openAndSplit())
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+
+	//close waits for the requests in flight
+	root := openAndSplit()
+	it, err := Blk_Extents(root, 0, 0, "")
+	assert.Nil(t, err)
+	assert.True(t, it.Next())
+	var wg sync.WaitGroup
+	var written [8]bool
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := bytes.Repeat([]byte{0xa0 + byte(i)}, 3*DEFAULT_CLUSTER_SIZE)
+			if _, err := Blk_Pwrite(root, uint64(i)*3*DEFAULT_CLUSTER_SIZE, buf, uint64(len(buf)), 0); err == nil {
+				written[i] = true
+			} else {
+				assert.Equal(t, Err_Closed, err)
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond)
+	Blk_Close(root)
+	wg.Wait()
+
+	//the handle fails instead of panicking once it's closed
+	buf := make([]byte, 512)
+	_, err = Blk_Pread(root, 0, buf, 512)
+	assert.Equal(t, Err_Closed, err)
+	_, err = Blk_Pwrite(root, 0, buf, 512, 0)
+	assert.Equal(t, Err_Closed, err)
+	_, err = Blk_Pwrite_Zeroes(root, 0, 512, 0)
+	assert.Equal(t, Err_Closed, err)
+	assert.Equal(t, Err_Closed, Blk_Discard(root, 0, 65536))
+	assert.Equal(t, Err_Closed, Blk_Flush(root))
+	_, err = Blk_Getlength(root)
+	assert.Equal(t, Err_Closed, err)
+	_, err = Blk_Check(root, 0)
+	assert.Equal(t, Err_Closed, err)
+	assert.Equal(t, "", Blk_Info(root, false, false))
+	//an iterator of the closed image stops with the error
+	assert.False(t, it.Next())
+	assert.Equal(t, Err_Closed, it.Err())
+	Blk_Close(root)
+
+	//the completed writes reached the image
+	root, err = Blk_Open(filename, map[string]any{OPT_FILENAME: filename, OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	for i := 0; i < 8; i++ {
+		if !written[i] {
+			continue
+		}
+		buf := make([]byte, 3*DEFAULT_CLUSTER_SIZE)
+		_, err = Blk_Pread(root, uint64(i)*3*DEFAULT_CLUSTER_SIZE, buf, uint64(len(buf)))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{0xa0 + byte(i)}, len(buf)), buf)
+	}
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_block_pause(t *testing.T) {
+	var filename = "/tmp/test_block_pause.qcow2"
+	var snapshot = "/tmp/test_block_pause_snapshot.qcow2"
+	const writers = 4
+	const region = 3 * DEFAULT_CLUSTER_SIZE
+	os.Remove(filename)
+	os.Remove(snapshot)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	err := Blk_Create_Opts(filename, &CreateOptions{Size: 4 * 1048576})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FILENAME: filename, OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	//each writer keeps rewriting its region with one byte value per write
+	var completed int64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for gen := 1; ; gen++ {
+				buf := bytes.Repeat([]byte{byte(i*64 + gen%64)}, region)
+				if _, err := Blk_Pwrite(root, uint64(i*region+1000), buf, region, 0); err != nil {
+					assert.Equal(t, Err_Closed, err)
+					return
+				}
+				atomic.AddInt64(&completed, 1)
+			}
+		}(i)
+	}
+
+	for atomic.LoadInt64(&completed) < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, Blk_Drain(root))
+
+	//no write completes while the image is paused, the image file is consistent
+	assert.Nil(t, Blk_Pause(root))
+	time.Sleep(5 * time.Millisecond)
+	n := atomic.LoadInt64(&completed)
+	data, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(snapshot, data, 0644))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt64(&completed))
+
+	//the requests of a paused image give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = Blk_Pread_Ctx(ctx, root, 0, make([]byte, 512), 512)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	//pauses nest
+	assert.Nil(t, Blk_Pause(root))
+	assert.Nil(t, Blk_Resume(root))
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt64(&completed))
+	assert.Nil(t, Blk_Resume(root))
+	assert.Equal(t, Err_NotPaused, Blk_Resume(root))
+	for atomic.LoadInt64(&completed) < n+20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//closing a paused image fails the waiting requests
+	assert.Nil(t, Blk_Pause(root))
+	Blk_Close(root)
+	wg.Wait()
+	assert.Equal(t, Err_Closed, Blk_Pause(root))
+	assert.Equal(t, Err_Closed, Blk_Drain(root))
+
+	//the copy taken while paused is a consistent image
+	snap, err := Blk_Open(snapshot, map[string]any{OPT_FILENAME: snapshot, OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	res, err := Blk_Check(snap, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	buf := make([]byte, region)
+	for i := 0; i < writers; i++ {
+		_, err = Blk_Pread(snap, uint64(i*region+1000), buf, region)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat(buf[:1], region), buf)
+		assert.Equal(t, i, int(buf[0])/64)
+	}
+	Blk_Close(snap)
+	os.Remove(filename)
+	os.Remove(snapshot)
+}
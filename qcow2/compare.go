@@ -0,0 +1,205 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+* compare the guest visible content of two images, including their backing
+* chains. ranges which are zero in both images are skipped without reading
+* them. in strict mode the allocation state must match as well and images
+* of different sizes are never identical.
+ */
+func Blk_Compare(root1 *BdrvChild, root2 *BdrvChild, strict bool,
+	progress ProgressFunc) (*BlockCompareResult, error) {
+
+	if err := blk_check_child(root1); err != nil {
+		return nil, err
+	}
+	if err := blk_check_child(root2); err != nil {
+		return nil, err
+	}
+	return bdrv_compare(root1, root2, strict, progress)
+}
+
+func bdrv_compare(child1 *BdrvChild, child2 *BdrvChild, strict bool,
+	progress ProgressFunc) (*BlockCompareResult, error) {
+
+	var totalSize1, totalSize2, totalSize, progressBase uint64
+	var offset, chunk, pnum1, pnum2 uint64
+	var status1, status2 uint64
+	var err error
+	res := &BlockCompareResult{}
+	bs1, bs2 := child1.bs, child2.bs
+	buf1 := make([]byte, COMPARE_BUF_SIZE)
+	buf2 := make([]byte, COMPARE_BUF_SIZE)
+
+	if totalSize1, err = bdrv_getlength(bs1); err != nil {
+		return nil, err
+	}
+	if totalSize2, err = bdrv_getlength(bs2); err != nil {
+		return nil, err
+	}
+	totalSize = min(totalSize1, totalSize2)
+	progressBase = max(totalSize1, totalSize2)
+
+	for offset = 0; offset < totalSize; offset += chunk {
+		if status1, err = bdrv_block_status_above(bs1, nil, offset, totalSize1-offset,
+			&pnum1, nil, nil); err != nil {
+			return nil, err
+		}
+		if status2, err = bdrv_block_status_above(bs2, nil, offset, totalSize2-offset,
+			&pnum2, nil, nil); err != nil {
+			return nil, err
+		}
+		allocated1 := status1&BDRV_BLOCK_ALLOCATED > 0
+		allocated2 := status2&BDRV_BLOCK_ALLOCATED > 0
+		Assert(pnum1 > 0 && pnum2 > 0)
+		chunk = min(pnum1, pnum2)
+
+		if strict {
+			mask := uint64(BDRV_BLOCK_DATA | BDRV_BLOCK_ZERO | BDRV_BLOCK_ALLOCATED)
+			if status1&mask != status2&mask {
+				res.Offset = offset
+				res.Message = fmt.Sprintf("Strict mode: Offset %d block status mismatch!", offset)
+				return res, nil
+			}
+		}
+		if status1&BDRV_BLOCK_ZERO > 0 && status2&BDRV_BLOCK_ZERO > 0 {
+			/* nothing to do */
+		} else if allocated1 == allocated2 {
+			if allocated1 {
+				chunk = min(chunk, COMPARE_BUF_SIZE)
+				if _, err = Blk_Pread(child1, offset, buf1, chunk); err != nil {
+					return nil, err
+				}
+				if _, err = Blk_Pread(child2, offset, buf2, chunk); err != nil {
+					return nil, err
+				}
+				if pnum := compare_buffers(buf1[:chunk], buf2[:chunk]); pnum != chunk {
+					res.Offset = offset + pnum
+					res.Message = fmt.Sprintf("Content mismatch at offset %d!", res.Offset)
+					return res, nil
+				}
+			}
+		} else {
+			/* only one side has data, it must be zero */
+			var found bool
+			chunk = min(chunk, COMPARE_BUF_SIZE)
+			if allocated1 {
+				found, err = check_empty_sectors(child1, offset, chunk, buf1, res)
+			} else {
+				found, err = check_empty_sectors(child2, offset, chunk, buf1, res)
+			}
+			if err != nil || found {
+				return res, err
+			}
+		}
+		if progress != nil {
+			progress(offset+chunk, progressBase)
+		}
+	}
+
+	if totalSize1 != totalSize2 {
+		var childOver *BdrvChild
+		var totalSizeOver uint64
+
+		res.SizeMismatch = true
+		if strict {
+			res.Offset = totalSize
+			res.Message = "Strict mode: Image size mismatch!"
+			return res, nil
+		}
+		if totalSize1 > totalSize2 {
+			childOver, totalSizeOver = child1, totalSize1
+		} else {
+			childOver, totalSizeOver = child2, totalSize2
+		}
+		/* the part beyond the smaller image must be zero */
+		for offset = totalSize; offset < totalSizeOver; offset += chunk {
+			var status uint64
+			if status, err = bdrv_block_status_above(childOver.bs, nil, offset,
+				totalSizeOver-offset, &chunk, nil, nil); err != nil {
+				return nil, err
+			}
+			Assert(chunk > 0)
+			if status&BDRV_BLOCK_ALLOCATED > 0 && status&BDRV_BLOCK_ZERO == 0 {
+				var found bool
+				chunk = min(chunk, COMPARE_BUF_SIZE)
+				if found, err = check_empty_sectors(childOver, offset, chunk, buf1, res); err != nil || found {
+					return res, err
+				}
+			}
+			if progress != nil {
+				progress(offset+chunk, progressBase)
+			}
+		}
+	}
+
+	res.Identical = true
+	if res.SizeMismatch {
+		res.Message = "Warning: Image size mismatch! Images are identical."
+	} else {
+		res.Message = "Images are identical."
+	}
+	return res, nil
+}
+
+/*
+* returns the number of leading bytes that are equal in both buffers
+ */
+func compare_buffers(buf1 []byte, buf2 []byte) uint64 {
+	var i uint64
+	for i = 0; i < uint64(len(buf1)); i += DEFAULT_SECTOR_SIZE {
+		end := min(i+DEFAULT_SECTOR_SIZE, uint64(len(buf1)))
+		if !bytes.Equal(buf1[i:end], buf2[i:end]) {
+			break
+		}
+	}
+	for ; i < uint64(len(buf1)); i++ {
+		if buf1[i] != buf2[i] {
+			return i
+		}
+	}
+	return i
+}
+
+/*
+* checks whether the range only contains zeroes, it reports the mismatch
+* into the result and returns true if a non-zero byte is found.
+ */
+func check_empty_sectors(child *BdrvChild, offset uint64, bytes uint64, buf []byte,
+	res *BlockCompareResult) (bool, error) {
+
+	if _, err := Blk_Pread(child, offset, buf, bytes); err != nil {
+		return false, err
+	}
+	for i := uint64(0); i < bytes; i++ {
+		if buf[i] != 0 {
+			res.Offset = offset + i
+			res.Message = fmt.Sprintf("Content mismatch at offset %d!", res.Offset)
+			return true, nil
+		}
+	}
+	return false, nil
+}
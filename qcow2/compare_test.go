@@ -0,0 +1,133 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func create_compare_image(t *testing.T, filename string, backing string) *BdrvChild {
+	os.Remove(filename)
+	var create_opts = map[string]any{
+		OPT_SIZE:     4 * 1048576,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	}
+	if backing != "" {
+		create_opts[OPT_BACKING] = backing
+		create_opts[OPT_BACKING_FILE_FMT] = "qcow2"
+	}
+	err := Blk_Create(filename, create_opts)
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	return root
+}
+
+func Test_compare_qcow2(t *testing.T) {
+	var file1 = "/tmp/compare1.qcow2"
+	var file2 = "/tmp/compare2.qcow2"
+	buf := ([]byte)("this is a test")
+
+	root1 := create_compare_image(t, file1, "")
+	root2 := create_compare_image(t, file2, "")
+	for _, root := range []*BdrvChild{root1, root2} {
+		_, err := Blk_Pwrite(root, 1048576+123, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}
+	//explicit zeroes are identical to unallocated ranges
+	_, err := Blk_Pwrite(root2, 3*1048576, make([]byte, 65536), 65536, 0)
+	assert.Nil(t, err)
+
+	res, err := Blk_Compare(root1, root2, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+	assert.False(t, res.SizeMismatch)
+
+	//but not in strict mode
+	res, err = Blk_Compare(root1, root2, true, nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Identical)
+	assert.Equal(t, uint64(3*1048576), res.Offset)
+
+	//content mismatch in an allocated range of both images
+	_, err = Blk_Pwrite(root2, 1048576+125, []byte("a"), 1, 0)
+	assert.Nil(t, err)
+	res, err = Blk_Compare(root1, root2, false, nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Identical)
+	assert.Equal(t, uint64(1048576+125), res.Offset)
+
+	//content mismatch in a range allocated only in one image
+	_, err = Blk_Pwrite(root1, 1048576+125, []byte("a"), 1, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root1, 2*1048576+7, []byte("b"), 1, 0)
+	assert.Nil(t, err)
+	res, err = Blk_Compare(root1, root2, false, nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Identical)
+	assert.Equal(t, uint64(2*1048576+7), res.Offset)
+
+	Blk_Close(root1)
+	Blk_Close(root2)
+	os.Remove(file1)
+	os.Remove(file2)
+}
+
+func Test_compare_backing_and_raw(t *testing.T) {
+	var basefile = "/tmp/compare_base.qcow2"
+	var topfile = "/tmp/compare_top.qcow2"
+	var rawfile = "/tmp/compare.raw"
+	var lastProgress, total uint64
+	buf1 := ([]byte)("this is the base")
+	buf2 := ([]byte)("this is the top")
+
+	root := create_compare_image(t, basefile, "")
+	_, err := Blk_Pwrite(root, 123, buf1, uint64(len(buf1)), 0)
+	assert.Nil(t, err)
+	Blk_Close(root)
+	root = create_compare_image(t, topfile, basefile)
+	_, err = Blk_Pwrite(root, 1048576+123, buf2, uint64(len(buf2)), 0)
+	assert.Nil(t, err)
+
+	//a raw image with the same content, but bigger
+	os.Remove(rawfile)
+	err = Blk_Create(rawfile, map[string]any{OPT_FMT: "raw", OPT_FILENAME: rawfile})
+	assert.Nil(t, err)
+	err = os.Truncate(rawfile, 5*1048576)
+	assert.Nil(t, err)
+	rawRoot, err := Blk_Open(rawfile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(rawRoot, 123, buf1, uint64(len(buf1)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(rawRoot, 1048576+123, buf2, uint64(len(buf2)), 0)
+	assert.Nil(t, err)
+
+	res, err := Blk_Compare(root, rawRoot, false, func(current uint64, t uint64) {
+		lastProgress, total = current, t
+	})
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+	assert.True(t, res.SizeMismatch)
+	assert.Equal(t, uint64(5*1048576), lastProgress)
+	assert.Equal(t, uint64(5*1048576), total)
+
+	res, err = Blk_Compare(root, rawRoot, true, nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Identical)
+
+	//data beyond the end of the smaller image
+	_, err = Blk_Pwrite(rawRoot, 4*1048576+1, []byte("c"), 1, 0)
+	assert.Nil(t, err)
+	res, err = Blk_Compare(root, rawRoot, false, nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Identical)
+	assert.Equal(t, uint64(4*1048576+1), res.Offset)
+
+	Blk_Close(root)
+	Blk_Close(rawRoot)
+	os.Remove(basefile)
+	os.Remove(topfile)
+	os.Remove(rawfile)
+}
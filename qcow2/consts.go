@@ -29,6 +29,7 @@ const (
 	QCOW_L2_BITMAP_ALL_ALLOC           = uint64(1)<<32 - 1
 	QCOW_L2_BITMAP_ALL_ZEROES          = QCOW_L2_BITMAP_ALL_ALLOC << 32
 	QCOW_MAX_REFTABLE_SIZE             = (8 * 1024 * 1024)
+	QCOW_MAX_L1_SIZE                   = (32 * 1024 * 1024)
 )
 
 // L1 & L2 & Refcount masks
@@ -37,38 +38,49 @@ const (
 	L2E_OFFSET_MASK  = uint64(0x00fffffffffffe00)
 	REFT_OFFSET_MASK = uint64(0xfffffffffffffe00)
 	INV_OFFSET       = uint64(0xff00000000000000)
+
+	L1E_RESERVED_MASK     = uint64(0x7f000000000001ff)
+	L2E_STD_RESERVED_MASK = uint64(0x3f000000000001fe)
+	REFT_RESERVED_MASK    = uint64(0x1ff)
 )
 
 const (
-	DEFAULT_CLUSTER_SIZE = 65536
-	DEFAULT_SECTOR_SIZE  = 512
-	DEFAULT_CLUSTER_BITS = 16
+	DEFAULT_CLUSTER_SIZE   = 65536
+	DEFAULT_SECTOR_SIZE    = 512
+	DEFAULT_CLUSTER_BITS   = 16
+	MIN_CLUSTER_BITS       = 9  //512 bytes
+	MAX_CLUSTER_BITS       = 21 //2 MiB
+	MIN_EXTL2_CLUSTER_BITS = 14 //the subclusters of an extended l2 entry are at least 512 bytes
 	//1 refcount block can hold 2GiB data (64k * 32k),
 	//1 refcount table holds 8k refcount blocks,
 	//so 1 table can hold up to 16TiB data (including refcount blocks and l2 blocks and data blocks)
 	DEFAULT_REFCOUNT_TABLE_CLUSTERS = 1
 	QCOW2_VERSION2                  = 2
 	QCOW2_VERSION3                  = 3
+	QCOW2_V2_HEADER_LENGTH          = 72 //a version 2 header ends before the feature fields
 	QCOW2_REFCOUNT_ORDER            = 4
+	QCOW2_MAX_REFCOUNT_ORDER        = 6
 	QCOW2_CRYPT_METHOD              = 0
 	//	DEFAULT_ALIGNMENT               = 4096    //align to 4k
-	DEFAULT_ALIGNMENT    = DEFAULT_SECTOR_SIZE //align to sector
-	DEFAULT_MAX_TRANSFER = 1 << 31             //2G
-	DEFAULT_L2_CACHE     = 1024 * 1024         //default 1MiB for l2 cache
+	DEFAULT_ALIGNMENT     = DEFAULT_SECTOR_SIZE //align to sector
+	DEFAULT_MAX_TRANSFER  = 1 << 31             //2G
+	DEFAULT_L2_CACHE      = 1024 * 1024         //default 1MiB for l2 cache
+	QCOW2_MAX_WORKERS     = 8                   //default workers of an image, also the tasks in flight of a request
+	QCOW2_AIO_QUEUE_DEPTH = 64                  //default queued tasks of an image
 )
 
-// backing file offset
+// backing file offset, at most the middle of the header cluster
 const (
 	BACKING_FILE_OFFSET = 32768
 )
 
-// L1 table offset
+// L1 table offset of the default cluster size
 const (
 	L1_TABLE_OFFSET = 65536 * 3
 	L1_TABLE_SIZE   = 65536 >> 3
 )
 
-// refcount table offset
+// refcount table offset of the default cluster size
 const (
 	REFCOUNT_TABLE_OFFSET = 65536
 	REFCOUNT_TABLE_SIZE   = 65536 >> 3
@@ -81,6 +93,14 @@ const (
 	QCOW_OFLAG_ZERO       = 1 << 0
 )
 
+// compressed clusters
+const (
+	QCOW2_COMPRESSED_SECTOR_SIZE = 512  //the size of a compressed cluster is counted in sectors
+	QCOW2_COMPRESSION_TYPE_ZLIB  = 0    //raw deflate, the only supported compression type
+	QCOW2_COMPRESSION_TYPE_ZSTD  = 1    //not supported
+	QCOW2_ZLIB_WINDOW_SIZE       = 4096 //qemu inflates with a 4KiB window
+)
+
 const (
 	QCOW2_INCOMPAT_DIRTY_BITNR       = 0
 	QCOW2_INCOMPAT_CORRUPT_BITNR     = 1
@@ -204,6 +224,16 @@ const (
 	OPT_L2CACHESIZE      = "l2-cache-size"
 	OPT_DATAFILE         = "datafile"
 	OPT_BACKING_FILE_FMT = "backingFileFmt"
+	OPT_OVERLAP_CHECK    = "overlap-check"
+	OPT_CLUSTER_SIZE     = "cluster-size"
+	OPT_PREALLOC         = "preallocation"
+	OPT_COMPAT           = "compat"
+	OPT_REFCOUNT_BITS    = "refcount-bits"
+	OPT_DETECT_ZEROES    = "detect-zeroes"
+	OPT_PROTOCOL         = "protocol"
+	OPT_AIO_WORKERS      = "aio-max-workers"
+	OPT_AIO_QUEUE_DEPTH  = "aio-queue-depth"
+	OPT_AIO              = "aio"
 )
 
 /* permission constants */
@@ -218,9 +248,16 @@ const (
 
 const Max_WRITE_ZEROS = uint64(65536)
 const MAX_BOUNCE_BUFFER = uint64(32768 << 9)
+const STREAM_CHUNK = uint64(512 * 1024)
+const COMPARE_BUF_SIZE = uint64(2 * 1024 * 1024)
+const CONVERT_BUF_SIZE = uint64(2 * 1024 * 1024)
+const CONVERT_MAX_WORKERS = 16
+const COMPACT_BATCH_CLUSTERS = 64
 
 // external data file magic number
 const (
-	QCOW2_EXT_MAGIC_DATA_FILE   = uint32(0x44415441)
-	QCOW2_EXT_MAGIC_BACKING_FMT = uint32(0xe2792aca)
+	QCOW2_EXT_MAGIC_DATA_FILE     = uint32(0x44415441)
+	QCOW2_EXT_MAGIC_BACKING_FMT   = uint32(0xe2792aca)
+	QCOW2_EXT_MAGIC_FEATURE_TABLE = uint32(0x6803f857) /* version 3 only */
+	QCOW2_EXT_MAGIC_BITMAPS       = uint32(0x23852875) /* version 3 only */
 )
@@ -0,0 +1,364 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync"
+	"unsafe"
+)
+
+/*
+* copy the guest visible content of the source image into the target image,
+* the target must be newly created so that it reads as zeroes. ranges which
+* are zero in the source are skipped via block status and the data is copied
+* in segments of up to CONVERT_BUF_SIZE bytes aligned to the target clusters.
+*
+* the segments are read and written by a number of goroutines, and at most
+* Readers+Writers segments are in flight so that the memory is bounded. the
+* segments are written out of order unless InOrder is set.
+*
+* if the target has a backing file, only the ranges allocated in the top
+* image of the source are copied and the zero ranges are written explicitly,
+* the rest is supposed to be provided by the target's backing file.
+*
+* if Compress is set, the data clusters of the target are written compressed,
+* which only a qcow2 target supports.
+ */
+func Blk_Convert(src *BdrvChild, dst *BdrvChild, opts *BlockConvertOptions,
+	progress ProgressFunc) error {
+
+	if err := blk_check_child(src); err != nil {
+		return err
+	}
+	if err := blk_check_child(dst); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &BlockConvertOptions{}
+	}
+	if opts.Readers > CONVERT_MAX_WORKERS || opts.Writers > CONVERT_MAX_WORKERS {
+		return ERR_EINVAL
+	}
+	if opts.Compress && dst.bs.Drv.bdrv_pwritev_compressed_part == nil {
+		return ERR_ENOTSUP
+	}
+	return bdrv_convert(src, dst, opts, progress)
+}
+
+// a segment of the source going through the convert pipeline
+type convertSegment struct {
+	seq    uint64
+	offset uint64
+	bytes  uint64
+	zero   bool //the segment is written as zeroes without reading the source
+	buf    []byte
+}
+
+type convertState struct {
+	src       *BdrvChild
+	dst       *BdrvChild
+	opts      *BlockConvertOptions
+	totalSize uint64
+	dstSize   uint64
+
+	bufPool chan []byte
+	readCh  chan *convertSegment
+	writeCh chan *convertSegment
+	quit    chan struct{}
+
+	lock     sync.Mutex
+	err      error
+	done     uint64
+	progress ProgressFunc
+}
+
+func bdrv_convert(src *BdrvChild, dst *BdrvChild, opts *BlockConvertOptions,
+	progress ProgressFunc) error {
+
+	var err error
+	var readers, writers sync.WaitGroup
+	nbReaders, nbWriters := max(opts.Readers, 1), max(opts.Writers, 1)
+	if opts.InOrder {
+		nbWriters = 1
+	}
+
+	s := &convertState{
+		src:      src,
+		dst:      dst,
+		opts:     opts,
+		bufPool:  make(chan []byte, nbReaders+nbWriters),
+		readCh:   make(chan *convertSegment),
+		writeCh:  make(chan *convertSegment),
+		quit:     make(chan struct{}),
+		progress: progress,
+	}
+	if s.totalSize, err = bdrv_getlength(src.bs); err != nil {
+		return err
+	}
+	if s.dstSize, err = bdrv_getlength(dst.bs); err != nil {
+		return err
+	}
+	if s.dstSize < s.totalSize {
+		return ERR_EINVAL
+	}
+	for i := 0; i < nbReaders+nbWriters; i++ {
+		s.bufPool <- make([]byte, CONVERT_BUF_SIZE)
+	}
+
+	for i := 0; i < nbReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			convert_reader(s)
+		}()
+	}
+	for i := 0; i < nbWriters; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			if opts.InOrder {
+				convert_ordered_writer(s)
+			} else {
+				convert_writer(s)
+			}
+		}()
+	}
+
+	if err = convert_dispatch(s); err != nil {
+		convert_set_error(s, err)
+	}
+	close(s.readCh)
+	readers.Wait()
+	close(s.writeCh)
+	writers.Wait()
+
+	if s.err != nil {
+		return s.err
+	}
+	return bdrv_flush(dst.bs)
+}
+
+/*
+* walks the block status of the source and hands the segments to be copied
+* to the readers in the guest offset order.
+ */
+func convert_dispatch(s *convertState) error {
+
+	var offset, chunk, end, status, seq uint64
+	var base *BlockDriverState
+	var err error
+	clusterSize := bdrv_get_cluster_size(s.dst.bs)
+
+	if s.opts.TargetHasBacking {
+		base = bdrv_filter_or_cow_bs(s.src.bs)
+	}
+
+	for offset = 0; offset < s.totalSize; offset += chunk {
+		if status, err = bdrv_block_status_above(s.src.bs, base, offset, s.totalSize-offset,
+			&chunk, nil, nil); err != nil {
+			return err
+		}
+		Assert(chunk > 0)
+		/* never cross a CONVERT_BUF_SIZE boundary, which is a target cluster boundary as well */
+		chunk = min(chunk, round_down(offset+CONVERT_BUF_SIZE, CONVERT_BUF_SIZE)-offset)
+		/*
+		* the segments end on the target cluster boundaries so that the target clusters
+		* are written as a whole, a cluster holding several kinds of ranges is copied
+		* as data, its zero and unallocated ranges read as what the guest sees
+		 */
+		if end = offset + chunk; end < s.totalSize && end%clusterSize != 0 {
+			if round_down(end, clusterSize) > offset {
+				chunk = round_down(end, clusterSize) - offset
+			} else {
+				chunk = min(round_up(end, clusterSize), s.totalSize) - offset
+				status = BDRV_BLOCK_DATA
+			}
+		}
+
+		seg := &convertSegment{seq: seq, offset: offset, bytes: chunk}
+		if status&BDRV_BLOCK_ZERO > 0 {
+			if !s.opts.TargetHasBacking {
+				convert_progress(s, chunk)
+				continue
+			}
+			seg.zero = true
+		} else if status&BDRV_BLOCK_DATA == 0 && s.opts.TargetHasBacking {
+			/* the range is provided by the backing file of the target */
+			convert_progress(s, chunk)
+			continue
+		} else {
+			/* the buffer is taken in order, so the oldest segment never starves */
+			select {
+			case seg.buf = <-s.bufPool:
+			case <-s.quit:
+				return nil
+			}
+		}
+		select {
+		case s.readCh <- seg:
+			seq++
+		case <-s.quit:
+			return nil
+		}
+	}
+	return nil
+}
+
+func convert_reader(s *convertState) {
+	for seg := range s.readCh {
+		if !seg.zero && !convert_failed(s) {
+			if _, err := Blk_Pread(s.src, seg.offset, seg.buf, seg.bytes); err != nil {
+				convert_set_error(s, err)
+			}
+		}
+		select {
+		case s.writeCh <- seg:
+		case <-s.quit:
+			convert_release(s, seg)
+		}
+	}
+}
+
+func convert_writer(s *convertState) {
+	for seg := range s.writeCh {
+		convert_write_segment(s, seg)
+	}
+}
+
+/*
+* the segments arriving out of order are kept until all the previous ones
+* are written, the buffers are taken in order by the dispatcher so that the
+* next segment can always be read.
+ */
+func convert_ordered_writer(s *convertState) {
+	var next uint64
+	pending := make(map[uint64]*convertSegment)
+	for seg := range s.writeCh {
+		pending[seg.seq] = seg
+		for {
+			if seg = pending[next]; seg == nil {
+				break
+			}
+			delete(pending, next)
+			convert_write_segment(s, seg)
+			next++
+		}
+	}
+	for _, seg := range pending {
+		convert_release(s, seg)
+	}
+}
+
+func convert_write_segment(s *convertState, seg *convertSegment) {
+	var err error
+	if !convert_failed(s) {
+		if seg.zero {
+			_, err = Blk_Pwrite_Zeroes(s.dst, seg.offset, seg.bytes, 0)
+		} else if s.opts.Compress {
+			/*
+			* a compressed write covers whole clusters, the segment at the end of the source
+			* is padded with zeroes up to the cluster end, or the end of the target
+			 */
+			bytes := min(round_up(seg.offset+seg.bytes, bdrv_get_cluster_size(s.dst.bs)), s.dstSize) - seg.offset
+			if bytes > seg.bytes {
+				memset(unsafe.Pointer(&seg.buf[seg.bytes]), int(bytes-seg.bytes))
+			}
+			err = convert_write(s.dst, seg.offset, seg.buf[:bytes], s.opts.TargetHasBacking,
+				BDRV_REQ_WRITE_COMPRESSED)
+		} else {
+			err = convert_write(s.dst, seg.offset, seg.buf[:seg.bytes], s.opts.TargetHasBacking, 0)
+		}
+		if err != nil {
+			convert_set_error(s, err)
+		} else {
+			convert_progress(s, seg.bytes)
+		}
+	}
+	convert_release(s, seg)
+}
+
+func convert_release(s *convertState, seg *convertSegment) {
+	if seg.buf != nil {
+		s.bufPool <- seg.buf
+		seg.buf = nil
+	}
+}
+
+func convert_progress(s *convertState, bytes uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.done += bytes
+	if s.progress != nil {
+		s.progress(s.done, s.totalSize)
+	}
+}
+
+// only the first error is kept, it stops the whole pipeline
+func convert_set_error(s *convertState, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.quit)
+	}
+}
+
+func convert_failed(s *convertState) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err != nil
+}
+
+/*
+* writes the buffer cluster by cluster, zero clusters are skipped since the
+* target reads as zeroes, unless the target has a backing file in which case
+* they are written as zeroes. the data is written with flags.
+ */
+func convert_write(dst *BdrvChild, offset uint64, buf []byte, writeZeroes bool,
+	flags BdrvRequestFlags) error {
+
+	var start, end, n uint64
+	var err error
+	size := uint64(len(buf))
+	clusterSize := bdrv_get_cluster_size(dst.bs)
+
+	for start = 0; start < size; start = end {
+		isZero := false
+		for end = start; end < size; end += n {
+			n = min(round_down(offset+end+clusterSize, clusterSize)-offset-end,
+				size-end)
+			zero := buffer_is_zero(buf[end:end+n], n)
+			if end == start {
+				isZero = zero
+			} else if zero != isZero {
+				break
+			}
+		}
+		if !isZero {
+			_, err = Blk_Pwrite(dst, offset+start, buf[start:end], end-start, flags)
+		} else if writeZeroes {
+			_, err = Blk_Pwrite_Zeroes(dst, offset+start, end-start, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
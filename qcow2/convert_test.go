@@ -0,0 +1,215 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_convert_qcow2(t *testing.T) {
+	var srcFile = "/tmp/convert_src.qcow2"
+	var dstFile = "/tmp/convert_dst.qcow2"
+	var rawFile = "/tmp/convert_dst.raw"
+	buf := ([]byte)("this is a test")
+
+	src := create_compare_image(t, srcFile, "")
+	defer Blk_Close(src)
+	_, err := Blk_Pwrite(src, 1048576+123, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(src, 3*1048576-5, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	//explicit zeroes are not copied
+	_, err = Blk_Pwrite(src, 2*1048576, make([]byte, 65536), 65536, 0)
+	assert.Nil(t, err)
+
+	dst := create_compare_image(t, dstFile, "")
+	defer Blk_Close(dst)
+	var current, total uint64
+	err = Blk_Convert(src, dst, nil, func(c uint64, t uint64) { current, total = c, t })
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4*1048576), current)
+	assert.Equal(t, uint64(4*1048576), total)
+
+	res, err := Blk_Compare(src, dst, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+
+	entries, err := Blk_Map(dst, 0, 0)
+	assert.Nil(t, err)
+	var allocated uint64
+	for _, e := range entries {
+		if e.Data {
+			allocated += e.Length
+		}
+	}
+	assert.Equal(t, uint64(3*65536), allocated)
+
+	os.Remove(rawFile)
+	err = Blk_Create(rawFile, map[string]any{OPT_SIZE: 4 * 1048576, OPT_FMT: "raw", OPT_FILENAME: rawFile})
+	assert.Nil(t, err)
+	raw, err := Blk_Open(rawFile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	defer Blk_Close(raw)
+	err = Blk_Convert(src, raw, nil, nil)
+	assert.Nil(t, err)
+	res, err = Blk_Compare(src, raw, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+
+	//the target is too small
+	small := "/tmp/convert_small.raw"
+	os.Remove(small)
+	err = Blk_Create(small, map[string]any{OPT_SIZE: 1048576, OPT_FMT: "raw", OPT_FILENAME: small})
+	assert.Nil(t, err)
+	smallRoot, err := Blk_Open(small, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	defer Blk_Close(smallRoot)
+	assert.Equal(t, ERR_EINVAL, Blk_Convert(src, smallRoot, nil, nil))
+}
+
+func Test_convert_target_backing(t *testing.T) {
+	var baseFile = "/tmp/convert_base.qcow2"
+	var srcFile = "/tmp/convert_overlay.qcow2"
+	var dstFile = "/tmp/convert_target.qcow2"
+	buf := make([]byte, 65536)
+	for i := range buf {
+		buf[i] = 0x5a
+	}
+
+	base := create_compare_image(t, baseFile, "")
+	_, err := Blk_Pwrite(base, 0, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(base, 1048576, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	src := create_compare_image(t, srcFile, baseFile)
+	defer Blk_Close(src)
+	_, err = Blk_Pwrite(src, 2*1048576, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	//zeroes over the data of the backing file must be kept
+	_, err = Blk_Pwrite_Zeroes(src, 1048576, 65536, 0)
+	assert.Nil(t, err)
+
+	dst := create_compare_image(t, dstFile, baseFile)
+	defer Blk_Close(dst)
+	err = Blk_Convert(src, dst, &BlockConvertOptions{TargetHasBacking: true}, nil)
+	assert.Nil(t, err)
+
+	res, err := Blk_Compare(src, dst, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+
+	//the data of the backing file is not copied into the target
+	entries, err := Blk_Map(dst, 0, 65536)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, 1, entries[0].Depth)
+}
+
+func Test_convert_parallel(t *testing.T) {
+	var srcFile = "/tmp/convert_parallel_src.qcow2"
+	var dstFile = "/tmp/convert_parallel_dst.qcow2"
+	buf := make([]byte, 65536)
+
+	src := create_compare_image(t, srcFile, "")
+	defer Blk_Close(src)
+	//scatter the data in the reverse order so that the source is fragmented
+	for i := 63; i >= 0; i -= 3 {
+		for j := range buf {
+			buf[j] = byte(i + 1)
+		}
+		_, err := Blk_Pwrite(src, uint64(i)*65536, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}
+
+	for _, inOrder := range []bool{false, true} {
+		dst := create_compare_image(t, dstFile, "")
+		var current uint64
+		err := Blk_Convert(src, dst, &BlockConvertOptions{Readers: 4, Writers: 4, InOrder: inOrder},
+			func(c uint64, t uint64) { current = c })
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(4*1048576), current)
+
+		res, err := Blk_Compare(src, dst, false, nil)
+		assert.Nil(t, err)
+		assert.True(t, res.Identical)
+
+		if inOrder {
+			//the host clusters are allocated in the guest offset order
+			entries, err := Blk_Map(dst, 0, 0)
+			assert.Nil(t, err)
+			var last uint64
+			for _, e := range entries {
+				if e.Data {
+					assert.Greater(t, e.Offset, last)
+					last = e.Offset
+				}
+			}
+		}
+		Blk_Close(dst)
+	}
+
+	dst := create_compare_image(t, dstFile, "")
+	defer Blk_Close(dst)
+	err := Blk_Convert(src, dst, &BlockConvertOptions{Readers: CONVERT_MAX_WORKERS + 1}, nil)
+	assert.Equal(t, ERR_EINVAL, err)
+}
+
+func Test_convert_cluster_aligned(t *testing.T) {
+	var srcFile = "/tmp/convert_aligned_src.qcow2"
+	var dstFile = "/tmp/convert_aligned_dst.qcow2"
+	buf := ([]byte)("this is a test")
+
+	//the source ranges are 512 bytes long
+	os.Remove(srcFile)
+	err := Blk_Create(srcFile, map[string]any{OPT_SIZE: 4*1048576 - 1024, OPT_FMT: "qcow2", OPT_CLUSTER_SIZE: 512})
+	assert.Nil(t, err)
+	src, err := Blk_Open(srcFile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	defer Blk_Close(src)
+	for _, offset := range []uint64{700, 65536 + 10000, 3*65536 - 5, 4*1048576 - 1500} {
+		_, err = Blk_Pwrite(src, offset, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}
+	dst := create_compare_image(t, dstFile, "")
+	defer Blk_Close(dst)
+
+	//every segment ends on a target cluster boundary or at the end of the source
+	for _, hasBacking := range []bool{false, true} {
+		s := &convertState{
+			src:     src,
+			dst:     dst,
+			opts:    &BlockConvertOptions{TargetHasBacking: hasBacking},
+			bufPool: make(chan []byte, 1),
+			readCh:  make(chan *convertSegment),
+			quit:    make(chan struct{}),
+		}
+		s.totalSize, err = bdrv_getlength(src.bs)
+		assert.Nil(t, err)
+		s.bufPool <- make([]byte, CONVERT_BUF_SIZE)
+		go func() {
+			assert.Nil(t, convert_dispatch(s))
+			close(s.readCh)
+		}()
+		var next, copied uint64
+		for seg := range s.readCh {
+			assert.GreaterOrEqual(t, seg.offset, next)
+			assert.Equal(t, uint64(0), seg.offset%65536)
+			if seg.offset+seg.bytes != s.totalSize {
+				assert.Equal(t, uint64(0), (seg.offset+seg.bytes)%65536)
+			}
+			next = seg.offset + seg.bytes
+			copied += seg.bytes
+			convert_release(s, seg)
+		}
+		assert.Equal(t, s.totalSize, s.done+copied)
+	}
+
+	err = Blk_Convert(src, dst, nil, nil)
+	assert.Nil(t, err)
+	res, err := Blk_Compare(src, dst, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Identical)
+}
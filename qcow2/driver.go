@@ -0,0 +1,159 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// BlockDriverOps holds the callbacks of a driver provided outside of this package,
+// the callbacks left nil are reported as not supported
+type BlockDriverOps struct {
+	Open         Bdrv_Open_Func
+	Close        Bdrv_Close_Func
+	Create       Bdrv_Create_Func
+	BlockStatus  Bdrv_Block_Status_Func
+	Preadv       Bdrv_Preadv_Func
+	Pwritev      Bdrv_Pwritev_Func
+	PreadvPart   Bdrv_Preadv_Part_Func
+	PwritevPart  Bdrv_Pwritev_Part_Func
+	Flush        Bdrv_Flush_Func
+	FlushToOs    Bdrv_Flush_To_Os_Func
+	FlushToDisk  Bdrv_Flush_To_Disk_Func
+	PwriteZeroes Bdrv_Pwrite_Zeroes_Func
+	Getlength    Bdrv_Getlength_Func
+	Truncate     Bdrv_Truncate_Func
+	Pdiscard     Bdrv_Pdiscard_Func
+	Measure      Bdrv_Measure_Func
+}
+
+var (
+	driverLock sync.RWMutex
+	drivers    = make(map[string]*BlockDriver)
+)
+
+func init() {
+	RegisterDriver(newRawDriver())
+	RegisterDriver(newQcow2Driver())
+}
+
+// NewBlockDriver builds a driver from the given callbacks, a protocol driver (isFormat is false)
+// accesses the storage directly and can be put under a qcow2 image by the OPT_PROTOCOL option
+func NewBlockDriver(formatName string, isFormat bool, supportBacking bool, ops *BlockDriverOps) *BlockDriver {
+	drv := &BlockDriver{
+		FormatName:     formatName,
+		IsFormat:       isFormat,
+		SupportBacking: supportBacking,
+	}
+	if ops != nil {
+		drv.bdrv_open = ops.Open
+		drv.bdrv_close = ops.Close
+		drv.bdrv_create = ops.Create
+		drv.bdrv_block_status = ops.BlockStatus
+		drv.bdrv_preadv = ops.Preadv
+		drv.bdrv_pwritev = ops.Pwritev
+		drv.bdrv_preadv_part = ops.PreadvPart
+		drv.bdrv_pwritev_part = ops.PwritevPart
+		drv.bdrv_flush = ops.Flush
+		drv.bdrv_flush_to_os = ops.FlushToOs
+		drv.bdrv_flush_to_disk = ops.FlushToDisk
+		drv.bdrv_pwrite_zeroes = ops.PwriteZeroes
+		drv.bdrv_getlength = ops.Getlength
+		drv.bdrv_truncate = ops.Truncate
+		drv.bdrv_pdiscard = ops.Pdiscard
+		drv.bdrv_measure = ops.Measure
+	}
+	return drv
+}
+
+// RegisterDriver makes the driver available to Blk_Create, Blk_Open and backing chains by its name
+func RegisterDriver(drv *BlockDriver) error {
+	if drv == nil || drv.FormatName == "" || drv.bdrv_open == nil {
+		return Err_IncompleteParameters
+	}
+	driverLock.Lock()
+	defer driverLock.Unlock()
+	if _, ok := drivers[drv.FormatName]; ok {
+		return Err_DriverExists
+	}
+	drivers[drv.FormatName] = drv
+	return nil
+}
+
+// LookupDriver returns the registered driver of the name, or nil
+func LookupDriver(name string) *BlockDriver {
+	driverLock.RLock()
+	defer driverLock.RUnlock()
+	return drivers[name]
+}
+
+func get_driver(fmt string) *BlockDriver {
+	return LookupDriver(fmt)
+}
+
+// the protocol driver a format driver opens its files with, raw files by default
+func bdrv_protocol(options map[string]any) string {
+	if val, ok := options[OPT_PROTOCOL]; ok && val.(string) != "" {
+		return val.(string)
+	}
+	return TYPE_RAW_NAME
+}
+
+// NewBlockDriverState is used by the open callback of an external driver,
+// opaque is the driver's own state, which is got back by Opaque()
+func NewBlockDriverState(filename string, opaque any, flags int) *BlockDriverState {
+	return &BlockDriverState{
+		filename:         filename,
+		opaque:           opaque,
+		options:          make(map[string]any),
+		RequestAlignment: DEFAULT_ALIGNMENT,
+		MaxTransfer:      DEFAULT_MAX_TRANSFER,
+		OpenFlags:        flags,
+	}
+}
+
+func (bs *BlockDriverState) Opaque() any {
+	return bs.opaque
+}
+
+func (bs *BlockDriverState) Filename() string {
+	return bs.filename
+}
+
+func (qiov *QEMUIOVector) Size() uint64 {
+	return qiov.size
+}
+
+// ToBuf copies the vector's bytes from offset into buf, returns the number of bytes copied
+func (qiov *QEMUIOVector) ToBuf(offset uint64, buf []byte) uint64 {
+	if len(buf) == 0 {
+		return 0
+	}
+	return qemu_iovec_to_buf(qiov, offset, unsafe.Pointer(&buf[0]), uint64(len(buf)))
+}
+
+// FromBuf copies buf into the vector from offset, returns the number of bytes copied
+func (qiov *QEMUIOVector) FromBuf(offset uint64, buf []byte) uint64 {
+	if len(buf) == 0 {
+		return 0
+	}
+	return qemu_iovec_from_buf(qiov, offset, unsafe.Pointer(&buf[0]), uint64(len(buf)))
+}
@@ -0,0 +1,186 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// an in-memory protocol, as an application would provide one
+var memFiles = make(map[string][]byte)
+
+type memState struct {
+	name string
+}
+
+func mem_open(filename string, options map[string]any, flags int) (*BlockDriverState, error) {
+	if _, ok := memFiles[filename]; !ok {
+		if flags&BDRV_O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		memFiles[filename] = nil
+	}
+	return NewBlockDriverState(filename, &memState{name: filename}, flags), nil
+}
+
+func mem_getlength(bs *BlockDriverState) (uint64, error) {
+	return uint64(len(memFiles[bs.Opaque().(*memState).name])), nil
+}
+
+func mem_truncate(bs *BlockDriverState, offset uint64) error {
+	name := bs.Opaque().(*memState).name
+	data := make([]byte, offset)
+	copy(data, memFiles[name])
+	memFiles[name] = data
+	return nil
+}
+
+func mem_preadv(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
+	data := memFiles[bs.Opaque().(*memState).name]
+	buf := make([]byte, bytes)
+	if offset < uint64(len(data)) {
+		copy(buf, data[offset:])
+	}
+	qiov.FromBuf(0, buf)
+	return nil
+}
+
+func mem_pwritev(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
+	name := bs.Opaque().(*memState).name
+	if offset+bytes > uint64(len(memFiles[name])) {
+		mem_truncate(bs, offset+bytes)
+	}
+	qiov.ToBuf(0, memFiles[name][offset:offset+bytes])
+	return nil
+}
+
+func Test_driver_register(t *testing.T) {
+
+	assert.NotNil(t, LookupDriver(TYPE_RAW_NAME))
+	assert.NotNil(t, LookupDriver(TYPE_QCOW2_NAME))
+	assert.Nil(t, LookupDriver("mem"))
+	assert.Equal(t, Err_DriverExists, RegisterDriver(newRawDriver()))
+	assert.Equal(t, Err_IncompleteParameters, RegisterDriver(NewBlockDriver("mem", false, false, nil)))
+
+	_, err := Blk_Open("/tmp/none.img", map[string]any{OPT_FMT: "nonexistent"}, BDRV_O_RDWR)
+	assert.Equal(t, Err_NoDriverFound, err)
+
+	drv := NewBlockDriver("mem", false, false, &BlockDriverOps{
+		Open:      mem_open,
+		Getlength: mem_getlength,
+		Truncate:  mem_truncate,
+		Preadv:    mem_preadv,
+		Pwritev:   mem_pwritev,
+	})
+	assert.Nil(t, RegisterDriver(drv))
+	assert.Equal(t, drv, LookupDriver("mem"))
+
+	//a backing chain of qcow2 images stored by the protocol
+	err = Blk_Create("base", map[string]any{
+		OPT_SIZE:     1048576,
+		OPT_FILENAME: "base",
+		OPT_FMT:      "qcow2",
+		OPT_PROTOCOL: "mem",
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open("base", map[string]any{OPT_FMT: "qcow2", OPT_PROTOCOL: "mem"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	buf := []byte("this is a test")
+	_, err = Blk_Pwrite(root, 123, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	err = Blk_Create("overlay", map[string]any{
+		OPT_SIZE:     1048576,
+		OPT_FILENAME: "overlay",
+		OPT_FMT:      "qcow2",
+		OPT_PROTOCOL: "mem",
+		OPT_BACKING:  "base",
+	})
+	assert.Nil(t, err)
+	root, err = Blk_Open("overlay", map[string]any{OPT_FMT: "qcow2", OPT_PROTOCOL: "mem"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	bufOut := make([]byte, len(buf))
+	_, err = Blk_Pread(root, 123, bufOut, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, buf, bufOut)
+	Blk_Close(root)
+
+	//the format driver writes nothing to the local file system
+	_, err = os.Stat("base")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// the protocol fails the data writes of a cancellable request as if it was cancelled meanwhile
+var memCancel context.CancelFunc
+
+func mem_cancel_pwritev(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
+	if ctx.Done() != nil && memCancel != nil {
+		memCancel()
+		return ctx.Err()
+	}
+	return mem_pwritev(ctx, bs, offset, bytes, qiov, flags)
+}
+
+func Test_driver_context(t *testing.T) {
+
+	drv := NewBlockDriver("memcancel", false, false, &BlockDriverOps{
+		Open:      mem_open,
+		Getlength: mem_getlength,
+		Truncate:  mem_truncate,
+		Preadv:    mem_preadv,
+		Pwritev:   mem_cancel_pwritev,
+	})
+	assert.Nil(t, RegisterDriver(drv))
+	err := Blk_Create("cancel", map[string]any{
+		OPT_SIZE:     1048576,
+		OPT_FILENAME: "cancel",
+		OPT_FMT:      "qcow2",
+		OPT_PROTOCOL: "memcancel",
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open("cancel", map[string]any{OPT_FMT: "qcow2", OPT_PROTOCOL: "memcancel"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	buf := bytes.Repeat([]byte{0x5a}, 3*65536)
+
+	//a done context fails before any I/O
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Blk_Pwrite_Ctx(ctx, root, 0, buf, uint64(len(buf)), 0)
+	assert.Equal(t, context.Canceled, err)
+	_, err = Blk_Pread_Ctx(ctx, root, 0, buf, uint64(len(buf)))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, Blk_Discard_Ctx(ctx, root, 0, 65536))
+	assert.Equal(t, context.Canceled, Blk_Flush_Ctx(ctx, root))
+	_, err = Blk_Open_Ctx(ctx, "cancel", map[string]any{OPT_FMT: "qcow2", OPT_PROTOCOL: "memcancel"}, 0)
+	assert.Equal(t, context.Canceled, err)
+
+	//cancelled while writing the data, the allocated clusters are released again
+	ctx, memCancel = context.WithCancel(context.Background())
+	_, err = Blk_Pwrite_Ctx(ctx, root, 0, buf, uint64(len(buf)), 0)
+	memCancel = nil
+	assert.Equal(t, context.Canceled, err)
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	out := make([]byte, len(buf))
+	_, err = Blk_Pread(root, 0, out, uint64(len(out)))
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, len(buf)), out)
+
+	//the image keeps working
+	_, err = Blk_Pwrite(root, 0, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(root, 0, out, uint64(len(out)))
+	assert.Nil(t, err)
+	assert.Equal(t, buf, out)
+	Blk_Close(root)
+}
@@ -95,3 +95,76 @@ const (
 )
 
 type Qcow2DiscardType int
+
+// check and repair modes
+const (
+	BDRV_FIX_LEAKS   = 1
+	BDRV_FIX_ERRORS  = 2
+	BDRV_FIX_REBUILD = 4 /* always rebuild the refcount structures from scratch */
+)
+
+type BdrvCheckMode int
+
+// metadata overlap check bits
+const (
+	QCOW2_OL_MAIN_HEADER_BITNR = iota
+	QCOW2_OL_ACTIVE_L1_BITNR
+	QCOW2_OL_ACTIVE_L2_BITNR
+	QCOW2_OL_REFCOUNT_TABLE_BITNR
+	QCOW2_OL_REFCOUNT_BLOCK_BITNR
+	QCOW2_OL_SNAPSHOT_TABLE_BITNR
+	QCOW2_OL_INACTIVE_L1_BITNR
+	QCOW2_OL_INACTIVE_L2_BITNR
+	QCOW2_OL_MAX_BITNR
+)
+
+const (
+	QCOW2_OL_NONE           = 0
+	QCOW2_OL_MAIN_HEADER    = 1 << QCOW2_OL_MAIN_HEADER_BITNR
+	QCOW2_OL_ACTIVE_L1      = 1 << QCOW2_OL_ACTIVE_L1_BITNR
+	QCOW2_OL_ACTIVE_L2      = 1 << QCOW2_OL_ACTIVE_L2_BITNR
+	QCOW2_OL_REFCOUNT_TABLE = 1 << QCOW2_OL_REFCOUNT_TABLE_BITNR
+	QCOW2_OL_REFCOUNT_BLOCK = 1 << QCOW2_OL_REFCOUNT_BLOCK_BITNR
+	QCOW2_OL_SNAPSHOT_TABLE = 1 << QCOW2_OL_SNAPSHOT_TABLE_BITNR
+	QCOW2_OL_INACTIVE_L1    = 1 << QCOW2_OL_INACTIVE_L1_BITNR
+	/* NOTE: Checking overlaps with inactive L2 tables will result in bdrv
+	 * reads. */
+	QCOW2_OL_INACTIVE_L2 = 1 << QCOW2_OL_INACTIVE_L2_BITNR
+
+	/* Perform all overlap checks which can be done in constant time */
+	QCOW2_OL_CONSTANT = QCOW2_OL_MAIN_HEADER | QCOW2_OL_ACTIVE_L1 | QCOW2_OL_REFCOUNT_TABLE |
+		QCOW2_OL_SNAPSHOT_TABLE | QCOW2_OL_INACTIVE_L1
+	/* Perform all overlap checks which don't require disk access */
+	QCOW2_OL_CACHED = QCOW2_OL_CONSTANT | QCOW2_OL_ACTIVE_L2 | QCOW2_OL_REFCOUNT_BLOCK
+	/* Perform all overlap checks */
+	QCOW2_OL_ALL = QCOW2_OL_CACHED | QCOW2_OL_INACTIVE_L2
+)
+
+type Qcow2MetadataOverlap int
+
+// compatibility levels of the qcow2 format
+const (
+	COMPAT_V2 = "0.10" //version 2
+	COMPAT_V3 = "1.1"  //version 3
+)
+
+// detect-zeroes modes, unmap also deallocates the zeroed clusters
+const (
+	DETECT_ZEROES_OFF   = "off"
+	DETECT_ZEROES_ON    = "on"
+	DETECT_ZEROES_UNMAP = "unmap"
+)
+
+// the aio modes of the raw files
+const (
+	AIO_THREADS  = "threads"  /* synchronous syscalls on the goroutines of the requests */
+	AIO_IO_URING = "io_uring" /* io_uring on linux, the threads mode elsewhere */
+)
+
+// preallocation modes
+const (
+	PREALLOC_MODE_OFF      = "off"
+	PREALLOC_MODE_METADATA = "metadata"
+	PREALLOC_MODE_FALLOC   = "falloc"
+	PREALLOC_MODE_FULL     = "full"
+)
@@ -36,6 +36,7 @@ var (
 
 	Err_IdxOutOfRange        = fmt.Errorf("index is out of range")
 	Err_NoDriverFound        = fmt.Errorf("no driver found")
+	Err_DriverExists         = fmt.Errorf("driver is already registered")
 	Err_NullObject           = fmt.Errorf("null object")
 	Err_IncompleteParameters = fmt.Errorf("incomplete parameters")
 	Err_L2Alloc              = fmt.Errorf("allocate l2 table fails")
@@ -43,4 +44,7 @@ var (
 	Err_NoWritePerm          = fmt.Errorf("no write permission")
 	Err_NoReadPerm           = fmt.Errorf("no read permission")
 	Err_Misaligned           = fmt.Errorf("misaligned")
+	Err_ImageCorrupt         = fmt.Errorf("image is corrupt, it can only be opened read/write for repairing")
+	Err_Closed               = fmt.Errorf("image is closed")
+	Err_NotPaused            = fmt.Errorf("image is not paused")
 )
@@ -0,0 +1,163 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+)
+
+// an extent of the guest visible content sharing the same allocation status
+type BlockExtent struct {
+	Start      uint64
+	Length     uint64
+	Status     uint64 //BDRV_BLOCK_* flags
+	Depth      int    //the depth in the backing chain where the status was determined, 0 for the top image
+	HostOffset uint64 //the host offset in Filename, only valid with BDRV_BLOCK_OFFSET_VALID
+	Filename   string
+}
+
+// the content is determined by an image between the top and the base
+func (e *BlockExtent) IsAllocated() bool {
+	return e.Status&BDRV_BLOCK_ALLOCATED > 0
+}
+
+// the content reads as zero
+func (e *BlockExtent) IsZero() bool {
+	return e.Status&BDRV_BLOCK_ZERO > 0
+}
+
+// the content is held by a data cluster
+func (e *BlockExtent) IsData() bool {
+	return e.Status&BDRV_BLOCK_DATA > 0
+}
+
+// the host offset is valid
+func (e *BlockExtent) HasOffset() bool {
+	return e.Status&BDRV_BLOCK_OFFSET_VALID > 0
+}
+
+/*
+* iterates the extents of a range, the usage is like:
+*
+*	it, err := Blk_Extents(root, 0, 0, "")
+*	for it.Next() {
+*		extent := it.Extent()
+*	}
+*	err = it.Err()
+ */
+type BlockExtentIterator struct {
+	bs     *BlockDriverState
+	base   *BlockDriverState
+	offset uint64
+	end    uint64
+	extent BlockExtent
+	err    error
+}
+
+/*
+* returns an iterator over the extents of the range, a length of 0 means up to
+* the end of the image. if a base is given, the ranges allocated only in the
+* base or below are reported as unallocated. adjacent extents are not merged.
+ */
+func Blk_Extents(root *BdrvChild, offset uint64, length uint64, base string) (*BlockExtentIterator, error) {
+
+	var baseBs *BlockDriverState
+	var size uint64
+	var err error
+
+	if err = blk_check_child(root); err != nil {
+		return nil, err
+	}
+	if base != "" {
+		if baseBs = bdrv_find_backing_image(root.bs, base); baseBs == nil {
+			return nil, fmt.Errorf("can not find '%s' in the backing chain", base)
+		}
+	}
+	if size, err = bdrv_getlength(root.bs); err != nil {
+		return nil, err
+	}
+	if length == 0 || offset+length > size {
+		length = size - min(offset, size)
+	}
+	return &BlockExtentIterator{
+		bs:     root.bs,
+		base:   baseBs,
+		offset: offset,
+		end:    offset + length,
+	}, nil
+}
+
+// advances to the next extent, it returns false at the end of the range or on errors
+func (it *BlockExtentIterator) Next() bool {
+
+	var e BlockExtent
+	if it.err != nil || it.offset >= it.end {
+		return false
+	}
+	if it.err = bdrv_get_extent(it.bs, it.base, it.offset, it.end-it.offset, &e); it.err != nil {
+		return false
+	}
+	it.extent = e
+	it.offset += e.Length
+	return true
+}
+
+// the current extent
+func (it *BlockExtentIterator) Extent() BlockExtent {
+	return it.extent
+}
+
+// the error which stopped the iteration, if any
+func (it *BlockExtentIterator) Err() error {
+	return it.err
+}
+
+/*
+* get the allocation status of the range from the backing chain above the
+* base, the extent covers the leading part of the range sharing the same status.
+ */
+func bdrv_get_extent(bs *BlockDriverState, base *BlockDriverState, offset uint64,
+	bytes uint64, e *BlockExtent) error {
+
+	var ret, pnum, tmap uint64
+	var file *BlockDriverState
+	var depth int
+	var err error
+
+	if ret, err = bdrv_common_block_status_above(bs, base, false, true, offset, bytes,
+		&pnum, &tmap, &file, &depth); err != nil {
+		return err
+	}
+	Assert(pnum > 0)
+
+	*e = BlockExtent{
+		Start:  offset,
+		Length: pnum,
+		Status: ret &^ uint64(BDRV_BLOCK_EOF|BDRV_BLOCK_RECURSE|BDRV_BLOCK_RAW),
+		Depth:  depth - 1,
+	}
+	if e.HasOffset() {
+		e.HostOffset = tmap
+		if file != nil {
+			e.Filename = file.filename
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_extents_above_base(t *testing.T) {
+	var basefile = "/tmp/extents_base.qcow2"
+	var midfile = "/tmp/extents_mid.qcow2"
+	var topfile = "/tmp/extents_top.qcow2"
+
+	//the base holds data at 123, the middle at 1M+123 and the top at 2M+123
+	prepare_stream_chain(t, basefile, midfile, topfile)
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+
+	collect := func(offset uint64, length uint64, base string) []BlockExtent {
+		var extents []BlockExtent
+		it, err := Blk_Extents(root, offset, length, base)
+		assert.Nil(t, err)
+		for it.Next() {
+			extents = append(extents, it.Extent())
+		}
+		assert.Nil(t, it.Err())
+		return extents
+	}
+	allocated := func(extents []BlockExtent) map[uint64]BlockExtent {
+		ret := make(map[uint64]BlockExtent)
+		for _, e := range extents {
+			if e.IsAllocated() {
+				ret[e.Start] = e
+			}
+		}
+		return ret
+	}
+
+	//the whole chain
+	extents := collect(0, 0, "")
+	assert.Equal(t, uint64(0), extents[0].Start)
+	assert.Equal(t, uint64(4*1048576), extents[len(extents)-1].Start+extents[len(extents)-1].Length)
+	allocs := allocated(extents)
+	assert.Equal(t, 3, len(allocs))
+	for i, filename := range []string{basefile, midfile, topfile} {
+		e, ok := allocs[uint64(i)*1048576]
+		assert.True(t, ok)
+		assert.Equal(t, uint64(65536), e.Length)
+		assert.Equal(t, 2-i, e.Depth)
+		assert.True(t, e.IsData() && e.HasOffset())
+		assert.Equal(t, filename, e.Filename)
+		assert.True(t, e.HostOffset > 0)
+	}
+
+	//the changes above the base
+	allocs = allocated(collect(0, 0, basefile))
+	assert.Equal(t, 2, len(allocs))
+	assert.Equal(t, 1, allocs[1048576].Depth)
+	assert.Equal(t, 0, allocs[2*1048576].Depth)
+
+	//the changes of the top image only
+	allocs = allocated(collect(0, 0, midfile))
+	assert.Equal(t, 1, len(allocs))
+	assert.Equal(t, topfile, allocs[2*1048576].Filename)
+
+	//a sub range
+	extents = collect(2*1048576+4096, 4096, midfile)
+	assert.Equal(t, 1, len(extents))
+	assert.True(t, extents[0].IsAllocated())
+	assert.Equal(t, uint64(4096), extents[0].Length)
+
+	_, err = Blk_Extents(root, 0, 0, "/tmp/extents_none.qcow2")
+	assert.NotNil(t, err)
+
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(midfile)
+	os.Remove(topfile)
+}
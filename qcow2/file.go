@@ -21,77 +21,179 @@ SOFTWARE.
 
 import (
 	"context"
+	"io"
 	"os"
+	"sync/atomic"
 	"unsafe"
 )
 
+const (
+	RWF_DSYNC = 0x2 /* per-write O_DSYNC, used for BDRV_REQ_FUA */
+
+	FALLOC_FL_ZERO_RANGE = 0x10 /* the range reads as zeroes, used for the zero writes */
+)
+
+// set once the kernel turns out to lack preadv2/pwritev2, the positional ReadAt/WriteAt are used then
+var noVectoredSyscalls int32
+
 /*
- * write the iov to the raw file, whose byte order follows the iov.
+ * write the iov to the raw file at offset, whose byte order follows the iov.
+ * the positional vectored syscall doesn't touch the file offset, so concurrent
+ * requests on the same file are safe. short writes are continued, the
+ * context is checked before each syscall.
+ * flags are the RWF_* flags of pwritev2. the writes are submitted to the ring
+ * if there is one.
  */
-func pwritev(ctx context.Context, file *os.File, iov []iovec, iovcnt int, offset uint64) (uint64, error) {
+func pwritev(ctx context.Context, file *os.File, ring *IoUring, iov []iovec, iovcnt int, offset uint64, flags int) (uint64, error) {
 
-	i := int(0)
 	ret := uint64(0)
+	var n uint64
 	var err error
-	var n int
 
-	file.Seek(int64(offset), 0)
-	for i < iovcnt {
-		buffer := unsafe.Slice((*byte)(iov[i].iov_base), iov[i].iov_len)
-		if n, err = file.Write(buffer); err != nil {
+	/* the syscall consumes the vector, the caller's one is left intact */
+	vecs := make([]iovec, iovcnt)
+	copy(vecs, iov[:iovcnt])
+
+	for len(vecs) > 0 {
+		if err = ctx.Err(); err != nil {
 			return ret, err
-		} else if n > 0 {
-			ret += uint64(n)
-		} else if n == 0 {
-			break
-		} else if err == ERR_EINTR {
-			continue
-		} else {
-			/* else it is some "other" error,
-			 * only return if there was no data processed. */
-			if n == 0 {
-				return ret, err
-			}
-			break
 		}
-		i++
+		n, err = file_ring_pwritev(file, ring, vecs[:min(len(vecs), IOV_MAX)], offset+ret, flags)
+		if err != nil {
+			return ret + n, err
+		}
+		if n == 0 {
+			return ret, io.ErrShortWrite
+		}
+		ret += n
+		vecs = iovecs_advance(vecs, n)
 	}
 	return ret, nil
 }
 
 /*
- * read the iov from the raw file, whose byte order follows the iov.
+ * read the iov from the raw file at offset, whose byte order follows the iov.
+ * the positional vectored syscall doesn't touch the file offset, so concurrent
+ * requests on the same file are safe. short reads are continued, the context
+ * is checked before each syscall. a short read at the
+ * end of the file is not an error. the reads are submitted to the ring if there is one.
  */
-func preadv(ctx context.Context, file *os.File, iov []iovec, iovcnt int, offset uint64) (uint64, error) {
+func preadv(ctx context.Context, file *os.File, ring *IoUring, iov []iovec, iovcnt int, offset uint64) (uint64, error) {
 
-	i := int(0)
 	ret := uint64(0)
+	var n uint64
 	var err error
-	var n int
-
-	file.Seek(int64(offset), 0)
-	for i < iovcnt {
 
-		buffer := unsafe.Slice((*byte)(iov[i].iov_base), iov[i].iov_len)
+	vecs := make([]iovec, iovcnt)
+	copy(vecs, iov[:iovcnt])
 
-		if n, err = file.Read(buffer); err != nil {
+	for len(vecs) > 0 {
+		if err = ctx.Err(); err != nil {
 			return ret, err
-		} else if n > 0 {
-			ret += uint64(n)
-		} else if n == 0 {
-			break
-		} else if err == ERR_EINTR {
-			continue
-		} else {
-			/* else it is some "other" error,
-			 * only return if there was no data processed. */
-			if n == 0 {
-				return ret, err
+		}
+		n, err = file_ring_preadv(file, ring, vecs[:min(len(vecs), IOV_MAX)], offset+ret, 0)
+		if err != nil {
+			return ret + n, err
+		}
+		if n == 0 {
+			if ret > 0 {
+				return ret, nil
 			}
-			break
+			return 0, io.EOF
 		}
-		i++
+		ret += n
+		vecs = iovecs_advance(vecs, n)
+	}
+	return ret, nil
+}
+
+// drop the first n bytes of the vector, the elements are adjusted in place
+func iovecs_advance(vecs []iovec, n uint64) []iovec {
+	for len(vecs) > 0 && n >= vecs[0].iov_len {
+		n -= vecs[0].iov_len
+		vecs = vecs[1:]
+	}
+	if len(vecs) > 0 && n > 0 {
+		vecs[0].iov_base = unsafe.Pointer(uintptr(vecs[0].iov_base) + uintptr(n))
+		vecs[0].iov_len -= n
+	}
+	return vecs
+}
+
+// one write through the ring, the synchronous syscall if there is no ring or it lacks the operation
+func file_ring_pwritev(file *os.File, ring *IoUring, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	if ring != nil {
+		if n, err := ring.pwritev(vecs, offset, flags); err != ERR_ENOTSUP {
+			return n, err
+		}
+	}
+	return file_pwritev(file, vecs, offset, flags)
+}
 
+func file_ring_preadv(file *os.File, ring *IoUring, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	if ring != nil {
+		if n, err := ring.preadv(vecs, offset, flags); err != ERR_ENOTSUP {
+			return n, err
+		}
+	}
+	return file_preadv(file, vecs, offset, flags)
+}
+
+func file_fsync(file *os.File, ring *IoUring) error {
+	if ring != nil {
+		if err := ring.fsync(); err != ERR_ENOTSUP {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// ERR_ENOTSUP if neither the platform nor the file system supports the mode
+func file_fallocate(file *os.File, ring *IoUring, mode uint32, offset uint64, length uint64) error {
+	if ring != nil {
+		if err := ring.fallocate(mode, offset, length); err != ERR_ENOTSUP {
+			return err
+		}
+	}
+	return file_fallocate_sync(file, mode, offset, length)
+}
+
+func file_vectored_syscalls() bool {
+	return have_vectored_syscalls && atomic.LoadInt32(&noVectoredSyscalls) == 0
+}
+
+/*
+ * the fallback of the platforms and kernels without preadv2/pwritev2, one positional
+ * write per vector element, RWF_DSYNC is emulated by syncing the file afterwards.
+ */
+func file_pwritev_fallback(file *os.File, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	ret := uint64(0)
+	for i := range vecs {
+		buffer := unsafe.Slice((*byte)(vecs[i].iov_base), vecs[i].iov_len)
+		n, err := file.WriteAt(buffer, int64(offset+ret))
+		ret += uint64(n)
+		if err != nil {
+			return ret, err
+		}
+	}
+	if flags&RWF_DSYNC > 0 {
+		return ret, file.Sync()
+	}
+	return ret, nil
+}
+
+func file_preadv_fallback(file *os.File, vecs []iovec, offset uint64) (uint64, error) {
+	ret := uint64(0)
+	for i := range vecs {
+		buffer := unsafe.Slice((*byte)(vecs[i].iov_base), vecs[i].iov_len)
+		n, err := file.ReadAt(buffer, int64(offset+ret))
+		ret += uint64(n)
+		if err == io.EOF {
+			/* the caller stops at the end of the file */
+			return ret, nil
+		} else if err != nil {
+			return ret, err
+		}
 	}
 	return ret, nil
 }
@@ -0,0 +1,138 @@
+//go:build linux && (amd64 || arm64)
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const have_vectored_syscalls = true
+
+/*
+ * one preadv2/pwritev2 call, the iovec has the layout of struct iovec on the
+ * 64-bit platforms. The high half of the offset is 0 on these platforms.
+ * EINTR is retried, like ReadAt/WriteAt do for the fallback.
+ */
+func file_rw_syscall(file *os.File, trap uintptr, vecs []iovec, offset uint64, flags int) (uint64, error) {
+
+	var n uintptr
+	var errno syscall.Errno
+
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if err = rawConn.Control(func(fd uintptr) {
+		for {
+			n, _, errno = syscall.Syscall6(trap, fd, uintptr(unsafe.Pointer(&vecs[0])), uintptr(len(vecs)),
+				uintptr(offset), 0, uintptr(flags))
+			if errno != syscall.EINTR {
+				break
+			}
+		}
+	}); err != nil {
+		return 0, err
+	}
+	runtime.KeepAlive(vecs)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint64(n), nil
+}
+
+// the syscall of file_pwritev and file_preadv, the tests replace it to fail
+var file_rw = file_rw_syscall
+
+/*
+ * RWF_DSYNC is emulated by syncing the data after the write if the kernel or the
+ * file system rejects it.
+ */
+func file_pwritev(file *os.File, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	if !file_vectored_syscalls() {
+		return file_pwritev_fallback(file, vecs, offset, flags)
+	}
+	n, err := file_rw(file, sys_PWRITEV2, vecs, offset, flags)
+	if err == syscall.ENOSYS {
+		atomic.StoreInt32(&noVectoredSyscalls, 1)
+		return file_pwritev_fallback(file, vecs, offset, flags)
+	}
+	if flags&RWF_DSYNC != 0 && (err == syscall.EOPNOTSUPP || err == syscall.EINVAL) {
+		if n, err = file_rw(file, sys_PWRITEV2, vecs, offset, flags&^RWF_DSYNC); err != nil {
+			return n, err
+		}
+		return n, file_fdatasync(file)
+	}
+	return n, err
+}
+
+func file_fdatasync(file *os.File) error {
+
+	var errno error
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err = rawConn.Control(func(fd uintptr) {
+		for {
+			if errno = syscall.Fdatasync(int(fd)); errno != syscall.EINTR {
+				break
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return errno
+}
+
+func file_fallocate_sync(file *os.File, mode uint32, offset uint64, length uint64) error {
+
+	var errno error
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err = rawConn.Control(func(fd uintptr) {
+		errno = syscall.Fallocate(int(fd), mode, int64(offset), int64(length))
+	}); err != nil {
+		return err
+	}
+	if errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS {
+		return ERR_ENOTSUP
+	}
+	return errno
+}
+
+func file_preadv(file *os.File, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	if !file_vectored_syscalls() {
+		return file_preadv_fallback(file, vecs, offset)
+	}
+	n, err := file_rw(file, sys_PREADV2, vecs, offset, flags)
+	if err == syscall.ENOSYS {
+		atomic.StoreInt32(&noVectoredSyscalls, 1)
+		return file_preadv_fallback(file, vecs, offset)
+	}
+	return n, err
+}
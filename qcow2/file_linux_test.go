@@ -0,0 +1,61 @@
+//go:build linux && (amd64 || arm64)
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pwritev_dsync_fallback(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), "test_file_dsync.img")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.FileMode(0755))
+	assert.Nil(t, err)
+	defer file.Close()
+	defer func() {
+		file_rw = file_rw_syscall
+		atomic.StoreInt32(&noVectoredSyscalls, 0)
+	}()
+
+	for i, errno := range []syscall.Errno{syscall.EOPNOTSUPP, syscall.EINVAL, syscall.ENOSYS} {
+		//the kernel or the file system rejects RWF_DSYNC, or pwritev2 at all
+		var rejected, written int
+		file_rw = func(file *os.File, trap uintptr, vecs []iovec, offset uint64, flags int) (uint64, error) {
+			if trap == sys_PWRITEV2 && (flags&RWF_DSYNC != 0 || errno == syscall.ENOSYS) {
+				rejected++
+				return 0, errno
+			}
+			if trap == sys_PWRITEV2 {
+				written++
+			}
+			return file_rw_syscall(file, trap, vecs, offset, flags)
+		}
+		buf := bytes.Repeat([]byte{byte(i + 1)}, 4096)
+		n, err := pwritev(context.Background(), file, nil, []iovec{{unsafe.Pointer(&buf[0]), 4096}}, 1, 0, RWF_DSYNC)
+		assert.Nil(t, err, "errno %v", errno)
+		assert.Equal(t, uint64(4096), n)
+		assert.Equal(t, 1, rejected)
+		out := make([]byte, 4096)
+		_, err = file.ReadAt(out, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, buf, out)
+
+		if errno == syscall.ENOSYS {
+			//the positional writes are used from now on
+			assert.Equal(t, 0, written)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&noVectoredSyscalls))
+		} else {
+			//written again without the flag, the vectored syscalls are kept
+			assert.Equal(t, 1, written)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&noVectoredSyscalls))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !(linux && (amd64 || arm64))
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+)
+
+const have_vectored_syscalls = false
+
+func file_pwritev(file *os.File, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return file_pwritev_fallback(file, vecs, offset, flags)
+}
+
+func file_fallocate_sync(file *os.File, mode uint32, offset uint64, length uint64) error {
+	return ERR_ENOTSUP
+}
+
+func file_preadv(file *os.File, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return file_preadv_fallback(file, vecs, offset)
+}
@@ -1,8 +1,12 @@
 package qcow2
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"unsafe"
 
@@ -34,7 +38,7 @@ func Test_Pwritev_Preadv(t *testing.T) {
 	file, err := os.OpenFile("/tmp/test.txt", os.O_CREATE|os.O_RDWR, os.FileMode(0755))
 	assert.Nil(t, err)
 
-	n, err := pwritev(context.Background(), file, qiov.iov, qiov.niov, 512)
+	n, err := pwritev(context.Background(), file, nil, qiov.iov, qiov.niov, 512, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(3072*8), n)
 
@@ -47,7 +51,7 @@ func Test_Pwritev_Preadv(t *testing.T) {
 	memset(qiov.iov[1].iov_base, int(qiov.iov[1].iov_len))
 
 	//now read the buffer from the file
-	n, err = preadv(context.Background(), file, qiov.iov, qiov.niov, 512)
+	n, err = preadv(context.Background(), file, nil, qiov.iov, qiov.niov, 512)
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(3072*8), n)
 
@@ -61,3 +65,65 @@ func Test_Pwritev_Preadv(t *testing.T) {
 	assert.Equal(t, uint64(6789), val2_2)
 	file.Close()
 }
+
+func Test_Pwritev_Preadv_concurrent(t *testing.T) {
+
+	var filename = "/tmp/test_file_concurrent.img"
+	os.Remove(filename)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.FileMode(0755))
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+	defer file.Close()
+
+	for _, fallback := range []bool{false, true} {
+		if fallback {
+			atomic.StoreInt32(&noVectoredSyscalls, 1)
+		}
+		//every goroutine writes and reads back its own range through many small vector elements
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				buf := bytes.Repeat([]byte{byte(g + 1)}, 65536)
+				qiov := New_QEMUIOVector()
+				qemu_iovec_init(qiov, 1)
+				for i := 0; i < 65536; i += 32 {
+					qemu_iovec_add(qiov, unsafe.Pointer(&buf[i]), 32)
+				}
+				assert.Greater(t, qiov.niov, IOV_MAX)
+				n, err := pwritev(context.Background(), file, nil, qiov.iov, qiov.niov, uint64(g)*65536, RWF_DSYNC)
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(65536), n)
+
+				out := make([]byte, 65536)
+				qemu_iovec_reset(qiov)
+				for i := 0; i < 65536; i += 32 {
+					qemu_iovec_add(qiov, unsafe.Pointer(&out[i]), 32)
+				}
+				n, err = preadv(context.Background(), file, nil, qiov.iov, qiov.niov, uint64(g)*65536)
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(65536), n)
+				assert.Equal(t, buf, out)
+			}(g)
+		}
+		wg.Wait()
+
+		//short reads at the end of the file
+		out := make([]byte, 4096)
+		qiov := New_QEMUIOVector()
+		qemu_iovec_init_buf(qiov, unsafe.Pointer(&out[0]), 4096)
+		n, err := preadv(context.Background(), file, nil, qiov.iov, qiov.niov, 16*65536-100)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(100), n)
+		_, err = preadv(context.Background(), file, nil, qiov.iov, qiov.niov, 16*65536)
+		assert.Equal(t, io.EOF, err)
+
+		//a done context stops before the syscall
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = preadv(ctx, file, nil, qiov.iov, qiov.niov, 0)
+		assert.Equal(t, context.Canceled, err)
+	}
+	atomic.StoreInt32(&noVectoredSyscalls, 0)
+}
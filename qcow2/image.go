@@ -0,0 +1,236 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Image wraps an opened block device into the standard io interfaces, the offsets are guest offsets
+// and the size is the virtual size of the image, which is not grown by writes
+type Image struct {
+	child     *BdrvChild
+	childLock sync.RWMutex //protects child, the requests hold it shared so that Close waits for them
+	lock      sync.Mutex   //protects offset
+	offset    int64        //the position of Read, Write and Seek
+}
+
+var (
+	_ io.ReaderAt        = (*Image)(nil)
+	_ io.WriterAt        = (*Image)(nil)
+	_ io.ReadWriteSeeker = (*Image)(nil)
+	_ io.Closer          = (*Image)(nil)
+)
+
+// OpenImage opens the image as Blk_Open does
+func OpenImage(filename string, options map[string]any, flags int) (*Image, error) {
+	child, err := Blk_Open(filename, options, flags)
+	if err != nil {
+		return nil, err
+	}
+	return NewImage(child), nil
+}
+
+// NewImage wraps an opened block device, closing the image closes the device
+func NewImage(child *BdrvChild) *Image {
+	return &Image{child: child}
+}
+
+// Child returns the block device for the Blk_* functions
+func (img *Image) Child() *BdrvChild {
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	return img.child
+}
+
+// Size returns the virtual size of the image
+func (img *Image) Size() int64 {
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	return image_size(img.child)
+}
+
+func image_size(child *BdrvChild) int64 {
+	if child == nil {
+		return 0
+	}
+	size, err := Blk_Getlength(child)
+	if err != nil {
+		return 0
+	}
+	return int64(size)
+}
+
+// the number of bytes of a request at off which are within the image, io.EOF if none
+func (img *Image) clamp(off int64, n int) (int, error) {
+	if img.child == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, ERR_EINVAL
+	}
+	size := image_size(img.child)
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+	return n, nil
+}
+
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	n, err := img.clamp(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if _, err = Blk_Pread(img.child, uint64(off), p[:n], uint64(n)); err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes within the virtual size only, the part beyond it fails with ENOSPC
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	n, err := img.clamp(off, len(p))
+	if err == io.EOF {
+		return 0, ERR_ENOSPC
+	} else if err != nil {
+		return 0, err
+	}
+	if img.child.perm&PERM_WRITABLE == 0 || img.child.bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return 0, Err_NoWritePerm
+	}
+	if _, err = Blk_Pwrite(img.child, uint64(off), p[:n], uint64(n), 0); err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, ERR_ENOSPC
+	}
+	return n, nil
+}
+
+func (img *Image) Read(p []byte) (int, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	n, err := img.ReadAt(p, img.offset)
+	img.offset += int64(n)
+	return n, err
+}
+
+func (img *Image) Write(p []byte) (int, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	n, err := img.WriteAt(p, img.offset)
+	img.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the position of Read and Write, seeking beyond the size is allowed as with files
+func (img *Image) Seek(offset int64, whence int) (int64, error) {
+	img.lock.Lock()
+	defer img.lock.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += img.offset
+	case io.SeekEnd:
+		offset += img.Size()
+	default:
+		return 0, ERR_EINVAL
+	}
+	if offset < 0 {
+		return 0, ERR_EINVAL
+	}
+	img.offset = offset
+	return offset, nil
+}
+
+// Sync flushes the caches and the written data to the disk
+func (img *Image) Sync() error {
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	if img.child == nil {
+		return os.ErrClosed
+	}
+	return Blk_Flush(img.child)
+}
+
+// Discard releases the range, it reads as zeroes or from the backing file afterwards
+func (img *Image) Discard(off int64, length int64) error {
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	if img.child == nil {
+		return os.ErrClosed
+	}
+	if off < 0 || length < 0 {
+		return ERR_EINVAL
+	}
+	return Blk_Discard(img.child, uint64(off), uint64(length))
+}
+
+// WriteZeroes makes the range read as zeroes, unmap allows the clusters to be released
+func (img *Image) WriteZeroes(off int64, length int64, unmap bool) error {
+	img.childLock.RLock()
+	defer img.childLock.RUnlock()
+	if img.child == nil {
+		return os.ErrClosed
+	}
+	if off < 0 || length < 0 {
+		return ERR_EINVAL
+	}
+	if length == 0 {
+		return nil
+	}
+	var flags BdrvRequestFlags
+	if unmap {
+		flags |= BDRV_REQ_MAY_UNMAP
+	}
+	_, err := Blk_Pwrite_Zeroes(img.child, uint64(off), uint64(length), flags)
+	return err
+}
+
+// Close waits for the requests in progress, the later ones fail with os.ErrClosed
+func (img *Image) Close() error {
+	img.childLock.Lock()
+	defer img.childLock.Unlock()
+	if img.child == nil {
+		return nil
+	}
+	err := Blk_Flush(img.child)
+	Blk_Close(img.child)
+	img.child = nil
+	return err
+}
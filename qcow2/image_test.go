@@ -0,0 +1,118 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_image_io(t *testing.T) {
+
+	var filename = "/tmp/test_image_io.qcow2"
+	var size int64 = 1048576
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{
+		OPT_SIZE:     size,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	})
+	assert.Nil(t, err)
+
+	img, err := OpenImage(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	assert.Equal(t, size, img.Size())
+
+	//fill the whole image through io.Copy and read it back
+	data := bytes.Repeat([]byte("0123456789abcdef"), int(size/16))
+	n, err := io.Copy(img, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+
+	pos, err := img.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pos)
+	var out bytes.Buffer
+	n, err = io.Copy(&out, img)
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, data, out.Bytes())
+
+	//the size bounds reads and writes
+	buf := make([]byte, 100)
+	m, err := img.ReadAt(buf, size-10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 10, m)
+	assert.Equal(t, data[size-10:], buf[:10])
+	_, err = img.ReadAt(buf, size)
+	assert.Equal(t, io.EOF, err)
+	m, err = img.WriteAt(buf, size-10)
+	assert.Equal(t, ERR_ENOSPC, err)
+	assert.Equal(t, 10, m)
+	_, err = img.ReadAt(buf, -1)
+	assert.NotNil(t, err)
+
+	pos, err = img.Seek(-16, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, size-16, pos)
+	_, err = img.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err)
+
+	//zeroes and discards
+	assert.Nil(t, img.WriteZeroes(0, 65536, false))
+	assert.Nil(t, img.Discard(65536, 65536))
+	zeroes := make([]byte, 2*65536)
+	out.Reset()
+	_, err = io.Copy(&out, io.NewSectionReader(img, 0, 2*65536))
+	assert.Nil(t, err)
+	assert.Equal(t, zeroes, out.Bytes())
+
+	assert.Nil(t, img.Sync())
+	assert.Nil(t, img.Close())
+	_, err = img.ReadAt(buf, 0)
+	assert.Equal(t, os.ErrClosed, err)
+
+	//read only images can not be written
+	img, err = OpenImage(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	_, err = img.WriteAt(buf, 0)
+	assert.Equal(t, Err_NoWritePerm, err)
+	m, err = img.ReadAt(buf, 2*65536)
+	assert.Nil(t, err)
+	assert.Equal(t, data[2*65536:2*65536+100], buf[:m])
+	img.Close()
+
+	//closed while the readers are running, they complete or fail with os.ErrClosed
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	img, err = OpenImage(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	var wg, started sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			out := make([]byte, 4096)
+			for j := 32; j < 256; j++ {
+				_, err := img.ReadAt(out, int64(j)*4096)
+				if j == 32 {
+					started.Done()
+				}
+				if err != nil {
+					assert.Equal(t, os.ErrClosed, err)
+					return
+				}
+				assert.Equal(t, data[j*4096:(j+1)*4096], out)
+			}
+		}()
+	}
+	started.Wait()
+	assert.Nil(t, img.Close())
+	wg.Wait()
+	assert.Nil(t, img.Child())
+	os.Remove(filename)
+}
@@ -21,21 +21,158 @@ SOFTWARE.
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
-func bdrv_flush(bs *BlockDriverState) error {
+// count a request in flight, it's refused once the image is closing
+func bdrv_inc_in_flight(bs *BlockDriverState) error {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	if bs.closing {
+		return Err_Closed
+	}
+	atomic.AddUint64(&bs.InFlight, 1)
+	return nil
+}
 
-	if bs.Drv == nil {
-		return Err_NoDriverFound
+/*
+* count a request of the user of the image, it waits while the image is drained or
+* paused, like the requests queued by qemu's BlockBackend while it's quiesced. The
+* request gives up waiting with the context's error once the context is done.
+ */
+func bdrv_inc_in_flight_queued(ctx context.Context, bs *BlockDriverState) error {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	if bs.quiesceCounter > 0 && !bs.closing && ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				bs.inFlightLock.Lock()
+				bdrv_in_flight_cond(bs).Broadcast()
+				bs.inFlightLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for bs.quiesceCounter > 0 && !bs.closing {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bdrv_in_flight_cond(bs).Wait()
+	}
+	if bs.closing {
+		return Err_Closed
+	}
+	atomic.AddUint64(&bs.InFlight, 1)
+	return nil
+}
+
+func bdrv_dec_in_flight(bs *BlockDriverState) {
+	bs.inFlightLock.Lock()
+	if atomic.AddUint64(&bs.InFlight, ^uint64(0)) == 0 && bs.inFlightCond != nil {
+		bs.inFlightCond.Broadcast()
+	}
+	bs.inFlightLock.Unlock()
+}
+
+// signalled when no request is in flight any more, the image is resumed or closing, bs.inFlightLock must be held
+func bdrv_in_flight_cond(bs *BlockDriverState) *sync.Cond {
+	if bs.inFlightCond == nil {
+		bs.inFlightCond = sync.NewCond(&bs.inFlightLock)
 	}
+	return bs.inFlightCond
+}
+
+// wait until no request is in flight, must be called with bs.inFlightLock held
+func bdrv_wait_in_flight_locked(bs *BlockDriverState) {
+	for atomic.LoadUint64(&bs.InFlight) > 0 {
+		bdrv_in_flight_cond(bs).Wait()
+	}
+}
 
+/*
+* begin a drained section, the new requests of the user wait until it ends and the
+* requests in flight are waited for. The internal requests are not held back, the
+* ones of the requests in flight must complete, the children are drained with them.
+ */
+func bdrv_drained_begin(bs *BlockDriverState) error {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	if bs.closing {
+		return Err_Closed
+	}
+	bs.quiesceCounter++
+	bdrv_wait_in_flight_locked(bs)
+	return nil
+}
+
+/*
+* begin a drained section for an operation which moves or frees clusters, e.g. compact.
+* The drained sections and pauses of the others end first, so that a paused image is
+* not modified. The operation counts as in flight, closing the image waits for it,
+* bdrv_drained_end_exclusive ends the section.
+ */
+func bdrv_drained_begin_exclusive(bs *BlockDriverState) error {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	for bs.quiesceCounter > 0 && !bs.closing {
+		bdrv_in_flight_cond(bs).Wait()
+	}
+	if bs.closing {
+		return Err_Closed
+	}
+	bs.quiesceCounter++
+	bdrv_wait_in_flight_locked(bs)
 	atomic.AddUint64(&bs.InFlight, 1)
-	defer atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	return nil
+}
+
+func bdrv_drained_end_exclusive(bs *BlockDriverState) {
+	bdrv_dec_in_flight(bs)
+	bdrv_drained_end(bs)
+}
+
+func bdrv_drained_end(bs *BlockDriverState) error {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	if bs.quiesceCounter == 0 {
+		return Err_NotPaused
+	}
+	bs.quiesceCounter--
+	if bs.quiesceCounter == 0 {
+		bdrv_in_flight_cond(bs).Broadcast()
+	}
+	return nil
+}
 
+func bdrv_is_closed(bs *BlockDriverState) bool {
+	bs.inFlightLock.Lock()
+	defer bs.inFlightLock.Unlock()
+	return bs.closing
+}
+
+func bdrv_flush(bs *BlockDriverState) error {
+
+	if err := bdrv_inc_in_flight(bs); err != nil {
+		return err
+	}
+	defer bdrv_dec_in_flight(bs)
+	return bdrv_do_flush(bs)
+}
+
+func bdrv_do_flush(bs *BlockDriverState) error {
+
+	if bs.Drv == nil {
+		return Err_NoDriverFound
+	}
 	if bs.Drv.bdrv_flush != nil {
 		return bs.Drv.bdrv_flush(bs)
 	}
@@ -63,10 +200,36 @@ func bdrv_pwrite(child *BdrvChild, offset uint64, buf unsafe.Pointer, bytes uint
 
 func bdrv_pwritev(child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
-	return bdrv_pwritev_part(child, offset, bytes, qiov, 0, flags)
+	return bdrv_pwritev_part(context.Background(), child, offset, bytes, qiov, 0, flags)
+}
+
+// parse the value of the detect-zeroes open option
+func bdrv_parse_detect_zeroes(value string, flags int) (string, error) {
+	switch value {
+	case DETECT_ZEROES_OFF, DETECT_ZEROES_ON:
+	case DETECT_ZEROES_UNMAP:
+		if flags&BDRV_O_UNMAP == 0 {
+			return "", fmt.Errorf("setting %s to unmap is not allowed without the BDRV_O_UNMAP flag",
+				OPT_DETECT_ZEROES)
+		}
+	default:
+		return "", fmt.Errorf("unsupported value '%s' for %s, expected off, on or unmap", value, OPT_DETECT_ZEROES)
+	}
+	return value, nil
 }
 
-func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
+// parse the value of the aio open option, the open flags are returned with BDRV_O_IO_URING set accordingly
+func bdrv_parse_aio(value string, flags int) (int, error) {
+	switch value {
+	case AIO_THREADS:
+		return flags &^ BDRV_O_IO_URING, nil
+	case AIO_IO_URING:
+		return flags | BDRV_O_IO_URING, nil
+	}
+	return 0, fmt.Errorf("unsupported value '%s' for %s, expected threads or io_uring", value, OPT_AIO)
+}
+
+func bdrv_pwritev_part(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	//check permission
@@ -75,10 +238,15 @@ func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
 	}
 	bs := child.bs
 	var pad BdrvRequestPadding
+	var req BdrvTrackedRequest
 	var err error
 	padded := false
 	align := bs.RequestAlignment
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
 	/* If the request is misaligned then we can't make it efficient */
 	if flags&BDRV_REQ_NO_FALLBACK > 0 &&
 		!is_aligned(int(offset|bytes), int(align)) {
@@ -89,6 +257,14 @@ func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
 		return err
 	}
 
+	if flags&BDRV_REQ_ZERO_WRITE == 0 && bs.DetectZeroes != DETECT_ZEROES_OFF && bs.DetectZeroes != "" &&
+		is_aligned(int(offset|bytes), int(align)) && qemu_iovec_is_zero(qiov, qiovOffset, bytes) {
+		flags |= BDRV_REQ_ZERO_WRITE
+		if bs.DetectZeroes == DETECT_ZEROES_UNMAP {
+			flags |= BDRV_REQ_MAY_UNMAP
+		}
+	}
+
 	if flags&BDRV_REQ_ZERO_WRITE == 0 {
 		if err = bdrv_pad_request(bs, &qiov, &qiovOffset, &offset, &bytes, &pad,
 			&padded); err != nil {
@@ -96,29 +272,33 @@ func bdrv_pwritev_part(child *BdrvChild, offset uint64, bytes uint64,
 		}
 	}
 
-	atomic.AddUint64(&bs.InFlight, 1)
+	if err = bdrv_inc_in_flight(bs); err != nil {
+		bdrv_padding_destroy(&pad)
+		return err
+	}
+	tracked_request_begin(&req, bs, offset, bytes, true)
 
 	if flags&BDRV_REQ_ZERO_WRITE > 0 {
 		Assert(!padded)
-		err = bdrv_do_zero_pwritev(child, offset, bytes, flags)
+		err = bdrv_do_zero_pwritev(ctx, child, offset, bytes, flags, &req)
 		goto out
 	}
 
 	if padded {
-		//if the requests is queued already, won't use this feature
-		//bdrv_make_request_serialising(&req, align)
-		overlapOffset := offset & uint64(^(align - 1))
-		overlapBytes := round_up(offset+bytes, uint64(align)) - overlapOffset
-		bdrv_padding_rmw_read(child, overlapOffset, overlapBytes, &pad, false)
+		/* no other request may touch the padding between reading and writing it back */
+		bdrv_make_request_serialising(&req, uint64(align))
+		if err = bdrv_padding_rmw_read(ctx, child, &req, &pad, false); err != nil {
+			goto out
+		}
 	}
 
-	err = bdrv_aligned_pwritev(child, offset, bytes, uint64(align),
+	err = bdrv_aligned_pwritev(ctx, child, &req, offset, bytes, uint64(align),
 		qiov, qiovOffset, flags)
 
-	bdrv_padding_destroy(&pad)
-
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_padding_destroy(&pad)
+	tracked_request_end(&req)
+	bdrv_dec_in_flight(bs)
 	return err
 }
 
@@ -134,8 +314,13 @@ func bdrv_pad_request(bs *BlockDriverState, qiov **QEMUIOVector, qiovOffset *uin
 		return nil
 	}
 
+	//the tail is empty if the request ends aligned, the address past the buffer can't be taken
+	var tailBuf unsafe.Pointer
+	if pad.Tail > 0 {
+		tailBuf = unsafe.Pointer(&pad.Buf[pad.BufLen-pad.Tail])
+	}
 	if err = qemu_iovec_init_extended(&pad.LocalQiov, unsafe.Pointer(&pad.Buf[0]), pad.Head,
-		*qiov, *qiovOffset, *bytes, unsafe.Pointer(&pad.Buf[pad.BufLen-pad.Tail]), pad.Tail); err != nil {
+		*qiov, *qiovOffset, *bytes, tailBuf, pad.Tail); err != nil {
 		bdrv_padding_destroy(pad)
 		return err
 	}
@@ -151,7 +336,8 @@ func bdrv_pad_request(bs *BlockDriverState, qiov **QEMUIOVector, qiovOffset *uin
 	return nil
 }
 
-func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+func bdrv_do_zero_pwritev(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags,
+	req *BdrvTrackedRequest) error {
 
 	bs := child.bs
 	var localQiov QEMUIOVector
@@ -163,10 +349,10 @@ func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags B
 	padding = bdrv_init_padding(bs, offset, bytes, &pad)
 
 	if padding {
-		//bdrv_make_request_serialising(req, align);
-		overlapOffset := offset & ^(align - 1)
-		overlapBytes := round_up(offset+bytes, align) - overlapOffset
-		bdrv_padding_rmw_read(child, overlapOffset, overlapBytes, &pad, true)
+		bdrv_make_request_serialising(req, align)
+		if err = bdrv_padding_rmw_read(ctx, child, req, &pad, true); err != nil {
+			goto out
+		}
 
 		if pad.Head > 0 || pad.MergeReads {
 			alignedOffset := offset & ^(align - 1)
@@ -178,7 +364,7 @@ func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags B
 			}
 
 			qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&pad.Buf[0]), writeBytes)
-			if err = bdrv_aligned_pwritev(child, alignedOffset, writeBytes,
+			if err = bdrv_aligned_pwritev(ctx, child, req, alignedOffset, writeBytes,
 				align, &localQiov, 0, flags & ^BDRV_REQ_ZERO_WRITE); err != nil || pad.MergeReads {
 				/* Error or all work is done */
 				goto out
@@ -192,7 +378,7 @@ func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags B
 	if bytes >= align {
 		/* Write the aligned part in the middle. */
 		alignedBytes := bytes & ^(align - 1)
-		if err = bdrv_aligned_pwritev(child, offset, alignedBytes, align,
+		if err = bdrv_aligned_pwritev(ctx, child, req, offset, alignedBytes, align,
 			nil, 0, flags); err != nil {
 			goto out
 		}
@@ -203,7 +389,7 @@ func bdrv_do_zero_pwritev(child *BdrvChild, offset uint64, bytes uint64, flags B
 	if bytes > 0 {
 		Assert(align == pad.Tail+bytes)
 		qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&pad.TailBuf[0]), align)
-		err = bdrv_aligned_pwritev(child, offset, align, align,
+		err = bdrv_aligned_pwritev(ctx, child, req, offset, align, align,
 			&localQiov, 0, flags & ^BDRV_REQ_ZERO_WRITE)
 	}
 
@@ -212,13 +398,18 @@ out:
 	return err
 }
 
-func bdrv_padding_rmw_read(child *BdrvChild, overlapOffset uint64, overlapBytes uint64, pad *BdrvRequestPadding, zeroMiddle bool) error {
+// the request must be serialising, its overlap range is the aligned range to be written
+func bdrv_padding_rmw_read(ctx context.Context, child *BdrvChild, req *BdrvTrackedRequest, pad *BdrvRequestPadding, zeroMiddle bool) error {
 
 	var localQiov QEMUIOVector
 	bs := child.bs
 	align := bs.RequestAlignment
 	var err error
 	var bytes uint64
+	overlapOffset := req.overlapOffset
+	overlapBytes := req.overlapBytes
+
+	Assert(req.serialising)
 
 	if pad.Head > 0 || pad.MergeReads {
 
@@ -230,7 +421,7 @@ func bdrv_padding_rmw_read(child *BdrvChild, overlapOffset uint64, overlapBytes
 
 		qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&pad.Buf[0]), bytes)
 
-		if err = bdrv_aligned_preadv(child, overlapOffset, bytes,
+		if err = bdrv_aligned_preadv(ctx, child, req, overlapOffset, bytes,
 			align, &localQiov, 0, 0); err != nil {
 			return err
 		}
@@ -244,7 +435,7 @@ func bdrv_padding_rmw_read(child *BdrvChild, overlapOffset uint64, overlapBytes
 
 		qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&pad.TailBuf[0]), uint64(align))
 
-		if err = bdrv_aligned_preadv(child, overlapOffset+overlapBytes-uint64(align),
+		if err = bdrv_aligned_preadv(ctx, child, req, overlapOffset+overlapBytes-uint64(align),
 			uint64(align), align, &localQiov, 0, 0); err != nil {
 			return err
 		}
@@ -257,7 +448,7 @@ zero_mem:
 	return err
 }
 
-func bdrv_aligned_pwritev(child *BdrvChild, offset uint64, bytes uint64,
+func bdrv_aligned_pwritev(ctx context.Context, child *BdrvChild, req *BdrvTrackedRequest, offset uint64, bytes uint64,
 	align uint64, qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	bs := child.bs
@@ -266,14 +457,16 @@ func bdrv_aligned_pwritev(child *BdrvChild, offset uint64, bytes uint64,
 
 	Assert((offset & (align - 1)) == 0)
 	Assert((bytes & (align - 1)) == 0)
+
+	bdrv_wait_serialising_requests(req)
 	maxTransfer := uint64(align_down(bs.MaxTransfer, uint32(align))) //64MiB
 
 	if flags&BDRV_REQ_ZERO_WRITE > 0 {
-		err = bdrv_do_pwrite_zeroes(bs, offset, bytes, flags)
+		err = bdrv_do_pwrite_zeroes(ctx, bs, offset, bytes, flags)
 	} else if flags&BDRV_REQ_WRITE_COMPRESSED > 0 {
-		//do nothing
+		err = bdrv_driver_pwritev_compressed(ctx, bs, offset, bytes, qiov, qiovOffset)
 	} else if bytes <= maxTransfer {
-		err = bdrv_driver_pwritev(bs, offset, bytes, qiov, qiovOffset, flags)
+		err = bdrv_driver_pwritev(ctx, bs, offset, bytes, qiov, qiovOffset, flags)
 	} else {
 
 		for bytesRemaining > 0 {
@@ -285,7 +478,7 @@ func bdrv_aligned_pwritev(child *BdrvChild, offset uint64, bytes uint64,
 				 * need to flush on the last iteration */
 				localFlags &= ^BDRV_REQ_FUA
 			}
-			if err = bdrv_driver_pwritev(bs, offset+bytes-bytesRemaining,
+			if err = bdrv_driver_pwritev(ctx, bs, offset+bytes-bytesRemaining,
 				num, qiov, qiovOffset+bytes-bytesRemaining, localFlags); err != nil {
 				break
 			}
@@ -299,7 +492,7 @@ func bdrv_aligned_pwritev(child *BdrvChild, offset uint64, bytes uint64,
 	return err
 }
 
-func bdrv_aligned_preadv(child *BdrvChild, offset uint64,
+func bdrv_aligned_preadv(ctx context.Context, child *BdrvChild, req *BdrvTrackedRequest, offset uint64,
 	bytes uint64, align uint32, qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	//check permission
@@ -320,6 +513,13 @@ func bdrv_aligned_preadv(child *BdrvChild, offset uint64,
 	maxTransfer = align_down(uint64(bs.MaxTransfer), uint64(align))
 	Assert((int(flags) & ^(BDRV_REQ_COPY_ON_READ | BDRV_REQ_PREFETCH)) == 0)
 
+	if flags&BDRV_REQ_COPY_ON_READ > 0 {
+		/* the clusters are written back, no other request may modify them meanwhile */
+		bdrv_make_request_serialising(req, bdrv_get_cluster_size(bs))
+	} else {
+		bdrv_wait_serialising_requests(req)
+	}
+
 	if flags&BDRV_REQ_COPY_ON_READ > 0 {
 		var pnum uint64
 
@@ -331,7 +531,7 @@ func bdrv_aligned_preadv(child *BdrvChild, offset uint64,
 		}
 
 		if ret == 0 || pnum != bytes {
-			err = bdrv_do_copy_on_readv(child, offset, bytes,
+			err = bdrv_do_copy_on_readv(ctx, child, offset, bytes,
 				qiov, qiovOffset, flags)
 			goto out
 		} else if flags&BDRV_REQ_PREFETCH > 0 {
@@ -347,7 +547,7 @@ func bdrv_aligned_preadv(child *BdrvChild, offset uint64,
 	Assert((uint64(flags) & ^bs.SupportedReadFlags) == 0)
 	maxBytes = round_up(max(0, totalBytes-offset), uint64(align))
 	if bytes <= maxBytes && bytes <= maxTransfer {
-		err = bdrv_driver_preadv(bs, offset, bytes, qiov, qiovOffset, flags)
+		err = bdrv_driver_preadv(ctx, bs, offset, bytes, qiov, qiovOffset, flags)
 		goto out
 	}
 
@@ -357,7 +557,7 @@ func bdrv_aligned_preadv(child *BdrvChild, offset uint64,
 		if maxBytes > 0 {
 			num = min(bytesRemaining, maxBytes, maxTransfer)
 			Assert(num > 0)
-			err = bdrv_driver_preadv(bs, offset+bytes-bytesRemaining,
+			err = bdrv_driver_preadv(ctx, bs, offset+bytes-bytesRemaining,
 				num, qiov, qiovOffset+bytes-bytesRemaining, flags)
 			maxBytes -= num
 		} else {
@@ -415,7 +615,125 @@ func bdrv_init_padding(bs *BlockDriverState, offset uint64, bytes uint64, pad *B
 	return true
 }
 
-func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+// add the request to the in-flight requests of bs
+func tracked_request_begin(req *BdrvTrackedRequest, bs *BlockDriverState, offset uint64, bytes uint64, isWrite bool) {
+
+	*req = BdrvTrackedRequest{
+		bs:            bs,
+		offset:        offset,
+		bytes:         bytes,
+		isWrite:       isWrite,
+		overlapOffset: offset,
+		overlapBytes:  bytes,
+		done:          make(chan struct{}),
+	}
+	bs.reqsLock.Lock()
+	req.elem = bs.trackedRequests.PushBack(req)
+	bs.reqsLock.Unlock()
+}
+
+// remove the request from the in-flight requests and wake up the requests waiting for it
+func tracked_request_end(req *BdrvTrackedRequest) {
+
+	bs := req.bs
+	bs.reqsLock.Lock()
+	if req.serialising {
+		bs.serialisingInFlight--
+	}
+	bs.trackedRequests.Remove(req.elem)
+	close(req.done)
+	bs.reqsLock.Unlock()
+}
+
+func tracked_request_overlaps(req *BdrvTrackedRequest, offset uint64, bytes uint64) bool {
+	/*        aaaa   bbbb */
+	if offset >= req.overlapOffset+req.overlapBytes {
+		return false
+	}
+	/* bbbb   aaaa        */
+	if req.overlapOffset >= offset+bytes {
+		return false
+	}
+	return true
+}
+
+/*
+* return the first request conflicting with self, requests conflict if they overlap and
+* one of them is serialising. Must be called with bs.reqsLock held.
+ */
+func bdrv_find_conflicting_request(self *BdrvTrackedRequest) *BdrvTrackedRequest {
+
+	for e := self.bs.trackedRequests.Front(); e != nil; e = e.Next() {
+		req := e.Value.(*BdrvTrackedRequest)
+		if req == self || (!req.serialising && !self.serialising) {
+			continue
+		}
+		if !tracked_request_overlaps(req, self.overlapOffset, self.overlapBytes) {
+			continue
+		}
+		/* If the request is already (indirectly) waiting for us, or will wait
+		 * for us as soon as it wakes up, then just go on */
+		if req.waitingFor == nil {
+			return req
+		}
+	}
+	return nil
+}
+
+// must be called with bs.reqsLock held, it's released while waiting
+func bdrv_wait_serialising_requests_locked(self *BdrvTrackedRequest) {
+
+	bs := self.bs
+	for {
+		req := bdrv_find_conflicting_request(self)
+		if req == nil {
+			break
+		}
+		self.waitingFor = req
+		bs.reqsLock.Unlock()
+		<-req.done
+		bs.reqsLock.Lock()
+		self.waitingFor = nil
+	}
+}
+
+// wait for the overlapping serialising requests, or all overlapping requests if self is serialising
+func bdrv_wait_serialising_requests(self *BdrvTrackedRequest) {
+
+	bs := self.bs
+	if self.serialising {
+		/* it waited when made serialising, the overlapping requests started since then wait for it */
+		return
+	}
+	bs.reqsLock.Lock()
+	if bs.serialisingInFlight > 0 {
+		bdrv_wait_serialising_requests_locked(self)
+	}
+	bs.reqsLock.Unlock()
+}
+
+/*
+* make the request serialising, its overlap range is extended to the alignment, then
+* wait for all the requests overlapping it
+ */
+func bdrv_make_request_serialising(req *BdrvTrackedRequest, align uint64) {
+
+	bs := req.bs
+	overlapOffset := req.offset & ^(align - 1)
+	overlapBytes := round_up(req.offset+req.bytes, align) - overlapOffset
+
+	bs.reqsLock.Lock()
+	if !req.serialising {
+		bs.serialisingInFlight++
+		req.serialising = true
+	}
+	req.overlapOffset = min(req.overlapOffset, overlapOffset)
+	req.overlapBytes = max(req.overlapBytes, overlapBytes)
+	bdrv_wait_serialising_requests_locked(req)
+	bs.reqsLock.Unlock()
+}
+
+func bdrv_do_pwrite_zeroes(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
 	var (
 		qiov      QEMUIOVector
 		buf       unsafe.Pointer //[]byte
@@ -427,6 +745,9 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 	drv := bs.Drv
 	maxWriteZeroes := Max_WRITE_ZEROS
 	alignment := Max_WRITE_ZEROS
+	if bs.PwriteZeroesAlignment > 0 {
+		alignment = max(uint64(bs.PwriteZeroesAlignment), uint64(bs.RequestAlignment))
+	}
 	maxTransfer := Max_WRITE_ZEROS
 
 	if flags&BdrvRequestFlags(^bs.SupportedZeroFlags)&BDRV_REQ_NO_FALLBACK > 0 {
@@ -456,7 +777,7 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 		err = ERR_ENOTSUP
 		/* First try the efficient write zeroes operation */
 		if drv.bdrv_pwrite_zeroes != nil {
-			err = drv.bdrv_pwrite_zeroes(bs, offset, num,
+			err = drv.bdrv_pwrite_zeroes(ctx, bs, offset, num,
 				flags&BdrvRequestFlags(bs.SupportedZeroFlags))
 			if err != ERR_ENOTSUP && flags&BDRV_REQ_FUA > 0 &&
 				bs.SupportedZeroFlags&BDRV_REQ_FUA == 0 {
@@ -482,7 +803,7 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 			}
 			qemu_iovec_init_buf(&qiov, buf, num)
 
-			err = bdrv_driver_pwritev(bs, offset, num, &qiov, 0, writeFlags)
+			err = bdrv_driver_pwritev(ctx, bs, offset, num, &qiov, 0, writeFlags)
 			if num < maxTransfer {
 				buf = nil
 			}
@@ -500,7 +821,20 @@ func bdrv_do_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, fl
 }
 
 // do write the buffer to disk
-func bdrv_driver_pwritev(bs *BlockDriverState, offset uint64, bytes uint64,
+// write the whole clusters compressed, only a driver which supports it can do it
+func bdrv_driver_pwritev_compressed(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64) error {
+
+	if bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	if bs.Drv.bdrv_pwritev_compressed_part == nil {
+		return ERR_ENOTSUP
+	}
+	return bs.Drv.bdrv_pwritev_compressed_part(ctx, bs, offset, bytes, qiov, qiovOffset)
+}
+
+func bdrv_driver_pwritev(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	var localQiov QEMUIOVector
@@ -515,7 +849,7 @@ func bdrv_driver_pwritev(bs *BlockDriverState, offset uint64, bytes uint64,
 		return Err_NoDriverFound
 	}
 	if drv.bdrv_pwritev_part != nil {
-		err = drv.bdrv_pwritev_part(bs, offset, bytes, qiov, qiovOffset, flags&BdrvRequestFlags(bs.SupportedWriteFlags))
+		err = drv.bdrv_pwritev_part(ctx, bs, offset, bytes, qiov, qiovOffset, flags&BdrvRequestFlags(bs.SupportedWriteFlags))
 		flags &= BdrvRequestFlags(^bs.SupportedWriteFlags)
 		goto out
 	}
@@ -526,7 +860,7 @@ func bdrv_driver_pwritev(bs *BlockDriverState, offset uint64, bytes uint64,
 	}
 
 	if drv.bdrv_pwritev != nil {
-		err = drv.bdrv_pwritev(bs, offset, bytes, qiov,
+		err = drv.bdrv_pwritev(ctx, bs, offset, bytes, qiov,
 			flags&BdrvRequestFlags(bs.SupportedWriteFlags))
 		flags &= BdrvRequestFlags(^bs.SupportedWriteFlags)
 		goto out
@@ -544,40 +878,48 @@ out:
 	return err
 }
 
-func bdrv_pwrite_zeroes(child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+func bdrv_pwrite_zeroes(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
 
 	if child.bs.OpenFlags&BDRV_O_UNMAP == 0 {
 		flags &= ^BDRV_REQ_MAY_UNMAP
 	}
-	return bdrv_pwritev(child, offset, bytes, nil, BDRV_REQ_ZERO_WRITE|flags)
+	return bdrv_pwritev_part(ctx, child, offset, bytes, nil, 0, BDRV_REQ_ZERO_WRITE|flags)
 }
 
 func bdrv_preadv(child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
-	return bdrv_preadv_part(child, offset, bytes, qiov, 0, flags)
+	return bdrv_preadv_part(context.Background(), child, offset, bytes, qiov, 0, flags)
 }
 
-func bdrv_preadv_part(child *BdrvChild, offset uint64, bytes uint64,
+func bdrv_preadv_part(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 	bs := child.bs
 	var pad BdrvRequestPadding
+	var req BdrvTrackedRequest
 	var err error
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	if bytes == 0 && !is_aligned(offset, uint64(bs.RequestAlignment)) {
 		return nil
 	}
 
-	atomic.AddUint64(&bs.InFlight, 1)
+	if err = bdrv_inc_in_flight(bs); err != nil {
+		return err
+	}
 
 	if err = bdrv_pad_request(bs, &qiov, &qiovOffset, &offset, &bytes, &pad, nil); err != nil {
 		goto fail
 	}
-	err = bdrv_aligned_preadv(child, offset, bytes, bs.RequestAlignment, qiov, qiovOffset, flags)
+	tracked_request_begin(&req, bs, offset, bytes, false)
+	err = bdrv_aligned_preadv(ctx, child, &req, offset, bytes, bs.RequestAlignment, qiov, qiovOffset, flags)
+	tracked_request_end(&req)
 
 	bdrv_padding_destroy(&pad)
 
 fail:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	return err
 }
 
@@ -598,12 +940,41 @@ func bdrv_is_allocated(bs *BlockDriverState, offset uint64, bytes uint64, pnum *
 		return 0, err
 	}
 	if ret&BDRV_BLOCK_ALLOCATED > 0 {
-		ret = 1
+		return 1, nil
 	}
-	return ret, nil
+	return 0, nil
 }
 
-func bdrv_driver_preadv(bs *BlockDriverState, offset uint64, bytes uint64,
+/*
+* Given an image chain: ... -> [BASE] -> [INTER1] -> [INTER2] -> [TOP]
+*
+* Return a positive depth if (a prefix of) the given range is allocated in any
+* image between BASE and TOP (BASE is only included if include_base is set).
+* BASE can be NULL to check if the given offset is allocated in any
+* image of the chain.  Return 0 otherwise
+*
+* 'pnum' is set to the number of bytes (including and immediately
+* following the specified offset) that are known to be in the same
+* allocated/unallocated state.
+ */
+func bdrv_is_allocated_above(top *BlockDriverState, base *BlockDriverState, includeBase bool,
+	offset uint64, bytes uint64, pnum *uint64) (int, error) {
+
+	var depth int
+	var ret uint64
+	var err error
+
+	if ret, err = bdrv_common_block_status_above(top, base, includeBase, false,
+		offset, bytes, pnum, nil, nil, &depth); err != nil {
+		return 0, err
+	}
+	if ret&BDRV_BLOCK_ALLOCATED > 0 {
+		return depth, nil
+	}
+	return 0, nil
+}
+
+func bdrv_driver_preadv(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	var localQiov QEMUIOVector
@@ -617,14 +988,14 @@ func bdrv_driver_preadv(bs *BlockDriverState, offset uint64, bytes uint64,
 	Assert((flags & BDRV_REQ_NO_FALLBACK) == 0)
 
 	if drv.bdrv_preadv_part != nil {
-		return drv.bdrv_preadv_part(bs, offset, bytes, qiov, qiovOffset, flags)
+		return drv.bdrv_preadv_part(ctx, bs, offset, bytes, qiov, qiovOffset, flags)
 	}
 	if qiovOffset > 0 || bytes != qiov.size {
 		qemu_iovec_init_slice(&localQiov, qiov, qiovOffset, bytes)
 		qiov = &localQiov
 	}
 	if drv.bdrv_preadv != nil {
-		err = drv.bdrv_preadv(bs, offset, bytes, qiov, flags)
+		err = drv.bdrv_preadv(ctx, bs, offset, bytes, qiov, flags)
 		goto out
 	}
 	Assert(false)
@@ -635,7 +1006,7 @@ out:
 	return err
 }
 
-func bdrv_do_copy_on_readv(child *BdrvChild, offset uint64, bytes uint64,
+func bdrv_do_copy_on_readv(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	bs := child.bs
@@ -689,15 +1060,15 @@ func bdrv_do_copy_on_readv(child *BdrvChild, offset uint64, bytes uint64,
 
 			qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&bounceBuffer[0]), pnum)
 
-			if err = bdrv_driver_preadv(bs, clusterOffset, pnum, &localQiov, 0, 0); err != nil {
+			if err = bdrv_driver_preadv(ctx, bs, clusterOffset, pnum, &localQiov, 0, 0); err != nil {
 				goto err
 			}
 			if drv.bdrv_pwrite_zeroes != nil &&
 				buffer_is_zero(bounceBuffer, pnum) {
-				err = bdrv_do_pwrite_zeroes(bs, clusterOffset, pnum,
+				err = bdrv_do_pwrite_zeroes(ctx, bs, clusterOffset, pnum,
 					BDRV_REQ_WRITE_UNCHANGED)
 			} else {
-				err = bdrv_driver_pwritev(bs, clusterOffset, pnum,
+				err = bdrv_driver_pwritev(ctx, bs, clusterOffset, pnum,
 					&localQiov, 0, BDRV_REQ_WRITE_UNCHANGED)
 			}
 			if err != nil {
@@ -710,7 +1081,7 @@ func bdrv_do_copy_on_readv(child *BdrvChild, offset uint64, bytes uint64,
 			}
 		} else if flags&BDRV_REQ_PREFETCH == 0 {
 			/* Read directly into the destination */
-			if err = bdrv_driver_preadv(bs, offset+progress, min(pnum-skipBytes, bytes-progress),
+			if err = bdrv_driver_preadv(ctx, bs, offset+progress, min(pnum-skipBytes, bytes-progress),
 				qiov, qiovOffset+progress, 0); err != nil {
 				goto err
 			}
@@ -832,17 +1203,20 @@ func bdrv_block_status(bs *BlockDriverState, wantZero bool, offset uint64, bytes
 
 	Assert(pnum != nil)
 	*pnum = 0
-	if total_size, err = bdrv_getlength(bs); err != nil {
+	if err = bdrv_inc_in_flight(bs); err != nil {
 		goto early_out
 	}
+	if total_size, err = bdrv_getlength(bs); err != nil {
+		goto out
+	}
 
 	if offset >= total_size {
 		ret = BDRV_BLOCK_EOF
-		goto early_out
+		goto out
 	}
 	if bytes == 0 {
 		ret = 0
-		goto early_out
+		goto out
 	}
 
 	n = total_size - offset
@@ -850,8 +1224,6 @@ func bdrv_block_status(bs *BlockDriverState, wantZero bool, offset uint64, bytes
 		bytes = n
 	}
 
-	atomic.AddUint64(&bs.InFlight, uint64(0))
-
 	/* Round out to request_alignment boundaries */
 	align = bs.RequestAlignment
 	aligned_offset = align_down(offset, uint64(align))
@@ -918,7 +1290,7 @@ func bdrv_block_status(bs *BlockDriverState, wantZero bool, offset uint64, bytes
 		}
 	}
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	bdrv_dec_in_flight(bs)
 	if err == nil && offset+*pnum == total_size {
 		ret |= BDRV_BLOCK_EOF
 	}
@@ -939,9 +1311,19 @@ func bdrv_round_to_clusters(bs *BlockDriverState, offset uint64, bytes uint64,
 	if bs == nil || bs.opaque == nil {
 		*clusterOffset = offset
 		*clusterBytes = bytes
+		return
+	}
+	clusterSize := bdrv_get_cluster_size(bs)
+	*clusterOffset = align_down(offset, clusterSize)
+	*clusterBytes = align_up(offset-*clusterOffset+bytes, clusterSize)
+}
+
+// the cluster size of a qcow2 image, or the request alignment of the other drivers
+func bdrv_get_cluster_size(bs *BlockDriverState) uint64 {
+	if s, ok := bs.opaque.(*BDRVQcow2State); ok {
+		return uint64(s.ClusterSize)
 	}
-	*clusterOffset = align_down(offset, uint64(DEFAULT_CLUSTER_SIZE))
-	*clusterBytes = align_up(offset-*clusterOffset+bytes, uint64(DEFAULT_CLUSTER_SIZE))
+	return uint64(bs.RequestAlignment)
 }
 
 func bdrv_open_child(filename string, format string, options map[string]any, flags int) (*BdrvChild, error) {
@@ -949,6 +1331,9 @@ func bdrv_open_child(filename string, format string, options map[string]any, fla
 	var err error
 	var drv *BlockDriver = get_driver(format)
 
+	if drv == nil || drv.bdrv_open == nil {
+		return nil, Err_NoDriverFound
+	}
 	if bs, err = drv.bdrv_open(filename, options, flags); err != nil {
 		return nil, err
 	}
@@ -1043,8 +1428,24 @@ func bdrv_filter_or_cow_child(bs *BlockDriverState) *BdrvChild {
 	return bdrv_cow_child(bs)
 }
 
+/*
+* close the image, the new requests are refused with Err_Closed, the requests in flight
+* are waited for, then the image is flushed and the driver releases its resources.
+* closing an image again does nothing.
+ */
 func bdrv_close(bs *BlockDriverState) {
-	bdrv_flush(bs)
+	bs.inFlightLock.Lock()
+	if bs.closing {
+		bs.inFlightLock.Unlock()
+		return
+	}
+	bs.closing = true
+	//the requests waiting for a drained or paused image fail
+	bdrv_in_flight_cond(bs).Broadcast()
+	bdrv_wait_in_flight_locked(bs)
+	bs.inFlightLock.Unlock()
+
+	bdrv_do_flush(bs)
 	if bs.Drv != nil {
 		if bs.Drv.bdrv_close != nil {
 			bs.Drv.bdrv_close(bs)
@@ -1092,15 +1493,25 @@ func bdrv_direct_pwrite(child *BdrvChild, offset int64, object any, size int64)
 	return n, nil
 }
 
-func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
+func bdrv_pdiscard(ctx context.Context, child *BdrvChild, offset uint64, bytes uint64) error {
 
 	var head, tail, align uint64
+	var req BdrvTrackedRequest
 	bs := child.bs
 	var err error
 
-	if bs == nil || bs.Drv == nil {
+	if bs == nil {
 		return Err_NoDriverFound
 	}
+	if bdrv_is_closed(bs) {
+		return Err_Closed
+	}
+	if bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 
 	if bs.OpenFlags&BDRV_O_UNMAP == 0 {
 		return nil
@@ -1115,11 +1526,18 @@ func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
 	head = offset % align
 	tail = (offset + bytes) % align
 
-	atomic.AddUint64(&bs.InFlight, 1)
+	if err = bdrv_inc_in_flight(bs); err != nil {
+		return err
+	}
+	tracked_request_begin(&req, bs, offset, bytes, true)
+	bdrv_wait_serialising_requests(&req)
 
 	for bytes > 0 {
 		num := bytes
 
+		if err = ctx.Err(); err != nil {
+			goto out
+		}
 		if head > 0 {
 			/* Make small requests to get to alignment boundaries. */
 			num = min(bytes, align-head)
@@ -1137,7 +1555,7 @@ func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
 			}
 		}
 		if bs.Drv.bdrv_pdiscard != nil {
-			err = bs.Drv.bdrv_pdiscard(bs, offset, num)
+			err = bs.Drv.bdrv_pdiscard(ctx, bs, offset, num)
 		}
 		if err != nil && err != ERR_ENOTSUP {
 			goto out
@@ -1148,6 +1566,84 @@ func bdrv_pdiscard(child *BdrvChild, offset uint64, bytes uint64) error {
 	}
 	err = nil
 out:
-	atomic.AddUint64(&bs.InFlight, ^uint64(0))
+	tracked_request_end(&req)
+	bdrv_dec_in_flight(bs)
 	return err
 }
+
+func bdrv_change_backing_file(bs *BlockDriverState, backingFile string, backingFmt string) error {
+
+	if bs == nil || bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	if bs.Drv.bdrv_change_backing_file == nil {
+		return ERR_ENOTSUP
+	}
+	if bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return Err_NoWritePerm
+	}
+	return bs.Drv.bdrv_change_backing_file(bs, backingFile, backingFmt)
+}
+
+func bdrv_amend_options(bs *BlockDriverState, opts map[string]any, progress ProgressFunc) error {
+	if bs == nil || bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	if bs.Drv.bdrv_amend_options == nil {
+		return ERR_ENOTSUP
+	}
+	return bs.Drv.bdrv_amend_options(bs, opts, progress)
+}
+
+func bdrv_truncate(child *BdrvChild, offset uint64) error {
+	if child == nil || child.bs == nil || child.bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	if child.bs.Drv.bdrv_truncate == nil {
+		return ERR_ENOTSUP
+	}
+	return child.bs.Drv.bdrv_truncate(child.bs, offset)
+}
+
+func bdrv_compact(bs *BlockDriverState, opts *BlockCompactOptions, progress ProgressFunc) (*BlockCompactResult, error) {
+	if bs == nil || bs.Drv == nil {
+		return nil, Err_NoDriverFound
+	}
+	if bs.Drv.bdrv_compact == nil {
+		return nil, ERR_ENOTSUP
+	}
+	return bs.Drv.bdrv_compact(bs, opts, progress)
+}
+
+func bdrv_sparsify(bs *BlockDriverState, progress ProgressFunc) (*BlockSparsifyResult, error) {
+	if bs == nil || bs.Drv == nil {
+		return nil, Err_NoDriverFound
+	}
+	if bs.Drv.bdrv_sparsify == nil {
+		return nil, ERR_ENOTSUP
+	}
+	return bs.Drv.bdrv_sparsify(bs, progress)
+}
+
+func bdrv_measure(drv *BlockDriver, opts map[string]any, inBs *BlockDriverState) (*BlockMeasureInfo, error) {
+	if drv == nil {
+		return nil, Err_NoDriverFound
+	}
+	if drv.bdrv_measure == nil {
+		return nil, ERR_ENOTSUP
+	}
+	return drv.bdrv_measure(opts, inBs)
+}
+
+func bdrv_check(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode) error {
+
+	if bs == nil || bs.Drv == nil {
+		return Err_NoDriverFound
+	}
+	res.Filename = bs.filename
+	res.Format = bs.Drv.FormatName
+	if bs.Drv.bdrv_check == nil {
+		return ERR_ENOTSUP
+	}
+	return bs.Drv.bdrv_check(bs, res, fix)
+}
@@ -0,0 +1,197 @@
+package qcow2
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_concurrent_requests(t *testing.T) {
+	var filename = "/tmp/test_concurrent_requests.qcow2"
+	//unaligned chunks, neighbours share sectors, subclusters and clusters
+	const chunk = 3000
+	const writers = 16
+	const chunks = 32 * writers
+	//large writes spanning several clusters after the chunks, they go through the aio routine
+	const large = 300000
+	const largeWriters = 4
+	const largeStart = 2 * 1048576
+	//the requests must really run in parallel, even on a single cpu
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	for _, subcluster := range []bool{false, true} {
+		os.Remove(filename)
+		err := Blk_Create(filename, map[string]any{
+			OPT_SIZE:       8 * 1048576,
+			OPT_FMT:        "qcow2",
+			OPT_SUBCLUSTER: subcluster,
+		})
+		assert.Nil(t, err)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+		assert.Nil(t, err)
+
+		pattern := func(g int, round int) []byte {
+			return bytes.Repeat([]byte{byte(g*8 + round + 1)}, chunk)
+		}
+
+		//the writers rewrite and zero their own chunks while the readers read anywhere
+		var writersWg, readersWg sync.WaitGroup
+		stop := make(chan struct{})
+		for r := 0; r < 4; r++ {
+			readersWg.Add(1)
+			go func(r int) {
+				defer readersWg.Done()
+				rnd := rand.New(rand.NewSource(int64(r)))
+				buf := make([]byte, 4*chunk)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					offset := uint64(rnd.Intn(chunks * chunk))
+					_, err := Blk_Pread(root, offset, buf, uint64(rnd.Intn(len(buf))+1))
+					assert.Nil(t, err)
+				}
+			}(r)
+		}
+		for g := 0; g < writers; g++ {
+			writersWg.Add(1)
+			go func(g int) {
+				defer writersWg.Done()
+				for round := 0; round < 3; round++ {
+					for i := g; i < chunks; i += writers {
+						offset := uint64(i * chunk)
+						if round == 1 {
+							_, err := Blk_Pwrite_Zeroes(root, offset, chunk, BDRV_REQ_MAY_UNMAP)
+							assert.Nil(t, err)
+							continue
+						}
+						_, err := Blk_Pwrite(root, offset, pattern(g, round), chunk, 0)
+						assert.Nil(t, err)
+					}
+				}
+			}(g)
+		}
+		for g := 0; g < largeWriters; g++ {
+			writersWg.Add(1)
+			go func(g int) {
+				defer writersWg.Done()
+				for round := 0; round < 3; round++ {
+					buf := bytes.Repeat([]byte{byte(0x80 + g*8 + round)}, large)
+					_, err := Blk_Pwrite(root, uint64(largeStart+g*large), buf, large, 0)
+					assert.Nil(t, err)
+				}
+			}(g)
+		}
+		writersWg.Wait()
+		close(stop)
+		readersWg.Wait()
+
+		//every chunk holds the last pattern of its writer, read back concurrently
+		var wg sync.WaitGroup
+		for g := 0; g < writers; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				buf := make([]byte, chunk)
+				for i := g; i < chunks; i += writers {
+					_, err := Blk_Pread(root, uint64(i*chunk), buf, chunk)
+					assert.Nil(t, err)
+					assert.Equal(t, pattern(g, 2), buf)
+				}
+			}(g)
+		}
+		for g := 0; g < largeWriters; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				buf := make([]byte, large)
+				_, err := Blk_Pread(root, uint64(largeStart+g*large), buf, large)
+				assert.Nil(t, err)
+				assert.Equal(t, bytes.Repeat([]byte{byte(0x80 + g*8 + 2)}, large), buf)
+			}(g)
+		}
+		wg.Wait()
+
+		//no allocation was lost or done twice
+		res, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, res.Corruptions)
+		assert.Equal(t, 0, res.Leaks)
+		assert.Equal(t, 0, res.CheckErrors)
+		assert.Nil(t, Blk_Flush(root))
+		Blk_Close(root)
+	}
+	os.Remove(filename)
+}
+
+// wait until req blocks on the request it conflicts with, it's observed under the lock
+func wait_tracked_request_waiting(req *BdrvTrackedRequest, conflict *BdrvTrackedRequest) {
+	for {
+		req.bs.reqsLock.Lock()
+		waitingFor := req.waitingFor
+		req.bs.reqsLock.Unlock()
+		if waitingFor == conflict {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func Test_tracked_requests_serialising(t *testing.T) {
+	bs := &BlockDriverState{}
+	var req1, req2, req3 BdrvTrackedRequest
+
+	//plain requests never wait for each other
+	tracked_request_begin(&req1, bs, 0, 4096, true)
+	tracked_request_begin(&req2, bs, 1024, 4096, false)
+	bdrv_wait_serialising_requests(&req2)
+	assert.Equal(t, 0, bs.serialisingInFlight)
+
+	//a serialising request waits for the overlapping ones, its range is aligned
+	tracked_request_begin(&req3, bs, 8000, 100, true)
+	waited := make(chan struct{})
+	go func() {
+		bdrv_make_request_serialising(&req3, 4096)
+		close(waited)
+	}()
+	wait_tracked_request_waiting(&req3, &req2)
+	tracked_request_end(&req1)
+	select {
+	case <-waited:
+		assert.Fail(t, "serialising request didn't wait")
+	default:
+	}
+	tracked_request_end(&req2)
+	<-waited
+	assert.True(t, req3.serialising)
+	assert.Nil(t, req3.waitingFor)
+	assert.Equal(t, uint64(4096), req3.overlapOffset)
+	assert.Equal(t, uint64(4096), req3.overlapBytes)
+	assert.Equal(t, 1, bs.serialisingInFlight)
+
+	//a plain request overlapping the serialising one waits for it
+	tracked_request_begin(&req1, bs, 0, 4097, false)
+	waited = make(chan struct{})
+	go func() {
+		bdrv_wait_serialising_requests(&req1)
+		close(waited)
+	}()
+	wait_tracked_request_waiting(&req1, &req3)
+	select {
+	case <-waited:
+		assert.Fail(t, "plain request didn't wait")
+	default:
+	}
+	tracked_request_end(&req3)
+	<-waited
+	tracked_request_end(&req1)
+	assert.Equal(t, 0, bs.serialisingInFlight)
+	assert.Equal(t, 0, bs.trackedRequests.Len())
+}
@@ -0,0 +1,526 @@
+//go:build linux && (amd64 || arm64)
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// the io_uring syscalls have the same numbers on all the architectures
+const (
+	sys_IO_URING_SETUP    = 425
+	sys_IO_URING_ENTER    = 426
+	sys_IO_URING_REGISTER = 427
+)
+
+const (
+	IORING_OFF_SQ_RING      = 0
+	IORING_OFF_CQ_RING      = 0x8000000
+	IORING_OFF_SQES         = 0x10000000
+	IORING_FEAT_SINGLE_MMAP = 1 << 0
+	IORING_ENTER_GETEVENTS  = 1 << 0
+	IORING_REGISTER_PROBE   = 8
+	IO_URING_OP_SUPPORTED   = 1 << 0
+
+	IORING_OP_NOP       = 0
+	IORING_OP_READV     = 1
+	IORING_OP_WRITEV    = 2
+	IORING_OP_FSYNC     = 3
+	IORING_OP_FALLOCATE = 17
+)
+
+// the kernel structures, see include/uapi/linux/io_uring.h
+type io_sqring_offsets struct {
+	head         uint32
+	tail         uint32
+	ring_mask    uint32
+	ring_entries uint32
+	flags        uint32
+	dropped      uint32
+	array        uint32
+	resv1        uint32
+	user_addr    uint64
+}
+
+type io_cqring_offsets struct {
+	head         uint32
+	tail         uint32
+	ring_mask    uint32
+	ring_entries uint32
+	overflow     uint32
+	cqes         uint32
+	flags        uint32
+	resv1        uint32
+	user_addr    uint64
+}
+
+type io_uring_params struct {
+	sq_entries     uint32
+	cq_entries     uint32
+	flags          uint32
+	sq_thread_cpu  uint32
+	sq_thread_idle uint32
+	features       uint32
+	wq_fd          uint32
+	resv           [3]uint32
+	sq_off         io_sqring_offsets
+	cq_off         io_cqring_offsets
+}
+
+type io_uring_sqe struct {
+	opcode       uint8
+	flags        uint8
+	ioprio       uint16
+	fd           int32
+	off          uint64
+	addr         uint64
+	len          uint32
+	rw_flags     uint32 /* fsync_flags for fsync */
+	user_data    uint64
+	buf_index    uint16
+	personality  uint16
+	splice_fd_in int32
+	addr3        uint64
+	pad          uint64
+}
+
+type io_uring_cqe struct {
+	user_data uint64
+	res       int32
+	flags     uint32
+}
+
+type io_uring_probe_op struct {
+	op    uint8
+	resv  uint8
+	flags uint16
+	resv2 uint32
+}
+
+type io_uring_probe struct {
+	last_op uint8
+	ops_len uint8
+	resv    uint16
+	resv2   [3]uint32
+	ops     [IORING_OP_FALLOCATE + 1]io_uring_probe_op
+}
+
+// set once io_uring turns out to be unavailable, the images are opened with the synchronous syscalls then
+var noIoUring int32
+
+/*
+* An io_uring instance of a raw file. The requests queue their SQE and the one which
+* finds SQEs pending submits them all with one io_uring_enter, so the requests issued
+* concurrently by the workers of an image are submitted in batches. The completions
+* are reaped by one goroutine, which wakes the requests. A request waiting for its
+* completion parks its goroutine instead of blocking a thread in a syscall.
+* The in-flight requests are bounded by the entries of the ring, which keeps the
+* completion queue from overflowing.
+ */
+type IoUring struct {
+	fd      int
+	fileFd  int32
+	file    *os.File /* kept open by the raw driver until the ring is closed */
+	entries uint32
+	ops     uint64 /* bitmap of the supported opcodes */
+
+	sqRing  []byte
+	cqRing  []byte
+	sqeMem  []byte
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []io_uring_sqe
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []io_uring_cqe
+
+	lock     sync.Mutex
+	enter    sync.Mutex /* serialises the submissions, so the SQEs not consumed by the kernel are known */
+	slotFree *sync.Cond
+	reqs     []*ioUringRequest /* by slot, the slot is the user_data of the SQE */
+	free     []uint32
+	pending  uint32 /* queued but not submitted */
+	closed   bool
+	reaped   chan struct{}
+}
+
+type ioUringRequest struct {
+	res  int32
+	err  error /* set if the SQE was taken back since it couldn't be submitted */
+	done chan struct{}
+	keep any /* the memory the kernel accesses, alive until the completion */
+	stop bool
+}
+
+func io_uring_enter(fd int, toSubmit uint32, minComplete uint32, flags uint32) (uint32, error) {
+	n, _, errno := syscall.Syscall6(sys_IO_URING_ENTER, uintptr(fd), uintptr(toSubmit),
+		uintptr(minComplete), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(n), nil
+}
+
+func io_uring_mmap(fd int, offset int64, size int) ([]byte, error) {
+	return syscall.Mmap(fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED|syscall.MAP_POPULATE)
+}
+
+/*
+* set up a ring of the given entries for the file, ERR_ENOTSUP if the kernel lacks
+* io_uring or it's disabled, the file is accessed with the synchronous syscalls then.
+ */
+func newIoUring(file *os.File, entries uint32) (*IoUring, error) {
+
+	var params io_uring_params
+	var err error
+
+	if atomic.LoadInt32(&noIoUring) != 0 {
+		return nil, ERR_ENOTSUP
+	}
+	fd, _, errno := syscall.RawSyscall(sys_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno == syscall.ENOSYS || errno == syscall.EPERM {
+		atomic.StoreInt32(&noIoUring, 1)
+		return nil, ERR_ENOTSUP
+	} else if errno != 0 {
+		return nil, errno
+	}
+	r := &IoUring{
+		fd:      int(fd),
+		file:    file,
+		entries: params.sq_entries,
+		reaped:  make(chan struct{}),
+	}
+	r.slotFree = sync.NewCond(&r.lock)
+
+	rawConn, err := file.SyscallConn()
+	if err == nil {
+		err = rawConn.Control(func(fd uintptr) {
+			r.fileFd = int32(fd)
+		})
+	}
+	if err != nil {
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	if err = r.mmap(&params); err != nil {
+		r.unmap()
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	r.probe()
+
+	r.reqs = make([]*ioUringRequest, r.entries)
+	r.free = make([]uint32, r.entries)
+	for i := range r.free {
+		r.free[i] = r.entries - 1 - uint32(i)
+	}
+	go r.reap()
+	return r, nil
+}
+
+func (r *IoUring) mmap(p *io_uring_params) error {
+
+	var err error
+	sqSize := int(p.sq_off.array + p.sq_entries*4)
+	cqSize := int(p.cq_off.cqes + p.cq_entries*uint32(unsafe.Sizeof(io_uring_cqe{})))
+	if p.features&IORING_FEAT_SINGLE_MMAP > 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	if r.sqRing, err = io_uring_mmap(r.fd, IORING_OFF_SQ_RING, sqSize); err != nil {
+		return err
+	}
+	if p.features&IORING_FEAT_SINGLE_MMAP > 0 {
+		r.cqRing = r.sqRing
+	} else if r.cqRing, err = io_uring_mmap(r.fd, IORING_OFF_CQ_RING, cqSize); err != nil {
+		return err
+	}
+	if r.sqeMem, err = io_uring_mmap(r.fd, IORING_OFF_SQES,
+		int(p.sq_entries*uint32(unsafe.Sizeof(io_uring_sqe{})))); err != nil {
+		return err
+	}
+
+	sq := unsafe.Pointer(&r.sqRing[0])
+	r.sqHead = (*uint32)(unsafe.Add(sq, p.sq_off.head))
+	r.sqTail = (*uint32)(unsafe.Add(sq, p.sq_off.tail))
+	r.sqMask = *(*uint32)(unsafe.Add(sq, p.sq_off.ring_mask))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Add(sq, p.sq_off.array)), p.sq_entries)
+	r.sqes = unsafe.Slice((*io_uring_sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sq_entries)
+
+	cq := unsafe.Pointer(&r.cqRing[0])
+	r.cqHead = (*uint32)(unsafe.Add(cq, p.cq_off.head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, p.cq_off.tail))
+	r.cqMask = *(*uint32)(unsafe.Add(cq, p.cq_off.ring_mask))
+	r.cqes = unsafe.Slice((*io_uring_cqe)(unsafe.Add(cq, p.cq_off.cqes)), p.cq_entries)
+	return nil
+}
+
+func (r *IoUring) unmap() {
+	if r.sqeMem != nil {
+		syscall.Munmap(r.sqeMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+	r.sqeMem, r.cqRing, r.sqRing = nil, nil, nil
+}
+
+// find the supported opcodes, the kernels before 5.6 can't be probed and support the ones up to fsync
+func (r *IoUring) probe() {
+	var probe io_uring_probe
+	_, _, errno := syscall.Syscall6(sys_IO_URING_REGISTER, uintptr(r.fd), IORING_REGISTER_PROBE,
+		uintptr(unsafe.Pointer(&probe)), uintptr(len(probe.ops)), 0, 0)
+	if errno != 0 {
+		r.ops = 1<<IORING_OP_NOP | 1<<IORING_OP_READV | 1<<IORING_OP_WRITEV | 1<<IORING_OP_FSYNC
+		return
+	}
+	for i := 0; i < int(probe.ops_len) && i < len(probe.ops); i++ {
+		if probe.ops[i].flags&IO_URING_OP_SUPPORTED > 0 {
+			r.ops |= 1 << probe.ops[i].op
+		}
+	}
+}
+
+func (r *IoUring) supported(op uint8) bool {
+	return r.ops&(1<<op) > 0
+}
+
+/*
+* queue the SQE, submit the pending ones and wait for the completion, the result is
+* the res of the CQE. The request can't give up waiting since the kernel accesses
+* its memory until it completes. If the submission fails, the SQEs not consumed by
+* the kernel are taken back out of the ring and their requests fail.
+ */
+func (r *IoUring) submit(sqe io_uring_sqe, keep any, stop bool) (int32, error) {
+
+	req := &ioUringRequest{done: make(chan struct{}), keep: keep, stop: stop}
+
+	r.lock.Lock()
+	for !r.closed && len(r.free) == 0 {
+		r.slotFree.Wait()
+	}
+	if r.closed {
+		r.lock.Unlock()
+		return 0, Err_Closed
+	}
+	if stop {
+		r.closed = true
+	}
+	slot := r.free[len(r.free)-1]
+	r.free = r.free[:len(r.free)-1]
+	r.reqs[slot] = req
+
+	/* the ring has room for the SQE, as each of the SQEs in it holds a slot */
+	tail := *r.sqTail
+	idx := tail & r.sqMask
+	sqe.user_data = uint64(slot)
+	r.sqes[idx] = sqe
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+	r.lock.Unlock()
+
+	/* the SQEs queued by the others meanwhile are submitted along */
+	r.enter.Lock()
+	r.lock.Lock()
+	toSubmit := r.pending
+	r.pending = 0
+	r.lock.Unlock()
+	for toSubmit > 0 {
+		n, err := io_uring_enter(r.fd, toSubmit, 0, 0)
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.EAGAIN || err == syscall.EBUSY {
+			time.Sleep(time.Millisecond)
+			continue
+		} else if err != nil {
+			r.lock.Lock()
+			r.take_back_unsubmitted(err)
+			r.lock.Unlock()
+			break
+		}
+		toSubmit -= n
+	}
+	r.enter.Unlock()
+
+	<-req.done
+	if req.err != nil {
+		return 0, req.err
+	}
+	return req.res, nil
+}
+
+/*
+* take the SQEs after the kernel's head back out of the ring, their requests fail with
+* err. It's called with both locks held, the kernel only consumes the SQEs while
+* entering, so none of them is submitted.
+ */
+func (r *IoUring) take_back_unsubmitted(err error) {
+	head := atomic.LoadUint32(r.sqHead)
+	tail := *r.sqTail
+	for i := head; i != tail; i++ {
+		slot := uint32(r.sqes[r.sqArray[i&r.sqMask]].user_data)
+		req := r.reqs[slot]
+		r.reqs[slot] = nil
+		r.free = append(r.free, slot)
+		req.err = err
+		req.keep = nil
+		close(req.done)
+	}
+	atomic.StoreUint32(r.sqTail, head)
+	r.pending = 0
+	r.slotFree.Broadcast()
+}
+
+func (r *IoUring) reap() {
+
+	stopping := false
+	for {
+		if _, err := io_uring_enter(r.fd, 0, 1, IORING_ENTER_GETEVENTS); err != nil && err != syscall.EINTR {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			continue
+		}
+		r.lock.Lock()
+		for ; head != tail; head++ {
+			cqe := &r.cqes[head&r.cqMask]
+			req := r.reqs[cqe.user_data]
+			r.reqs[cqe.user_data] = nil
+			r.free = append(r.free, uint32(cqe.user_data))
+			req.res = cqe.res
+			req.keep = nil
+			stopping = stopping || req.stop
+			close(req.done)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		r.slotFree.Broadcast()
+		/* the completions may come in any order, the requests before the nop are waited for */
+		idle := len(r.free) == int(r.entries)
+		r.lock.Unlock()
+		if stopping && idle {
+			break
+		}
+	}
+	close(r.reaped)
+}
+
+func (r *IoUring) rw(opcode uint8, vecs []iovec, offset uint64, flags int) (uint64, error) {
+	if !r.supported(opcode) {
+		return 0, ERR_ENOTSUP
+	}
+	res, err := r.submit(io_uring_sqe{
+		opcode:   opcode,
+		fd:       r.fileFd,
+		off:      offset,
+		addr:     uint64(uintptr(unsafe.Pointer(&vecs[0]))),
+		len:      uint32(len(vecs)),
+		rw_flags: uint32(flags),
+	}, vecs, false)
+	runtime.KeepAlive(vecs)
+	if err != nil {
+		return 0, err
+	}
+	if res < 0 {
+		return 0, io_uring_errno(res)
+	}
+	return uint64(res), nil
+}
+
+func (r *IoUring) preadv(vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return r.rw(IORING_OP_READV, vecs, offset, flags)
+}
+
+func (r *IoUring) pwritev(vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return r.rw(IORING_OP_WRITEV, vecs, offset, flags)
+}
+
+func (r *IoUring) fsync() error {
+	if !r.supported(IORING_OP_FSYNC) {
+		return ERR_ENOTSUP
+	}
+	res, err := r.submit(io_uring_sqe{opcode: IORING_OP_FSYNC, fd: r.fileFd}, nil, false)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return io_uring_errno(res)
+	}
+	return nil
+}
+
+// the length is passed in addr and the mode in len
+func (r *IoUring) fallocate(mode uint32, offset uint64, length uint64) error {
+	if !r.supported(IORING_OP_FALLOCATE) {
+		return ERR_ENOTSUP
+	}
+	res, err := r.submit(io_uring_sqe{opcode: IORING_OP_FALLOCATE, fd: r.fileFd,
+		off: offset, addr: length, len: mode}, nil, false)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return io_uring_errno(res)
+	}
+	return nil
+}
+
+// the unsupported operations are reported as ERR_ENOTSUP, so that the callers fall back
+func io_uring_errno(res int32) error {
+	errno := syscall.Errno(-res)
+	if errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS {
+		return ERR_ENOTSUP
+	}
+	return errno
+}
+
+/*
+* close the ring once the requests in flight completed, the reaper is stopped by a nop
+* queued last. The file is closed by the caller afterwards.
+ */
+func (r *IoUring) close() {
+	if r == nil {
+		return
+	}
+	if _, err := r.submit(io_uring_sqe{opcode: IORING_OP_NOP}, nil, true); err != nil {
+		return
+	}
+	<-r.reaped
+	r.unmap()
+	syscall.Close(r.fd)
+	runtime.KeepAlive(r.file)
+}
@@ -0,0 +1,184 @@
+//go:build linux && (amd64 || arm64)
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_io_uring(t *testing.T) {
+
+	var filename = "/tmp/test_io_uring.img"
+	const goroutines = 16
+	const chunk = 65536
+	os.Remove(filename)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.FileMode(0755))
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+	defer file.Close()
+
+	//a small ring, so that the requests wait for free entries
+	ring, err := newIoUring(file, 4)
+	if err == ERR_ENOTSUP {
+		t.Skip("io_uring is not available")
+	}
+	assert.Nil(t, err)
+	assert.True(t, ring.supported(IORING_OP_READV))
+	assert.True(t, ring.supported(IORING_OP_WRITEV))
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			//two vector elements, the second one starts in the middle of the chunk
+			buf := bytes.Repeat([]byte{byte(g + 1)}, chunk)
+			qiov := New_QEMUIOVector()
+			qemu_iovec_init(qiov, 2)
+			qemu_iovec_add(qiov, unsafe.Pointer(&buf[0]), 1000)
+			qemu_iovec_add(qiov, unsafe.Pointer(&buf[1000]), chunk-1000)
+			for i := 0; i < 10; i++ {
+				n, err := pwritev(context.Background(), file, ring, qiov.iov, qiov.niov, uint64(g)*chunk, 0)
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(chunk), n)
+				out := make([]byte, chunk)
+				n, err = preadv(context.Background(), file, ring, []iovec{{unsafe.Pointer(&out[0]), chunk}}, 1, uint64(g)*chunk)
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(chunk), n)
+				assert.Equal(t, buf, out)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Nil(t, file_fsync(file, ring))
+
+	//a short read at the end of the file
+	out := make([]byte, chunk)
+	n, err := preadv(context.Background(), file, ring, []iovec{{unsafe.Pointer(&out[0]), chunk}}, 1, goroutines*chunk-100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), n)
+
+	//zero a range in the middle of the chunk of the first goroutine
+	err = file_fallocate(file, ring, FALLOC_FL_ZERO_RANGE, 4096, 8192)
+	if err != ERR_ENOTSUP {
+		assert.Nil(t, err)
+		_, err = preadv(context.Background(), file, ring, []iovec{{unsafe.Pointer(&out[0]), chunk}}, 1, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{1}, 4096), out[:4096])
+		assert.Equal(t, make([]byte, 8192), out[4096:12288])
+		assert.Equal(t, bytes.Repeat([]byte{1}, chunk-12288), out[12288:])
+	}
+
+	//the ring fd replaced by another file, the request is taken back out of the ring
+	ringFd, err := syscall.Dup(ring.fd)
+	assert.Nil(t, err)
+	null, err := os.Open(os.DevNull)
+	assert.Nil(t, err)
+	assert.Nil(t, syscall.Dup3(int(null.Fd()), ring.fd, 0))
+	_, err = ring.pwritev([]iovec{{unsafe.Pointer(&out[0]), chunk}}, 0, 0)
+	assert.NotNil(t, err)
+	ring.lock.Lock()
+	assert.Equal(t, int(ring.entries), len(ring.free))
+	assert.Equal(t, atomic.LoadUint32(ring.sqHead), *ring.sqTail)
+	ring.lock.Unlock()
+	assert.Nil(t, syscall.Dup3(ringFd, ring.fd, 0))
+	syscall.Close(ringFd)
+	null.Close()
+	n, err = preadv(context.Background(), file, ring, []iovec{{unsafe.Pointer(&out[0]), chunk}}, 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(chunk), n)
+
+	//the ring refuses the requests once closed
+	ring.close()
+	_, err = ring.pwritev([]iovec{{unsafe.Pointer(&out[0]), chunk}}, 0, 0)
+	assert.Equal(t, Err_Closed, err)
+}
+
+func Test_io_uring_image(t *testing.T) {
+
+	var filename = "/tmp/test_io_uring.qcow2"
+	const writers = 8
+	const region = 5 * DEFAULT_CLUSTER_SIZE / 2
+	os.Remove(filename)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	err := Blk_Create_Opts(filename, &CreateOptions{Size: 4 * 1048576})
+	assert.Nil(t, err)
+	_, err = Blk_Open_Opts(filename, &OpenOptions{Aio: "native"}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+
+	before := runtime.NumGoroutine()
+	root, err := Blk_Open_Opts(filename, &OpenOptions{Aio: AIO_IO_URING, QueueDepth: 8}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	if root.bs.current.bs.opaque.(*BDRVRawState).Ring == nil {
+		Blk_Close(root)
+		t.Skip("io_uring is not available")
+	}
+
+	//concurrent writes split into several host ranges, then zero writes over them
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := bytes.Repeat([]byte{byte(i + 1)}, region)
+			for j := 0; j < 3; j++ {
+				_, err := Blk_Pwrite(root, uint64(i*region+512), buf, region, 0)
+				assert.Nil(t, err)
+			}
+			if i%2 == 1 {
+				_, err := Blk_Pwrite_Zeroes(root, uint64(i*region+512), DEFAULT_CLUSTER_SIZE, 0)
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, Blk_Flush(root))
+
+	buf := make([]byte, region)
+	for i := 0; i < writers; i++ {
+		_, err = Blk_Pread(root, uint64(i*region+512), buf, region)
+		assert.Nil(t, err)
+		expected := bytes.Repeat([]byte{byte(i + 1)}, region)
+		if i%2 == 1 {
+			copy(expected, make([]byte, DEFAULT_CLUSTER_SIZE))
+		}
+		assert.Equal(t, expected, buf)
+	}
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	Blk_Close(root)
+
+	//the reapers of the rings are stopped on close
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+
+	//without io_uring the image is accessed with the synchronous syscalls
+	atomic.StoreInt32(&noIoUring, 1)
+	defer atomic.StoreInt32(&noIoUring, 0)
+	root, err = Blk_Open(filename, map[string]any{OPT_FILENAME: filename, OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_IO_URING)
+	assert.Nil(t, err)
+	assert.Nil(t, root.bs.current.bs.opaque.(*BDRVRawState).Ring)
+	_, err = Blk_Pread(root, 512, buf, region)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, region), buf)
+	Blk_Close(root)
+	os.Remove(filename)
+}
@@ -0,0 +1,51 @@
+//go:build !(linux && (amd64 || arm64))
+
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"os"
+)
+
+// io_uring is linux only, the files are accessed with the synchronous syscalls elsewhere
+type IoUring struct{}
+
+func newIoUring(file *os.File, entries uint32) (*IoUring, error) {
+	return nil, ERR_ENOTSUP
+}
+
+func (r *IoUring) preadv(vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return 0, ERR_ENOTSUP
+}
+
+func (r *IoUring) pwritev(vecs []iovec, offset uint64, flags int) (uint64, error) {
+	return 0, ERR_ENOTSUP
+}
+
+func (r *IoUring) fsync() error {
+	return ERR_ENOTSUP
+}
+
+func (r *IoUring) fallocate(mode uint32, offset uint64, length uint64) error {
+	return ERR_ENOTSUP
+}
+
+func (r *IoUring) close() {}
@@ -260,6 +260,27 @@ func iov_memset(iov []iovec, iovCnt uint64, offset uint64, fillc int, bytes uint
 	return done
 }
 
+/*
+ * Checks if the bytes of the qiov starting at offset are all zeroes
+ */
+func qemu_iovec_is_zero(qiov *QEMUIOVector, offset uint64, bytes uint64) bool {
+
+	var currentOffset uint64
+	iov := iov_skip_offset(qiov.iov, offset, &currentOffset)
+
+	for bytes > 0 {
+		length := min(iov[0].iov_len-currentOffset, bytes)
+		buf := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(iov[0].iov_base)+uintptr(currentOffset))), length)
+		if !buffer_is_zero(buf, length) {
+			return false
+		}
+		currentOffset = 0
+		bytes -= length
+		iov = iov[1:]
+	}
+	return true
+}
+
 func qemu_iovec_to_buf(qiov *QEMUIOVector, offset uint64, buf unsafe.Pointer, bytes uint64) uint64 {
 	return iov_to_buf(qiov.iov, uint64(qiov.niov), offset, buf, bytes)
 }
@@ -0,0 +1,91 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+* map the guest visible content of the range into extents, adjacent extents
+* sharing the same allocation state are merged. a length of 0 means up to the
+* end of the image.
+ */
+func Blk_Map(root *BdrvChild, offset uint64, length uint64) ([]BlockMapEntry, error) {
+
+	it, err := Blk_Extents(root, offset, length, "")
+	if err != nil {
+		return nil, err
+	}
+	return bdrv_map(it)
+}
+
+func bdrv_map(it *BlockExtentIterator) ([]BlockMapEntry, error) {
+
+	var entries []BlockMapEntry
+	var curr, next BlockMapEntry
+
+	for it.Next() {
+		e := it.Extent()
+		next = BlockMapEntry{
+			Start:     e.Start,
+			Length:    e.Length,
+			Depth:     e.Depth,
+			Present:   e.IsAllocated(),
+			Zero:      e.IsZero(),
+			Data:      e.IsData(),
+			Offset:    e.HostOffset,
+			HasOffset: e.HasOffset(),
+			Filename:  e.Filename,
+		}
+		if entry_mergeable(&curr, &next) {
+			curr.Length += next.Length
+			continue
+		}
+		if curr.Length > 0 {
+			entries = append(entries, curr)
+		}
+		curr = next
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	if curr.Length > 0 {
+		entries = append(entries, curr)
+	}
+	return entries, nil
+}
+
+func entry_mergeable(curr *BlockMapEntry, next *BlockMapEntry) bool {
+
+	if curr.Length == 0 {
+		return false
+	}
+	if curr.Zero != next.Zero || curr.Data != next.Data ||
+		curr.Depth != next.Depth || curr.Present != next.Present {
+		return false
+	}
+	if curr.Filename != next.Filename {
+		return false
+	}
+	if curr.HasOffset != next.HasOffset {
+		return false
+	}
+	if curr.HasOffset && curr.Offset+curr.Length != next.Offset {
+		return false
+	}
+	return true
+}
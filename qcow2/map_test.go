@@ -0,0 +1,66 @@
+package qcow2
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_map_backing_chain(t *testing.T) {
+	var basefile = "/tmp/map_base.qcow2"
+	var topfile = "/tmp/map_top.qcow2"
+	buf := ([]byte)("this is a test")
+
+	root := create_compare_image(t, basefile, "")
+	_, err := Blk_Pwrite(root, 123, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 3*1048576, 65536, BDRV_REQ_MAY_UNMAP)
+	assert.Nil(t, err)
+	Blk_Close(root)
+	root = create_compare_image(t, topfile, basefile)
+	_, err = Blk_Pwrite(root, 1048576, make([]byte, 2*65536), 2*65536, 0)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+
+	entries, err := Blk_Map(root, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(entries))
+
+	//data in the base image
+	assert.Equal(t, BlockMapEntry{Start: 0, Length: 65536, Depth: 1, Present: true, Data: true,
+		Offset: entries[0].Offset, HasOffset: true, Filename: basefile}, entries[0])
+	//unallocated in the whole chain
+	assert.Equal(t, BlockMapEntry{Start: 65536, Length: 1048576 - 65536, Depth: 1, Zero: true}, entries[1])
+	//data in the top image, two adjacent clusters are merged
+	l2Slice, l2Index, err := get_cluster_table(root.bs, 1048576)
+	assert.Nil(t, err)
+	hostOffset := get_l2_entry(s, l2Slice, l2Index) & L2E_OFFSET_MASK
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+	assert.Equal(t, BlockMapEntry{Start: 1048576, Length: 2 * 65536, Depth: 0, Present: true, Data: true,
+		Offset: hostOffset, HasOffset: true, Filename: topfile}, entries[2])
+	assert.Equal(t, uint64(3*1048576), entries[4].Start)
+	assert.Equal(t, uint64(65536), entries[4].Length)
+	assert.True(t, entries[4].Zero && entries[4].Present)
+	assert.Equal(t, 1, entries[4].Depth)
+	assert.Equal(t, uint64(4*1048576), entries[5].Start+entries[5].Length)
+
+	//a sub range
+	entries, err = Blk_Map(root, 1048576+4096, 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, hostOffset+4096, entries[0].Offset)
+
+	//the host offset is only emitted if valid
+	bytes, err := json.Marshal(BlockMapEntry{Start: 0, Length: 512, Zero: true})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bytes), "offset")
+	bytes, err = json.Marshal(BlockMapEntry{Start: 0, Length: 512, Data: true, HasOffset: true})
+	assert.Nil(t, err)
+	assert.Contains(t, string(bytes), `"offset":0`)
+
+	Blk_Close(root)
+	os.Remove(basefile)
+	os.Remove(topfile)
+}
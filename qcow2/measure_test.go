@@ -0,0 +1,86 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_measure_size(t *testing.T) {
+
+	//values reported by "qemu-img measure -O qcow2 --size 1G"
+	info, err := Blk_Measure(map[string]any{
+		OPT_FMT:  "qcow2",
+		OPT_SIZE: 1 << 30,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(393216), info.Required)
+	assert.Equal(t, uint64(1074135040), info.FullyAllocated)
+
+	info, err = Blk_Measure(map[string]any{
+		OPT_FMT:      "qcow2",
+		OPT_SIZE:     1 << 30,
+		OPT_PREALLOC: PREALLOC_MODE_FULL,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, info.FullyAllocated, info.Required)
+
+	info, err = Blk_Measure(map[string]any{
+		OPT_FMT:  "raw",
+		OPT_SIZE: 1000,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1024), info.Required)
+	assert.Equal(t, uint64(1024), info.FullyAllocated)
+
+	_, err = Blk_Measure(map[string]any{
+		OPT_FMT:          "qcow2",
+		OPT_SIZE:         1 << 30,
+		OPT_CLUSTER_SIZE: 1000,
+	}, nil)
+	assert.NotNil(t, err)
+
+	_, err = Blk_Measure(map[string]any{OPT_FMT: "qcow2"}, nil)
+	assert.Equal(t, Err_IncompleteParameters, err)
+
+	_, err = Blk_Measure(map[string]any{OPT_FMT: "vmdk", OPT_SIZE: 1 << 30}, nil)
+	assert.Equal(t, Err_NoDriverFound, err)
+}
+
+func Test_measure_image(t *testing.T) {
+	var filename = "/tmp/measure.qcow2"
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{
+		OPT_SIZE:     1 << 30,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	defer Blk_Close(root)
+
+	buf := make([]byte, 65536)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	//data spanning two clusters and one zeroed cluster
+	_, err = Blk_Pwrite(root, 123, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 1<<20, 65536, 0)
+	assert.Nil(t, err)
+
+	info, err := Blk_Measure(map[string]any{OPT_FMT: "qcow2"}, root)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1074135040), info.FullyAllocated)
+	assert.Equal(t, uint64(393216+2*65536), info.Required)
+
+	//the backing file may have nothing in common with the source
+	info, err = Blk_Measure(map[string]any{
+		OPT_FMT:     "qcow2",
+		OPT_BACKING: "/tmp/measure_base.qcow2",
+	}, root)
+	assert.Nil(t, err)
+	assert.Equal(t, info.FullyAllocated, info.Required)
+}
@@ -0,0 +1,239 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+)
+
+type optionType int
+
+const (
+	optionString optionType = iota
+	optionUint
+	optionBool
+)
+
+func (t optionType) String() string {
+	switch t {
+	case optionString:
+		return "a string"
+	case optionUint:
+		return "a non-negative integer"
+	default:
+		return "a bool"
+	}
+}
+
+// the types of the known options of the map form, other keys are left to the drivers
+var optionTypes = map[string]optionType{
+	OPT_FMT:              optionString,
+	OPT_SIZE:             optionUint,
+	OPT_FILENAME:         optionString,
+	OPT_BACKING:          optionString,
+	OPT_SUBCLUSTER:       optionBool,
+	OPT_L2CACHESIZE:      optionUint,
+	OPT_DATAFILE:         optionString,
+	OPT_BACKING_FILE_FMT: optionString,
+	OPT_OVERLAP_CHECK:    optionString,
+	OPT_CLUSTER_SIZE:     optionUint,
+	OPT_PREALLOC:         optionString,
+	OPT_COMPAT:           optionString,
+	OPT_REFCOUNT_BITS:    optionUint,
+	OPT_DETECT_ZEROES:    optionString,
+	OPT_PROTOCOL:         optionString,
+	OPT_AIO_WORKERS:      optionUint,
+	OPT_AIO_QUEUE_DEPTH:  optionUint,
+	OPT_AIO:              optionString,
+}
+
+/*
+* check the value types of the options in the map form, so that the drivers
+* can read them without panicking on a wrong type
+ */
+func bdrv_validate_options(options map[string]any) error {
+	for key, val := range options {
+		optType, ok := optionTypes[key]
+		if !ok {
+			continue
+		}
+		valid := false
+		switch optType {
+		case optionString:
+			_, valid = val.(string)
+		case optionBool:
+			_, valid = val.(bool)
+		case optionUint:
+			switch v := val.(type) {
+			case int:
+				valid = v >= 0
+			case int8:
+				valid = v >= 0
+			case int16:
+				valid = v >= 0
+			case int32:
+				valid = v >= 0
+			case int64:
+				valid = v >= 0
+			case uint, uint8, uint16, uint32, uint64:
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid value %v (%T) for option '%s', expected %s", val, val, key, optType)
+		}
+	}
+	return nil
+}
+
+// CreateOptions are the typed options of Blk_Create_Opts, the comments give the qemu-img names
+type CreateOptions struct {
+	Format        string // fmt, qcow2 if empty
+	Size          uint64 // size, the virtual size in bytes, required
+	ClusterSize   uint64 // cluster_size, 65536 if zero
+	Subcluster    bool   // extended_l2
+	BackingFile   string // backing_file
+	BackingFormat string // backing_fmt, qcow2 if empty
+	DataFile      string // data_file
+	Protocol      string // the driver of the image file, raw files if empty
+}
+
+// Validate checks the options, the defaults are filled in by ToMap
+func (o *CreateOptions) Validate() error {
+	if o.Size == 0 {
+		return fmt.Errorf("option '%s' is required", OPT_SIZE)
+	}
+	if o.ClusterSize != 0 {
+		if err := qcow2_check_cluster_size(o.ClusterSize, o.Subcluster); err != nil {
+			return err
+		}
+	}
+	if o.BackingFormat != "" && o.BackingFile == "" {
+		return fmt.Errorf("option '%s' requires option '%s'", OPT_BACKING_FILE_FMT, OPT_BACKING)
+	}
+	if o.Format != "" && LookupDriver(o.Format) == nil {
+		return fmt.Errorf("unknown format '%s'", o.Format)
+	}
+	if o.Protocol != "" && LookupDriver(o.Protocol) == nil {
+		return fmt.Errorf("unknown protocol '%s'", o.Protocol)
+	}
+	return nil
+}
+
+// ToMap converts the options into the map form with the defaults filled in
+func (o *CreateOptions) ToMap() map[string]any {
+	options := map[string]any{
+		OPT_FMT:  TYPE_QCOW2_NAME,
+		OPT_SIZE: o.Size,
+	}
+	if o.Format != "" {
+		options[OPT_FMT] = o.Format
+	}
+	if o.ClusterSize != 0 {
+		options[OPT_CLUSTER_SIZE] = o.ClusterSize
+	}
+	if o.Subcluster {
+		options[OPT_SUBCLUSTER] = true
+	}
+	if o.BackingFile != "" {
+		options[OPT_BACKING] = o.BackingFile
+	}
+	if o.BackingFormat != "" {
+		options[OPT_BACKING_FILE_FMT] = o.BackingFormat
+	}
+	if o.DataFile != "" {
+		options[OPT_DATAFILE] = o.DataFile
+	}
+	if o.Protocol != "" {
+		options[OPT_PROTOCOL] = o.Protocol
+	}
+	return options
+}
+
+// OpenOptions are the typed options of Blk_Open_Opts, the comments give the qemu names
+type OpenOptions struct {
+	Format       string // driver, qcow2 if empty
+	L2CacheSize  uint64 // l2-cache-size in bytes, derived from the virtual size if zero
+	OverlapCheck string // overlap-check: none, constant, cached or all
+	DetectZeroes string // detect-zeroes: off, on or unmap, off if empty
+	Protocol     string // the driver of the image file, raw files if empty
+	Workers      uint64 // the workers running the tasks of the split requests, QCOW2_MAX_WORKERS if zero
+	QueueDepth   uint64 // the tasks queued to the workers and the entries of the io_uring, QCOW2_AIO_QUEUE_DEPTH if zero
+	Aio          string // aio: threads or io_uring, threads if empty
+}
+
+// Validate checks the options, the defaults are filled in by ToMap
+func (o *OpenOptions) Validate() error {
+	if o.Format != "" && LookupDriver(o.Format) == nil {
+		return fmt.Errorf("unknown format '%s'", o.Format)
+	}
+	if o.Protocol != "" && LookupDriver(o.Protocol) == nil {
+		return fmt.Errorf("unknown protocol '%s'", o.Protocol)
+	}
+	if o.OverlapCheck != "" {
+		if _, err := qcow2_parse_overlap_check(o.OverlapCheck); err != nil {
+			return err
+		}
+	}
+	if o.DetectZeroes != "" {
+		//unmap is checked against the open flags by Blk_Open
+		if _, err := bdrv_parse_detect_zeroes(o.DetectZeroes, BDRV_O_UNMAP); err != nil {
+			return err
+		}
+	}
+	if o.Aio != "" {
+		if _, err := bdrv_parse_aio(o.Aio, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToMap converts the options into the map form with the defaults filled in
+func (o *OpenOptions) ToMap() map[string]any {
+	options := map[string]any{
+		OPT_FMT: TYPE_QCOW2_NAME,
+	}
+	if o.Format != "" {
+		options[OPT_FMT] = o.Format
+	}
+	if o.L2CacheSize != 0 {
+		options[OPT_L2CACHESIZE] = o.L2CacheSize
+	}
+	if o.OverlapCheck != "" {
+		options[OPT_OVERLAP_CHECK] = o.OverlapCheck
+	}
+	if o.DetectZeroes != "" {
+		options[OPT_DETECT_ZEROES] = o.DetectZeroes
+	}
+	if o.Protocol != "" {
+		options[OPT_PROTOCOL] = o.Protocol
+	}
+	if o.Workers != 0 {
+		options[OPT_AIO_WORKERS] = o.Workers
+	}
+	if o.QueueDepth != 0 {
+		options[OPT_AIO_QUEUE_DEPTH] = o.QueueDepth
+	}
+	if o.Aio != "" {
+		options[OPT_AIO] = o.Aio
+	}
+	return options
+}
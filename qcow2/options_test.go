@@ -0,0 +1,63 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_options_validate(t *testing.T) {
+
+	assert.Nil(t, bdrv_validate_options(map[string]any{
+		OPT_FMT:         "qcow2",
+		OPT_SIZE:        int32(1048576),
+		OPT_L2CACHESIZE: 65536,
+		OPT_SUBCLUSTER:  true,
+		"custom-option": 1.5,
+	}))
+	assert.NotNil(t, bdrv_validate_options(map[string]any{OPT_SIZE: "1M"}))
+	assert.NotNil(t, bdrv_validate_options(map[string]any{OPT_SIZE: -1}))
+	assert.NotNil(t, bdrv_validate_options(map[string]any{OPT_SUBCLUSTER: "true"}))
+	assert.NotNil(t, bdrv_validate_options(map[string]any{OPT_FMT: 1}))
+
+	assert.NotNil(t, (&CreateOptions{}).Validate())
+	assert.NotNil(t, (&CreateOptions{Size: 1048576, ClusterSize: 4097}).Validate())
+	assert.NotNil(t, (&CreateOptions{Size: 1048576, ClusterSize: 4096, Subcluster: true}).Validate())
+	assert.Nil(t, (&CreateOptions{Size: 1048576, ClusterSize: 4096}).Validate())
+	assert.NotNil(t, (&CreateOptions{Size: 1048576, BackingFormat: "qcow2"}).Validate())
+	assert.NotNil(t, (&CreateOptions{Size: 1048576, Format: "vmdk"}).Validate())
+	assert.NotNil(t, (&OpenOptions{OverlapCheck: "some"}).Validate())
+	assert.NotNil(t, (&OpenOptions{DetectZeroes: "yes"}).Validate())
+	assert.Nil(t, (&OpenOptions{DetectZeroes: DETECT_ZEROES_UNMAP, OverlapCheck: "all"}).Validate())
+}
+
+func Test_options_typed(t *testing.T) {
+
+	var filename = "/tmp/test_options.qcow2"
+	os.Remove(filename)
+
+	//the map form reports wrong types instead of panicking
+	err := Blk_Create(filename, map[string]any{OPT_FMT: "qcow2", OPT_SIZE: 1048576, OPT_SUBCLUSTER: 1})
+	assert.NotNil(t, err)
+
+	err = Blk_Create_Opts(filename, &CreateOptions{Size: 1048576, Subcluster: true})
+	assert.Nil(t, err)
+
+	//an int l2 cache size used to panic
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_L2CACHESIZE: 131072}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, root.bs.opaque.(*BDRVQcow2State).L2TableCache.size)
+	Blk_Close(root)
+
+	root, err = Blk_Open_Opts(filename, &OpenOptions{L2CacheSize: 65536, OverlapCheck: "all"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	assert.True(t, has_subclusters(s))
+	assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_ALL), s.OverlapCheck)
+	Blk_Close(root)
+
+	_, err = Blk_Open_Opts(filename, &OpenOptions{DetectZeroes: DETECT_ZEROES_UNMAP}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	os.Remove(filename)
+}
@@ -20,6 +20,7 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
 	"container/list"
 	"context"
 	"encoding/binary"
@@ -47,6 +48,15 @@ func newQcow2Driver() *BlockDriver {
 		bdrv_copy_range_from: qcow2_copy_range_from,
 		bdrv_copy_range_to:   qcow2_copy_range_to,
 		bdrv_pdiscard:        qcow2_pdiscard,
+
+		bdrv_change_backing_file: qcow2_change_backing_file,
+		bdrv_check:               qcow2_check,
+		bdrv_measure:             qcow2_measure,
+		bdrv_amend_options:       qcow2_amend_options,
+		bdrv_compact:             qcow2_compact,
+		bdrv_sparsify:            qcow2_sparsify,
+
+		bdrv_pwritev_compressed_part: qcow2_pwritev_compressed_part,
 	}
 }
 
@@ -55,22 +65,32 @@ func qcow2_close(bs *BlockDriverState) {
 		return
 	}
 	s := bs.opaque.(*BDRVQcow2State)
-	qcow2_cache_flush(bs, s.L2TableCache)
-	qcow2_cache_flush(bs, s.RefcountBlockCache)
+	//no request is in flight, the workers are idle
+	if s.AioWorkers != nil {
+		s.AioWorkers.shutdown()
+	}
+	if s.L2TableCache != nil {
+		qcow2_cache_flush(bs, s.L2TableCache)
+		qcow2_cache_destroy(s.L2TableCache)
+	}
+	if s.RefcountBlockCache != nil {
+		qcow2_cache_flush(bs, s.RefcountBlockCache)
+		qcow2_cache_destroy(s.RefcountBlockCache)
+	}
 	s.L1Table = nil
-	qcow2_cache_destroy(s.L2TableCache)
-	qcow2_cache_destroy(s.RefcountBlockCache)
+	s.L2TableCache = nil
+	s.RefcountBlockCache = nil
+	if has_data_file(bs) {
+		bdrv_close(s.DataFile.bs)
+	}
+	s.DataFile = nil
 	if bs.current != nil {
 		bdrv_close(bs.current.bs)
 	}
 	if bs.backing != nil {
 		bdrv_close(bs.backing.bs)
+		bs.backing = nil
 	}
-	if has_data_file(bs) {
-		bdrv_close(s.DataFile.bs)
-		s.DataFile = nil
-	}
-
 }
 
 func qcow2_create(filename string, options map[string]any) error {
@@ -82,6 +102,7 @@ func qcow2_create(filename string, options map[string]any) error {
 	var enableSc bool
 	var dataFile string
 	var backingFileFmt string
+	var clusterSize uint64 = DEFAULT_CLUSTER_SIZE
 
 	//check file name
 	if filename == "" {
@@ -95,6 +116,11 @@ func qcow2_create(filename string, options map[string]any) error {
 		size = interface2uint64(val)
 	}
 
+	//check cluster size
+	if val, ok := options[OPT_CLUSTER_SIZE]; ok && interface2uint64(val) > 0 {
+		clusterSize = interface2uint64(val)
+	}
+
 	//check backing file
 	if val, ok := options[OPT_BACKING]; ok {
 		backingFile = val.(string)
@@ -105,6 +131,11 @@ func qcow2_create(filename string, options map[string]any) error {
 		enableSc = val.(bool)
 	}
 
+	if err = qcow2_check_cluster_size(clusterSize, enableSc); err != nil {
+		return err
+	}
+	clusterBits := uint64(ctz32(uint32(clusterSize)))
+
 	//data file
 	if val, ok := options[OPT_DATAFILE]; ok {
 		dataFile = val.(string)
@@ -116,7 +147,7 @@ func qcow2_create(filename string, options map[string]any) error {
 	}
 
 	//now open the child
-	if child, err = bdrv_open_child(filename, "raw", options, BDRV_O_CREATE|BDRV_O_RDWR); err != nil {
+	if child, err = bdrv_open_child(filename, bdrv_protocol(options), options, BDRV_O_CREATE|BDRV_O_RDWR); err != nil {
 		return err
 	} else {
 		bdrv_set_perm(child, PERM_ALL)
@@ -126,8 +157,16 @@ func qcow2_create(filename string, options map[string]any) error {
 	size = round_up(size, DEFAULT_SECTOR_SIZE)
 
 	//calculate the l1size based on the cluster size
-	size2 := round_up(size, DEFAULT_CLUSTER_SIZE)
-	l1Size := round_up(size2, 1<<(DEFAULT_CLUSTER_BITS+DEFAULT_CLUSTER_BITS-3)) >> (DEFAULT_CLUSTER_BITS + DEFAULT_CLUSTER_BITS - 3)
+	size2 := round_up(size, clusterSize)
+	l1Size := round_up(size2, 1<<(clusterBits+clusterBits-3)) >> (clusterBits + clusterBits - 3)
+	if enableSc {
+		l1Size *= 2
+	}
+	if l1Size*L1E_SIZE > QCOW_MAX_L1_SIZE {
+		return fmt.Errorf("image size %d is too big for the cluster size %d", size, clusterSize)
+	}
+	//the header, the refcount table and the refcount block take a cluster each, the l1 table follows
+	l1Clusters := round_up(l1Size*L1E_SIZE, clusterSize) / clusterSize
 
 	//initiate default header
 	header := &QCowHeader{
@@ -135,12 +174,12 @@ func qcow2_create(filename string, options map[string]any) error {
 		Version:               QCOW2_VERSION3,
 		BackingFileOffset:     uint64(0),
 		BackingFileSize:       uint32(0),
-		ClusterBits:           uint32(DEFAULT_CLUSTER_BITS),
+		ClusterBits:           uint32(clusterBits),
 		Size:                  uint64(size),
 		CryptMethod:           uint32(QCOW2_CRYPT_METHOD),
 		L1Size:                uint32(l1Size),
-		L1TableOffset:         uint64(L1_TABLE_OFFSET),
-		RefcountTableOffset:   uint64(REFCOUNT_TABLE_OFFSET),
+		L1TableOffset:         3 * clusterSize,
+		RefcountTableOffset:   clusterSize,
 		RefcountTableClusters: uint32(DEFAULT_REFCOUNT_TABLE_CLUSTERS),
 		NbSnapshots:           uint32(0),
 		SnapshotsOffset:       uint64(0),
@@ -153,7 +192,6 @@ func qcow2_create(filename string, options map[string]any) error {
 	//set enable subcluster
 	if enableSc {
 		header.IncompatibleFeatures |= QCOW2_INCOMPAT_EXTL2
-		header.L1Size = header.L1Size * 2
 	}
 	if dataFile != "" {
 		header.IncompatibleFeatures |= QCOW2_INCOMPAT_DATA_FILE
@@ -161,12 +199,15 @@ func qcow2_create(filename string, options map[string]any) error {
 	}
 	//set the backing file
 	if backingFile != "" {
-		header.BackingFileOffset = BACKING_FILE_OFFSET
-		if _, err = os.Stat(backingFile); err != nil {
-			return err
-		}
-		if backingFile, err = filepath.Abs(backingFile); err != nil {
-			return err
+		header.BackingFileOffset = qcow2_backing_file_offset(clusterSize)
+		//the names of other protocols are not local paths
+		if bdrv_protocol(options) == TYPE_RAW_NAME {
+			if _, err = os.Stat(backingFile); err != nil {
+				return err
+			}
+			if backingFile, err = filepath.Abs(backingFile); err != nil {
+				return err
+			}
 		}
 		header.BackingFileSize = uint32(len(backingFile))
 	}
@@ -180,7 +221,7 @@ func qcow2_create(filename string, options map[string]any) error {
 		//SupportedWriteFlags: BDRV_REQ_WRITE_UNCHANGED | BDRV_REQ_FUA,
 		SupportedWriteFlags: 0,
 		RequestAlignment:    DEFAULT_ALIGNMENT,
-		PdiscardAlignment:   DEFAULT_CLUSTER_SIZE,
+		PdiscardAlignment:   qcow2State.ClusterSize,
 		MaxTransfer:         DEFAULT_MAX_TRANSFER,
 	}
 
@@ -199,7 +240,7 @@ func qcow2_create(filename string, options map[string]any) error {
 		}
 		var dataChild *BdrvChild
 		//now open the child
-		if dataChild, err = bdrv_open_child(dataFile, "raw", options, BDRV_O_CREATE|BDRV_O_RDWR); err != nil {
+		if dataChild, err = bdrv_open_child(dataFile, bdrv_protocol(options), options, BDRV_O_CREATE|BDRV_O_RDWR); err != nil {
 			return err
 		} else {
 			bdrv_set_perm(dataChild, PERM_ALL)
@@ -211,7 +252,7 @@ func qcow2_create(filename string, options map[string]any) error {
 	}
 	//write the backing file
 	if backingFile != "" {
-		if _, err := Blk_Pwrite_Object(bs.current, BACKING_FILE_OFFSET,
+		if _, err := Blk_Pwrite_Object(bs.current, header.BackingFileOffset,
 			([]byte)(backingFile), uint64(len(backingFile))); err != nil {
 			return err
 		}
@@ -226,26 +267,26 @@ func qcow2_create(filename string, options map[string]any) error {
 	qcow2State.RefcountBlockCache = qcow2_cache_create(bs, 1, qcow2State.ClusterSize)
 
 	// Write a refcount table with one refcount block
-	qcow2State.RefcountTable = make([]uint64, 2*REFCOUNT_TABLE_SIZE)
-	qcow2State.RefcountTable[0] = 2 * DEFAULT_CLUSTER_SIZE
-	if _, err := Blk_Pwrite_Object(bs.current, REFCOUNT_TABLE_OFFSET,
-		qcow2State.RefcountTable, uint64(2*REFCOUNT_TABLE_SIZE*SIZE_UINT64)); err != nil {
+	qcow2State.RefcountTable = make([]uint64, 2*clusterSize/REFTABLE_ENTRY_SIZE)
+	qcow2State.RefcountTable[0] = 2 * clusterSize
+	if _, err := Blk_Pwrite_Object(bs.current, header.RefcountTableOffset,
+		qcow2State.RefcountTable, 2*clusterSize); err != nil {
 		return err
 	}
 	bdrv_flush(bs)
 
 	//write l1 table
 	qcow2State.L1Table = make([]uint64, header.L1Size)
-	if _, err := Blk_Pwrite_Object(bs.current, L1_TABLE_OFFSET, qcow2State.L1Table,
+	if _, err := Blk_Pwrite_Object(bs.current, header.L1TableOffset, qcow2State.L1Table,
 		l1Size*SIZE_UINT64); err != nil {
 		return err
 	}
 	//sync to disk
 	bdrv_flush(bs)
 
-	//alloc 4 clusters for the header block,
+	//alloc the clusters of the header block, the refcount table, the refcount block and the l1 table,
 	//then mark them as occupied
-	if _, err = qcow2_alloc_clusters(bs, 4*DEFAULT_CLUSTER_SIZE); err != nil {
+	if _, err = qcow2_alloc_clusters(bs, (3+l1Clusters)*clusterSize); err != nil {
 		return err
 	}
 
@@ -263,7 +304,8 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	var enableSc bool
 	var l2CacheSize uint64
 	var l2CacehNum uint32
-	var dataFile string
+	var overlapCheck Qcow2MetadataOverlap = QCOW2_OL_CACHED
+	var aioWorkers, aioQueueDepth int
 
 	//check file name
 	if filename == "" {
@@ -271,11 +313,22 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	}
 
 	if val, ok := opts[OPT_L2CACHESIZE]; ok {
-		l2CacheSize = val.(uint64)
+		l2CacheSize = interface2uint64(val)
+	}
+	if val, ok := opts[OPT_OVERLAP_CHECK]; ok {
+		if overlapCheck, err = qcow2_parse_overlap_check(val.(string)); err != nil {
+			return nil, err
+		}
+	}
+	if val, ok := opts[OPT_AIO_WORKERS]; ok {
+		aioWorkers = int(interface2uint64(val))
+	}
+	if val, ok := opts[OPT_AIO_QUEUE_DEPTH]; ok {
+		aioQueueDepth = int(interface2uint64(val))
 	}
 
 	//now open the child
-	if child, err = bdrv_open_child(filename, "raw", opts, flags); err != nil {
+	if child, err = bdrv_open_child(filename, bdrv_protocol(opts), opts, flags); err != nil {
 		return nil, err
 	} else {
 		bdrv_set_perm(child, PERM_ALL)
@@ -286,26 +339,23 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	if _, err = Blk_Pread_Object(child, 0, &header, uint64(unsafe.Sizeof(header))); err != nil {
 		return nil, fmt.Errorf("qcow2 file %s read fail, err: %v", filename, err)
 	}
+	//a version 2 header has no feature fields, use their implied values
+	if header.Version == QCOW2_VERSION2 {
+		qcow2_set_v2_header(&header)
+	} else if header.HeaderLength <= uint32(unsafe.Offsetof(header.CompressionType)) {
+		//the byte read is not part of the header, zlib is implied then
+		header.CompressionType = QCOW2_COMPRESSION_TYPE_ZLIB
+	}
 	//check header
 	if err = check_header(&header); err != nil {
 		return nil, err
 	}
 	child.header = &header
 
-	//read the backing file
-	var backingFile string
-	if header.BackingFileOffset > 0 && header.BackingFileSize > 0 {
-		backingBytes := make([]byte, header.BackingFileSize)
-		if _, err = Blk_Pread_Object(child, header.BackingFileOffset,
-			backingBytes, uint64(header.BackingFileSize)); err != nil {
-			return nil, fmt.Errorf("can not read backing file, err: %v", err)
-		}
-		backingFile = string(backingBytes)
-		if backing, err = bdrv_open_child(backingFile, "qcow2", opts, flags); err != nil {
-			return nil, err
-		} else {
-			bdrv_set_perm(backing, PERM_READABLE)
-		}
+	//a corrupt image can only be opened read/write for repairing it
+	if header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0 &&
+		flags&BDRV_O_RDWR > 0 && flags&BDRV_O_CHECK == 0 {
+		return nil, Err_ImageCorrupt
 	}
 
 	if header.IncompatibleFeatures&QCOW2_INCOMPAT_EXTL2 > 0 {
@@ -313,40 +363,69 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 	}
 
 	qcow2State := initiate_qcow2_state(&header, enableSc)
+	qcow2State.OverlapCheck = overlapCheck
+	qcow2State.AioWorkers = NewAioWorkerPool(aioWorkers, aioQueueDepth)
 	//opaque.DataFile = child
 	//initiate the BlockDriverState struct
 	bs := &BlockDriverState{
 		filename:            filename,
-		backingFile:         backingFile,
 		opaque:              qcow2State, //initiate the BDRVQcow2State struct
 		options:             make(map[string]any),
 		SupportedWriteFlags: 0,
+		SupportedZeroFlags:  BDRV_REQ_MAY_UNMAP,
 		RequestAlignment:    DEFAULT_ALIGNMENT,
-		PdiscardAlignment:   DEFAULT_CLUSTER_SIZE,
-		MaxTransfer:         DEFAULT_MAX_TRANSFER,
-		TotalSectors:        header.Size / BDRV_SECTOR_SIZE,
-		InheritsFrom:        nil,
-		OpenFlags:           flags,
+		PdiscardAlignment:   qcow2State.ClusterSize,
+		//the unaligned head and tail of the zero writes each fit in a subcluster
+		PwriteZeroesAlignment: uint32(qcow2State.SubclusterSize),
+		MaxTransfer:           DEFAULT_MAX_TRANSFER,
+		TotalSectors:          header.Size / BDRV_SECTOR_SIZE,
+		InheritsFrom:          nil,
+		OpenFlags:             flags,
 	}
 	//update child
 	bdrv_link_child(bs, child, filename)
-	//link backing
-	if backing != nil {
-		bdrv_link_backing(bs, backing, backingFile)
+
+	//read the header extensions, they end at the backing file name if any
+	extEnd := uint64(qcow2State.ClusterSize)
+	if header.BackingFileOffset > 0 && header.BackingFileOffset < extEnd {
+		extEnd = header.BackingFileOffset
+	}
+	if err = qcow2_read_extensions(bs, uint64(header.HeaderLength), extEnd); err != nil {
+		return nil, err
 	}
 
-	if header.IncompatibleFeatures&QCOW2_INCOMPAT_DATA_FILE > 0 {
-		//read the header ext
-		if dataFile, err = header_ext_read_external_data_file(bs, uint64(unsafe.Sizeof(header))); err != nil {
+	//read the backing file
+	if header.BackingFileOffset > 0 && header.BackingFileSize > 0 {
+		backingBytes := make([]byte, header.BackingFileSize)
+		if _, err = Blk_Pread_Object(child, header.BackingFileOffset,
+			backingBytes, uint64(header.BackingFileSize)); err != nil {
+			return nil, fmt.Errorf("can not read backing file, err: %v", err)
+		}
+		bs.backingFile = string(backingBytes)
+		backingFmt := qcow2State.ImageBackingFormat
+		if backingFmt == "" {
+			backingFmt = TYPE_QCOW2_NAME
+		}
+		if backing, err = bdrv_open_child(bs.backingFile, backingFmt, opts, flags); err != nil {
 			return nil, err
+		} else {
+			bdrv_set_perm(backing, PERM_READABLE)
+		}
+		//link backing
+		bdrv_link_backing(bs, backing, bs.backingFile)
+	}
+
+	if header.IncompatibleFeatures&QCOW2_INCOMPAT_DATA_FILE > 0 {
+		if qcow2State.ImageDataFile == "" {
+			return nil, fmt.Errorf("missing external data file name")
 		}
 		var dataChild *BdrvChild
 		//now open the child
-		if dataChild, err = bdrv_open_child(dataFile, "raw", opts, flags); err != nil {
+		if dataChild, err = bdrv_open_child(qcow2State.ImageDataFile, bdrv_protocol(opts), opts, flags); err != nil {
 			return nil, err
 		} else {
 			bdrv_set_perm(dataChild, PERM_ALL)
-			dataChild.name = dataFile
+			dataChild.name = qcow2State.ImageDataFile
 			qcow2State.DataFile = dataChild
 		}
 	} else {
@@ -365,11 +444,18 @@ func qcow2_open(filename string, opts map[string]any, flags int) (*BlockDriverSt
 			return nil, fmt.Errorf("could not read L1 table")
 		}
 	}
+	//load the snapshot table, it is only used to protect the snapshot metadata
+	if header.NbSnapshots > 0 {
+		if qcow2State.Snapshots, qcow2State.SnapshotsSize, err = qcow2_read_snapshots(bs); err != nil {
+			return nil, fmt.Errorf("could not read snapshot table, err: %v", err)
+		}
+		qcow2State.SnapshotsOffset = header.SnapshotsOffset
+	}
 
 	//initiate the caches
 	if l2CacheSize > 0 {
-		l2CacheSize = round_up(l2CacheSize, DEFAULT_CLUSTER_SIZE)
-		l2CacehNum = uint32(l2CacheSize / DEFAULT_CLUSTER_SIZE)
+		l2CacheSize = round_up(l2CacheSize, uint64(qcow2State.ClusterSize))
+		l2CacehNum = uint32(l2CacheSize / uint64(qcow2State.ClusterSize))
 	} else {
 		l2CacehNum = qcow2State.L1Size
 	}
@@ -390,20 +476,25 @@ func initiate_qcow2_state(header *QCowHeader, enableSC bool) *BDRVQcow2State {
 		L1Size:               header.L1Size,
 		RefcountBlockBits:    header.ClusterBits - (header.RefcountOrder - 3),
 		RefcountBlockSize:    1 << (header.ClusterBits - (header.RefcountOrder - 3)),
+		RefcountOrder:        header.RefcountOrder,
+		RefcountMax:          uint64(1)<<(1<<header.RefcountOrder) - 1,
 		RefcountTableOffset:  header.RefcountTableOffset,
 		RefcountTableSize:    header.RefcountTableClusters << (header.ClusterBits - 3),
 		ClusterOffsetMask:    1<<(70-header.ClusterBits) - 1, //only 54 bits
+		CsizeShift:           70 - header.ClusterBits,
+		CsizeMask:            1<<(header.ClusterBits-8) - 1,
+		CompressionType:      header.CompressionType,
 		L1TableOffset:        header.L1TableOffset,
 		QcowVersion:          int(header.Version),
 		ClusterAllocs:        list.New(),
 		Discards:             list.New(),
-		get_refcount:         get_refcount,
-		set_refcount:         set_refcount,
-		AioTaskRoutine:       qcow2_aio_routine,
+		get_refcount:         get_refcount_funcs[header.RefcountOrder],
+		set_refcount:         set_refcount_funcs[header.RefcountOrder],
 		Lock:                 &sync.Mutex{},
 		AutoclearFeatures:    header.AutoclearFeatures,
 		IncompatibleFeatures: header.IncompatibleFeatures,
 		CompatibleFeatures:   header.CompatibleFeatures,
+		OverlapCheck:         QCOW2_OL_CACHED,
 	}
 	//subcluster related
 	if enableSC {
@@ -432,6 +523,24 @@ func initiate_qcow2_state(header *QCowHeader, enableSC bool) *BDRVQcow2State {
 	return s
 }
 
+// check the cluster size of a new image, the limits are the same as qemu's
+func qcow2_check_cluster_size(clusterSize uint64, extendedL2 bool) error {
+	if clusterSize < 1<<MIN_CLUSTER_BITS || clusterSize > 1<<MAX_CLUSTER_BITS || clusterSize&(clusterSize-1) != 0 {
+		return fmt.Errorf("cluster size must be a power of two between %d and %dk",
+			1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+	}
+	if extendedL2 && clusterSize < 1<<MIN_EXTL2_CLUSTER_BITS {
+		return fmt.Errorf("extended L2 entries are only supported with cluster sizes of at least %d bytes",
+			1<<MIN_EXTL2_CLUSTER_BITS)
+	}
+	return nil
+}
+
+// the backing file name is stored in the header cluster, behind the header extensions
+func qcow2_backing_file_offset(clusterSize uint64) uint64 {
+	return min(BACKING_FILE_OFFSET, clusterSize/2)
+}
+
 func check_header(header *QCowHeader) error {
 	//check header magic
 	if header.Magic != binary.BigEndian.Uint32(QCOW_MAGIC) {
@@ -442,12 +551,18 @@ func check_header(header *QCowHeader) error {
 		return fmt.Errorf("not support header version: %d", header.Version)
 	}
 	//check cluster bits
-	if header.ClusterBits != DEFAULT_CLUSTER_BITS {
-		return fmt.Errorf("not support cluster size of %d, only cluster size of 64 kib is supported", 1<<header.ClusterBits)
+	if header.ClusterBits < MIN_CLUSTER_BITS || header.ClusterBits > MAX_CLUSTER_BITS {
+		return fmt.Errorf("not support cluster size of 2^%d, the cluster size must be between %d and %dk",
+			header.ClusterBits, 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+	}
+	if header.IncompatibleFeatures&QCOW2_INCOMPAT_EXTL2 > 0 && header.ClusterBits < MIN_EXTL2_CLUSTER_BITS {
+		return fmt.Errorf("extended L2 entries are only supported with cluster sizes of at least %d bytes",
+			1<<MIN_EXTL2_CLUSTER_BITS)
 	}
 	//check refcountorder
-	if header.RefcountOrder != QCOW2_REFCOUNT_ORDER {
-		return fmt.Errorf("not support refcount order of %d, only refcount order of 4 is supported", header.RefcountOrder)
+	if header.RefcountOrder > QCOW2_MAX_REFCOUNT_ORDER {
+		return fmt.Errorf("not support refcount order of %d, the refcount order must be at most %d",
+			header.RefcountOrder, QCOW2_MAX_REFCOUNT_ORDER)
 	}
 	//check crypt method
 	if header.CryptMethod != QCOW2_CRYPT_METHOD {
@@ -457,21 +572,48 @@ func check_header(header *QCowHeader) error {
 	if header.HeaderLength > uint32(unsafe.Sizeof(QCowHeader{})) {
 		return fmt.Errorf("not support extended qcow2 header")
 	}
+	if header.Version == QCOW2_VERSION3 && header.HeaderLength < uint32(unsafe.Offsetof(header.CompressionType)) {
+		return fmt.Errorf("invalid qcow2 header length: %d", header.HeaderLength)
+	}
+	//check compression type, the other types than zlib need the incompatible feature bit
+	if header.CompressionType > QCOW2_COMPRESSION_TYPE_ZSTD {
+		return fmt.Errorf("not support compression type: %d", header.CompressionType)
+	}
+	if header.CompressionType != QCOW2_COMPRESSION_TYPE_ZLIB &&
+		header.IncompatibleFeatures&QCOW2_INCOMPAT_COMPRESSION == 0 {
+		return fmt.Errorf("compression type %d requires the compression incompatible feature",
+			header.CompressionType)
+	}
 	return nil
 }
 
-func qcow2_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
+func qcow2_preadv_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
+	s := bs.opaque.(*BDRVQcow2State)
+	return qcow2_do_preadv_part(ctx, bs, offset, bytes, qiov, qiovOffset, s.AioWorkers)
+}
+
+/*
+* read the range, the parts in several host ranges run in the workers. They are
+* read one after the other if workers is nil, which the reads running in a worker
+* need, since waiting there for tasks queued to the same workers may deadlock.
+ */
+func qcow2_do_preadv_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64, workers *AioWorkerPool) error {
+
 	s := bs.opaque.(*BDRVQcow2State)
 	var err error
 	var curBytes uint32 /* number of bytes in current iteration */
 	var hostOffset uint64
 	var sctype QCow2SubclusterType
-	var isAio bool
+	var aio *AioTaskPool
 
-	for bytes != 0 {
+	for bytes != 0 && aio_task_pool_status(aio) == nil {
 
+		if err = ctx.Err(); err != nil {
+			goto out
+		}
 		curBytes = uint32(bytes)
 		s.Qlock()
 		err = qcow2_get_host_offset(bs, offset, &curBytes,
@@ -486,27 +628,30 @@ func qcow2_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
 			(sctype == QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC && bs.backing == nil) {
 			qemu_iovec_memset(qiov, qiovOffset, 0, uint64(curBytes))
 		} else {
-			if !isAio && curBytes != uint32(bytes) {
-				isAio = true
+			if aio == nil && workers != nil && curBytes != uint32(bytes) {
+				aio = aio_task_pool_new(workers, workers.Workers())
 			}
-			if err = qcow2_add_task(bs, isAio, qcow2_preadv_task_entry, sctype,
+			if err = qcow2_add_task(ctx, bs, aio, qcow2_preadv_task_entry, sctype,
 				hostOffset, offset, uint64(curBytes),
 				qiov, qiovOffset, nil); err != nil {
 				goto out
 			}
-			/*if err = qcow2_preadv_task(bs, sctype, hostOffset, offset, bytes, qiov, qiovOffset); err != nil {
-				goto out
-			}*/
 		}
 		bytes -= uint64(curBytes)
 		offset += uint64(curBytes)
 		qiovOffset += uint64(curBytes)
 	}
 out:
+	if aio != nil {
+		aio_task_pool_wait_all(aio)
+		if err == nil {
+			err = aio_task_pool_status(aio)
+		}
+	}
 	return err
 }
 
-func qcow2_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
+func qcow2_pwritev_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	s := bs.opaque.(*BDRVQcow2State)
@@ -515,10 +660,19 @@ func qcow2_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 	var curBytes uint64 /* number of sectors in current iteration */
 	var hostOffset uint64
 	var l2meta *QCowL2Meta
-	var isAio bool
+	var aio *AioTaskPool
 
-	for bytes != 0 {
+	//a corrupt image refuses any further writes
+	if qcow2_corruption_signaled(s) {
+		return ERR_EIO
+	}
+
+	for bytes != 0 && aio_task_pool_status(aio) == nil {
 
+		/* stop before allocating, the former parts are written and linked already */
+		if err = ctx.Err(); err != nil {
+			goto fail_nometa
+		}
 		l2meta = nil
 		curBytes = bytes
 
@@ -530,12 +684,15 @@ func qcow2_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 		if err = qcow2_alloc_host_offset(bs, offset, &curBytes, &hostOffset, &l2meta); err != nil {
 			goto out_locked
 		}
+		if err = qcow2_pre_write_overlap_check(bs, 0, hostOffset, curBytes, true); err != nil {
+			goto out_locked
+		}
 		s.Qunlock()
 
-		if !isAio && curBytes != bytes {
-			isAio = true
+		if aio == nil && curBytes != bytes {
+			aio = aio_task_pool_new(s.AioWorkers, s.AioWorkers.Workers())
 		}
-		err = qcow2_add_task(bs, isAio, qcow2_pwritev_task_entry, 0, hostOffset, offset, curBytes, qiov, qiovOffset, l2meta)
+		err = qcow2_add_task(ctx, bs, aio, qcow2_pwritev_task_entry, 0, hostOffset, offset, curBytes, qiov, qiovOffset, l2meta)
 		l2meta = nil /* l2meta is consumed by qcow2_co_pwritev_task() */
 		if err != nil {
 			goto fail_nometa
@@ -553,14 +710,24 @@ out_locked:
 	qcow2_handle_l2meta(bs, &l2meta, false)
 	s.Qunlock()
 fail_nometa:
+	if aio != nil {
+		aio_task_pool_wait_all(aio)
+		if err == nil {
+			err = aio_task_pool_status(aio)
+		}
+	}
 	return err
 }
 
-func qcow2_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+func qcow2_pwrite_zeroes(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
 
 	var err error
 	s := bs.opaque.(*BDRVQcow2State)
 
+	if qcow2_corruption_signaled(s) {
+		return ERR_EIO
+	}
+
 	head := offset_into_subcluster(s, offset)
 	tail := round_up(offset+bytes, s.SubclusterSize) - (offset + bytes)
 	if offset+bytes == bs.TotalSectors*BDRV_SECTOR_SIZE {
@@ -583,6 +750,7 @@ func qcow2_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flag
 		/* We can have new write after previous check */
 		offset -= head
 		bytes = s.SubclusterSize
+		qcow2_wait_for_allocations(bs, offset, bytes)
 		nr = uint32(s.SubclusterSize)
 		err = qcow2_get_host_offset(bs, offset, &nr, &off, &sctype)
 		if err != nil ||
@@ -591,10 +759,15 @@ func qcow2_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flag
 				sctype != QCOW2_SUBCLUSTER_ZERO_PLAIN &&
 				sctype != QCOW2_SUBCLUSTER_ZERO_ALLOC) {
 			s.Qunlock()
-			return err
+			if err != nil {
+				return err
+			}
+			/* the subcluster was written meanwhile, fall back to writing the zeroes */
+			return ERR_ENOTSUP
 		}
 	} else {
 		s.Qlock()
+		qcow2_wait_for_allocations(bs, offset, bytes)
 	}
 
 	/* Whatever is left can use real zero subclusters */
@@ -620,6 +793,7 @@ func qcow2_handle_l2meta(bs *BlockDriverState, pl2meta **QCowL2Meta, linkL2 bool
 		}
 
 		s.ClusterAllocs.Remove(l2meta.NextInFlight)
+		close(l2meta.DependentRequests)
 		l2meta = l2meta.Next
 	}
 
@@ -628,20 +802,23 @@ out:
 	return err
 }
 
-func qcow2_preadv_task(bs *BlockDriverState, scType QCow2SubclusterType,
+func qcow2_preadv_task(ctx context.Context, bs *BlockDriverState, scType QCow2SubclusterType,
 	hostOffset uint64, offset uint64, bytes uint64, qiov *QEMUIOVector, qiovOffset uint64) error {
 
 	s := bs.opaque.(*BDRVQcow2State)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	switch scType {
 	case QCOW2_SUBCLUSTER_ZERO_PLAIN, QCOW2_SUBCLUSTER_ZERO_ALLOC:
 		/* Both zero types are handled in qcow2_co_preadv_part */
 		Assert(false)
 	case QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN, QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC:
-		return bdrv_preadv_part(bs.backing, offset, bytes, qiov, qiovOffset, 0)
+		return bdrv_preadv_part(ctx, bs.backing, offset, bytes, qiov, qiovOffset, 0)
 	case QCOW2_SUBCLUSTER_COMPRESSED:
-		//do nothing
+		return qcow2_preadv_compressed(ctx, bs, hostOffset, offset, bytes, qiov, qiovOffset)
 	case QCOW2_SUBCLUSTER_NORMAL:
-		return bdrv_preadv_part(s.DataFile, hostOffset,
+		return bdrv_preadv_part(ctx, s.DataFile, hostOffset,
 			bytes, qiov, qiovOffset, 0)
 	default:
 		Assert(false)
@@ -650,19 +827,24 @@ func qcow2_preadv_task(bs *BlockDriverState, scType QCow2SubclusterType,
 	return nil
 }
 
-func qcow2_pwritev_task(bs *BlockDriverState, hostOffset uint64, offset uint64,
+func qcow2_pwritev_task(ctx context.Context, bs *BlockDriverState, hostOffset uint64, offset uint64,
 	bytes uint64, qiov *QEMUIOVector, qiovOffset uint64, l2meta *QCowL2Meta) error {
 
 	var err error
 	s := bs.opaque.(*BDRVQcow2State)
 
+	/* a cancelled request releases the allocated clusters through qcow2_alloc_cluster_abort */
+	if err = ctx.Err(); err != nil {
+		goto out_unlocked
+	}
+
 	/* Try to efficiently initialize the physical space with zeroes */
-	if err = handle_alloc_space(bs, l2meta); err != nil {
+	if err = handle_alloc_space(ctx, bs, l2meta); err != nil {
 		goto out_unlocked
 	}
 
 	if !merge_cow(offset, bytes, qiov, qiovOffset, l2meta) {
-		if err = bdrv_pwritev_part(s.DataFile, hostOffset,
+		if err = bdrv_pwritev_part(ctx, s.DataFile, hostOffset,
 			bytes, qiov, qiovOffset, 0); err != nil {
 			goto out_unlocked
 		}
@@ -681,7 +863,7 @@ out_locked:
 	return err
 }
 
-func handle_alloc_space(bs *BlockDriverState, l2meta *QCowL2Meta) error {
+func handle_alloc_space(ctx context.Context, bs *BlockDriverState, l2meta *QCowL2Meta) error {
 
 	s := bs.opaque.(*BDRVQcow2State)
 	var m *QCowL2Meta
@@ -706,7 +888,13 @@ func handle_alloc_space(bs *BlockDriverState, l2meta *QCowL2Meta) error {
 			continue
 		}
 
-		if err = bdrv_pwrite_zeroes(s.DataFile, startOffset, nbBytes, BDRV_REQ_NO_FALLBACK); err != nil {
+		s.Qlock()
+		err = qcow2_pre_write_overlap_check(bs, 0, startOffset, nbBytes, true)
+		s.Qunlock()
+		if err != nil {
+			return err
+		}
+		if err = bdrv_pwrite_zeroes(ctx, s.DataFile, startOffset, nbBytes, BDRV_REQ_NO_FALLBACK); err != nil {
 			if err != ERR_ENOTSUP && err != ERR_EAGAIN {
 				return err
 			}
@@ -804,11 +992,179 @@ func qcow2_flush_to_os(bs *BlockDriverState) error {
 	return qcow2_write_caches(bs)
 }
 
+/*
+* Calculates the number of bytes of the refcount metadata (refcount table and
+* refcount blocks) needed to reference count the given number of clusters.
+*
+* Every host cluster is reference-counted, including metadata (even
+* refcount metadata is recursively included).
+*
+* An accurate formula for the size of refcount metadata size is difficult
+* to derive.  An easier method of calculation is finding the fixed point
+* where no further refcount blocks or table clusters are required to
+* reference count every cluster.
+*
+* If generousIncrease is true, the refcount table is made 50% bigger than
+* needed, which leaves room for growing the image.
+ */
 func qcow2_refcount_metadata_size(clusters uint64, clusterSize uint64, refcountOrder int,
 	generousIncrease bool, refblockCount *uint64) (uint64, error) {
-	//TODO2
-	//so far never reach here due to qcow2 file is limited to 4TiB
-	return 0, nil
+
+	blocksPerTableCluster := clusterSize / REFTABLE_ENTRY_SIZE
+	refcountsPerBlock := clusterSize * 8 / (1 << refcountOrder)
+	var table, blocks, last, n uint64 /* refcount table and refcount block clusters */
+
+	for {
+		last = n
+		blocks = div_round_up(clusters+table+blocks, refcountsPerBlock)
+		table = div_round_up(blocks, blocksPerTableCluster)
+		n = clusters + blocks + table
+
+		if n == last && generousIncrease {
+			clusters += div_round_up(table, 2)
+			n = 0 /* force another loop */
+			generousIncrease = false
+		}
+		if n == last {
+			break
+		}
+	}
+
+	if refblockCount != nil {
+		*refblockCount = blocks
+	}
+	return (blocks + table) * clusterSize, nil
+}
+
+/*
+* Calculates the size of a fully preallocated image of the given virtual size,
+* including the header, the L1 and L2 tables and the refcount metadata.
+ */
+func qcow2_calc_prealloc_size(totalSize uint64, clusterSize uint64, refcountOrder int,
+	extendedL2 bool) uint64 {
+
+	var metaSize, nl1e, nl2e uint64
+	alignedTotalSize := round_up(totalSize, clusterSize)
+	l2eSize := uint64(L2E_SIZE_NORMAL)
+	if extendedL2 {
+		l2eSize = L2E_SIZE_EXTENDED
+	}
+
+	/* header: 1 cluster */
+	metaSize += clusterSize
+
+	/* total size of L2 tables */
+	nl2e = alignedTotalSize / clusterSize
+	nl2e = round_up(nl2e, clusterSize/l2eSize)
+	metaSize += nl2e * l2eSize
+
+	/* total size of L1 tables */
+	nl1e = nl2e * l2eSize / clusterSize
+	nl1e = round_up(nl1e, clusterSize/L1E_SIZE)
+	metaSize += nl1e * L1E_SIZE
+
+	/* total size of refcount table and blocks */
+	refcountSize, _ := qcow2_refcount_metadata_size((metaSize+alignedTotalSize)/clusterSize,
+		clusterSize, refcountOrder, false, nil)
+	metaSize += refcountSize
+
+	return metaSize + alignedTotalSize
+}
+
+/*
+* Measures the host size needed by a new qcow2 image created with the options,
+* inBs is the source image if the new image is converted from it.
+ */
+func qcow2_measure(options map[string]any, inBs *BlockDriverState) (*BlockMeasureInfo, error) {
+
+	var extendedL2, hasBackingFile bool
+	var virtualSize, required uint64
+	var err error
+	clusterSize := uint64(DEFAULT_CLUSTER_SIZE)
+	prealloc := PREALLOC_MODE_OFF
+
+	/* Parse image creation options */
+	if val, ok := options[OPT_SUBCLUSTER]; ok {
+		extendedL2 = val.(bool)
+	}
+	if val, ok := options[OPT_CLUSTER_SIZE]; ok {
+		clusterSize = interface2uint64(val)
+	}
+	if val, ok := options[OPT_PREALLOC]; ok {
+		prealloc = val.(string)
+	}
+	if val, ok := options[OPT_BACKING]; ok {
+		hasBackingFile = val.(string) != ""
+	}
+	switch prealloc {
+	case PREALLOC_MODE_OFF, PREALLOC_MODE_METADATA, PREALLOC_MODE_FALLOC, PREALLOC_MODE_FULL:
+	default:
+		return nil, fmt.Errorf("invalid preallocation mode '%s'", prealloc)
+	}
+	if err = qcow2_check_cluster_size(clusterSize, extendedL2); err != nil {
+		return nil, err
+	}
+
+	if val, ok := options[OPT_SIZE]; ok {
+		virtualSize = round_up(interface2uint64(val), clusterSize)
+	}
+
+	/* Account for input image */
+	if inBs != nil {
+		var ssize, offset, pnum, ret uint64
+		if ssize, err = bdrv_getlength(inBs); err != nil {
+			return nil, err
+		}
+		virtualSize = round_up(ssize, clusterSize)
+
+		if hasBackingFile {
+			/* We don't how much of the backing chain is shared by the input
+			 * image and the new image file.  In the worst case the new image's
+			 * backing file has nothing in common with the input image.  Be
+			 * conservative and assume all clusters need to be written.
+			 */
+			required = virtualSize
+		} else {
+			for offset = 0; offset < ssize; offset += pnum {
+				if ret, err = bdrv_block_status_above(inBs, nil, offset, ssize-offset,
+					&pnum, nil, nil); err != nil {
+					return nil, fmt.Errorf("unable to get block status, err: %v", err)
+				}
+				if ret&BDRV_BLOCK_ZERO > 0 {
+					/* Skip zero regions (safe with no backing file) */
+				} else if ret&(BDRV_BLOCK_DATA|BDRV_BLOCK_ALLOCATED) ==
+					(BDRV_BLOCK_DATA | BDRV_BLOCK_ALLOCATED) {
+					/* Extend pnum to end of cluster for next iteration */
+					pnum = round_up(offset+pnum, clusterSize) - offset
+
+					/* Count clusters we've seen */
+					required += offset%clusterSize + pnum
+				}
+			}
+		}
+	}
+
+	if virtualSize > MAX_QCOW2_SIZE {
+		return nil, fmt.Errorf("the image size is too large, it is limited to %d bytes", uint64(MAX_QCOW2_SIZE))
+	}
+
+	/* Take into account preallocation.  Nothing special is needed for
+	 * PREALLOC_MODE_METADATA since metadata is always counted.
+	 */
+	if prealloc == PREALLOC_MODE_FULL || prealloc == PREALLOC_MODE_FALLOC {
+		required = virtualSize
+	}
+
+	info := &BlockMeasureInfo{}
+	info.FullyAllocated = qcow2_calc_prealloc_size(virtualSize, clusterSize,
+		QCOW2_REFCOUNT_ORDER, extendedL2)
+
+	/* Remove data clusters that are not required.  This overestimates the
+	 * required size because metadata needed for the fully allocated file is
+	 * still counted.
+	 */
+	info.Required = info.FullyAllocated - virtualSize + required
+	return info, nil
 }
 
 func qcow2_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
@@ -861,8 +1217,11 @@ func qcow2_copy_range_to(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	return fmt.Errorf("[qcow2_copy_range_to] no implementation")
 }
 
-func qcow2_pdiscard(bs *BlockDriverState, offset uint64, bytes uint64) error {
+func qcow2_pdiscard(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64) error {
 	s := bs.opaque.(*BDRVQcow2State)
+	if qcow2_corruption_signaled(s) {
+		return ERR_EIO
+	}
 	if !is_aligned(offset|bytes, uint64(s.ClusterSize)) {
 		Assert(bytes < uint64(s.ClusterSize))
 		if !is_aligned(offset, uint64(s.ClusterSize)) ||
@@ -872,6 +1231,7 @@ func qcow2_pdiscard(bs *BlockDriverState, offset uint64, bytes uint64) error {
 	}
 	s.Qlock()
 	defer s.Qunlock()
+	qcow2_wait_for_allocations(bs, offset, bytes)
 	return qcow2_cluster_discard(bs, offset, bytes, QCOW2_DISCARD_REQUEST, false)
 }
 
@@ -920,57 +1280,194 @@ func header_ext_add(bs *BlockDriverState, magic uint32, offset uint64, data stri
 	return totalSize + paddingLength, nil
 }
 
-func header_ext_read_external_data_file(bs *BlockDriverState, offset uint64) (string, error) {
-	return header_ext_read(bs, offset, QCOW2_EXT_MAGIC_DATA_FILE)
+// read all the header extensions between offset start and end
+func qcow2_read_extensions(bs *BlockDriverState, start uint64, end uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var extHeader QCowExtension
+	extLen := uint64(unsafe.Sizeof(extHeader))
+	offset := start
+
+	s.UnknownHeaderExts = nil
+	for offset+extLen <= end {
+		if _, err := Blk_Pread_Object(bs.current, offset, &extHeader, extLen); err != nil {
+			return fmt.Errorf("qcow2 header extension read fail, err: %v", err)
+		}
+		offset += extLen
+		if extHeader.Magic == 0 {
+			/* end of the extensions */
+			break
+		}
+		if uint64(extHeader.Length) > end-offset {
+			return fmt.Errorf("qcow2 header extension 0x%x exceeds the header cluster", extHeader.Magic)
+		}
+		data := make([]byte, extHeader.Length)
+		if extHeader.Length > 0 {
+			if _, err := Blk_Pread_Object(bs.current, offset, data, uint64(extHeader.Length)); err != nil {
+				return fmt.Errorf("qcow2 header extension read fail, err: %v", err)
+			}
+		}
+		switch extHeader.Magic {
+		case QCOW2_EXT_MAGIC_DATA_FILE:
+			s.ImageDataFile = string(data)
+		case QCOW2_EXT_MAGIC_BACKING_FMT:
+			s.ImageBackingFormat = string(data)
+		default:
+			/* unknown extensions are kept to be written back on header rewrites */
+			s.UnknownHeaderExts = append(s.UnknownHeaderExts, QCowUnknownExtension{
+				Magic: extHeader.Magic,
+				Data:  data,
+			})
+		}
+		offset += round_up(uint64(extHeader.Length), 8)
+	}
+	return nil
+}
+
+/*
+* rewrite the header, the header extensions and the backing file name
+* from the in-memory header in a single write
+ */
+func qcow2_update_header(bs *BlockDriverState) error {
+
+	var buffer bytes.Buffer
+	s := bs.opaque.(*BDRVQcow2State)
+	header := bs.current.header
+	if header == nil {
+		return Err_NullObject
+	}
+
+	addExt := func(magic uint32, data []byte) {
+		binary.Write(&buffer, binary.BigEndian, &QCowExtension{Magic: magic, Length: uint32(len(data))})
+		buffer.Write(data)
+		buffer.Write(make([]byte, round_up(uint64(len(data)), 8)-uint64(len(data))))
+	}
+
+	//the backing file name is moved to its fixed offset, wherever the image had it
+	backingFileOffset := qcow2_backing_file_offset(uint64(s.ClusterSize))
+	if bs.backingFile != "" {
+		header.BackingFileOffset = backingFileOffset
+		header.BackingFileSize = uint32(len(bs.backingFile))
+	}
+	binary.Write(&buffer, binary.BigEndian, header)
+	//the header is as long as its version requires, the extensions follow it
+	buffer.Truncate(int(header.HeaderLength))
+	if s.ImageDataFile != "" {
+		addExt(QCOW2_EXT_MAGIC_DATA_FILE, []byte(s.ImageDataFile))
+	}
+	if bs.backingFile != "" && s.ImageBackingFormat != "" {
+		addExt(QCOW2_EXT_MAGIC_BACKING_FMT, []byte(s.ImageBackingFormat))
+	}
+	for _, ext := range s.UnknownHeaderExts {
+		addExt(ext.Magic, ext.Data)
+	}
+	/* end of the extensions */
+	buffer.Write(make([]byte, unsafe.Sizeof(QCowExtension{})))
+
+	if uint64(buffer.Len()) > backingFileOffset {
+		return ERR_ENOSPC
+	}
+	if bs.backingFile != "" {
+		buffer.Write(make([]byte, backingFileOffset-uint64(buffer.Len())))
+		buffer.WriteString(bs.backingFile)
+	}
+	_, err := Blk_Pwrite(bs.current, 0, buffer.Bytes(), uint64(buffer.Len()), 0)
+	return err
 }
 
-func header_ext_read_backing_file_format(bs *BlockDriverState, offset uint64) (string, error) {
-	return header_ext_read(bs, offset, QCOW2_EXT_MAGIC_BACKING_FMT)
+// switch the refcount table in the image header, the adjacent refcount_table_offset
+// and refcount_table_clusters fields are written at once so the switch is atomic
+func qcow2_update_header_reftable(bs *BlockDriverState, tableOffset uint64, tableClusters uint32) error {
+
+	var buf [12]byte
+	header := bs.current.header
+	if header == nil {
+		return Err_NullObject
+	}
+
+	binary.BigEndian.PutUint64(buf[0:], tableOffset)
+	binary.BigEndian.PutUint32(buf[8:], tableClusters)
+	if err := bdrv_pwrite(bs.current, uint64(unsafe.Offsetof(header.RefcountTableOffset)),
+		unsafe.Pointer(&buf[0]), uint64(len(buf))); err != nil {
+		return err
+	}
+	if err := bdrv_flush(bs.current.bs); err != nil {
+		return err
+	}
+	header.RefcountTableOffset = tableOffset
+	header.RefcountTableClusters = tableClusters
+	return nil
+}
+
+// clear the fields which don't exist in a version 2 header
+func qcow2_set_v2_header(header *QCowHeader) {
+	header.Version = QCOW2_VERSION2
+	header.IncompatibleFeatures = 0
+	header.CompatibleFeatures = 0
+	header.AutoclearFeatures = 0
+	header.RefcountOrder = QCOW2_REFCOUNT_ORDER
+	header.HeaderLength = QCOW2_V2_HEADER_LENGTH
+	header.CompressionType = 0
 }
 
-func header_ext_read(bs *BlockDriverState, offset uint64, magic uint32) (string, error) {
+func qcow2_change_backing_file(bs *BlockDriverState, backingFile string, backingFmt string) error {
 
-	qcow2HeaderExtensionReadError := func(err error) error {
-		return fmt.Errorf("qcow2 header extension read fail, err: %v", err)
+	s := bs.opaque.(*BDRVQcow2State)
+	header := bs.current.header
+	if header == nil {
+		return Err_NullObject
+	}
+	if backingFile != "" && has_data_file(bs) && data_file_is_raw(bs) {
+		return ERR_EINVAL
+	}
+	if uint64(len(backingFile)) > uint64(s.ClusterSize)-qcow2_backing_file_offset(uint64(s.ClusterSize)) {
+		return ERR_EINVAL
 	}
 
-	var extHeader QCowExtension
-	extLen := uint64(unsafe.Sizeof(extHeader))
-	//read the ext header
-	if _, err := Blk_Pread_Object(bs.current, offset, &extHeader, extLen); err != nil {
-		return "", qcow2HeaderExtensionReadError(err)
-	}
-	if extHeader.Magic != magic || extHeader.Length == 0 {
-		return "", nil
-	}
-	//read the data file path
-	var data string
-	bytes := make([]byte, extHeader.Length)
-	if _, err := Blk_Pread_Object(bs.current, offset+extLen, bytes, uint64(extHeader.Length)); err != nil {
-		return "", qcow2HeaderExtensionReadError(err)
+	oldHeader := *header
+	oldBackingFile, oldBackingFmt := bs.backingFile, s.ImageBackingFormat
+	if backingFile != "" {
+		header.BackingFileOffset = qcow2_backing_file_offset(uint64(s.ClusterSize))
+		header.BackingFileSize = uint32(len(backingFile))
 	} else {
-		data = string(bytes)
+		header.BackingFileOffset = 0
+		header.BackingFileSize = 0
+		backingFmt = ""
+	}
+	bs.backingFile = backingFile
+	s.ImageBackingFormat = backingFmt
+
+	if err := qcow2_update_header(bs); err != nil {
+		*header = oldHeader
+		bs.backingFile = oldBackingFile
+		s.ImageBackingFormat = oldBackingFmt
+		return err
 	}
-	return data, nil
+	return nil
 }
 
 func qcow2_pwritev_task_entry(task *Qcow2Task) error {
 	Assert(task.subclusterType == 0)
-	return qcow2_pwritev_task(task.bs, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset, task.l2meta)
+	return qcow2_pwritev_task(task.ctx, task.bs, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset, task.l2meta)
 }
 
 func qcow2_preadv_task_entry(task *Qcow2Task) error {
 	Assert(task.l2meta == nil)
-	return qcow2_preadv_task(task.bs, task.subclusterType, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset)
+	return qcow2_preadv_task(task.ctx, task.bs, task.subclusterType, task.hostOffset, task.offset, task.bytes, task.qiov, task.qiovOffset)
 }
 
-func qcow2_add_task(bs *BlockDriverState, isAio bool, taskfunc AioTaskFunc, subclusterType QCow2SubclusterType,
+/*
+* run the task right away if aio is nil, otherwise start it in the image's workers and
+* return, its error is reported by the status of aio. The task carries the request's context,
+* which the task functions check before doing the I/O, the caller always waits for all the
+* tasks of aio since they still use the caller's qiov.
+ */
+func qcow2_add_task(ctx context.Context, bs *BlockDriverState, aio *AioTaskPool, taskfunc AioTaskFunc, subclusterType QCow2SubclusterType,
 	hostOffset uint64, offset uint64, bytes uint64, qiov *QEMUIOVector, qiovOffset uint64,
 	l2meta *QCowL2Meta) error {
 
-	var err error
-	s := bs.opaque.(*BDRVQcow2State)
 	task := &Qcow2Task{
+		ctx:            ctx,
 		taskFunc:       taskfunc,
 		bs:             bs,
 		subclusterType: subclusterType,
@@ -980,27 +1477,11 @@ func qcow2_add_task(bs *BlockDriverState, isAio bool, taskfunc AioTaskFunc, subc
 		bytes:          bytes,
 		qiovOffset:     qiovOffset,
 		l2meta:         l2meta,
-		completeCh:     make(chan any, 1),
-		errorCh:        make(chan error, 1),
 	}
 
-	if !isAio {
+	if aio == nil {
 		return taskfunc(task)
 	}
-
-	if s.AioTaskList == nil {
-		s.Qlock()
-		if s.AioTaskList == nil {
-			s.AioTaskList = NewSignalList()
-			go s.AioTaskRoutine(context.Background(), s.AioTaskList)
-		}
-		s.Qunlock()
-	}
-
-	s.AioTaskList.Push(task)
-	select {
-	case <-task.completeCh:
-	case err = <-task.errorCh:
-	}
-	return err
+	aio_task_pool_start_task(aio, task)
+	return nil
 }
@@ -0,0 +1,252 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+* amend the options of the image, so far the compat level can be changed
+* between 0.10 (version 2) and 1.1 (version 3), and the refcount width can be
+* changed for version 3 images.
+ */
+func qcow2_amend_options(bs *BlockDriverState, options map[string]any, progress ProgressFunc) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	newVersion := s.QcowVersion
+	newRefcountOrder := s.RefcountOrder
+	var err error
+
+	for key, val := range options {
+		switch key {
+		case OPT_FMT, OPT_FILENAME:
+			/* not an image option */
+		case OPT_COMPAT:
+			switch val.(string) {
+			case COMPAT_V2:
+				newVersion = QCOW2_VERSION2
+			case COMPAT_V3:
+				newVersion = QCOW2_VERSION3
+			default:
+				return fmt.Errorf("unknown compatibility level %s", val.(string))
+			}
+		case OPT_REFCOUNT_BITS:
+			refcountBits := interface2uint64(val)
+			if refcountBits == 0 || refcountBits > 64 || refcountBits&(refcountBits-1) != 0 {
+				return fmt.Errorf("refcount width must be a power of two and may not exceed 64 bits")
+			}
+			newRefcountOrder = uint32(ctz32(uint32(refcountBits)))
+		default:
+			return fmt.Errorf("changing option %s is not supported", key)
+		}
+	}
+
+	if newVersion < QCOW2_VERSION3 && newRefcountOrder != 4 {
+		return fmt.Errorf("different refcount widths than 16 bits require compatibility level 1.1 or above")
+	}
+
+	s.Qlock()
+	defer s.Qunlock()
+	if s.SignaledCorruption {
+		return ERR_EIO
+	}
+	/* upgrade first, so the refcount width can be changed */
+	if newVersion > s.QcowVersion {
+		if err = qcow2_upgrade(bs, newVersion); err != nil {
+			return err
+		}
+	}
+	if newRefcountOrder != s.RefcountOrder {
+		if err = qcow2_change_refcount_order(bs, newRefcountOrder, progress); err != nil {
+			return err
+		}
+	}
+	/* downgrade last, after the refcount width has become 16 bits */
+	if newVersion < s.QcowVersion {
+		return qcow2_downgrade(bs, newVersion, progress)
+	}
+	return nil
+}
+
+/*
+* upgrade a version 2 image to version 3, the version 3 header is a superset
+* of the version 2 one, so rewriting the header is all it takes.
+ */
+func qcow2_upgrade(bs *BlockDriverState, targetVersion int) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	header := bs.current.header
+	oldHeader := *header
+
+	Assert(targetVersion > s.QcowVersion)
+	header.Version = uint32(targetVersion)
+	header.HeaderLength = uint32(unsafe.Sizeof(QCowHeader{}))
+	if err := qcow2_update_header(bs); err != nil {
+		*header = oldHeader
+		return err
+	}
+	s.QcowVersion = targetVersion
+	return bdrv_flush(bs.current.bs)
+}
+
+/*
+* downgrade a version 3 image to version 2, the zero clusters are expanded
+* into real zeroed clusters since version 2 has no zero flag, and the version
+* 3 only features and header extensions are dropped.
+ */
+func qcow2_downgrade(bs *BlockDriverState, targetVersion int, progress ProgressFunc) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	header := bs.current.header
+	var err error
+
+	Assert(targetVersion < s.QcowVersion)
+	if targetVersion != QCOW2_VERSION2 {
+		return fmt.Errorf("cannot downgrade to version %d", targetVersion)
+	}
+	if s.RefcountOrder != 4 {
+		return fmt.Errorf("only images with refcount_bits=16 can be downgraded")
+	}
+	if has_data_file(bs) {
+		return fmt.Errorf("cannot downgrade an image with a data file")
+	}
+	if has_subclusters(s) {
+		return fmt.Errorf("cannot downgrade an image with extended L2 entries")
+	}
+	if header.IncompatibleFeatures != 0 {
+		return fmt.Errorf("cannot downgrade an image with incompatible features 0x%x set",
+			header.IncompatibleFeatures)
+	}
+	if header.NbSnapshots > 0 {
+		return fmt.Errorf("cannot downgrade an image with internal snapshots")
+	}
+
+	if err = qcow2_expand_zero_clusters(bs, progress); err != nil {
+		return fmt.Errorf("failed to turn zero into data clusters, err: %v", err)
+	}
+
+	oldHeader := *header
+	oldExts := s.UnknownHeaderExts
+	qcow2_set_v2_header(header)
+	s.UnknownHeaderExts = nil
+	for _, ext := range oldExts {
+		if ext.Magic != QCOW2_EXT_MAGIC_FEATURE_TABLE && ext.Magic != QCOW2_EXT_MAGIC_BITMAPS {
+			s.UnknownHeaderExts = append(s.UnknownHeaderExts, ext)
+		}
+	}
+	if err = qcow2_update_header(bs); err != nil {
+		*header = oldHeader
+		s.UnknownHeaderExts = oldExts
+		return err
+	}
+	s.QcowVersion = targetVersion
+	s.IncompatibleFeatures = 0
+	s.CompatibleFeatures = 0
+	s.AutoclearFeatures = 0
+	return bdrv_flush(bs.current.bs)
+}
+
+/*
+* turn the zero clusters of the active L2 tables into clusters which are
+* explicitly filled with zeroes. a zero cluster without host cluster becomes
+* unallocated if there is no backing file, since it reads as zeroes anyway.
+ */
+func qcow2_expand_zero_clusters(bs *BlockDriverState, progress ProgressFunc) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var i, j, l2Index uint32
+	var err error
+	zeroes := make([]byte, s.ClusterSize)
+	slicesPerTable := s.L2Size / uint32(s.L2SliceSize)
+
+	for i = 0; i < s.L1Size; i++ {
+		l2Offset := s.L1Table[i] & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		for j = 0; j < slicesPerTable; j++ {
+			if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache,
+				l2Offset+uint64(j)*uint64(s.L2SliceSize)*l2_entry_size(s)); err != nil {
+				return err
+			}
+			for l2Index = 0; l2Index < uint32(s.L2SliceSize); l2Index++ {
+				if err = expand_zero_l2_entry(bs, l2Slice, l2Index, zeroes); err != nil {
+					qcow2_cache_put(s.L2TableCache, l2Slice)
+					return err
+				}
+			}
+			qcow2_cache_put(s.L2TableCache, l2Slice)
+		}
+		if progress != nil {
+			progress(uint64(i+1), uint64(s.L1Size))
+		}
+	}
+	return qcow2_flush_caches(bs)
+}
+
+func expand_zero_l2_entry(bs *BlockDriverState, l2Slice unsafe.Pointer, l2Index uint32,
+	zeroes []byte) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refcount uint64
+	var err error
+	l2Entry := get_l2_entry(s, l2Slice, l2Index)
+	offset := l2Entry & L2E_OFFSET_MASK
+
+	switch qcow2_get_cluster_type(bs, l2Entry) {
+	case QCOW2_CLUSTER_ZERO_PLAIN:
+		if bs.backing == nil {
+			/* unallocated clusters read as zeroes as well */
+			qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+			set_l2_entry(s, l2Slice, l2Index, 0)
+			return nil
+		}
+		if offset, err = qcow2_alloc_clusters(bs, uint64(s.ClusterSize)); err != nil {
+			return err
+		}
+		/* the new cluster must be referenced before the L2 entry points to it */
+		qcow2_cache_set_dependency(bs, s.L2TableCache, s.RefcountBlockCache)
+		refcount = 1
+	case QCOW2_CLUSTER_ZERO_ALLOC:
+		if refcount, err = qcow2_get_refcount(bs, offset>>s.ClusterBits); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if err = qcow2_pre_write_overlap_check(bs, 0, offset, uint64(s.ClusterSize), true); err != nil {
+		return err
+	}
+	if err = bdrv_pwrite(s.DataFile, offset, unsafe.Pointer(&zeroes[0]), uint64(s.ClusterSize)); err != nil {
+		return err
+	}
+
+	l2Entry = offset
+	if refcount == 1 {
+		l2Entry |= QCOW_OFLAG_COPIED
+	}
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	set_l2_entry(s, l2Slice, l2Index, l2Entry)
+	return nil
+}
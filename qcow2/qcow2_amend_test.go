@@ -0,0 +1,204 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_amend_compat(t *testing.T) {
+	var filename = "/tmp/amend.qcow2"
+	buf := bytes.Repeat([]byte{0x5a}, 65536)
+	readBuf := make([]byte, 65536)
+
+	root := create_compare_image(t, filename, "")
+	_, err := Blk_Pwrite(root, 0, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	//a zero cluster without host cluster
+	_, err = Blk_Pwrite_Zeroes(root, 1048576, 65536, 0)
+	assert.Nil(t, err)
+	//a zero cluster with a host cluster
+	_, err = Blk_Pwrite(root, 2*1048576, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, 2*1048576, 65536, 0)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_SIZE: 1 << 30}, nil))
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_COMPAT: "0.9"}, nil))
+
+	err = Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil)
+	assert.Nil(t, err)
+	//zeroes are written as data in version 2
+	_, err = Blk_Pwrite_Zeroes(root, 0, 512, 0)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION2), root.bs.current.header.Version)
+	assert.Equal(t, uint32(QCOW2_V2_HEADER_LENGTH), root.bs.current.header.HeaderLength)
+	assert.Contains(t, Blk_Info(root, false, false), `"compat":"0.10"`)
+
+	_, err = Blk_Pread(root, 0, readBuf, 65536)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 512), readBuf[:512])
+	assert.Equal(t, buf[512:], readBuf[512:])
+	for _, offset := range []uint64{1048576, 2 * 1048576} {
+		_, err = Blk_Pread(root, offset, readBuf, 65536)
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 65536), readBuf)
+	}
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+
+	err = Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V3}, nil)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	defer Blk_Close(root)
+	assert.Equal(t, uint32(QCOW2_VERSION3), root.bs.current.header.Version)
+	assert.Contains(t, Blk_Info(root, false, false), `"compat":"1.1"`)
+	_, err = Blk_Pread(root, 0, readBuf, 65536)
+	assert.Nil(t, err)
+	assert.Equal(t, buf[512:], readBuf[512:])
+	assert.Equal(t, Err_NoWritePerm, Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil))
+}
+
+func Test_amend_downgrade_backing(t *testing.T) {
+	var baseFile = "/tmp/amend_base.qcow2"
+	var filename = "/tmp/amend_overlay.qcow2"
+	buf := bytes.Repeat([]byte{0x5a}, 65536)
+	readBuf := make([]byte, 65536)
+
+	base := create_compare_image(t, baseFile, "")
+	_, err := Blk_Pwrite(base, 0, buf, uint64(len(buf)), 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	//the zeroes hide the data of the backing file
+	root := create_compare_image(t, filename, baseFile)
+	_, err = Blk_Pwrite_Zeroes(root, 0, 65536, 0)
+	assert.Nil(t, err)
+	err = Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	defer Blk_Close(root)
+	_, err = Blk_Pread(root, 0, readBuf, 65536)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 65536), readBuf)
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+}
+
+func Test_amend_downgrade_extensions(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), "amend_exts.qcow2")
+	featureTable := QCowUnknownExtension{Magic: QCOW2_EXT_MAGIC_FEATURE_TABLE, Data: make([]byte, 48)}
+	bitmaps := QCowUnknownExtension{Magic: QCOW2_EXT_MAGIC_BITMAPS, Data: make([]byte, 24)}
+	unknown := QCowUnknownExtension{Magic: 0x12345678, Data: []byte("an unknown extension")}
+
+	//the extensions of an image created by qemu
+	root := create_compare_image(t, filename, "")
+	s := root.bs.opaque.(*BDRVQcow2State)
+	s.UnknownHeaderExts = []QCowUnknownExtension{featureTable, bitmaps, unknown}
+	assert.Nil(t, qcow2_update_header(root.bs))
+	Blk_Close(root)
+
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, []QCowUnknownExtension{featureTable, bitmaps, unknown}, s.UnknownHeaderExts)
+
+	//the extensions are kept if the header can't be rewritten
+	large := QCowUnknownExtension{Magic: 0x12345679, Data: make([]byte, BACKING_FILE_OFFSET)}
+	s.UnknownHeaderExts = append(s.UnknownHeaderExts, large)
+	assert.Equal(t, ERR_ENOSPC, Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil))
+	assert.Equal(t, []QCowUnknownExtension{featureTable, bitmaps, unknown, large}, s.UnknownHeaderExts)
+	assert.Equal(t, uint32(QCOW2_VERSION3), root.bs.current.header.Version)
+
+	s.UnknownHeaderExts = s.UnknownHeaderExts[:3]
+	assert.Nil(t, Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil))
+	Blk_Close(root)
+
+	//only the version 3 ones are dropped
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	defer Blk_Close(root)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, uint32(QCOW2_VERSION2), root.bs.current.header.Version)
+	assert.Equal(t, []QCowUnknownExtension{unknown}, s.UnknownHeaderExts)
+}
+
+func Test_amend_downgrade_unsupported(t *testing.T) {
+	var filename = "/tmp/amend_extl2.qcow2"
+	root := prepare_check_image(t, filename, true)
+	defer Blk_Close(root)
+	err := Blk_Amend(root, map[string]any{OPT_COMPAT: COMPAT_V2}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(QCOW2_VERSION3), root.bs.current.header.Version)
+}
+
+func Test_amend_refcount_bits(t *testing.T) {
+	var filename = "/tmp/amend_refcount.qcow2"
+	buf := bytes.Repeat([]byte{0x5a}, 65536)
+	readBuf := make([]byte, 65536)
+
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{
+		OPT_SIZE:     4 * 1 << 30,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	for _, offset := range []uint64{0, 1048576, 1 << 30} {
+		_, err := Blk_Pwrite(root, offset, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}
+
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: 12}, nil))
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: 128}, nil))
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: 8, OPT_COMPAT: COMPAT_V2}, nil))
+
+	for _, bits := range []int{64, 1, 8} {
+		err := Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: bits}, nil)
+		assert.Nil(t, err)
+		//allocate a new cluster with the new refcount width
+		_, err = Blk_Pwrite(root, uint64(bits)*2*1048576, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+		Blk_Close(root)
+
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(ctz32(uint32(bits))), root.bs.current.header.RefcountOrder)
+		for _, offset := range []uint64{0, 1048576, 1 << 30, uint64(bits) * 2 * 1048576} {
+			_, err = Blk_Pread(root, offset, readBuf, 65536)
+			assert.Nil(t, err)
+			assert.Equal(t, buf, readBuf)
+		}
+		res, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, res.Corruptions)
+		assert.Equal(t, 0, res.Leaks)
+	}
+
+	//a refcount of 2 doesn't fit into 1 bit
+	err = update_refcount(root.bs, 0, 65536, 1, false, QCOW2_DISCARD_NEVER)
+	assert.Nil(t, err)
+	assert.NotNil(t, Blk_Amend(root, map[string]any{OPT_REFCOUNT_BITS: 1}, nil))
+	refcount, err := qcow2_get_refcount(root.bs, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), refcount)
+	Blk_Close(root)
+}
@@ -105,7 +105,7 @@ func qcow2_cache_create(bs *BlockDriverState, numTables uint32, tableSize uint32
 	if bs != nil {
 		s := bs.opaque.(*BDRVQcow2State)
 		Assert(numTables > 0)
-		Assert(tableSize >= (1 << DEFAULT_CLUSTER_BITS))
+		Assert(tableSize >= (1 << MIN_CLUSTER_BITS))
 		Assert(tableSize <= s.ClusterSize)
 	}
 
@@ -155,6 +155,21 @@ func qcow2_cache_entry_flush(bs *BlockDriverState, c *Qcow2Cache, i int) error {
 		return err
 	}
 
+	s := bs.opaque.(*BDRVQcow2State)
+	if c == s.RefcountBlockCache {
+		err = qcow2_pre_write_overlap_check(bs, QCOW2_OL_REFCOUNT_BLOCK,
+			uint64(c.entries[i].offset), uint64(c.tableSize), false)
+	} else if c == s.L2TableCache {
+		err = qcow2_pre_write_overlap_check(bs, QCOW2_OL_ACTIVE_L2,
+			uint64(c.entries[i].offset), uint64(c.tableSize), false)
+	} else {
+		err = qcow2_pre_write_overlap_check(bs, 0,
+			uint64(c.entries[i].offset), uint64(c.tableSize), false)
+	}
+	if err != nil {
+		return err
+	}
+
 	if err = bdrv_pwrite(bs.current, uint64(c.entries[i].offset),
 		qcow2_cache_get_table_addr(c, i), uint64(c.tableSize)); err != nil {
 		return err
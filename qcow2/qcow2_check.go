@@ -0,0 +1,976 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"unsafe"
+)
+
+const (
+	CHECK_FRAG_INFO = 0x2 /* update BlockFragInfo counters */
+)
+
+func qcow2_check(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+
+	if fix != 0 && bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return Err_NoWritePerm
+	}
+
+	s.Qlock()
+	defer s.Qunlock()
+
+	/* the on-disk metadata must be up to date before it is walked */
+	if err = qcow2_write_caches(bs); err != nil {
+		return err
+	}
+	if err = qcow2_check_refcounts(bs, res, fix); err != nil {
+		return err
+	}
+
+	/* the image is consistent again once everything has been repaired */
+	if fix != 0 && res.CheckErrors == 0 && res.Corruptions == 0 {
+		if err = qcow2_mark_consistent(bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Checks an image for refcount consistency.
+*
+* Returns nil if no errors are found, the number of errors in res
+ */
+func qcow2_check_refcounts(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var size, nbClusters, highestCluster uint64
+	var refcountTable []uint64
+	var preCompareRes BlockCheckResult
+	var rebuild bool
+	var err error
+
+	if size, err = bdrv_getlength(bs.current.bs); err != nil {
+		res.CheckErrors++
+		return err
+	}
+	nbClusters = size_to_clusters(s, size)
+	res.TotalClusters = size_to_clusters(s, bs.TotalSectors*BDRV_SECTOR_SIZE)
+
+	if refcountTable, err = calculate_refcounts(bs, res, fix, &rebuild, nbClusters); err != nil {
+		return err
+	}
+	if fix&BDRV_FIX_REBUILD > 0 {
+		rebuild = true
+	}
+
+	/* In case we don't need to rebuild the refcount structure (but want to fix
+	 * something), this function is immediately called again, in which case the
+	 * result should be ignored */
+	preCompareRes = *res
+	compare_refcounts(bs, res, 0, &rebuild, &highestCluster, refcountTable, nbClusters)
+
+	if rebuild && fix&BDRV_FIX_ERRORS > 0 {
+		oldRes := *res
+		freshLeaks := 0
+
+		res.report("Rebuilding refcount structure")
+		if err = rebuild_refcount_structure(bs, res, &refcountTable); err != nil {
+			return err
+		}
+
+		/* Because the old reftable has been exchanged for a new one the
+		 * references have to be recalculated */
+		rebuild = false
+		if size, err = bdrv_getlength(bs.current.bs); err != nil {
+			res.CheckErrors++
+			return err
+		}
+		nbClusters = size_to_clusters(s, size)
+		recalcRes := &BlockCheckResult{}
+		if refcountTable, err = calculate_refcounts(bs, recalcRes, 0, &rebuild, nbClusters); err != nil {
+			return err
+		}
+		res.Corruptions = recalcRes.Corruptions
+		res.Leaks = recalcRes.Leaks
+		res.CheckErrors += recalcRes.CheckErrors
+
+		if fix&BDRV_FIX_LEAKS > 0 {
+			/* The old refcount structures are now leaked, fix it; the result
+			 * can be ignored, aside from leaks which were introduced by
+			 * rebuild_refcount_structure() that could not be fixed */
+			leakRes := &BlockCheckResult{Messages: res.Messages}
+			highestCluster = 0
+			compare_refcounts(bs, leakRes, BDRV_FIX_LEAKS, &rebuild, &highestCluster,
+				refcountTable, nbClusters)
+			if rebuild {
+				leakRes.report("ERROR rebuilt refcount structure is still broken")
+			}
+			/* Any leaks accounted for here were introduced by
+			 * rebuild_refcount_structure() because that function has created a
+			 * new refcount structure from scratch */
+			freshLeaks = leakRes.Leaks
+			res.Messages = leakRes.Messages
+		}
+
+		if res.Corruptions < oldRes.Corruptions {
+			res.CorruptionsFixed += oldRes.Corruptions - res.Corruptions
+		}
+		if res.Leaks < oldRes.Leaks {
+			res.LeaksFixed += oldRes.Leaks - res.Leaks
+		}
+		res.Leaks += freshLeaks
+	} else if fix != 0 {
+		if rebuild {
+			res.report("ERROR need to rebuild refcount structures")
+			res.CheckErrors++
+			return ERR_EIO
+		}
+
+		if res.Leaks > 0 || res.Corruptions > 0 {
+			*res = preCompareRes
+			compare_refcounts(bs, res, fix, &rebuild, &highestCluster, refcountTable, nbClusters)
+		}
+	} else if rebuild {
+		res.report("ERROR need to rebuild refcount structures")
+	}
+
+	/* check OFLAG_COPIED */
+	if err = check_oflag_copied(bs, res, fix); err != nil {
+		return err
+	}
+
+	res.ImageEndOffset = (highestCluster + 1) * uint64(s.ClusterSize)
+	return nil
+}
+
+/*
+* Calculates an in-memory refcount table by walking the header, the L1 and L2
+* tables, the snapshots and the refcount structures
+ */
+func calculate_refcounts(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode,
+	rebuild *bool, nbClusters uint64) ([]uint64, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refcountTable []uint64
+	var snapshots []QCowSnapshot
+	var snapshotsSize uint64
+	var err error
+
+	/* header */
+	qcow2_inc_refcounts_imrt(bs, res, &refcountTable, nbClusters, 0, uint64(s.ClusterSize))
+
+	/* current L1 table */
+	if err = check_refcounts_l1(bs, res, &refcountTable, nbClusters, s.L1TableOffset,
+		s.L1Size, CHECK_FRAG_INFO, fix, true); err != nil {
+		return nil, err
+	}
+
+	/* snapshots */
+	if snapshots, snapshotsSize, err = qcow2_read_snapshots(bs); err != nil {
+		res.CheckErrors++
+		return nil, err
+	}
+	for i, sn := range snapshots {
+		/* the snapshot table comes from the file, don't trust its L1 size */
+		if uint64(sn.L1Size) > QCOW_MAX_L1_SIZE/L1E_SIZE {
+			res.report("ERROR snapshot %d l1_size=0x%x: L1 table is too large; snapshot table entry corrupted",
+				i, sn.L1Size)
+			res.Corruptions++
+			continue
+		}
+		if sn.L1TableOffset > nbClusters<<s.ClusterBits ||
+			uint64(sn.L1Size)*L1E_SIZE > nbClusters<<s.ClusterBits-sn.L1TableOffset {
+			res.report("ERROR snapshot %d l1_offset=0x%x: L1 table is beyond the end of the image; snapshot table entry corrupted",
+				i, sn.L1TableOffset)
+			res.Corruptions++
+			continue
+		}
+		if err = check_refcounts_l1(bs, res, &refcountTable, nbClusters, sn.L1TableOffset,
+			sn.L1Size, 0, fix, false); err != nil {
+			return nil, err
+		}
+	}
+	qcow2_inc_refcounts_imrt(bs, res, &refcountTable, nbClusters,
+		bs.current.header.SnapshotsOffset, snapshotsSize)
+
+	/* refcount data */
+	qcow2_inc_refcounts_imrt(bs, res, &refcountTable, nbClusters,
+		s.RefcountTableOffset, uint64(s.RefcountTableSize)*REFTABLE_ENTRY_SIZE)
+
+	check_refblocks(bs, res, rebuild, &refcountTable, nbClusters)
+
+	return refcountTable, nil
+}
+
+/*
+* Increases the refcount for a range of clusters in a given refcount table.
+ */
+func qcow2_inc_refcounts_imrt(bs *BlockDriverState, res *BlockCheckResult, refcountTable *[]uint64,
+	nbClusters uint64, offset uint64, size uint64) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var start, last, clusterOffset, k uint64
+
+	if size == 0 {
+		return
+	}
+
+	start = start_of_cluster(s, offset)
+	last = start_of_cluster(s, offset+size-1)
+	for clusterOffset = start; clusterOffset <= last; clusterOffset += uint64(s.ClusterSize) {
+		k = clusterOffset >> s.ClusterBits
+		if k >= nbClusters {
+			res.report("ERROR cluster %d is out of bounds of the image file", k)
+			res.Corruptions++
+		}
+		if k >= uint64(len(*refcountTable)) {
+			newSize := round_up(k+1, uint64(s.RefcountBlockSize))
+			*refcountTable = append(*refcountTable, make([]uint64, newSize-uint64(len(*refcountTable)))...)
+		}
+		if (*refcountTable)[k] == s.RefcountMax {
+			res.report("ERROR: overflow cluster offset=0x%x", clusterOffset)
+			res.Corruptions++
+			continue
+		}
+		(*refcountTable)[k]++
+	}
+}
+
+/*
+* Increases the refcount in the given refcount table for the all clusters
+* referenced in the L1 table and the L2 tables it points to.
+ */
+func check_refcounts_l1(bs *BlockDriverState, res *BlockCheckResult, refcountTable *[]uint64,
+	nbClusters uint64, l1TableOffset uint64, l1Size uint32, flags int, fix BdrvCheckMode, active bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l1Table []uint64
+	var l2Offset uint64
+	var err error
+
+	l1Size2 := uint64(l1Size) * L1E_SIZE
+
+	/* Mark L1 table as used */
+	qcow2_inc_refcounts_imrt(bs, res, refcountTable, nbClusters, l1TableOffset, l1Size2)
+
+	if l1Size == 0 {
+		return nil
+	}
+	if offset_into_cluster(s, l1TableOffset) > 0 ||
+		l1TableOffset>>s.ClusterBits >= nbClusters {
+		res.report("ERROR l1_offset=0x%x: L1 table is misplaced", l1TableOffset)
+		res.Corruptions++
+		return nil
+	}
+
+	/* Read L1 table entries from disk */
+	l1Table = make([]uint64, l1Size)
+	if err = bdrv_pread(bs.current, l1TableOffset, unsafe.Pointer(&l1Table[0]), l1Size2); err != nil {
+		res.report("ERROR: I/O error in check_refcounts_l1")
+		res.CheckErrors++
+		return err
+	}
+
+	/* Do the actual checks */
+	for i := uint32(0); i < l1Size; i++ {
+		l1Entry := be64_to_cpu(l1Table[i])
+
+		if l1Entry&L1E_RESERVED_MASK > 0 {
+			res.report("ERROR found L1 entry with reserved bits set: 0x%x", l1Entry)
+			res.Corruptions++
+		}
+
+		l2Offset = l1Entry & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+
+		/* Mark L2 table as used */
+		qcow2_inc_refcounts_imrt(bs, res, refcountTable, nbClusters, l2Offset, uint64(s.ClusterSize))
+
+		/* L2 tables are cluster aligned */
+		if offset_into_cluster(s, l2Offset) > 0 {
+			res.report("ERROR l2_offset=0x%x: Table is not cluster aligned; L1 entry corrupted", l2Offset)
+			res.Corruptions++
+			continue
+		}
+		if l2Offset>>s.ClusterBits >= nbClusters {
+			/* already reported as out of bounds */
+			continue
+		}
+
+		/* Process and check L2 entries */
+		if err = check_refcounts_l2(bs, res, refcountTable, nbClusters, l2Offset, flags, fix, active); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Increases the refcount in the given refcount table for the all clusters
+* referenced in the L2 table.
+ */
+func check_refcounts_l2(bs *BlockDriverState, res *BlockCheckResult, refcountTable *[]uint64,
+	nbClusters uint64, l2Offset uint64, flags int, fix BdrvCheckMode, active bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Entry, l2Bitmap, nextContiguousOffset uint64
+	var err error
+
+	/* Read L2 table from disk */
+	l2Table := make([]byte, s.ClusterSize)
+	if err = bdrv_pread(bs.current, l2Offset, unsafe.Pointer(&l2Table[0]), uint64(s.ClusterSize)); err != nil {
+		res.report("ERROR: I/O error in check_refcounts_l2")
+		res.CheckErrors++
+		return err
+	}
+	l2 := unsafe.Pointer(&l2Table[0])
+
+	/* Do the actual checks */
+	for i := uint32(0); i < s.L2Size; i++ {
+		l2Entry = get_l2_entry(s, l2, i)
+		l2Bitmap = get_l2_bitmap(s, l2, i)
+		ctype := qcow2_get_cluster_type(bs, l2Entry)
+
+		if ctype != QCOW2_CLUSTER_COMPRESSED {
+			/* Check reserved bits of Standard Cluster Descriptor */
+			if l2Entry&L2E_STD_RESERVED_MASK > 0 {
+				res.report("ERROR found l2 entry with reserved bits set: 0x%x", l2Entry)
+				res.Corruptions++
+			}
+		}
+
+		switch ctype {
+		case QCOW2_CLUSTER_COMPRESSED:
+			/* Compressed clusters don't have QCOW_OFLAG_COPIED */
+			if l2Entry&QCOW_OFLAG_COPIED > 0 {
+				res.report("ERROR: coffset=0x%x: copied flag must never be set for compressed clusters",
+					l2Entry&s.ClusterOffsetMask)
+				l2Entry &^= QCOW_OFLAG_COPIED
+				res.Corruptions++
+			}
+			if has_data_file(bs) {
+				res.report("ERROR compressed cluster %d with data file, entry=0x%x", i, l2Entry)
+				res.Corruptions++
+				break
+			}
+			if l2Bitmap > 0 {
+				res.report("ERROR compressed cluster %d with non-zero subcluster allocation bitmap, entry=0x%x",
+					i, l2Entry)
+				res.Corruptions++
+				break
+			}
+
+			/* Mark cluster as used */
+			coffset, csize := qcow2_parse_compressed_l2_entry(s, l2Entry)
+			qcow2_inc_refcounts_imrt(bs, res, refcountTable, nbClusters, coffset, csize)
+
+			if flags&CHECK_FRAG_INFO > 0 {
+				res.AllocatedClusters++
+				/* Compressed clusters are fragmented by nature, the same sectors are read
+				 * again for the adjacent compressed clusters. */
+				res.FragmentedClusters++
+			}
+
+		case QCOW2_CLUSTER_ZERO_ALLOC, QCOW2_CLUSTER_NORMAL:
+			offset := l2Entry & L2E_OFFSET_MASK
+
+			if has_subclusters(s) && l2Bitmap&(l2Bitmap>>32) > 0 {
+				res.report("ERROR: Invalid subcluster allocation bitmap 0x%x of l2 entry 0x%x", l2Bitmap, l2Entry)
+				res.Corruptions++
+			}
+
+			if flags&CHECK_FRAG_INFO > 0 {
+				res.AllocatedClusters++
+				if nextContiguousOffset > 0 && offset != nextContiguousOffset {
+					res.FragmentedClusters++
+				}
+				nextContiguousOffset = offset + uint64(s.ClusterSize)
+			}
+
+			/* Correct offsets are cluster aligned */
+			if offset_into_cluster(s, offset) > 0 {
+				var containsData bool
+				res.Corruptions++
+
+				if has_subclusters(s) {
+					containsData = l2Bitmap&QCOW_L2_BITMAP_ALL_ALLOC > 0
+				} else {
+					containsData = l2Entry&QCOW_OFLAG_ZERO == 0
+				}
+
+				if !containsData && fix&BDRV_FIX_ERRORS > 0 && active {
+					res.report("Repairing offset=0x%x: Preallocated cluster is not properly aligned; L2 entry corrupted.", offset)
+					if err = fix_l2_entry_to_zero(bs, l2Offset, i); err != nil {
+						res.report("ERROR: Failed to overwrite L2 table entry: %v", err)
+						res.CheckErrors++
+					} else {
+						res.Corruptions--
+						res.CorruptionsFixed++
+						/* the entry no longer references a cluster */
+						continue
+					}
+				} else if !containsData {
+					res.report("ERROR offset=0x%x: Preallocated cluster is not properly aligned; L2 entry corrupted.", offset)
+				} else {
+					res.report("ERROR offset=0x%x: Data cluster is not properly aligned; L2 entry corrupted.", offset)
+				}
+			}
+
+			/* Mark cluster as used */
+			if !has_data_file(bs) {
+				qcow2_inc_refcounts_imrt(bs, res, refcountTable, nbClusters, offset, uint64(s.ClusterSize))
+			}
+
+		case QCOW2_CLUSTER_ZERO_PLAIN:
+			/* Impossible when image has subclusters */
+
+		case QCOW2_CLUSTER_UNALLOCATED:
+			if l2Bitmap&QCOW_L2_BITMAP_ALL_ALLOC > 0 {
+				res.report("ERROR: Unallocated cluster has non-zero subcluster allocation map")
+				res.Corruptions++
+			}
+
+		default:
+			Assert(false)
+		}
+	}
+	return nil
+}
+
+// turn the l2 entry of the active l2 table into a plain zero cluster
+func fix_l2_entry_to_zero(bs *BlockDriverState, l2Offset uint64, l2Index uint32) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var err error
+
+	if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache, l2Offset); err != nil {
+		return err
+	}
+	if has_subclusters(s) {
+		set_l2_entry(s, l2Slice, l2Index, 0)
+		set_l2_bitmap(s, l2Slice, l2Index, QCOW_L2_BITMAP_ALL_ZEROES)
+	} else {
+		set_l2_entry(s, l2Slice, l2Index, QCOW_OFLAG_ZERO)
+	}
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+	return qcow2_cache_flush(bs, s.L2TableCache)
+}
+
+/*
+* Checks consistency of refblocks and accounts for each refblock in
+* refcountTable.
+ */
+func check_refblocks(bs *BlockDriverState, res *BlockCheckResult, rebuild *bool,
+	refcountTable *[]uint64, nbClusters uint64) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var offset, cluster uint64
+
+	for i := uint32(0); i < s.RefcountTableSize; i++ {
+		offset = s.RefcountTable[i] & REFT_OFFSET_MASK
+		cluster = offset >> s.ClusterBits
+
+		if s.RefcountTable[i]&REFT_RESERVED_MASK > 0 {
+			res.report("ERROR refcount table entry %d has reserved bits set", i)
+			res.Corruptions++
+			*rebuild = true
+			continue
+		}
+
+		/* Refcount blocks are cluster aligned */
+		if offset_into_cluster(s, offset) > 0 {
+			res.report("ERROR refcount block %d is not cluster aligned; refcount table entry corrupted", i)
+			res.Corruptions++
+			*rebuild = true
+			continue
+		}
+
+		if cluster >= nbClusters {
+			res.report("ERROR refcount block %d is outside image", i)
+			res.Corruptions++
+			*rebuild = true
+			continue
+		}
+
+		if offset != 0 {
+			qcow2_inc_refcounts_imrt(bs, res, refcountTable, nbClusters, offset, uint64(s.ClusterSize))
+			if (*refcountTable)[cluster] != 1 {
+				res.report("ERROR refcount block %d refcount=%d", i, (*refcountTable)[cluster])
+				res.Corruptions++
+				*rebuild = true
+			}
+		}
+	}
+}
+
+/*
+* Compares the actual reference count for each cluster in the image against the
+* refcount as reported by the refcount structures on-disk.
+ */
+func compare_refcounts(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode,
+	rebuild *bool, highestCluster *uint64, refcountTable []uint64, nbClusters uint64) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refcount1, refcount2 uint64
+	var refcount uint64
+	var err error
+
+	for i := uint64(0); i < nbClusters; i++ {
+		if refcount, err = qcow2_get_refcount(bs, i); err != nil {
+			res.report("Can't get refcount for cluster %d: %v", i, err)
+			res.CheckErrors++
+			continue
+		}
+		refcount1 = uint64(refcount)
+
+		refcount2 = 0
+		if i < uint64(len(refcountTable)) {
+			refcount2 = refcountTable[i]
+		}
+
+		if refcount1 > 0 || refcount2 > 0 {
+			*highestCluster = i
+		}
+
+		if refcount1 != refcount2 {
+			/* Check if we're allowed to fix the mismatch */
+			var numFixed *int
+			var addend uint64
+			var decrease bool
+
+			if refcount1 == 0 {
+				/* the refblock may be missing, never allocate from a damaged structure */
+				*rebuild = true
+			} else if refcount1 > refcount2 && fix&BDRV_FIX_LEAKS > 0 {
+				numFixed = &res.LeaksFixed
+			} else if refcount1 < refcount2 && fix&BDRV_FIX_ERRORS > 0 {
+				numFixed = &res.CorruptionsFixed
+			}
+
+			if numFixed != nil {
+				res.report("Repairing cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+			} else if refcount1 < refcount2 {
+				res.report("ERROR cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+			} else {
+				res.report("Leaked cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+			}
+
+			if numFixed != nil {
+				if refcount1 > refcount2 {
+					addend, decrease = refcount1-refcount2, true
+				} else {
+					addend, decrease = refcount2-refcount1, false
+				}
+				if err = update_refcount(bs, i<<s.ClusterBits, 1, addend, decrease,
+					QCOW2_DISCARD_ALWAYS); err == nil {
+					(*numFixed)++
+					continue
+				}
+			}
+
+			/* And if we couldn't, print an error */
+			if refcount1 < refcount2 {
+				res.Corruptions++
+			} else {
+				res.Leaks++
+			}
+		}
+	}
+	if res.LeaksFixed > 0 || res.CorruptionsFixed > 0 {
+		if err = qcow2_cache_flush(bs, s.RefcountBlockCache); err != nil {
+			res.report("ERROR: failed to flush the refcount block cache: %v", err)
+			res.CheckErrors++
+		}
+	}
+}
+
+/*
+* Checks the OFLAG_COPIED flag for all L1 and L2 entries of the active L1 table.
+* It must be set exactly when the refcount of the referenced cluster is 1
+ */
+func check_oflag_copied(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var l1Entry, l2Offset, l2Entry, dataOffset uint64
+	var refcount uint64
+	var err error
+	var repairedL1, repairedL2 bool
+
+	for i := uint32(0); i < s.L1Size; i++ {
+		l1Entry = s.L1Table[i]
+		l2Offset = l1Entry & L1E_OFFSET_MASK
+
+		if l2Offset == 0 {
+			continue
+		}
+
+		if refcount, err = qcow2_get_refcount(bs, l2Offset>>s.ClusterBits); err != nil {
+			/* don't print message nor increment check_errors */
+			continue
+		}
+		if (refcount == 1) != (l1Entry&QCOW_OFLAG_COPIED > 0) {
+			if fix&BDRV_FIX_ERRORS > 0 {
+				res.report("Repairing OFLAG_COPIED L2 cluster: l1_index=%d l1_entry=0x%x refcount=%d",
+					i, l1Entry, refcount)
+				if refcount == 1 {
+					s.L1Table[i] = l1Entry | QCOW_OFLAG_COPIED
+				} else {
+					s.L1Table[i] = l1Entry &^ QCOW_OFLAG_COPIED
+				}
+				if err = qcow2_write_l1_entry(bs, i); err != nil {
+					res.CheckErrors++
+					return err
+				}
+				res.CorruptionsFixed++
+				repairedL1 = true
+			} else {
+				res.report("ERROR OFLAG_COPIED L2 cluster: l1_index=%d l1_entry=0x%x refcount=%d",
+					i, l1Entry, refcount)
+				res.Corruptions++
+			}
+		}
+
+		if offset_into_cluster(s, l2Offset) > 0 {
+			/* already reported by check_refcounts_l1 */
+			continue
+		}
+
+		if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache, l2Offset); err != nil {
+			res.report("ERROR: I/O error in check_oflag_copied")
+			res.CheckErrors++
+			return err
+		}
+
+		for j := uint32(0); j < s.L2Size; j++ {
+			l2Entry = get_l2_entry(s, l2Slice, j)
+			dataOffset = l2Entry & L2E_OFFSET_MASK
+			ctype := qcow2_get_cluster_type(bs, l2Entry)
+
+			if ctype != QCOW2_CLUSTER_NORMAL && ctype != QCOW2_CLUSTER_ZERO_ALLOC {
+				continue
+			}
+			if has_data_file(bs) {
+				refcount = 1
+			} else if refcount, err = qcow2_get_refcount(bs, dataOffset>>s.ClusterBits); err != nil {
+				/* don't print message nor increment check_errors */
+				continue
+			}
+			if (refcount == 1) != (l2Entry&QCOW_OFLAG_COPIED > 0) {
+				if fix&BDRV_FIX_ERRORS > 0 {
+					res.report("Repairing OFLAG_COPIED data cluster: l2_entry=0x%x refcount=%d",
+						l2Entry, refcount)
+					if refcount == 1 {
+						set_l2_entry(s, l2Slice, j, l2Entry|QCOW_OFLAG_COPIED)
+					} else {
+						set_l2_entry(s, l2Slice, j, l2Entry&^QCOW_OFLAG_COPIED)
+					}
+					qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+					res.CorruptionsFixed++
+					repairedL2 = true
+				} else {
+					res.report("ERROR OFLAG_COPIED data cluster: l2_entry=0x%x refcount=%d",
+						l2Entry, refcount)
+					res.Corruptions++
+				}
+			}
+		}
+		qcow2_cache_put(s.L2TableCache, l2Slice)
+	}
+
+	if repairedL2 {
+		if err = qcow2_cache_flush(bs, s.L2TableCache); err != nil {
+			res.CheckErrors++
+			return err
+		}
+	}
+	if repairedL1 {
+		return bdrv_flush(bs.current.bs)
+	}
+	return nil
+}
+
+// read the snapshot table, return the snapshots and the size of the table
+func qcow2_read_snapshots(bs *BlockDriverState) ([]QCowSnapshot, uint64, error) {
+
+	var snapshots []QCowSnapshot
+	var snHeader QCowSnapshotHeader
+	var err error
+	header := bs.current.header
+	offset := header.SnapshotsOffset
+	snHeaderSize := uint64(unsafe.Sizeof(snHeader))
+
+	for i := uint32(0); i < header.NbSnapshots; i++ {
+		if _, err = Blk_Pread_Object(bs.current, offset, &snHeader, snHeaderSize); err != nil {
+			return nil, 0, err
+		}
+		snapshots = append(snapshots, QCowSnapshot{
+			L1TableOffset: snHeader.L1TableOffset,
+			L1Size:        snHeader.L1Size,
+		})
+		offset += snHeaderSize + uint64(snHeader.ExtraDataSize) +
+			uint64(snHeader.IdStrSize) + uint64(snHeader.NameSize)
+		offset = round_up(offset, 8)
+	}
+	return snapshots, offset - header.SnapshotsOffset, nil
+}
+
+/*
+* Allocates clusters using an in-memory refcount table (IMRT) in contrast to
+* the on-disk refcount structures.
+*
+* On input, firstFreeCluster should be set to the first free cluster, the
+* search starts there; it is updated to the first free cluster found.
+ */
+func alloc_clusters_imrt(bs *BlockDriverState, clusterCount uint64, refcountTable *[]uint64,
+	firstFreeCluster *uint64) uint64 {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var contiguousFreeClusters uint64
+	cluster := *firstFreeCluster
+	firstGap := true
+
+	/* Starting at firstFreeCluster, find a range of at least clusterCount
+	 * continuously free clusters */
+	for ; cluster < uint64(len(*refcountTable)) && contiguousFreeClusters < clusterCount; cluster++ {
+		if (*refcountTable)[cluster] == 0 {
+			contiguousFreeClusters++
+			if firstGap {
+				/* If this is the first free cluster found, update
+				 * firstFreeCluster accordingly */
+				*firstFreeCluster = cluster
+				firstGap = false
+			}
+		} else if contiguousFreeClusters > 0 {
+			contiguousFreeClusters = 0
+		}
+	}
+
+	/* If no such range could be found, grow the in-memory refcount table
+	 * accordingly to append free clusters at the end of the image */
+	if contiguousFreeClusters < clusterCount {
+		newSize := round_up(cluster+clusterCount-contiguousFreeClusters, uint64(s.RefcountBlockSize))
+		*refcountTable = append(*refcountTable, make([]uint64, newSize-uint64(len(*refcountTable)))...)
+	}
+
+	/* Go back to the first free cluster */
+	cluster -= contiguousFreeClusters
+	for i := uint64(0); i < clusterCount; i++ {
+		(*refcountTable)[cluster+i] = 1
+	}
+
+	return cluster << s.ClusterBits
+}
+
+/*
+* Helper function for rebuild_refcount_structure().
+*
+* Scan the range of clusters [firstCluster, endCluster) for allocated
+* clusters and write all corresponding refblocks to disk.  The refblock
+* and allocation data is taken from the in-memory refcount table
+* refcountTable, the refblock offsets are stored in reftable, which is
+* grown if necessary.
+*
+* Returns whether the on-disk reftable array was resized.
+ */
+func rebuild_refcounts_write_refblocks(bs *BlockDriverState, refcountTable *[]uint64,
+	firstCluster uint64, endCluster uint64, reftable *[]uint64) (bool, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refblockOffset, refblockStart, refblockIndex uint64
+	var firstFreeCluster uint64
+	var reftableGrown bool
+	var err error
+	refblock := make([]byte, s.ClusterSize)
+
+	for cluster := firstCluster; cluster < endCluster && cluster < uint64(len(*refcountTable)); cluster++ {
+		/* Check all clusters to find refblocks that contain non-zero entries */
+		if (*refcountTable)[cluster] == 0 {
+			continue
+		}
+
+		/*
+		 * This cluster is allocated, so we need to create a refblock
+		 * for it.  The data we will write to disk is just the
+		 * respective slice from refcountTable, so it will contain
+		 * accurate refcounts for all clusters belonging to this
+		 * refblock.  After we have written it, we will therefore skip
+		 * all remaining clusters in this refblock.
+		 */
+		refblockIndex = cluster >> s.RefcountBlockBits
+		refblockStart = refblockIndex << s.RefcountBlockBits
+
+		if uint64(len(*reftable)) > refblockIndex && (*reftable)[refblockIndex] > 0 {
+			/* The refblock is already allocated by a previous run */
+			refblockOffset = (*reftable)[refblockIndex]
+		} else {
+			/* Don't allocate a cluster in a refblock already written to disk */
+			if firstFreeCluster < refblockStart {
+				firstFreeCluster = refblockStart
+			}
+			refblockOffset = alloc_clusters_imrt(bs, 1, refcountTable, &firstFreeCluster)
+
+			if refblockOffset>>s.ClusterBits >= endCluster {
+				/* We must write the refblock that holds this refblock's refcount */
+				endCluster = refblockOffset>>s.ClusterBits + 1
+			}
+
+			if uint64(len(*reftable)) <= refblockIndex {
+				entries := round_up((refblockIndex+1)*REFTABLE_ENTRY_SIZE,
+					uint64(s.ClusterSize)) / REFTABLE_ENTRY_SIZE
+				*reftable = append(*reftable, make([]uint64, entries-uint64(len(*reftable)))...)
+				reftableGrown = true
+			}
+			(*reftable)[refblockIndex] = refblockOffset
+		}
+
+		/* Refblock is allocated, write it to disk */
+		if err = qcow2_pre_write_overlap_check(bs, 0, refblockOffset, uint64(s.ClusterSize), false); err != nil {
+			return false, err
+		}
+		for i := uint64(0); i < uint64(s.RefcountBlockSize); i++ {
+			s.set_refcount(unsafe.Pointer(&refblock[0]), i, (*refcountTable)[refblockStart+i])
+		}
+		if err = bdrv_pwrite(bs.current, refblockOffset, unsafe.Pointer(&refblock[0]),
+			uint64(s.ClusterSize)); err != nil {
+			return false, err
+		}
+
+		/* This refblock is done, skip to its end */
+		cluster = refblockStart + uint64(s.RefcountBlockSize) - 1
+	}
+
+	return reftableGrown, nil
+}
+
+/*
+* Creates a new refcount structure based solely on the in-memory information
+* given through refcountTable (this in-memory information is basically just
+* the concatenation of all refblocks).  All necessary allocations will be
+* reflected in that array.
+*
+* On success, the old refcount structure is leaked (it will be covered by the
+* new refcount structure).
+ */
+func rebuild_refcount_structure(bs *BlockDriverState, res *BlockCheckResult, refcountTable *[]uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var reftable []uint64
+	var reftableOffset, reftableClusters uint64
+	var reftableSizeChanged bool
+	var err error
+
+	if err = qcow2_cache_empty(bs, s.RefcountBlockCache); err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	/*
+	 * For each refblock containing entries, we try to allocate a
+	 * cluster (in the in-memory refcount table) and write its offset
+	 * into the new reftable, the refblock itself is written to disk as
+	 * a slice of the in-memory refcount table.
+	 *
+	 * Once we have scanned all clusters, we try to find space for the
+	 * reftable.  This will dirty the in-memory refcount table, so the
+	 * refblocks of the range where the reftable has been allocated are
+	 * written again, which might allocate another refblock, then we
+	 * need to repeat...
+	 */
+	if reftableSizeChanged, err = rebuild_refcounts_write_refblocks(bs, refcountTable,
+		0, uint64(len(*refcountTable)), &reftable); err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	/* There was no reftable before, so it must have been grown from nothing */
+	Assert(reftableSizeChanged)
+
+	for reftableSizeChanged {
+		var firstFreeCluster uint64
+
+		reftableClusters = size_to_clusters(s, uint64(len(reftable))*REFTABLE_ENTRY_SIZE)
+		reftableOffset = alloc_clusters_imrt(bs, reftableClusters, refcountTable, &firstFreeCluster)
+
+		/*
+		 * We need to update the affected refblocks, so re-run the
+		 * write_refblocks loop for the reftable's range of clusters.
+		 */
+		reftableStartCluster := reftableOffset >> s.ClusterBits
+		reftableEndCluster := reftableStartCluster + reftableClusters
+		if reftableSizeChanged, err = rebuild_refcounts_write_refblocks(bs, refcountTable,
+			reftableStartCluster, reftableEndCluster, &reftable); err != nil {
+			res.CheckErrors++
+			return err
+		}
+
+		/*
+		 * If the reftable size has changed, we will need to find a new
+		 * allocation, repeating the loop.
+		 */
+		if reftableSizeChanged {
+			for i := reftableStartCluster; i < reftableEndCluster; i++ {
+				(*refcountTable)[i] = 0
+			}
+		}
+	}
+
+	/* Enter new reftable into the image */
+	onDiskReftable := make([]uint64, len(reftable))
+	for i := range reftable {
+		onDiskReftable[i] = cpu_to_be64(reftable[i])
+	}
+	if err = qcow2_pre_write_overlap_check(bs, 0, reftableOffset,
+		uint64(len(reftable))*REFTABLE_ENTRY_SIZE, false); err != nil {
+		res.CheckErrors++
+		return err
+	}
+	if err = bdrv_pwrite(bs.current, reftableOffset, unsafe.Pointer(&onDiskReftable[0]),
+		uint64(len(reftable))*REFTABLE_ENTRY_SIZE); err != nil {
+		res.CheckErrors++
+		return err
+	}
+	if err = bdrv_flush(bs.current.bs); err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	/* Enter new reftable into the image header */
+	if err = qcow2_update_header_reftable(bs, reftableOffset, uint32(reftableClusters)); err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	s.RefcountTable = reftable
+	s.RefcountTableOffset = reftableOffset
+	s.RefcountTableSize = uint32(len(reftable))
+	s.FreeClusterIndex = 0
+	update_max_refcount_table_index(s)
+
+	return nil
+}
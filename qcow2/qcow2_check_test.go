@@ -0,0 +1,240 @@
+package qcow2
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepare_check_image(t *testing.T, filename string, subcluster bool) *BdrvChild {
+	os.Remove(filename)
+	var create_opts = map[string]any{
+		OPT_SIZE:       4 * 1048576,
+		OPT_FILENAME:   filename,
+		OPT_FMT:        "qcow2",
+		OPT_SUBCLUSTER: subcluster,
+	}
+	err := Blk_Create(filename, create_opts)
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+
+	buf := ([]byte)("this is a test")
+	for _, offset := range []uint64{123, 1048576 + 123, 3*1048576 + 123} {
+		_, err = Blk_Pwrite(root, offset, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}
+	return root
+}
+
+func Test_check_clean(t *testing.T) {
+	var filename = "/tmp/check_clean.qcow2"
+	for _, subcluster := range []bool{false, true} {
+		root := prepare_check_image(t, filename, subcluster)
+		res, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, res.Corruptions)
+		assert.Equal(t, 0, res.Leaks)
+		assert.Equal(t, 0, res.CheckErrors)
+		assert.Equal(t, uint64(3), res.AllocatedClusters)
+		assert.Equal(t, uint64(64), res.TotalClusters)
+		//header, reftable, refblock, l1, l2 and three data clusters
+		assert.Equal(t, uint64(8*DEFAULT_CLUSTER_SIZE), res.ImageEndOffset)
+		assert.Empty(t, res.Messages)
+		Blk_Close(root)
+	}
+	os.Remove(filename)
+}
+
+func Test_check_repair_leaks(t *testing.T) {
+	var filename = "/tmp/check_leaks.qcow2"
+	root := prepare_check_image(t, filename, true)
+	bs := root.bs
+
+	//allocate two clusters which are never referenced
+	offset, err := qcow2_alloc_clusters(bs, 2*DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(bs.current, offset, make([]byte, 2*DEFAULT_CLUSTER_SIZE), 2*DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Leaks)
+	assert.Equal(t, 0, res.Corruptions)
+
+	res, err = Blk_Check(root, BDRV_FIX_LEAKS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Leaks)
+	assert.Equal(t, 2, res.LeaksFixed)
+	Blk_Close(root)
+
+	//the repair is persistent
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Leaks)
+	assert.Equal(t, 0, res.Corruptions)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_check_repair_errors(t *testing.T) {
+	var filename = "/tmp/check_errors.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+
+	//clear the OFLAG_COPIED of the first data cluster
+	l2Slice, l2Index, err := get_cluster_table(bs, 0)
+	assert.Nil(t, err)
+	l2Entry := get_l2_entry(s, l2Slice, l2Index)
+	set_l2_entry(s, l2Slice, l2Index, l2Entry&^QCOW_OFLAG_COPIED)
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+
+	res, err = Blk_Check(root, BDRV_FIX_ERRORS|BDRV_FIX_LEAKS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 1, res.CorruptionsFixed)
+
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Empty(t, res.Messages)
+
+	//a data cluster pointing behind the end of the image
+	l2Slice, l2Index, err = get_cluster_table(bs, 1048576)
+	assert.Nil(t, err)
+	l2Entry = get_l2_entry(s, l2Slice, l2Index)
+	set_l2_entry(s, l2Slice, l2Index, (l2Entry&^L2E_OFFSET_MASK)|(1<<30))
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.True(t, res.Corruptions > 0)
+	assert.Equal(t, 1, res.Leaks)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_check_rebuild_refcounts(t *testing.T) {
+	var filename = "/tmp/check_rebuild.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+
+	//lose the only refblock
+	err := qcow2_cache_empty(bs, s.RefcountBlockCache)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(bs.current, s.RefcountTableOffset, make([]byte, 8), 8, 0)
+	assert.Nil(t, err)
+	s.RefcountTable[0] = 0
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.True(t, res.Corruptions > 0)
+	assert.Contains(t, res.Messages, "ERROR need to rebuild refcount structures")
+
+	//repairing without rebuilding is refused
+	res, err = Blk_Check(root, BDRV_FIX_LEAKS)
+	assert.NotNil(t, err)
+
+	res, err = Blk_Check(root, BDRV_FIX_ERRORS|BDRV_FIX_LEAKS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.True(t, res.CorruptionsFixed > 0)
+	assert.Equal(t, 0, res.Leaks)
+	assert.Equal(t, 0, res.CheckErrors)
+	Blk_Close(root)
+
+	//the rebuilt structures are persistent and usable
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	assert.Empty(t, res.Messages)
+
+	buf := make([]byte, 14)
+	_, err = Blk_Pread(root, 1048576+123, buf, 14)
+	assert.Nil(t, err)
+	assert.Equal(t, "this is a test", string(buf))
+
+	_, err = Blk_Pwrite(root, 2*1048576, buf, 14, 0)
+	assert.Nil(t, err)
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_check_force_rebuild(t *testing.T) {
+	var filename = "/tmp/check_force_rebuild.qcow2"
+	root := prepare_check_image(t, filename, true)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	oldTableOffset := s.RefcountTableOffset
+
+	res, err := Blk_Check(root, BDRV_FIX_ERRORS|BDRV_FIX_LEAKS|BDRV_FIX_REBUILD)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	assert.NotEqual(t, oldTableOffset, s.RefcountTableOffset)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.NotEqual(t, oldTableOffset, s.RefcountTableOffset)
+	res, err = Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_check_snapshot_table(t *testing.T) {
+	var filename = "/tmp/check_snapshots.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	header := bs.current.header
+
+	//a snapshot table with a huge L1 table and one beyond the end of the image
+	offset, err := qcow2_alloc_clusters(bs, DEFAULT_CLUSTER_SIZE)
+	assert.Nil(t, err)
+	snapshots := []QCowSnapshotHeader{
+		{L1TableOffset: 5 * DEFAULT_CLUSTER_SIZE, L1Size: 0xffffffff},
+		{L1TableOffset: 1 << 40, L1Size: 16},
+	}
+	snSize := uint64(unsafe.Sizeof(snapshots[0]))
+	for i := range snapshots {
+		_, err = Blk_Pwrite_Object(bs.current, offset+uint64(i)*snSize, &snapshots[i], snSize)
+		assert.Nil(t, err)
+	}
+	header.NbSnapshots = 2
+	header.SnapshotsOffset = offset
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	assert.Contains(t, res.Messages[0], "L1 table is too large")
+	assert.Contains(t, res.Messages[1], "L1 table is beyond the end of the image")
+
+	header.NbSnapshots = 0
+	header.SnapshotsOffset = 0
+	Blk_Close(root)
+	os.Remove(filename)
+}
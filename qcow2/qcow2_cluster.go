@@ -1,6 +1,7 @@
 package qcow2
 
 import (
+	"context"
 	"math"
 	"unsafe"
 )
@@ -47,6 +48,10 @@ func qcow2_write_l1_entry(bs *BlockDriverState, l1Index uint32) error {
 		buf[i] = cpu_to_be64(s.L1Table[l1StartIndex+i])
 	}
 
+	if err = qcow2_pre_write_overlap_check(bs, QCOW2_OL_ACTIVE_L1,
+		s.L1TableOffset+L1E_SIZE*l1StartIndex, bufsize, false); err != nil {
+		return err
+	}
 	if err = bdrv_pwrite(bs.current, s.L1TableOffset+L1E_SIZE*l1StartIndex,
 		unsafe.Pointer(&buf[0]), bufsize); err != nil {
 		return err
@@ -240,7 +245,12 @@ func qcow2_get_host_offset(bs *BlockDriverState, offset uint64, bytes *uint32,
 	case QCOW2_SUBCLUSTER_INVALID:
 		//do nothing
 	case QCOW2_SUBCLUSTER_COMPRESSED:
-		//do nothing
+		if has_data_file(bs) {
+			err = ERR_EIO
+			goto fail
+		}
+		/* the whole descriptor is returned, it is parsed by the reader */
+		*hostOffset = l2Entry
 	case QCOW2_SUBCLUSTER_ZERO_PLAIN, QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN:
 		//do nothing
 	case QCOW2_SUBCLUSTER_ZERO_ALLOC, QCOW2_SUBCLUSTER_NORMAL, QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC:
@@ -279,6 +289,56 @@ fail:
 	return err
 }
 
+/*
+* allocates the host space for the compressed data of the cluster at offset and links it in
+* the l2 table, the host offset of the data is returned. compressed clusters are only written
+* to the unallocated clusters, anything else fails with EIO.
+ */
+func qcow2_alloc_compressed_cluster_offset(bs *BlockDriverState, offset uint64,
+	compressedSize uint64) (uint64, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var l2Index uint32
+	var clusterOffset, nbCsectors uint64
+	var err error
+
+	if has_data_file(bs) {
+		return 0, ERR_ENOTSUP
+	}
+
+	if l2Slice, l2Index, err = get_cluster_table(bs, offset); err != nil {
+		return 0, err
+	}
+
+	/* Compression can't overwrite anything. Fail if the cluster was already allocated. */
+	if get_l2_entry(s, l2Slice, l2Index)&L2E_OFFSET_MASK > 0 {
+		qcow2_cache_put(s.L2TableCache, l2Slice)
+		return 0, ERR_EIO
+	}
+
+	if clusterOffset, err = qcow2_alloc_bytes(bs, compressedSize); err != nil {
+		qcow2_cache_put(s.L2TableCache, l2Slice)
+		return 0, err
+	}
+
+	nbCsectors = (clusterOffset+compressedSize-1)/QCOW2_COMPRESSED_SECTOR_SIZE -
+		clusterOffset/QCOW2_COMPRESSED_SECTOR_SIZE
+
+	/* The offset and size must fit in their fields of the L2 table entry */
+	Assert(clusterOffset&s.ClusterOffsetMask == clusterOffset)
+	Assert(nbCsectors&s.CsizeMask == nbCsectors)
+
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	set_l2_entry(s, l2Slice, l2Index, clusterOffset|QCOW_OFLAG_COMPRESSED|nbCsectors<<s.CsizeShift)
+	if has_subclusters(s) {
+		set_l2_bitmap(s, l2Slice, l2Index, 0)
+	}
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	return clusterOffset, nil
+}
+
 func qcow2_alloc_cluster_link_l2(bs *BlockDriverState, m *QCowL2Meta) error {
 
 	s := bs.opaque.(*BDRVQcow2State)
@@ -497,11 +557,71 @@ func calculate_l2_meta(bs *BlockDriverState, hostClusterOffset uint64,
 			NbBytes: cow_end_to - cow_end_from,
 		},
 	}
-	//TODO2
+	(*m).DependentRequests = make(chan struct{})
 	(*m).NextInFlight = s.ClusterAllocs.PushFront(*m)
 	return nil
 }
 
+/*
+* Check if there are running allocations overlapping the request, the request is
+* shortened to stop before the first one. If the request starts within a running
+* allocation, wait for it to complete and return ERR_EAGAIN, the caller must look
+* up the clusters again since the L2 table has changed meanwhile.
+* Must be called with s.Lock held, it's released while waiting.
+ */
+func handle_dependencies(bs *BlockDriverState, guestOffset uint64,
+	curBytes *uint64, m **QCowL2Meta) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	bytes := *curBytes
+
+	for e := s.ClusterAllocs.Front(); e != nil; e = e.Next() {
+		oldAlloc := e.Value.(*QCowL2Meta)
+
+		start := guestOffset
+		end := start + bytes
+		oldStart := start_of_cluster(s, l2meta_cow_start(oldAlloc))
+		oldEnd := round_up(l2meta_cow_end(oldAlloc), uint64(s.ClusterSize))
+
+		if end <= oldStart || start >= oldEnd {
+			/* No intersection */
+			continue
+		}
+
+		if oldAlloc.KeepOldClusters &&
+			(end <= l2meta_cow_start(oldAlloc) || start >= l2meta_cow_end(oldAlloc)) {
+			/* Clusters intersect but COW areas don't, and the cluster is already allocated */
+			continue
+		}
+
+		/* Conflict */
+		if start < oldStart {
+			/* Stop at the start of a running allocation */
+			bytes = oldStart - start
+		} else {
+			bytes = 0
+		}
+
+		/* Stop if an l2meta already exists, it wouldn't be valid any more after waiting */
+		if bytes == 0 && *m != nil {
+			*curBytes = 0
+			return nil
+		}
+
+		if bytes == 0 {
+			/* Wait for the dependency to complete, the clusters must be checked again then */
+			s.Qunlock()
+			<-oldAlloc.DependentRequests
+			s.Qlock()
+			return ERR_EAGAIN
+		}
+	}
+
+	/* existing clusters and new allocations are only used up to the next dependency */
+	*curBytes = bytes
+	return nil
+}
+
 func cluster_needs_new_alloc(bs *BlockDriverState, l2Entry uint64) bool {
 
 	switch qcow2_get_cluster_type(bs, l2Entry) {
@@ -567,6 +687,30 @@ func do_alloc_cluster_offset(bs *BlockDriverState, guestOffset uint64, hostOffse
 	return nil
 }
 
+/*
+* Wait for the running allocations on the clusters of the range, whose L2 entries
+* are updated when they complete and so must not be zeroed or discarded meanwhile.
+* Must be called with s.Lock held, it's released while waiting.
+ */
+func qcow2_wait_for_allocations(bs *BlockDriverState, offset uint64, bytes uint64) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	start := start_of_cluster(s, offset)
+	end := round_up(offset+bytes, uint64(s.ClusterSize))
+
+again:
+	for e := s.ClusterAllocs.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*QCowL2Meta)
+		if end <= m.Offset || start >= m.Offset+uint64(m.NbClusters)<<s.ClusterBits {
+			continue
+		}
+		s.Qunlock()
+		<-m.DependentRequests
+		s.Qlock()
+		goto again
+	}
+}
+
 func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 	bytes *uint64, hostOffset *uint64, m **QCowL2Meta) error {
 
@@ -576,7 +720,7 @@ func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 	var curBytes uint64
 	var err error
 
-	//again:
+again:
 	start = offset
 	remaining = *bytes
 	clusterOffset = INV_OFFSET
@@ -599,7 +743,15 @@ func qcow2_alloc_host_offset(bs *BlockDriverState, offset uint64,
 		}
 		curBytes = remaining
 
-		//TODO2: so far we don't handle dependencies
+		/* wait for or stop before the overlapping allocations in flight */
+		if err = handle_dependencies(bs, start, &curBytes, m); err == ERR_EAGAIN {
+			Assert(*m == nil)
+			goto again
+		} else if err != nil {
+			return err
+		} else if curBytes == 0 {
+			break
+		}
 
 		var ret uint64
 		ret, err = handle_copied(bs, start, &clusterOffset, &curBytes, m)
@@ -784,7 +936,8 @@ func qcow2_get_subcluster_range_type(bs *BlockDriverState, l2Entry uint64, l2Bit
 		return uint64(cto32(val)) - scFrom, nil
 
 	case QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN, QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC:
-		val = uint32(l2Bitmap>>32) | uint32(l2Bitmap)&uint32(^qcow_oflag_sub_alloc_range(0, uint32(scFrom)))
+		/* the subclusters which are allocated or read as zeroes, ignoring those before scFrom */
+		val = (uint32(l2Bitmap>>32) | uint32(l2Bitmap)) & uint32(^qcow_oflag_sub_alloc_range(0, uint32(scFrom)))
 		return uint64(ctz32(val)) - scFrom, nil
 
 	default:
@@ -806,9 +959,9 @@ func qcow2_get_subcluster_type(bs *BlockDriverState, l2Entry uint64,
 		case QCOW2_CLUSTER_NORMAL:
 			if ((l2Bitmap >> 32) & l2Bitmap) > 0 {
 				return QCOW2_SUBCLUSTER_INVALID
-			} else if int(l2Bitmap)&qcow_oflag_sub_zero(uint32(scIndex)) > 0 {
+			} else if l2Bitmap&qcow_oflag_sub_zero(uint32(scIndex)) != 0 {
 				return QCOW2_SUBCLUSTER_ZERO_ALLOC
-			} else if int(l2Bitmap)&qcow_oflag_sub_alloc(uint32(scIndex)) > 0 {
+			} else if l2Bitmap&qcow_oflag_sub_alloc(uint32(scIndex)) != 0 {
 				return QCOW2_SUBCLUSTER_NORMAL
 			} else {
 				return QCOW2_SUBCLUSTER_UNALLOCATED_ALLOC
@@ -816,7 +969,7 @@ func qcow2_get_subcluster_type(bs *BlockDriverState, l2Entry uint64,
 		case QCOW2_CLUSTER_UNALLOCATED:
 			if l2Bitmap&QCOW_L2_BITMAP_ALL_ALLOC > 0 {
 				return QCOW2_SUBCLUSTER_INVALID
-			} else if int(l2Bitmap)&qcow_oflag_sub_zero(uint32(scIndex)) > 0 {
+			} else if l2Bitmap&qcow_oflag_sub_zero(uint32(scIndex)) != 0 {
 				return QCOW2_SUBCLUSTER_ZERO_PLAIN
 			} else {
 				return QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN
@@ -873,14 +1026,15 @@ func qcow2_free_any_cluster(bs *BlockDriverState, l2Entry uint64, dType Qcow2Dis
 		if s.DiscardPassthrough[dType] &&
 			(ctype == QCOW2_CLUSTER_NORMAL ||
 				ctype == QCOW2_CLUSTER_ZERO_ALLOC) {
-			bdrv_pdiscard(s.DataFile, l2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
+			bdrv_pdiscard(context.Background(), s.DataFile, l2Entry&L2E_OFFSET_MASK, uint64(s.ClusterSize))
 		}
 		return
 	}
 
 	switch ctype {
 	case QCOW2_CLUSTER_COMPRESSED:
-		//do nothing
+		coffset, csize := qcow2_parse_compressed_l2_entry(s, l2Entry)
+		qcow2_free_clusters(bs, coffset, csize, dType)
 	case QCOW2_CLUSTER_NORMAL, QCOW2_CLUSTER_ZERO_ALLOC:
 		if offset_into_cluster(s, l2Entry&L2E_OFFSET_MASK) > 0 {
 			Assert(false)
@@ -902,11 +1056,9 @@ func do_perform_cow_read(bs *BlockDriverState, srcClusterOffset uint64,
 	if qiov.size == 0 {
 		return nil
 	}
-	if bs.Drv == nil || bs.Drv.bdrv_preadv_part == nil {
-		return Err_NoDriverFound
-	}
-	if err = bs.Drv.bdrv_preadv_part(bs, srcClusterOffset+offsetInCluster,
-		qiov.size, qiov, 0, 0); err != nil {
+	/* the COW runs in a worker of the write, so the parts are not queued to the workers */
+	if err = qcow2_do_preadv_part(context.Background(), bs, srcClusterOffset+offsetInCluster,
+		qiov.size, qiov, 0, nil); err != nil {
 		return err
 	}
 
@@ -922,6 +1074,10 @@ func do_perform_cow_write(bs *BlockDriverState, clusterOffset uint64,
 	if qiov.size == 0 {
 		return nil
 	}
+	if err = qcow2_pre_write_overlap_check(bs, 0,
+		clusterOffset+offsetInCluster, qiov.size, true); err != nil {
+		return err
+	}
 	if err = bdrv_pwritev(s.DataFile, clusterOffset+offsetInCluster,
 		qiov.size, qiov, 0); err != nil {
 		return err
@@ -1093,9 +1249,17 @@ func qcow2_subcluster_zeroize(bs *BlockDriverState, offset uint64, bytes uint64,
 	var cleared uint64
 	var err error
 
+	/* The zero flag is only supported by version 3 and newer */
+	if s.QcowVersion < 3 {
+		return ERR_ENOTSUP
+	}
+
 	if data_file_is_raw(bs) {
 		Assert(has_data_file(bs))
-		err = bdrv_pwrite_zeroes(s.DataFile, offset, bytes, BdrvRequestFlags(flags))
+		if err = qcow2_pre_write_overlap_check(bs, 0, offset, bytes, true); err != nil {
+			return err
+		}
+		err = bdrv_pwrite_zeroes(context.Background(), s.DataFile, offset, bytes, BdrvRequestFlags(flags))
 		if err != nil {
 			return err
 		}
@@ -1280,8 +1444,10 @@ func discard_in_l2_slice(bs *BlockDriverState, offset uint64, nbClusters uint64,
 			if has_subclusters(s) {
 				new_l2_entry = 0
 				new_l2_bitmap = QCOW_L2_BITMAP_ALL_ZEROES
-			} else {
+			} else if s.QcowVersion >= 3 {
 				new_l2_entry = QCOW_OFLAG_ZERO
+			} else {
+				new_l2_entry = 0
 			}
 		}
 
@@ -0,0 +1,428 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// a host cluster referenced by the active L1 table or by an active L2 table
+type compactCluster struct {
+	offset  uint64 //the host offset of the cluster
+	l1Index uint32
+	l2Index uint32 //the index of the L2 entry, only valid for data clusters
+	isL2    bool   //the cluster is an L2 table
+}
+
+/*
+* compact the image, the data and L2 clusters at the tail of the image file are
+* moved into the free clusters before them, so the image file can be truncated
+* to the end of the last used cluster. the header, the L1 table and the
+* refcount structures are never moved.
+* with opts.Reorder, the clusters are first rewritten in the guest offset
+* order, so guest-contiguous ranges end up host-contiguous.
+ */
+func qcow2_compact(bs *BlockDriverState, opts *BlockCompactOptions, progress ProgressFunc) (*BlockCompactResult, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var result BlockCompactResult
+	var movers []compactCluster
+	var nbClusters, end uint64
+	var err error
+
+	if bs.current.header.NbSnapshots > 0 {
+		return nil, fmt.Errorf("cannot compact an image with internal snapshots")
+	}
+	if has_data_file(bs) {
+		return nil, fmt.Errorf("cannot compact an image with a data file")
+	}
+
+	s.Qlock()
+	defer s.Qunlock()
+	if s.SignaledCorruption {
+		return nil, ERR_EIO
+	}
+
+	if result.OldSize, err = bdrv_getlength(bs.current.bs); err != nil {
+		return nil, err
+	}
+	if err = qcow2_flush_caches(bs); err != nil {
+		return nil, err
+	}
+
+	walks := uint64(1)
+	if opts != nil && opts.Reorder {
+		walks = 2
+		if movers, err = compact_collect(bs); err != nil {
+			return nil, err
+		}
+		if !compact_is_sorted(movers) {
+			/* append the clusters in the guest offset order, the relocation
+			 * keeps their order while moving them back into the holes */
+			nbClusters = size_to_clusters(s, result.OldSize)
+			next := nbClusters
+			nextTarget := func() (uint64, bool) {
+				next++
+				return next - 1, true
+			}
+			if err = compact_move_clusters(bs, movers, nextTarget, progress, 0, walks); err != nil {
+				return nil, err
+			}
+			result.MovedClusters += uint64(len(movers))
+		}
+	}
+
+	/* the image is packed into the first end clusters */
+	if movers, end, err = compact_plan(bs); err != nil {
+		return nil, err
+	}
+	holes, err := compact_holes(bs, end)
+	if err != nil {
+		return nil, err
+	}
+	nextTarget := func() (uint64, bool) {
+		if len(holes) == 0 {
+			return 0, false
+		}
+		hole := holes[0]
+		holes = holes[1:]
+		return hole, true
+	}
+	if err = compact_move_clusters(bs, movers, nextTarget, progress, walks-1, walks); err != nil {
+		return nil, err
+	}
+	result.MovedClusters += uint64(len(movers))
+
+	if end, err = compact_used_end(bs); err != nil {
+		return nil, err
+	}
+	result.NewSize = result.OldSize
+	if end<<s.ClusterBits < result.OldSize {
+		if err = bdrv_truncate(bs.current, end<<s.ClusterBits); err != nil {
+			return nil, fmt.Errorf("failed to truncate the image file, err: %v", err)
+		}
+		result.NewSize = end << s.ClusterBits
+	}
+	if err = bdrv_flush(bs.current.bs); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+/*
+* collect the clusters which can be moved in the guest offset order, i.e. each
+* L2 table followed by its data clusters. a cluster is only movable if it is
+* referenced exactly once.
+ */
+func compact_collect(bs *BlockDriverState) ([]compactCluster, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var clusters []compactCluster
+	var l2Slice unsafe.Pointer
+	var i, j, k uint32
+	var refcount uint64
+	var err error
+	slicesPerTable := s.L2Size / uint32(s.L2SliceSize)
+
+	for i = 0; i < s.L1Size; i++ {
+		l2Offset := s.L1Table[i] & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		if refcount, err = qcow2_get_refcount(bs, l2Offset>>s.ClusterBits); err != nil {
+			return nil, err
+		}
+		if refcount == 1 {
+			clusters = append(clusters, compactCluster{offset: l2Offset, l1Index: i, isL2: true})
+		}
+		for j = 0; j < slicesPerTable; j++ {
+			if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache,
+				l2Offset+uint64(j)*uint64(s.L2SliceSize)*l2_entry_size(s)); err != nil {
+				return nil, err
+			}
+			for k = 0; k < uint32(s.L2SliceSize); k++ {
+				l2Entry := get_l2_entry(s, l2Slice, k)
+				switch qcow2_get_cluster_type(bs, l2Entry) {
+				case QCOW2_CLUSTER_NORMAL, QCOW2_CLUSTER_ZERO_ALLOC:
+				default:
+					/* compressed clusters may span several host clusters */
+					continue
+				}
+				offset := l2Entry & L2E_OFFSET_MASK
+				if refcount, err = qcow2_get_refcount(bs, offset>>s.ClusterBits); err != nil {
+					qcow2_cache_put(s.L2TableCache, l2Slice)
+					return nil, err
+				}
+				if refcount == 1 {
+					clusters = append(clusters, compactCluster{offset: offset, l1Index: i,
+						l2Index: j*uint32(s.L2SliceSize) + k})
+				}
+			}
+			qcow2_cache_put(s.L2TableCache, l2Slice)
+		}
+	}
+	return clusters, nil
+}
+
+func compact_is_sorted(clusters []compactCluster) bool {
+	for i := 1; i < len(clusters); i++ {
+		if clusters[i].offset <= clusters[i-1].offset {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+* find out the clusters to be moved, the image can be packed into as many
+* clusters as are in use, unless an unmovable cluster lies beyond them. the
+* movable clusters beyond the end are returned in the host offset order.
+ */
+func compact_plan(bs *BlockDriverState) ([]compactCluster, uint64, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var movers []compactCluster
+	var used, end, refcount uint64
+	var length uint64
+	var err error
+
+	clusters, err := compact_collect(bs)
+	if err != nil {
+		return nil, 0, err
+	}
+	movable := make(map[uint64]compactCluster, len(clusters))
+	for _, cluster := range clusters {
+		movable[cluster.offset>>s.ClusterBits] = cluster
+	}
+
+	if length, err = bdrv_getlength(bs.current.bs); err != nil {
+		return nil, 0, err
+	}
+	nbClusters := size_to_clusters(s, length)
+	for i := uint64(0); i < nbClusters; i++ {
+		if refcount, err = qcow2_get_refcount(bs, i); err != nil {
+			return nil, 0, err
+		}
+		if refcount == 0 {
+			continue
+		}
+		used++
+		if _, ok := movable[i]; !ok {
+			end = i + 1
+		}
+	}
+	end = max(end, used)
+
+	for i := end; i < nbClusters; i++ {
+		if cluster, ok := movable[i]; ok {
+			movers = append(movers, cluster)
+		}
+	}
+	return movers, end, nil
+}
+
+// the free clusters before end in the ascending order
+func compact_holes(bs *BlockDriverState, end uint64) ([]uint64, error) {
+
+	var holes []uint64
+	var refcount uint64
+	var err error
+
+	for i := uint64(0); i < end; i++ {
+		if refcount, err = qcow2_get_refcount(bs, i); err != nil {
+			return nil, err
+		}
+		if refcount == 0 {
+			holes = append(holes, i)
+		}
+	}
+	return holes, nil
+}
+
+// the index following the last used cluster
+func compact_used_end(bs *BlockDriverState) (uint64, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var refcount, length uint64
+	var err error
+
+	if length, err = bdrv_getlength(bs.current.bs); err != nil {
+		return 0, err
+	}
+	for i := size_to_clusters(s, length); i > 0; i-- {
+		if refcount, err = qcow2_get_refcount(bs, i-1); err != nil {
+			return 0, err
+		}
+		if refcount > 0 {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+/*
+* move the clusters to the targets given by nextTarget, in batches. in each
+* batch the targets are referenced first, then the clusters are copied, then
+* the L1 and L2 entries are switched to the copies and at last the original
+* clusters are freed, every step is flushed before the next one starts, so
+* a crash can leak clusters but never corrupts the image.
+ */
+func compact_move_clusters(bs *BlockDriverState, movers []compactCluster,
+	nextTarget func() (uint64, bool), progress ProgressFunc, index uint64, total uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	buf := make([]byte, s.ClusterSize)
+	targets := make([]uint64, 0, COMPACT_BATCH_CLUSTERS)
+	nbMovers := uint64(len(movers))
+
+	for start := 0; start < len(movers); start += COMPACT_BATCH_CLUSTERS {
+		batch := movers[start:min(start+COMPACT_BATCH_CLUSTERS, len(movers))]
+
+		/* reference the targets */
+		targets = targets[:0]
+		for range batch {
+			var target uint64
+			for {
+				var n uint64
+				var ok bool
+				if target, ok = nextTarget(); !ok {
+					return fmt.Errorf("no free cluster left to move the clusters into")
+				}
+				/* the target may have been taken by a new refcount block */
+				if n, err = qcow2_alloc_clusters_at(bs, target<<s.ClusterBits, 1); err != nil {
+					return err
+				}
+				if n == 1 {
+					break
+				}
+			}
+			targets = append(targets, target<<s.ClusterBits)
+		}
+		if err = qcow2_cache_flush(bs, s.RefcountBlockCache); err != nil {
+			return err
+		}
+
+		/* copy the clusters, the L2 tables must be read up to date */
+		if err = qcow2_cache_empty(bs, s.L2TableCache); err != nil {
+			return err
+		}
+		for i, cluster := range batch {
+			if err = compact_copy_cluster(bs, cluster, targets[i], buf); err != nil {
+				return err
+			}
+		}
+		if err = bdrv_flush(bs.current.bs); err != nil {
+			return err
+		}
+
+		/* switch the references, the L2 tables first */
+		for i, cluster := range batch {
+			if cluster.isL2 {
+				if err = compact_update_l1_entry(bs, cluster, targets[i]); err != nil {
+					return err
+				}
+			}
+		}
+		for i, cluster := range batch {
+			if !cluster.isL2 {
+				if err = compact_update_l2_entry(bs, cluster, targets[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if err = qcow2_cache_flush(bs, s.L2TableCache); err != nil {
+			return err
+		}
+
+		/* free the original clusters */
+		for _, cluster := range batch {
+			qcow2_free_clusters(bs, cluster.offset, uint64(s.ClusterSize), QCOW2_DISCARD_NEVER)
+		}
+		if err = qcow2_cache_flush(bs, s.RefcountBlockCache); err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(index*nbMovers+uint64(start+len(batch)), total*nbMovers)
+		}
+	}
+	return nil
+}
+
+func compact_copy_cluster(bs *BlockDriverState, cluster compactCluster, target uint64, buf []byte) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+	child := s.DataFile
+	if cluster.isL2 {
+		child = bs.current
+	}
+
+	if err = bdrv_pread(child, cluster.offset, unsafe.Pointer(&buf[0]), uint64(s.ClusterSize)); err != nil {
+		return err
+	}
+	if err = qcow2_pre_write_overlap_check(bs, 0, target, uint64(s.ClusterSize), false); err != nil {
+		return err
+	}
+	return bdrv_pwrite(child, target, unsafe.Pointer(&buf[0]), uint64(s.ClusterSize))
+}
+
+func compact_update_l1_entry(bs *BlockDriverState, cluster compactCluster, target uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	oldEntry := s.L1Table[cluster.l1Index]
+
+	if oldEntry&L1E_OFFSET_MASK != cluster.offset {
+		return fmt.Errorf("L1 entry %d doesn't point to the L2 table at 0x%x any more",
+			cluster.l1Index, cluster.offset)
+	}
+	s.L1Table[cluster.l1Index] = target | (oldEntry &^ L1E_OFFSET_MASK)
+	if err := qcow2_write_l1_entry(bs, cluster.l1Index); err != nil {
+		s.L1Table[cluster.l1Index] = oldEntry
+		return err
+	}
+	return nil
+}
+
+func compact_update_l2_entry(bs *BlockDriverState, cluster compactCluster, target uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var l2Slice unsafe.Pointer
+	var err error
+	guestOffset := uint64(cluster.l1Index)<<(s.L2Bits+s.ClusterBits) | uint64(cluster.l2Index)<<s.ClusterBits
+	l2Offset := s.L1Table[cluster.l1Index] & L1E_OFFSET_MASK
+
+	if l2Slice, err = l2_load(bs, guestOffset, l2Offset); err != nil {
+		return err
+	}
+	defer qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	l2Index := uint32(offset_to_l2_slice_index(s, guestOffset))
+	l2Entry := get_l2_entry(s, l2Slice, l2Index)
+	if l2Entry&L2E_OFFSET_MASK != cluster.offset {
+		return fmt.Errorf("L2 entry of the guest offset 0x%x doesn't point to 0x%x any more",
+			guestOffset, cluster.offset)
+	}
+	qcow2_cache_entry_mark_dirty(s.L2TableCache, l2Slice)
+	set_l2_entry(s, l2Slice, l2Index, target|(l2Entry&^L2E_OFFSET_MASK))
+	return nil
+}
@@ -0,0 +1,184 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compact(t *testing.T) {
+	var filename = "/tmp/compact.qcow2"
+	readBuf := make([]byte, 65536)
+
+	root := create_compare_image(t, filename, "")
+	//the host clusters are allocated in the reversed guest offset order
+	for i := 15; i >= 0; i-- {
+		buf := bytes.Repeat([]byte{byte(i + 1)}, 65536)
+		_, err := Blk_Pwrite(root, uint64(i)*65536, buf, 65536, 0)
+		assert.Nil(t, err)
+	}
+	Blk_Close(root)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	//free the host clusters in the middle
+	assert.Nil(t, Blk_Discard(root, 8*65536, 4*65536))
+	Blk_Flush(root)
+	info, err := os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(21*65536), info.Size())
+
+	verify := func() {
+		for i := 0; i < 16; i++ {
+			expected := bytes.Repeat([]byte{byte(i + 1)}, 65536)
+			if i >= 8 && i < 12 {
+				expected = make([]byte, 65536)
+			}
+			_, err := Blk_Pread(root, uint64(i)*65536, readBuf, 65536)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, readBuf)
+		}
+		res, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, res.Corruptions)
+		assert.Equal(t, 0, res.Leaks)
+	}
+
+	res, err := Blk_Compact(root, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), res.MovedClusters)
+	assert.Equal(t, uint64(21*65536), res.OldSize)
+	assert.Equal(t, uint64(17*65536), res.NewSize)
+	info, err = os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17*65536), info.Size())
+	verify()
+
+	//nothing left to compact
+	res, err = Blk_Compact(root, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), res.MovedClusters)
+	assert.Equal(t, res.OldSize, res.NewSize)
+
+	var current, total uint64
+	res, err = Blk_Compact(root, &BlockCompactOptions{Reorder: true},
+		func(c uint64, t uint64) { current, total = c, t })
+	assert.Nil(t, err)
+	assert.Equal(t, total, current)
+	assert.Equal(t, uint64(17*65536), res.NewSize)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	verify()
+	entries, err := Blk_Map(root, 0, 0)
+	assert.Nil(t, err)
+	var last uint64
+	for _, e := range entries {
+		if e.Data {
+			assert.Greater(t, e.Offset, last)
+			last = e.Offset
+		}
+	}
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	defer Blk_Close(root)
+	_, err = Blk_Compact(root, nil, nil)
+	assert.Equal(t, Err_NoWritePerm, err)
+}
+
+// a file protocol whose data writes are slow, signalled on slowWriting once one is started
+var slowWrites int32
+var slowWriting = make(chan struct{}, 1)
+
+func slow_pwritev(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
+	if atomic.LoadInt32(&slowWrites) != 0 && bytes > 65536 {
+		select {
+		case slowWriting <- struct{}{}:
+		default:
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return raw_pwritev(ctx, bs, offset, bytes, qiov, flags)
+}
+
+// open an image on the slow protocol, the 2MiB at 4MiB are allocated at the tail of the file
+// and the holes of discarded clusters are left before them
+func open_slow_image(t *testing.T, filename string) *BdrvChild {
+	if LookupDriver("slowfile") == nil {
+		assert.Nil(t, RegisterDriver(NewBlockDriver("slowfile", false, false, &BlockDriverOps{
+			Open:        raw_open,
+			Close:       raw_close,
+			Create:      raw_create,
+			Getlength:   raw_getlength,
+			Truncate:    raw_truncate,
+			Preadv:      raw_preadv,
+			Pwritev:     slow_pwritev,
+			FlushToDisk: raw_flush_to_disk,
+		})))
+	}
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{
+		OPT_SIZE:     8 * 1048576,
+		OPT_FILENAME: filename,
+		OPT_FMT:      "qcow2",
+		OPT_PROTOCOL: "slowfile",
+	})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_PROTOCOL: "slowfile"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 0, bytes.Repeat([]byte{0x11}, 16*65536), 16*65536, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 4*1048576, bytes.Repeat([]byte{0x22}, 2*1048576), 2*1048576, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, Blk_Discard(root, 4*65536, 8*65536))
+	return root
+}
+
+// the slow write over the 2MiB at 4MiB is started, then the operation runs while it's in flight
+func run_with_slow_write(t *testing.T, root *BdrvChild, op func()) {
+	buf := bytes.Repeat([]byte{0xab}, 2*1048576)
+	var wg sync.WaitGroup
+	atomic.StoreInt32(&slowWrites, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := Blk_Pwrite(root, 4*1048576, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+	}()
+	<-slowWriting
+	op()
+	wg.Wait()
+	atomic.StoreInt32(&slowWrites, 0)
+
+	out := make([]byte, len(buf))
+	_, err := Blk_Pread(root, 4*1048576, out, uint64(len(out)))
+	assert.Nil(t, err)
+	assert.Equal(t, buf, out)
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+}
+
+func Test_compact_in_flight(t *testing.T) {
+	var filename = "/tmp/compact_in_flight.qcow2"
+	root := open_slow_image(t, filename)
+
+	//the compaction waits for the write, the clusters it overwrites are moved afterwards
+	run_with_slow_write(t, root, func() {
+		res, err := Blk_Compact(root, nil, nil)
+		assert.Nil(t, err)
+		assert.Greater(t, res.MovedClusters, uint64(0))
+	})
+	Blk_Close(root)
+	os.Remove(filename)
+}
@@ -0,0 +1,200 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// the deflate writers and readers are big, they are kept for the next clusters
+var (
+	deflaterPool = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	inflaterPool = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+/*
+* compresses the cluster into raw deflate data, which fails with ENOSPC if it's
+* larger than limit. qemu inflates the compressed clusters with a 4KiB window
+* while the deflate writer looks back up to 32KiB, so the history is dropped
+* every 4KiB and no match reaches further back than the window.
+ */
+func qcow2_compress(src []byte, limit uint64) ([]byte, error) {
+
+	var out bytes.Buffer
+	var err error
+	w := deflaterPool.Get().(*flate.Writer)
+	defer deflaterPool.Put(w)
+
+	for start := 0; start < len(src); start += QCOW2_ZLIB_WINDOW_SIZE {
+		end := min(start+QCOW2_ZLIB_WINDOW_SIZE, len(src))
+		/* the flushed blocks end on a byte boundary, so the next writer continues the stream */
+		w.Reset(&out)
+		if _, err = w.Write(src[start:end]); err != nil {
+			return nil, err
+		}
+		if end < len(src) {
+			err = w.Flush()
+		} else {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if uint64(out.Len()) > limit {
+			return nil, ERR_ENOSPC
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// decompresses the raw deflate data, which must fill the whole dest
+func qcow2_decompress(dest []byte, src []byte) error {
+
+	r := inflaterPool.Get().(io.ReadCloser)
+	defer inflaterPool.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return ERR_EIO
+	}
+	if _, err := io.ReadFull(r, dest); err != nil {
+		return ERR_EIO
+	}
+	return nil
+}
+
+/*
+* reads bytes at offset from a compressed cluster, l2Entry is its descriptor.
+* the whole cluster is decompressed since the deflate data can't be entered
+* in the middle.
+ */
+func qcow2_preadv_compressed(ctx context.Context, bs *BlockDriverState, l2Entry uint64,
+	offset uint64, bytes uint64, qiov *QEMUIOVector, qiovOffset uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var localQiov QEMUIOVector
+	var err error
+
+	if s.CompressionType != QCOW2_COMPRESSION_TYPE_ZLIB {
+		return ERR_ENOTSUP
+	}
+
+	coffset, csize := qcow2_parse_compressed_l2_entry(s, l2Entry)
+	buf := make([]byte, csize)
+	outBuf := make([]byte, s.ClusterSize)
+
+	qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&buf[0]), csize)
+	if err = bdrv_preadv_part(ctx, bs.current, coffset, csize, &localQiov, 0, 0); err != nil {
+		return err
+	}
+	if err = qcow2_decompress(outBuf, buf); err != nil {
+		return err
+	}
+	qemu_iovec_from_buf(qiov, qiovOffset, unsafe.Pointer(&outBuf[offset_into_cluster(s, offset)]), bytes)
+	return nil
+}
+
+/*
+* writes whole clusters compressed, offset must be cluster aligned and so must be
+* bytes unless the range ends at the end of the image, the last cluster is padded
+* with zeroes then. the clusters must not be allocated yet. a cluster which doesn't
+* get smaller is written uncompressed.
+*
+* the clusters are compressed one by one in the caller, convert uses several
+* writers to compress in parallel.
+ */
+func qcow2_pwritev_compressed_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+
+	if qcow2_corruption_signaled(s) {
+		return ERR_EIO
+	}
+	if has_data_file(bs) || s.CompressionType != QCOW2_COMPRESSION_TYPE_ZLIB {
+		return ERR_ENOTSUP
+	}
+	if offset_into_cluster(s, offset) > 0 {
+		return ERR_EINVAL
+	}
+	if offset_into_cluster(s, bytes) > 0 &&
+		offset+bytes != bs.TotalSectors<<BDRV_SECTOR_BITS {
+		return ERR_EINVAL
+	}
+
+	for bytes > 0 {
+		chunk := min(bytes, uint64(s.ClusterSize))
+		if err = qcow2_pwritev_compressed_cluster(ctx, bs, offset, chunk, qiov, qiovOffset); err != nil {
+			return err
+		}
+		bytes -= chunk
+		offset += chunk
+		qiovOffset += chunk
+	}
+	return nil
+}
+
+func qcow2_pwritev_compressed_cluster(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var localQiov QEMUIOVector
+	var hostOffset uint64
+	var outBuf []byte
+	var err error
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, s.ClusterSize)
+	qemu_iovec_to_buf(qiov, qiovOffset, unsafe.Pointer(&buf[0]), bytes)
+
+	if outBuf, err = qcow2_compress(buf, uint64(s.ClusterSize)-1); err == ERR_ENOSPC {
+		/* could not compress: write normal cluster */
+		return qcow2_pwritev_part(ctx, bs, offset, bytes, qiov, qiovOffset, 0)
+	} else if err != nil {
+		return err
+	}
+
+	s.Qlock()
+	/* a cluster being allocated by a normal write is linked before it's checked */
+	qcow2_wait_for_allocations(bs, offset, bytes)
+	if hostOffset, err = qcow2_alloc_compressed_cluster_offset(bs, offset, uint64(len(outBuf))); err == nil {
+		err = qcow2_pre_write_overlap_check(bs, 0, hostOffset, uint64(len(outBuf)), true)
+	}
+	s.Qunlock()
+	if err != nil {
+		return err
+	}
+
+	qemu_iovec_init_buf(&localQiov, unsafe.Pointer(&outBuf[0]), uint64(len(outBuf)))
+	return bdrv_pwritev_part(ctx, s.DataFile, hostOffset, uint64(len(outBuf)), &localQiov, 0, 0)
+}
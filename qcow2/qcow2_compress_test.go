@@ -0,0 +1,140 @@
+package qcow2
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compress_window(t *testing.T) {
+	//a random 8KiB block repeated, only a match further back than 4KiB could compress it
+	block := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(block)
+	src := bytes.Repeat(block, 8)
+	_, err := qcow2_compress(src, uint64(len(src))-1)
+	assert.Equal(t, ERR_ENOSPC, err)
+
+	src = bytes.Repeat([]byte("this is a test "), 4369)
+	out, err := qcow2_compress(src, uint64(len(src))-1)
+	assert.Nil(t, err)
+	assert.Less(t, len(out), len(src)/10)
+	dest := make([]byte, len(src))
+	assert.Nil(t, qcow2_decompress(dest, out))
+	assert.True(t, bytes.Equal(src, dest))
+
+	//the compressed data must fill the whole cluster
+	assert.Equal(t, ERR_EIO, qcow2_decompress(make([]byte, len(src)+1), out))
+	assert.Equal(t, ERR_EIO, qcow2_decompress(dest, out[:len(out)/2]))
+}
+
+func Test_compress_convert(t *testing.T) {
+	var srcFile = "/tmp/compress_src.qcow2"
+	var dstFile = "/tmp/compress_dst.qcow2"
+	//the size ends in the middle of a cluster
+	size := uint64(4*1048576 - 1024)
+
+	for _, tc := range []struct {
+		clusterSize uint64
+		subcluster  bool
+	}{{512, false}, {65536, false}, {65536, true}} {
+		os.Remove(srcFile)
+		os.Remove(dstFile)
+		err := Blk_Create(srcFile, map[string]any{OPT_SIZE: size, OPT_FMT: "qcow2", OPT_FILENAME: srcFile})
+		assert.Nil(t, err)
+		src, err := Blk_Open(srcFile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		text := bytes.Repeat([]byte("this is a test "), 70000)
+		random := make([]byte, 65536)
+		rand.New(rand.NewSource(1)).Read(random)
+		_, err = Blk_Pwrite(src, 0, text, uint64(len(text)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(src, 2*1048576, random, uint64(len(random)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(src, size-3000, text[:3000], 3000, 0)
+		assert.Nil(t, err)
+
+		err = Blk_Create(dstFile, map[string]any{OPT_SIZE: size, OPT_FMT: "qcow2", OPT_FILENAME: dstFile,
+			OPT_CLUSTER_SIZE: tc.clusterSize, OPT_SUBCLUSTER: tc.subcluster})
+		assert.Nil(t, err)
+		dst, err := Blk_Open(dstFile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		err = Blk_Convert(src, dst, &BlockConvertOptions{Compress: true, Writers: 4}, nil)
+		assert.Nil(t, err)
+
+		//the text is compressed, the random data is not
+		s := dst.bs.opaque.(*BDRVQcow2State)
+		for _, c := range []struct {
+			offset uint64
+			scType QCow2SubclusterType
+		}{{0, QCOW2_SUBCLUSTER_COMPRESSED}, {2 * 1048576, QCOW2_SUBCLUSTER_NORMAL},
+			{size - 1, QCOW2_SUBCLUSTER_COMPRESSED}} {
+			var hostOffset uint64
+			var scType QCow2SubclusterType
+			bytes := uint32(1)
+			s.Qlock()
+			err = qcow2_get_host_offset(dst.bs, c.offset, &bytes, &hostOffset, &scType)
+			s.Qunlock()
+			assert.Nil(t, err)
+			assert.Equal(t, c.scType, scType, "cluster size %d offset %d", tc.clusterSize, c.offset)
+		}
+		Blk_Close(dst)
+
+		dst, err = Blk_Open(dstFile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_UNMAP)
+		assert.Nil(t, err)
+		res, err := Blk_Compare(src, dst, false, nil)
+		assert.Nil(t, err)
+		assert.True(t, res.Identical, "cluster size %d", tc.clusterSize)
+		check, err := Blk_Check(dst, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, check.Corruptions+check.Leaks+check.CheckErrors, "cluster size %d", tc.clusterSize)
+		info, err := os.Stat(dstFile)
+		assert.Nil(t, err)
+		assert.Less(t, info.Size(), int64(len(text)/2))
+
+		//a compressed cluster is copied on write, another one is discarded
+		buf := ([]byte)("overwritten")
+		_, err = Blk_Pwrite(src, 100, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(dst, 100, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite_Zeroes(src, 1048576, 65536, 0)
+		assert.Nil(t, err)
+		assert.Nil(t, Blk_Discard(dst, 1048576, 65536))
+		res, err = Blk_Compare(src, dst, false, nil)
+		assert.Nil(t, err)
+		assert.True(t, res.Identical, "cluster size %d", tc.clusterSize)
+		check, err = Blk_Check(dst, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, check.Corruptions+check.Leaks+check.CheckErrors, "cluster size %d", tc.clusterSize)
+
+		//compressed clusters are only written to unallocated clusters, at the cluster boundaries
+		_, err = Blk_Pwrite(dst, 0, text[:tc.clusterSize], tc.clusterSize, BDRV_REQ_WRITE_COMPRESSED)
+		assert.Equal(t, ERR_EIO, err)
+		_, err = Blk_Pwrite(dst, 3*1048576+512, text[:tc.clusterSize], tc.clusterSize, BDRV_REQ_WRITE_COMPRESSED)
+		if tc.clusterSize > 512 {
+			assert.Equal(t, ERR_EINVAL, err)
+		}
+		Blk_Close(dst)
+		Blk_Close(src)
+	}
+
+	//only qcow2 targets support compression
+	rawFile := "/tmp/compress_dst.raw"
+	os.Remove(rawFile)
+	err := Blk_Create(rawFile, map[string]any{OPT_SIZE: size, OPT_FMT: "raw", OPT_FILENAME: rawFile})
+	assert.Nil(t, err)
+	raw, err := Blk_Open(rawFile, map[string]any{OPT_FMT: "raw"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	src, err := Blk_Open(srcFile, map[string]any{OPT_FMT: "qcow2"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, ERR_ENOTSUP, Blk_Convert(src, raw, &BlockConvertOptions{Compress: true}, nil))
+	Blk_Close(src)
+	Blk_Close(raw)
+
+	os.Remove(srcFile)
+	os.Remove(dstFile)
+	os.Remove(rawFile)
+}
@@ -0,0 +1,235 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+var metadata_ol_names = [QCOW2_OL_MAX_BITNR]string{
+	QCOW2_OL_MAIN_HEADER_BITNR:    "qcow2_header",
+	QCOW2_OL_ACTIVE_L1_BITNR:      "active L1 table",
+	QCOW2_OL_ACTIVE_L2_BITNR:      "active L2 table",
+	QCOW2_OL_REFCOUNT_TABLE_BITNR: "refcount table",
+	QCOW2_OL_REFCOUNT_BLOCK_BITNR: "refcount block",
+	QCOW2_OL_SNAPSHOT_TABLE_BITNR: "snapshot table",
+	QCOW2_OL_INACTIVE_L1_BITNR:    "inactive L1 table",
+	QCOW2_OL_INACTIVE_L2_BITNR:    "inactive L2 table",
+}
+
+// parse the value of the overlap-check open option
+func qcow2_parse_overlap_check(template string) (Qcow2MetadataOverlap, error) {
+	switch template {
+	case "none":
+		return QCOW2_OL_NONE, nil
+	case "constant":
+		return QCOW2_OL_CONSTANT, nil
+	case "cached":
+		return QCOW2_OL_CACHED, nil
+	case "all":
+		return QCOW2_OL_ALL, nil
+	}
+	return QCOW2_OL_NONE, fmt.Errorf("unsupported value '%s' for %s, expected none, constant, cached or all",
+		template, OPT_OVERLAP_CHECK)
+}
+
+/*
+* Checks whether the given cluster range overlaps with any metadata structure.
+* Returns a bitmask of the overlapping metadata types (QCOW2_OL_*, only the
+* first type found is reported), or 0 if there is no overlap.
+* ign is a bitmask of the metadata types to be ignored.
+ */
+func qcow2_check_metadata_overlap(bs *BlockDriverState, ign Qcow2MetadataOverlap,
+	offset uint64, size uint64) (Qcow2MetadataOverlap, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	chk := s.OverlapCheck &^ ign
+	var err error
+
+	if size == 0 {
+		return 0, nil
+	}
+
+	if chk&QCOW2_OL_MAIN_HEADER > 0 {
+		if offset < uint64(s.ClusterSize) {
+			return QCOW2_OL_MAIN_HEADER, nil
+		}
+	}
+
+	/* align range to test to cluster boundaries */
+	size = round_up(offset_into_cluster(s, offset)+size, uint64(s.ClusterSize))
+	offset = start_of_cluster(s, offset)
+
+	overlapsWith := func(ofs uint64, sz uint64) bool {
+		return ranges_overlap(offset, size, ofs, sz)
+	}
+
+	if chk&QCOW2_OL_ACTIVE_L1 > 0 && s.L1Size > 0 {
+		if overlapsWith(s.L1TableOffset, uint64(s.L1Size)*L1E_SIZE) {
+			return QCOW2_OL_ACTIVE_L1, nil
+		}
+	}
+
+	if chk&QCOW2_OL_REFCOUNT_TABLE > 0 && s.RefcountTableSize > 0 {
+		if overlapsWith(s.RefcountTableOffset, uint64(s.RefcountTableSize)*REFTABLE_ENTRY_SIZE) {
+			return QCOW2_OL_REFCOUNT_TABLE, nil
+		}
+	}
+
+	if chk&QCOW2_OL_SNAPSHOT_TABLE > 0 && s.SnapshotsSize > 0 {
+		if overlapsWith(s.SnapshotsOffset, s.SnapshotsSize) {
+			return QCOW2_OL_SNAPSHOT_TABLE, nil
+		}
+	}
+
+	if chk&QCOW2_OL_INACTIVE_L1 > 0 {
+		for _, sn := range s.Snapshots {
+			if sn.L1Size > 0 && overlapsWith(sn.L1TableOffset, uint64(sn.L1Size)*L1E_SIZE) {
+				return QCOW2_OL_INACTIVE_L1, nil
+			}
+		}
+	}
+
+	if chk&QCOW2_OL_ACTIVE_L2 > 0 && s.L1Table != nil {
+		for i := uint32(0); i < s.L1Size; i++ {
+			l2Offset := s.L1Table[i] & L1E_OFFSET_MASK
+			if l2Offset > 0 && overlapsWith(l2Offset, uint64(s.ClusterSize)) {
+				return QCOW2_OL_ACTIVE_L2, nil
+			}
+		}
+	}
+
+	if chk&QCOW2_OL_REFCOUNT_BLOCK > 0 && s.RefcountTable != nil {
+		lastEntry := min(uint64(s.MaxRefcountTableIndex), uint64(len(s.RefcountTable)-1))
+		for i := uint64(0); i <= lastEntry; i++ {
+			refblockOffset := s.RefcountTable[i] & REFT_OFFSET_MASK
+			if refblockOffset > 0 && overlapsWith(refblockOffset, uint64(s.ClusterSize)) {
+				return QCOW2_OL_REFCOUNT_BLOCK, nil
+			}
+		}
+	}
+
+	if chk&QCOW2_OL_INACTIVE_L2 > 0 {
+		for _, sn := range s.Snapshots {
+			if sn.L1Size == 0 {
+				continue
+			}
+			l1 := make([]uint64, sn.L1Size)
+			if err = bdrv_pread(bs.current, sn.L1TableOffset, unsafe.Pointer(&l1[0]),
+				uint64(sn.L1Size)*L1E_SIZE); err != nil {
+				return 0, err
+			}
+			for j := range l1 {
+				l2Offset := be64_to_cpu(l1[j]) & L1E_OFFSET_MASK
+				if l2Offset > 0 && overlapsWith(l2Offset, uint64(s.ClusterSize)) {
+					return QCOW2_OL_INACTIVE_L2, nil
+				}
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+/*
+* Returns an error if the given write request would overwrite metadata, and
+* marks the image corrupt in that case. dataFile tells whether the write goes
+* to the data file, metadata can not be overlapped then if an external data
+* file is used.
+ */
+func qcow2_pre_write_overlap_check(bs *BlockDriverState, ign Qcow2MetadataOverlap,
+	offset uint64, size uint64, dataFile bool) error {
+
+	if dataFile && has_data_file(bs) {
+		return nil
+	}
+
+	ret, err := qcow2_check_metadata_overlap(bs, ign, offset, size)
+	if err != nil {
+		return err
+	} else if ret > 0 {
+		bitnr := bits.TrailingZeros32(uint32(ret))
+		Assert(bitnr < QCOW2_OL_MAX_BITNR)
+		return qcow2_signal_corruption(bs, offset, size,
+			"Preventing invalid write on metadata (overlaps with %s)", metadata_ol_names[bitnr])
+	}
+	return nil
+}
+
+// whether a corruption was signaled, the flag is set with s.Lock held by a writer
+func qcow2_corruption_signaled(s *BDRVQcow2State) bool {
+	s.Qlock()
+	defer s.Qunlock()
+	return s.SignaledCorruption
+}
+
+/*
+* Marks the image as corrupt and makes it refuse any further writes, it must be
+* called with s.Lock held. Only the first corruption is kept as the reason, which
+* the image info reports, further corruption events are suppressed. It returns EIO
+* for the caller to fail with, or the error of marking the image header.
+ */
+func qcow2_signal_corruption(bs *BlockDriverState, offset uint64, size uint64,
+	format string, args ...any) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	if s.SignaledCorruption {
+		return ERR_EIO
+	}
+	s.SignaledCorruption = true
+	s.CorruptionReason = fmt.Sprintf("%s (offset: %#x, length: %#x)", fmt.Sprintf(format, args...), offset, size)
+	if err := qcow2_mark_corrupt(bs); err != nil {
+		return fmt.Errorf("failed to mark the image as corrupt (%s), err: %v", s.CorruptionReason, err)
+	}
+	return ERR_EIO
+}
+
+// marks the image as corrupt in the image header
+func qcow2_mark_corrupt(bs *BlockDriverState) error {
+
+	header := bs.current.header
+	if header == nil {
+		return Err_NullObject
+	}
+	header.IncompatibleFeatures |= QCOW2_INCOMPAT_CORRUPT
+	if err := qcow2_update_header(bs); err != nil {
+		return err
+	}
+	return bdrv_flush(bs.current.bs)
+}
+
+// clears the corrupt flag in the image header, it is used after the image has been repaired
+func qcow2_mark_consistent(bs *BlockDriverState) error {
+
+	header := bs.current.header
+	if header == nil {
+		return Err_NullObject
+	}
+	if header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT == 0 {
+		return nil
+	}
+	header.IncompatibleFeatures &^= QCOW2_INCOMPAT_CORRUPT
+	if err := qcow2_update_header(bs); err != nil {
+		return err
+	}
+	return bdrv_flush(bs.current.bs)
+}
@@ -0,0 +1,189 @@
+package qcow2
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_overlap_check_templates(t *testing.T) {
+	var filename = "/tmp/overlap_templates.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	l2Offset := s.L1Table[0] & L1E_OFFSET_MASK
+	refblockOffset := s.RefcountTable[0] & REFT_OFFSET_MASK
+
+	for _, template := range []string{"none", "constant", "cached", "all"} {
+		overlapCheck, err := qcow2_parse_overlap_check(template)
+		assert.Nil(t, err)
+		s.OverlapCheck = overlapCheck
+
+		ret, err := qcow2_check_metadata_overlap(bs, 0, 0, 512)
+		assert.Nil(t, err)
+		ret2, err := qcow2_check_metadata_overlap(bs, 0, s.L1TableOffset+8, 8)
+		assert.Nil(t, err)
+		ret3, err := qcow2_check_metadata_overlap(bs, 0, l2Offset+4096, 512)
+		assert.Nil(t, err)
+		ret4, err := qcow2_check_metadata_overlap(bs, 0, refblockOffset, DEFAULT_CLUSTER_SIZE)
+		assert.Nil(t, err)
+		ret5, err := qcow2_check_metadata_overlap(bs, QCOW2_OL_ACTIVE_L2, l2Offset, DEFAULT_CLUSTER_SIZE)
+		assert.Nil(t, err)
+
+		switch template {
+		case "none":
+			assert.Equal(t, Qcow2MetadataOverlap(0), ret|ret2|ret3|ret4)
+		case "constant":
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_MAIN_HEADER), ret)
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_ACTIVE_L1), ret2)
+			assert.Equal(t, Qcow2MetadataOverlap(0), ret3|ret4)
+		default:
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_MAIN_HEADER), ret)
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_ACTIVE_L1), ret2)
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_ACTIVE_L2), ret3)
+			assert.Equal(t, Qcow2MetadataOverlap(QCOW2_OL_REFCOUNT_BLOCK), ret4)
+		}
+		assert.Equal(t, Qcow2MetadataOverlap(0), ret5)
+	}
+
+	_, err := qcow2_parse_overlap_check("some")
+	assert.NotNil(t, err)
+	Blk_Close(root)
+
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2", OPT_OVERLAP_CHECK: "some"}, BDRV_O_RDWR)
+	assert.NotNil(t, err)
+	os.Remove(filename)
+}
+
+func Test_overlap_check_prevent_write(t *testing.T) {
+	var filename = "/tmp/overlap_prevent.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+
+	//let the first data cluster point to the L1 table
+	l2Slice, l2Index, err := get_cluster_table(bs, 0)
+	assert.Nil(t, err)
+	l2Entry := get_l2_entry(s, l2Slice, l2Index)
+	set_l2_entry(s, l2Slice, l2Index, s.L1TableOffset|QCOW_OFLAG_COPIED)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	buf := make([]byte, 4096)
+	_, err = Blk_Pwrite(root, 0, buf, 4096, 0)
+	assert.Equal(t, ERR_EIO, err)
+	assert.True(t, bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0)
+	assert.Contains(t, s.CorruptionReason, "overlaps with active L1 table")
+
+	//the L1 table is intact
+	l1Table := make([]uint64, 1)
+	_, err = Blk_Pread_Object(bs.current, s.L1TableOffset, l1Table, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, s.L1Table[0], l1Table[0])
+
+	//any further write is refused
+	_, err = Blk_Pwrite(root, 2*1048576, buf, 4096, 0)
+	assert.Equal(t, ERR_EIO, err)
+
+	l2Slice, l2Index, err = get_cluster_table(bs, 0)
+	assert.Nil(t, err)
+	set_l2_entry(s, l2Slice, l2Index, l2Entry)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+	Blk_Close(root)
+
+	//a corrupt image can only be opened read-only or for repairing
+	_, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Equal(t, Err_ImageCorrupt, err)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR|BDRV_O_CHECK)
+	assert.Nil(t, err)
+	res, err := Blk_Check(root, BDRV_FIX_LEAKS|BDRV_FIX_ERRORS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.False(t, root.bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0)
+	Blk_Close(root)
+
+	root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite(root, 0, buf, 4096, 0)
+	assert.Nil(t, err)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_overlap_check_refcount_table_entry(t *testing.T) {
+	var filename = "/tmp/overlap_reftable_entry.qcow2"
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	assert.Nil(t, Blk_Flush(root))
+	l2Offset := s.L1Table[0] & L1E_OFFSET_MASK
+	l2Table := make([]byte, 8)
+	_, err := Blk_Pread(bs.current, l2Offset, l2Table, 8)
+	assert.Nil(t, err)
+
+	//let the second refcount table entry fall on the L2 table
+	s.RefcountTableOffset = l2Offset - REFTABLE_ENTRY_SIZE
+	Assert(s.RefcountTable[1] == 0)
+	s.Qlock()
+	_, err = alloc_refcount_block(bs, uint64(s.RefcountBlockSize))
+	s.Qunlock()
+	assert.Equal(t, ERR_EIO, err)
+	assert.True(t, bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0)
+
+	//the L2 table is intact
+	buf := make([]byte, 8)
+	_, err = Blk_Pread(bs.current, l2Offset, buf, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, l2Table, buf)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_overlap_check_parallel_writers(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), "overlap_parallel.qcow2")
+	const writers = 8
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	root := prepare_check_image(t, filename, false)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+
+	//let the first data cluster point to the L1 table
+	l2Slice, l2Index, err := get_cluster_table(bs, 0)
+	assert.Nil(t, err)
+	set_l2_entry(s, l2Slice, l2Index, s.L1TableOffset|QCOW_OFLAG_COPIED)
+	qcow2_cache_put(s.L2TableCache, l2Slice)
+
+	//one writer hits the corruption while the others write and zero their clusters
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for j := 0; j < 20; j++ {
+				offset := uint64(1+i*writers+j%writers) * DEFAULT_CLUSTER_SIZE
+				if i == 0 && j == 10 {
+					offset = 0
+				}
+				_, err := Blk_Pwrite(root, offset, buf, 4096, 0)
+				if err == nil {
+					_, err = Blk_Pwrite_Zeroes(root, offset, 4096, 0)
+				}
+				if err != nil {
+					assert.Equal(t, ERR_EIO, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0)
+	assert.Contains(t, s.CorruptionReason, "overlaps with active L1 table")
+	_, err = Blk_Pwrite(root, 2*1048576, make([]byte, 4096), 4096, 0)
+	assert.Equal(t, ERR_EIO, err)
+	Blk_Close(root)
+}
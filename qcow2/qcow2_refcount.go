@@ -21,20 +21,107 @@ SOFTWARE.
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"math"
 	"unsafe"
 )
 
-func get_refcount(refcountArray unsafe.Pointer, index uint64) uint16 {
+// the refcount accessors indexed by the refcount order, the refcounts
+// narrower than a byte are packed from the least significant bit
+var get_refcount_funcs = [...]Get_Refcount_Func{
+	get_refcount_ro0,
+	get_refcount_ro1,
+	get_refcount_ro2,
+	get_refcount_ro3,
+	get_refcount_ro4,
+	get_refcount_ro5,
+	get_refcount_ro6,
+}
+
+var set_refcount_funcs = [...]Set_Refcount_Func{
+	set_refcount_ro0,
+	set_refcount_ro1,
+	set_refcount_ro2,
+	set_refcount_ro3,
+	set_refcount_ro4,
+	set_refcount_ro5,
+	set_refcount_ro6,
+}
+
+func refcount_byte(refcountArray unsafe.Pointer, index uint64) *uint8 {
+	return (*uint8)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index)))
+}
+
+func get_refcount_ro0(refcountArray unsafe.Pointer, index uint64) uint64 {
+	return uint64(*refcount_byte(refcountArray, index/8)>>(index%8)) & 0x1
+}
+
+func set_refcount_ro0(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>1 == 0)
+	p := refcount_byte(refcountArray, index/8)
+	*p = *p&^(0x1<<(index%8)) | uint8(value)<<(index%8)
+}
+
+func get_refcount_ro1(refcountArray unsafe.Pointer, index uint64) uint64 {
+	return uint64(*refcount_byte(refcountArray, index/4)>>(2*(index%4))) & 0x3
+}
+
+func set_refcount_ro1(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>2 == 0)
+	p := refcount_byte(refcountArray, index/4)
+	*p = *p&^(0x3<<(2*(index%4))) | uint8(value)<<(2*(index%4))
+}
+
+func get_refcount_ro2(refcountArray unsafe.Pointer, index uint64) uint64 {
+	return uint64(*refcount_byte(refcountArray, index/2)>>(4*(index%2))) & 0xf
+}
+
+func set_refcount_ro2(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>4 == 0)
+	p := refcount_byte(refcountArray, index/2)
+	*p = *p&^(0xf<<(4*(index%2))) | uint8(value)<<(4*(index%2))
+}
+
+func get_refcount_ro3(refcountArray unsafe.Pointer, index uint64) uint64 {
+	return uint64(*refcount_byte(refcountArray, index))
+}
+
+func set_refcount_ro3(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>8 == 0)
+	*refcount_byte(refcountArray, index) = uint8(value)
+}
+
+func get_refcount_ro4(refcountArray unsafe.Pointer, index uint64) uint64 {
 	value := *(*uint16)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*2))) //uint16 occpies 2 bytes.
-	value = be16_to_cpu(value)
-	return value
+	return uint64(be16_to_cpu(value))
 }
 
-func set_refcount(refcountArray unsafe.Pointer, index uint64, value uint16) {
+func set_refcount_ro4(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>16 == 0)
 	p := (*uint16)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*2))) //uint16 occpies 2 bytes.
-	*p = cpu_to_be16(value)
+	*p = cpu_to_be16(uint16(value))
+}
+
+func get_refcount_ro5(refcountArray unsafe.Pointer, index uint64) uint64 {
+	value := *(*uint32)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*4))) //uint32 occpies 4 bytes.
+	return uint64(be32_to_cpu(value))
+}
+
+func set_refcount_ro5(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	Assert(value>>32 == 0)
+	p := (*uint32)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*4))) //uint32 occpies 4 bytes.
+	*p = cpu_to_be32(uint32(value))
+}
+
+func get_refcount_ro6(refcountArray unsafe.Pointer, index uint64) uint64 {
+	value := *(*uint64)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*8))) //uint64 occpies 8 bytes.
+	return be64_to_cpu(value)
+}
+
+func set_refcount_ro6(refcountArray unsafe.Pointer, index uint64, value uint64) {
+	p := (*uint64)(unsafe.Pointer(uintptr(refcountArray) + uintptr(index*8))) //uint64 occpies 8 bytes.
+	*p = cpu_to_be64(value)
 }
 
 // Initate the refcount table
@@ -67,14 +154,14 @@ func load_refcount_block(bs *BlockDriverState, refcountBlockOffset uint64) (unsa
 	return qcow2_cache_get(bs, s.RefcountBlockCache, refcountBlockOffset)
 }
 
-func qcow2_get_refcount(bs *BlockDriverState, clusterIndex uint64) (uint16, error) {
+func qcow2_get_refcount(bs *BlockDriverState, clusterIndex uint64) (uint64, error) {
 	s := bs.opaque.(*BDRVQcow2State)
 	var refcountTableIndex, blockIndex uint64
 	var refcountBlockOffset uint64
 	var err error
 	var refcountBlock unsafe.Pointer
 
-	refcount := uint16(0)
+	refcount := uint64(0)
 	refcountTableIndex = clusterIndex >> s.RefcountBlockBits
 	if refcountTableIndex >= uint64(s.RefcountTableSize) {
 		return 0, nil
@@ -178,6 +265,10 @@ func alloc_refcount_block(bs *BlockDriverState, clusterIndex uint64) (unsafe.Poi
 
 	if refcountTableIndex < uint64(s.RefcountTableSize) {
 		data64 = cpu_to_be64(newBlockOffset)
+		if err = qcow2_pre_write_overlap_check(bs, QCOW2_OL_REFCOUNT_TABLE,
+			s.RefcountTableOffset+refcountTableIndex*REFTABLE_ENTRY_SIZE, REFTABLE_ENTRY_SIZE, false); err != nil {
+			goto fail
+		}
 		if err = bdrv_pwrite(bs.current, s.RefcountTableOffset+refcountTableIndex*REFTABLE_ENTRY_SIZE,
 			unsafe.Pointer(&data64), REFTABLE_ENTRY_SIZE); err != nil {
 			goto fail
@@ -230,7 +321,7 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 	Assert((startOffset % uint64(s.ClusterSize)) == 0)
 
 	qcow2_refcount_metadata_size(startOffset/uint64(s.ClusterSize)+additionalClusters,
-		uint64(s.ClusterSize), QCOW2_REFCOUNT_ORDER,
+		uint64(s.ClusterSize), int(s.RefcountOrder),
 		!exactSize, &totalRefblockCount_u64)
 
 	if totalRefblockCount_u64 > QCOW_MAX_REFTABLE_SIZE {
@@ -268,7 +359,7 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 	}
 
 	if newRefblockOffset > 0 {
-		Assert(newRefblockOffset < totalRefblockCount)
+		Assert(newRefblockIndex < totalRefblockCount)
 		newTable[newRefblockIndex] = newRefblockOffset
 	}
 
@@ -316,7 +407,7 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 				j = 0
 			}
 
-			endIndex = min((endIndex-firstOffsetCovered)/uint64(s.ClusterSize), uint64(s.RefcountBlockSize))
+			endIndex = min((endOffset-firstOffsetCovered)/uint64(s.ClusterSize), uint64(s.RefcountBlockSize))
 
 			for ; j < endIndex; j++ {
 				s.set_refcount(refblockData, j, 1)
@@ -338,6 +429,9 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 		newTable[i] = cpu_to_be64(newTable[i])
 	}
 
+	if err = qcow2_pre_write_overlap_check(bs, 0, tableOffset, tableSize*REFTABLE_ENTRY_SIZE, false); err != nil {
+		goto fail
+	}
 	if err = bdrv_pwrite(bs.current, tableOffset, unsafe.Pointer(&newTable[0]), tableSize*REFTABLE_ENTRY_SIZE); err != nil {
 		goto fail
 	}
@@ -346,11 +440,10 @@ func qcow2_refcount_area(bs *BlockDriverState, startOffset uint64, additionalClu
 		newTable[i] = be64_to_cpu(newTable[i])
 	}
 
-	//TODO2
-	//update the header for the new refcount table
-	//since one refcount table can hold up to 16TiB data, and the qcow2 is limited to 4TiB, so never reach here
-	//just reserved for sometime in future that we unlimit it.
-	Assert(false)
+	/* Enter the new refcount table into the image header */
+	if err = qcow2_update_header_reftable(bs, tableOffset, uint32(tableClusters)); err != nil {
+		goto fail
+	}
 
 	/* And switch it in memory */
 	oldTableOffset = uint64(s.RefcountTableOffset)
@@ -391,7 +484,7 @@ func update_refcount(bs *BlockDriverState, offset uint64, length uint64, addend
 	last = start_of_cluster(s, offset+length-1)
 	for clusterOffset = start; clusterOffset <= last; clusterOffset += uint64(s.ClusterSize) {
 		var blockIndex int64
-		var refcount uint16
+		var refcount uint64
 		clusterIndex := int64(clusterOffset >> s.ClusterBits)
 		tableIndex := int64(clusterIndex >> s.RefcountBlockBits)
 		/* Load the refcount block and allocate it if needed */
@@ -413,20 +506,25 @@ func update_refcount(bs *BlockDriverState, offset uint64, length uint64, addend
 		blockIndex = clusterIndex & int64(s.RefcountBlockSize-1)
 		refcount = s.get_refcount(refcountBlock, uint64(blockIndex))
 
-		if (decrease && refcount-uint16(addend) > refcount) || (!decrease && (refcount+uint16(addend) < refcount)) {
+		if (decrease && refcount-addend > refcount) ||
+			(!decrease && (refcount+addend < refcount || refcount+addend > s.RefcountMax)) {
 			err = ERR_EINVAL
 			goto fail
 		}
 
 		if decrease {
-			refcount -= uint16(addend)
+			refcount -= addend
 		} else {
-			refcount += uint16(addend)
+			refcount += addend
 		}
 
 		if refcount == 0 && uint64(clusterIndex) < s.FreeClusterIndex {
 			s.FreeClusterIndex = uint64(clusterIndex)
 		}
+		/* a freed cluster may be allocated as a whole, the compressed clusters can't share it any more */
+		if refcount == 0 && s.FreeByteOffset > 0 && start_of_cluster(s, s.FreeByteOffset) == clusterOffset {
+			s.FreeByteOffset = 0
+		}
 		s.set_refcount(refcountBlock, uint64(blockIndex), refcount)
 
 		if refcount == 0 {
@@ -476,7 +574,7 @@ func alloc_clusters_noref(bs *BlockDriverState, size uint64, max uint64) (uint64
 
 	s := bs.opaque.(*BDRVQcow2State)
 	var nbClusters uint64
-	var refcount uint16
+	var refcount uint64
 	var err error
 
 	nbClusters = size_to_clusters(s, size)
@@ -515,11 +613,77 @@ func qcow2_alloc_clusters(bs *BlockDriverState, size uint64) (uint64, error) {
 	return offset, err
 }
 
+/*
+* allocates size bytes for a compressed cluster, the compressed clusters are packed
+* one after another into the host clusters, which are shared by them. the data may
+* span two host clusters if they are contiguous.
+ */
+func qcow2_alloc_bytes(bs *BlockDriverState, size uint64) (uint64, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var offset, freeInCluster, newCluster, refcount uint64
+	var err error
+
+	Assert(size > 0 && size <= uint64(s.ClusterSize))
+	Assert(s.FreeByteOffset == 0 || offset_into_cluster(s, s.FreeByteOffset) > 0)
+
+	offset = s.FreeByteOffset
+	if offset > 0 {
+		if refcount, err = qcow2_get_refcount(bs, offset>>s.ClusterBits); err != nil {
+			return 0, err
+		}
+		if refcount == s.RefcountMax {
+			offset = 0
+		}
+	}
+
+	freeInCluster = uint64(s.ClusterSize) - offset_into_cluster(s, offset)
+	for {
+		if offset == 0 || freeInCluster < size {
+			if newCluster, err = alloc_clusters_noref(bs, uint64(s.ClusterSize),
+				min(s.ClusterOffsetMask, MAX_QCOW2_SIZE)); err != nil {
+				return 0, err
+			}
+			if newCluster == 0 {
+				return 0, qcow2_signal_corruption(bs, 0, 0,
+					"Preventing invalid allocation of compressed cluster at offset 0")
+			}
+			if offset == 0 || round_up(offset, uint64(s.ClusterSize)) != newCluster {
+				offset = newCluster
+				freeInCluster = uint64(s.ClusterSize)
+			} else {
+				freeInCluster += uint64(s.ClusterSize)
+			}
+		}
+
+		Assert(offset > 0)
+		if err = update_refcount(bs, offset, size, 1, false, QCOW2_DISCARD_NEVER); err != nil {
+			offset = 0
+		}
+		if err != ERR_EAGAIN {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	/* The cluster refcount was incremented; refcount blocks must be flushed
+	 * before the caller's L2 table updates. */
+	qcow2_cache_set_dependency(bs, s.L2TableCache, s.RefcountBlockCache)
+
+	s.FreeByteOffset = offset + size
+	if offset_into_cluster(s, s.FreeByteOffset) == 0 {
+		s.FreeByteOffset = 0
+	}
+	return offset, nil
+}
+
 func qcow2_alloc_clusters_at(bs *BlockDriverState, offset uint64, nbClusters int64) (uint64, error) {
 
 	s := bs.opaque.(*BDRVQcow2State)
 	var clusterIndex, i uint64
-	var refcount uint16
+	var refcount uint64
 	var err error
 
 	Assert(nbClusters >= 0)
@@ -634,7 +798,296 @@ func qcow2_process_discards(bs *BlockDriverState, err error) {
 		d = e.Value.(*Qcow2DiscardRegion)
 		s.Discards.Remove(e)
 		if err == nil {
-			bdrv_pdiscard(bs.current, d.offset, d.bytes)
+			bdrv_pdiscard(context.Background(), bs.current, d.offset, d.bytes)
 		}
 	}
 }
+
+// the operation applied to every new refblock of the walk over the reftable
+type refblockFinishOp func(bs *BlockDriverState, reftable *[]uint64, reftableIndex uint64,
+	refblock []byte, refblockEmpty bool, allocated *bool) error
+
+/*
+* walks over the refcount structures and turns the refcounts into new refblocks
+* of the new width, the operation is called whenever a new refblock is complete.
+* the new refblock is only filled if newSetRefcount is given.
+ */
+func walk_over_reftable(bs *BlockDriverState, newReftable *[]uint64, newReftableIndex *uint64,
+	newRefblock []byte, newRefblockSize uint64, newRefcountBits uint64,
+	operation refblockFinishOp, allocated *bool, newSetRefcount Set_Refcount_Func,
+	progress ProgressFunc, index uint64, total uint64) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var reftableIndex, refblockIndex, newRefblockIndex, refcount uint64
+	var refblock unsafe.Pointer
+	var err error
+	newRefblockEmpty := true
+	/* the entries beyond the last used one are all empty */
+	tableSize := uint64(s.MaxRefcountTableIndex) + 1
+
+	for reftableIndex = 0; reftableIndex < tableSize; reftableIndex++ {
+		refblockOffset := s.RefcountTable[reftableIndex] & REFT_OFFSET_MASK
+		if progress != nil {
+			progress(index*tableSize+reftableIndex, total*tableSize)
+		}
+
+		refblock = nil
+		if refblockOffset > 0 {
+			if offset_into_cluster(s, refblockOffset) > 0 {
+				return qcow2_signal_corruption(bs, 0, 0, "Refblock offset %#x unaligned (reftable index: %#x)",
+					refblockOffset, reftableIndex)
+			}
+			if refblock, err = qcow2_cache_get(bs, s.RefcountBlockCache, refblockOffset); err != nil {
+				return err
+			}
+		}
+
+		for refblockIndex = 0; refblockIndex < uint64(s.RefcountBlockSize); refblockIndex++ {
+			if newRefblockIndex >= newRefblockSize {
+				/* newRefblock is now complete */
+				if err = operation(bs, newReftable, *newReftableIndex, newRefblock,
+					newRefblockEmpty, allocated); err != nil {
+					if refblock != nil {
+						qcow2_cache_put(s.RefcountBlockCache, refblock)
+					}
+					return err
+				}
+				(*newReftableIndex)++
+				newRefblockIndex = 0
+				newRefblockEmpty = true
+			}
+
+			/* no refblock means every refcount is 0 */
+			refcount = 0
+			if refblock != nil {
+				refcount = s.get_refcount(refblock, refblockIndex)
+			}
+			if newRefcountBits < 64 && refcount>>newRefcountBits > 0 {
+				offset := ((reftableIndex << s.RefcountBlockBits) + refblockIndex) << s.ClusterBits
+				qcow2_cache_put(s.RefcountBlockCache, refblock)
+				return fmt.Errorf("cannot decrease refcount entry width to %d bits: "+
+					"cluster at offset %#x has a refcount of %d", newRefcountBits, offset, refcount)
+			}
+
+			if newSetRefcount != nil {
+				newSetRefcount(unsafe.Pointer(&newRefblock[0]), newRefblockIndex, refcount)
+			}
+			newRefblockIndex++
+			newRefblockEmpty = newRefblockEmpty && refcount == 0
+		}
+		if refblock != nil {
+			qcow2_cache_put(s.RefcountBlockCache, refblock)
+		}
+	}
+
+	if newRefblockIndex > 0 {
+		/* Complete the potentially existing partially filled final refblock */
+		if newSetRefcount != nil {
+			for ; newRefblockIndex < newRefblockSize; newRefblockIndex++ {
+				newSetRefcount(unsafe.Pointer(&newRefblock[0]), newRefblockIndex, 0)
+			}
+		}
+		if err = operation(bs, newReftable, *newReftableIndex, newRefblock,
+			newRefblockEmpty, allocated); err != nil {
+			return err
+		}
+		(*newReftableIndex)++
+	}
+
+	if progress != nil {
+		progress((index+1)*tableSize, total*tableSize)
+	}
+	return nil
+}
+
+// allocates the new refblock if it isn't empty, the new reftable grows as needed
+func alloc_refblock(bs *BlockDriverState, reftable *[]uint64, reftableIndex uint64,
+	refblock []byte, refblockEmpty bool, allocated *bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var offset uint64
+	var err error
+
+	if !refblockEmpty && reftableIndex >= uint64(len(*reftable)) {
+		newReftableSize := round_up(reftableIndex+1, uint64(s.ClusterSize)/REFTABLE_ENTRY_SIZE)
+		if newReftableSize > QCOW_MAX_REFTABLE_SIZE/REFTABLE_ENTRY_SIZE {
+			return fmt.Errorf("this operation would make the refcount table grow " +
+				"beyond the maximum size supported, aborting")
+		}
+		*reftable = append(*reftable, make([]uint64, newReftableSize-uint64(len(*reftable)))...)
+	}
+
+	if !refblockEmpty && (*reftable)[reftableIndex] == 0 {
+		if offset, err = qcow2_alloc_clusters(bs, uint64(s.ClusterSize)); err != nil {
+			return fmt.Errorf("failed to allocate refblock, err: %v", err)
+		}
+		(*reftable)[reftableIndex] = offset
+		*allocated = true
+	}
+	return nil
+}
+
+// writes the new refblock to its allocated cluster
+func flush_refblock(bs *BlockDriverState, reftable *[]uint64, reftableIndex uint64,
+	refblock []byte, refblockEmpty bool, allocated *bool) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var err error
+
+	if reftableIndex < uint64(len(*reftable)) && (*reftable)[reftableIndex] > 0 {
+		offset := (*reftable)[reftableIndex]
+		if err = qcow2_pre_write_overlap_check(bs, 0, offset, uint64(s.ClusterSize), false); err != nil {
+			return fmt.Errorf("overlap check failed, err: %v", err)
+		}
+		if err = bdrv_pwrite(bs.current, offset, unsafe.Pointer(&refblock[0]), uint64(s.ClusterSize)); err != nil {
+			return fmt.Errorf("failed to write refblock, err: %v", err)
+		}
+	} else {
+		Assert(refblockEmpty)
+	}
+	return nil
+}
+
+/*
+* rewrites all the refcount structures with the new refcount order, the new
+* refblocks and the new reftable are allocated while being referenced by the
+* old structures, then the header is switched and the old structures are freed.
+ */
+func qcow2_change_refcount_order(bs *BlockDriverState, refcountOrder uint32, progress ProgressFunc) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	header := bs.current.header
+	var newReftable, oldReftable []uint64
+	var newReftableIndex, newReftableOffset, allocatedReftableSize uint64
+	var oldReftableOffset uint64
+	var oldReftableSize uint32
+	var oldRefcountOrder uint32
+	var walkIndex, totalWalks uint64
+	var newAllocation bool
+	var err error
+
+	Assert(s.QcowVersion >= 3)
+	Assert(refcountOrder <= QCOW2_MAX_REFCOUNT_ORDER)
+
+	newRefcountBits := uint64(1) << refcountOrder
+	/* see qcow2_open() */
+	newRefblockSize := uint64(1) << (s.ClusterBits - (refcountOrder - 3))
+	newSetRefcount := set_refcount_funcs[refcountOrder]
+	newRefblock := make([]byte, s.ClusterSize)
+
+	for {
+		newAllocation = false
+
+		/* At least we have to do this walk and the one which writes the
+		 * refblocks; also, at least we have to do this loop here at least
+		 * twice (normally), first to do the allocations, and second to
+		 * determine that everything is correctly allocated, this then makes
+		 * three walks in total */
+		totalWalks = max(walkIndex+2, 3)
+
+		/* First, allocate the structures so they are present in the refcount
+		 * structures */
+		if err = walk_over_reftable(bs, &newReftable, &newReftableIndex, nil,
+			newRefblockSize, newRefcountBits, alloc_refblock, &newAllocation, nil,
+			progress, walkIndex, totalWalks); err != nil {
+			goto done
+		}
+		walkIndex++
+		newReftableIndex = 0
+
+		if !newAllocation {
+			break
+		}
+		if newReftableOffset > 0 {
+			qcow2_free_clusters(bs, newReftableOffset, allocatedReftableSize*REFTABLE_ENTRY_SIZE,
+				QCOW2_DISCARD_NEVER)
+		}
+		if newReftableOffset, err = qcow2_alloc_clusters(bs,
+			uint64(len(newReftable))*REFTABLE_ENTRY_SIZE); err != nil {
+			newReftableOffset = 0
+			err = fmt.Errorf("failed to allocate the new reftable, err: %v", err)
+			goto done
+		}
+		allocatedReftableSize = uint64(len(newReftable))
+	}
+
+	/* Second, write the new refblocks */
+	if err = walk_over_reftable(bs, &newReftable, &newReftableIndex, newRefblock,
+		newRefblockSize, newRefcountBits, flush_refblock, &newAllocation, newSetRefcount,
+		progress, walkIndex, walkIndex+1); err != nil {
+		goto done
+	}
+	Assert(!newAllocation)
+
+	/* Write the new reftable */
+	if err = qcow2_pre_write_overlap_check(bs, 0, newReftableOffset,
+		uint64(len(newReftable))*REFTABLE_ENTRY_SIZE, false); err != nil {
+		err = fmt.Errorf("overlap check failed, err: %v", err)
+		goto done
+	}
+	if _, err = Blk_Pwrite_Object(bs.current, newReftableOffset, newReftable,
+		uint64(len(newReftable))*REFTABLE_ENTRY_SIZE); err != nil {
+		err = fmt.Errorf("failed to write the new reftable, err: %v", err)
+		goto done
+	}
+
+	/* Empty the refcount cache, the old refblocks are going to be freed */
+	if err = qcow2_cache_empty(bs, s.RefcountBlockCache); err != nil {
+		err = fmt.Errorf("failed to flush the refblock cache, err: %v", err)
+		goto done
+	}
+
+	/* Update the image header to point to the new reftable */
+	oldRefcountOrder = header.RefcountOrder
+	oldReftableOffset = header.RefcountTableOffset
+	oldReftableSize = header.RefcountTableClusters
+	header.RefcountOrder = refcountOrder
+	header.RefcountTableOffset = newReftableOffset
+	header.RefcountTableClusters = uint32(size_to_clusters(s, uint64(len(newReftable))*REFTABLE_ENTRY_SIZE))
+	if err = qcow2_update_header(bs); err == nil {
+		err = bdrv_flush(bs.current.bs)
+	}
+	if err != nil {
+		header.RefcountOrder = oldRefcountOrder
+		header.RefcountTableOffset = oldReftableOffset
+		header.RefcountTableClusters = oldReftableSize
+		err = fmt.Errorf("failed to update the qcow2 header, err: %v", err)
+		goto done
+	}
+
+	/* Now update the rest of the in-memory information */
+	oldReftable = s.RefcountTable
+	oldReftableSize = s.RefcountTableSize
+	s.RefcountTable = newReftable
+	s.RefcountTableSize = uint32(len(newReftable))
+	s.RefcountTableOffset = newReftableOffset
+	update_max_refcount_table_index(s)
+
+	s.RefcountOrder = refcountOrder
+	s.RefcountMax = uint64(1)<<(newRefcountBits-1) - 1 + uint64(1)<<(newRefcountBits-1)
+	s.RefcountBlockBits = s.ClusterBits - (refcountOrder - 3)
+	s.RefcountBlockSize = 1 << s.RefcountBlockBits
+	s.get_refcount = get_refcount_funcs[refcountOrder]
+	s.set_refcount = newSetRefcount
+	s.FreeClusterIndex = 0
+
+	/* For cleaning up all old refblocks and the old reftable below */
+	newReftable = oldReftable[:oldReftableSize]
+	newReftableOffset = oldReftableOffset
+
+done:
+	/* On success, newReftable actually holds the old reftable */
+	for _, entry := range newReftable {
+		if offset := entry & REFT_OFFSET_MASK; offset > 0 {
+			qcow2_free_clusters(bs, offset, uint64(s.ClusterSize), QCOW2_DISCARD_OTHER)
+		}
+	}
+	if newReftableOffset > 0 {
+		qcow2_free_clusters(bs, newReftableOffset, uint64(len(newReftable))*REFTABLE_ENTRY_SIZE,
+			QCOW2_DISCARD_OTHER)
+	}
+	if flushErr := qcow2_flush_caches(bs); err == nil {
+		err = flushErr
+	}
+	return err
+}
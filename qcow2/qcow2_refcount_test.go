@@ -10,16 +10,37 @@ import (
 func Test_get_set_refcount(t *testing.T) {
 
 	refcountArray := make([]uint16, 1<<15)
-	set_refcount(unsafe.Pointer(&refcountArray[0]), 1, 3)
-	val := get_refcount(unsafe.Pointer(&refcountArray[0]), 1)
-	assert.Equal(t, uint16(3), val)
+	set_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 1, 3)
+	val := get_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 1)
+	assert.Equal(t, uint64(3), val)
 
-	set_refcount(unsafe.Pointer(&refcountArray[0]), 11, 0)
-	val = get_refcount(unsafe.Pointer(&refcountArray[0]), 11)
-	assert.Equal(t, uint16(0), val)
+	set_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 11, 0)
+	val = get_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 11)
+	assert.Equal(t, uint64(0), val)
 
-	set_refcount(unsafe.Pointer(&refcountArray[0]), 111, 65535)
-	val = get_refcount(unsafe.Pointer(&refcountArray[0]), 111)
-	assert.Equal(t, uint16(65535), val)
+	set_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 111, 65535)
+	val = get_refcount_ro4(unsafe.Pointer(&refcountArray[0]), 111)
+	assert.Equal(t, uint64(65535), val)
 
 }
+
+func Test_get_set_refcount_orders(t *testing.T) {
+
+	for order := range get_refcount_funcs {
+		refcountArray := make([]byte, DEFAULT_CLUSTER_SIZE)
+		p := unsafe.Pointer(&refcountArray[0])
+		maxValue := uint64(1)<<(1<<order) - 1
+		if order == 6 {
+			maxValue = ^uint64(0)
+		}
+		//the neighbours must be kept when packing narrow refcounts
+		set_refcount_funcs[order](p, 10, maxValue)
+		set_refcount_funcs[order](p, 11, 1)
+		set_refcount_funcs[order](p, 12, maxValue)
+		set_refcount_funcs[order](p, 12, 0)
+		assert.Equal(t, maxValue, get_refcount_funcs[order](p, 10))
+		assert.Equal(t, uint64(1), get_refcount_funcs[order](p, 11))
+		assert.Equal(t, uint64(0), get_refcount_funcs[order](p, 12))
+		assert.Equal(t, uint64(0), get_refcount_funcs[order](p, 9))
+	}
+}
@@ -0,0 +1,177 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// an allocated cluster of the active image, which may read as zeroes
+type sparsifyCandidate struct {
+	offset   uint64 //the guest offset
+	l2Entry  uint64
+	l2Bitmap uint64
+}
+
+/*
+* sparsify the image, the data clusters and subclusters of the active image
+* whose content is all zeroes are turned into zero clusters and subclusters,
+* and the host clusters which are no longer used are freed. zero clusters
+* read as zeroes regardless of the backing file, so the guest visible content
+* doesn't change. the freed clusters can be given back by compacting the image.
+ */
+func qcow2_sparsify(bs *BlockDriverState, progress ProgressFunc) (*BlockSparsifyResult, error) {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var result BlockSparsifyResult
+	var l2Slice unsafe.Pointer
+	var candidates []sparsifyCandidate
+	var i, j, k uint32
+	var err error
+	buf := make([]byte, s.ClusterSize)
+	slicesPerTable := s.L2Size / uint32(s.L2SliceSize)
+	virtualSize := bs.TotalSectors << BDRV_SECTOR_BITS
+
+	if data_file_is_raw(bs) {
+		return nil, fmt.Errorf("cannot sparsify an image with a raw data file")
+	}
+	if s.QcowVersion < 3 && bs.backing != nil {
+		return nil, fmt.Errorf("cannot sparsify a version 2 image with a backing file")
+	}
+
+	s.Qlock()
+	defer s.Qunlock()
+	if s.SignaledCorruption {
+		return nil, ERR_EIO
+	}
+
+	for i = 0; i < s.L1Size; i++ {
+		if progress != nil {
+			progress(uint64(i), uint64(s.L1Size))
+		}
+		l2Offset := s.L1Table[i] & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		for j = 0; j < slicesPerTable; j++ {
+			if l2Slice, err = qcow2_cache_get(bs, s.L2TableCache,
+				l2Offset+uint64(j)*uint64(s.L2SliceSize)*l2_entry_size(s)); err != nil {
+				return nil, err
+			}
+			candidates = candidates[:0]
+			for k = 0; k < uint32(s.L2SliceSize); k++ {
+				l2Entry := get_l2_entry(s, l2Slice, k)
+				ctype := qcow2_get_cluster_type(bs, l2Entry)
+				if ctype != QCOW2_CLUSTER_NORMAL && ctype != QCOW2_CLUSTER_ZERO_ALLOC {
+					continue
+				}
+				offset := uint64(i)<<(s.L2Bits+s.ClusterBits) |
+					uint64(j*uint32(s.L2SliceSize)+k)<<s.ClusterBits
+				if offset >= virtualSize {
+					break
+				}
+				candidates = append(candidates, sparsifyCandidate{offset: offset,
+					l2Entry: l2Entry, l2Bitmap: get_l2_bitmap(s, l2Slice, k)})
+			}
+			qcow2_cache_put(s.L2TableCache, l2Slice)
+
+			for _, c := range candidates {
+				if err = sparsify_cluster(bs, c, buf, &result); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if progress != nil {
+		progress(uint64(s.L1Size), uint64(s.L1Size))
+	}
+	if err = qcow2_flush_caches(bs); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func sparsify_cluster(bs *BlockDriverState, c sparsifyCandidate, buf []byte, result *BlockSparsifyResult) error {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	var sc uint64
+	var err error
+	hostOffset := c.l2Entry & L2E_OFFSET_MASK
+	bytes := min(uint64(s.ClusterSize), bs.TotalSectors<<BDRV_SECTOR_BITS-c.offset)
+
+	if qcow2_get_cluster_type(bs, c.l2Entry) == QCOW2_CLUSTER_NORMAL {
+		if err = bdrv_pread(s.DataFile, hostOffset, unsafe.Pointer(&buf[0]), bytes); err != nil {
+			return err
+		}
+		if !sparsify_covers_cluster(bs, c.l2Bitmap, bytes) || !buffer_is_zero(buf, bytes) {
+			if !has_subclusters(s) {
+				return nil
+			}
+			/* the cluster stays allocated, but its zero subclusters don't */
+			for sc = 0; sc < s.SubclustersPerCluster; sc++ {
+				start := sc * s.SubclusterSize
+				if c.l2Bitmap&qcow_oflag_sub_alloc(uint32(sc)) == 0 || start >= bytes {
+					continue
+				}
+				if !buffer_is_zero(buf[start:], min(s.SubclusterSize, bytes-start)) {
+					continue
+				}
+				if err = zero_l2_subclusters(bs, c.offset+start, 1); err != nil {
+					return err
+				}
+				result.ZeroedBytes += min(s.SubclusterSize, bytes-start)
+			}
+			return nil
+		}
+	}
+
+	/* the whole cluster reads as zeroes, its host cluster is freed */
+	if s.QcowVersion < 3 {
+		/* no backing file, an unallocated cluster reads as zeroes as well */
+		err = qcow2_cluster_discard(bs, c.offset, bytes, QCOW2_DISCARD_REQUEST, true)
+	} else {
+		err = qcow2_subcluster_zeroize(bs, c.offset, bytes, BDRV_REQ_MAY_UNMAP)
+	}
+	if err != nil {
+		return err
+	}
+	result.ZeroedBytes += bytes
+	result.FreedClusters++
+	return nil
+}
+
+/*
+* a cluster can only become a zero cluster as a whole if none of its
+* subclusters reads from the backing file.
+ */
+func sparsify_covers_cluster(bs *BlockDriverState, l2Bitmap uint64, bytes uint64) bool {
+
+	s := bs.opaque.(*BDRVQcow2State)
+	if !has_subclusters(s) || bs.backing == nil {
+		return true
+	}
+	for sc := uint64(0); sc < s.SubclustersPerCluster && sc*s.SubclusterSize < bytes; sc++ {
+		if l2Bitmap&(qcow_oflag_sub_alloc(uint32(sc))|qcow_oflag_sub_zero(uint32(sc))) == 0 {
+			return false
+		}
+	}
+	return true
+}
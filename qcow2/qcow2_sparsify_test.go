@@ -0,0 +1,94 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sparsify(t *testing.T) {
+	var baseFile = "/tmp/sparsify_base.qcow2"
+	var filename = "/tmp/sparsify.qcow2"
+	backingBuf := bytes.Repeat([]byte{0x5a}, 4*65536)
+	buf := bytes.Repeat([]byte{0x11}, 65536)
+	zeroes := make([]byte, 65536)
+	readBuf := make([]byte, 65536)
+
+	for _, subcluster := range []bool{false, true} {
+		base := create_compare_image(t, baseFile, "")
+		_, err := Blk_Pwrite(base, 0, backingBuf, uint64(len(backingBuf)), 0)
+		assert.Nil(t, err)
+		Blk_Close(base)
+
+		os.Remove(filename)
+		err = Blk_Create(filename, map[string]any{
+			OPT_SIZE:             4 * 1048576,
+			OPT_FILENAME:         filename,
+			OPT_FMT:              "qcow2",
+			OPT_SUBCLUSTER:       subcluster,
+			OPT_BACKING:          baseFile,
+			OPT_BACKING_FILE_FMT: "qcow2",
+		})
+		assert.Nil(t, err)
+		root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+
+		//clusters 0 and 1 are written with zeroes as data, cluster 2 with data
+		_, err = Blk_Pwrite(root, 0, zeroes, 65536, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 65536, zeroes, 65536, 0)
+		assert.Nil(t, err)
+		_, err = Blk_Pwrite(root, 2*65536, buf, 65536, 0)
+		assert.Nil(t, err)
+		//cluster 3 is partially written with zeroes, the rest reads from the backing file
+		_, err = Blk_Pwrite(root, 3*65536, zeroes[:4096], 4096, 0)
+		assert.Nil(t, err)
+
+		res, err := Blk_Sparsify(root, nil)
+		assert.Nil(t, err)
+		if subcluster {
+			assert.Equal(t, uint64(2*65536+4096), res.ZeroedBytes)
+		} else {
+			//the whole cluster 3 is allocated, but not zero
+			assert.Equal(t, uint64(2*65536), res.ZeroedBytes)
+		}
+		assert.Equal(t, uint64(2), res.FreedClusters)
+		Blk_Close(root)
+
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		for i, expected := range [][]byte{zeroes, zeroes, buf,
+			append(append([]byte{}, zeroes[:4096]...), backingBuf[4096:65536]...)} {
+			_, err = Blk_Pread(root, uint64(i)*65536, readBuf, 65536)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, readBuf)
+		}
+		//nothing left to sparsify
+		res, err = Blk_Sparsify(root, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), res.ZeroedBytes)
+
+		check, err := Blk_Check(root, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, check.Corruptions)
+		assert.Equal(t, 0, check.Leaks)
+		Blk_Close(root)
+	}
+}
+
+func Test_sparsify_in_flight(t *testing.T) {
+	var filename = "/tmp/sparsify_in_flight.qcow2"
+	root := open_slow_image(t, filename)
+	//the clusters overwritten by the slow write read as zeroes until its data is written
+	_, err := Blk_Pwrite(root, 4*1048576, make([]byte, 2*1048576), 2*1048576, 0)
+	assert.Nil(t, err)
+
+	run_with_slow_write(t, root, func() {
+		_, err := Blk_Sparsify(root, nil)
+		assert.Nil(t, err)
+	})
+	Blk_Close(root)
+	os.Remove(filename)
+}
@@ -1,15 +1,14 @@
 package qcow2
 
 import (
-	"container/list"
 	"context"
 	"sync"
 )
 
 type AioTaskFunc func(task *Qcow2Task) error
-type AioTaskRoutineFunc func(ctx context.Context, taskList *SignalList)
 
 type Qcow2Task struct {
+	ctx            context.Context /* the request's context, checked by the task functions */
 	bs             *BlockDriverState
 	subclusterType QCow2SubclusterType
 	hostOffset     uint64
@@ -18,60 +17,115 @@ type Qcow2Task struct {
 	qiov           *QEMUIOVector
 	qiovOffset     uint64
 	l2meta         *QCowL2Meta /* only for write */
-	completeCh     chan any
-	errorCh        chan error
 	taskFunc       AioTaskFunc
+	pool           *AioTaskPool /* the request the task belongs to */
 }
 
-type SignalList struct {
-	list     *list.List
-	awakenCh chan any
-	lock     sync.RWMutex
+/*
+* The workers of an image, they run the tasks of the requests split into several
+* host ranges. The queue is bounded, submitting blocks while it's full. The workers
+* are started by the first submitted task.
+ */
+type AioWorkerPool struct {
+	workers int
+	queue   chan *Qcow2Task
+	start   sync.Once
+	stop    sync.Once
 }
 
-func NewSignalList() *SignalList {
-	return &SignalList{
-		list:     list.New(),
-		awakenCh: make(chan any),
+func NewAioWorkerPool(workers int, queueDepth int) *AioWorkerPool {
+	if workers <= 0 {
+		workers = QCOW2_MAX_WORKERS
 	}
+	if queueDepth <= 0 {
+		queueDepth = QCOW2_AIO_QUEUE_DEPTH
+	}
+	return &AioWorkerPool{
+		workers: workers,
+		queue:   make(chan *Qcow2Task, queueDepth),
+	}
+}
+
+func (p *AioWorkerPool) Workers() int {
+	return p.workers
+}
+
+func (p *AioWorkerPool) submit(task *Qcow2Task) {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go qcow2_aio_worker(p)
+		}
+	})
+	p.queue <- task
 }
 
-func (l *SignalList) Push(ele any) {
-	l.lock.Lock()
-	l.list.PushBack(ele)
-	l.lock.Unlock()
-	l.awakenCh <- struct{}{}
+/*
+* stop the workers once they finished the queued tasks, no task may be submitted
+* afterwards. The image is closing, so no request is in flight any more.
+ */
+func (p *AioWorkerPool) shutdown() {
+	p.stop.Do(func() {
+		close(p.queue)
+	})
 }
 
-func (l *SignalList) Pop() any {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-	ele := l.list.Front()
-	if ele != nil {
-		l.list.Remove(ele)
-		return ele.Value
+func qcow2_aio_worker(p *AioWorkerPool) {
+	for task := range p.queue {
+		aio_task_run(task)
 	}
-	return nil
 }
 
-func qcow2_aio_routine(ctx context.Context, taskList *SignalList) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-taskList.awakenCh:
-			for {
-				obj := taskList.Pop()
-				if obj == nil {
-					break
-				}
-				task := obj.(*Qcow2Task)
-				if err := task.taskFunc(task); err != nil {
-					task.errorCh <- err
-				} else {
-					task.completeCh <- struct{}{}
-				}
-			}
+/*
+* The tasks in flight of one request, like qemu's AioTaskPool. At most maxBusyTasks
+* of them run at once, they may complete in any order. The status is the error of
+* the first failed task, the request stops submitting tasks once it's set and always
+* waits for the tasks in flight since they use its qiov.
+ */
+type AioTaskPool struct {
+	workers *AioWorkerPool
+	slots   chan struct{} /* one per busy task */
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	status  error
+}
+
+func aio_task_pool_new(workers *AioWorkerPool, maxBusyTasks int) *AioTaskPool {
+	return &AioTaskPool{
+		workers: workers,
+		slots:   make(chan struct{}, maxBusyTasks),
+	}
+}
+
+// wait for a free slot of the request and queue the task to the workers
+func aio_task_pool_start_task(pool *AioTaskPool, task *Qcow2Task) {
+	pool.slots <- struct{}{}
+	pool.wg.Add(1)
+	task.pool = pool
+	pool.workers.submit(task)
+}
+
+func aio_task_run(task *Qcow2Task) {
+	pool := task.pool
+	if err := task.taskFunc(task); err != nil {
+		pool.lock.Lock()
+		if pool.status == nil {
+			pool.status = err
 		}
+		pool.lock.Unlock()
+	}
+	<-pool.slots
+	pool.wg.Done()
+}
+
+func aio_task_pool_wait_all(pool *AioTaskPool) {
+	pool.wg.Wait()
+}
+
+func aio_task_pool_status(pool *AioTaskPool) error {
+	if pool == nil {
+		return nil
 	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.status
 }
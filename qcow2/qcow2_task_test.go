@@ -0,0 +1,158 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_aio_task_pool(t *testing.T) {
+	var busy, maxBusy, done int32
+	err1 := errors.New("first")
+	err2 := errors.New("second")
+
+	taskFunc := func(task *Qcow2Task) error {
+		n := atomic.AddInt32(&busy, 1)
+		for {
+			m := atomic.LoadInt32(&maxBusy)
+			if n <= m || atomic.CompareAndSwapInt32(&maxBusy, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&busy, -1)
+		atomic.AddInt32(&done, 1)
+		switch task.offset {
+		case 3:
+			return err1
+		case 5:
+			//fails after the first error is set
+			time.Sleep(20 * time.Millisecond)
+			return err2
+		}
+		return nil
+	}
+
+	//the tasks in flight are bounded by the request, the workers are shared
+	workers := NewAioWorkerPool(8, 1)
+	aio := aio_task_pool_new(workers, 3)
+	for i := 0; i < 10; i++ {
+		aio_task_pool_start_task(aio, &Qcow2Task{offset: uint64(i), taskFunc: taskFunc})
+	}
+	aio_task_pool_wait_all(aio)
+	assert.Equal(t, int32(10), done)
+	assert.LessOrEqual(t, maxBusy, int32(3))
+	//the first failure is kept
+	assert.Equal(t, err1, aio_task_pool_status(aio))
+	assert.Nil(t, aio_task_pool_status(nil))
+
+	//and bounded by the workers of the image
+	atomic.StoreInt32(&maxBusy, 0)
+	workers = NewAioWorkerPool(2, 1)
+	aio = aio_task_pool_new(workers, 8)
+	for i := 6; i < 16; i++ {
+		aio_task_pool_start_task(aio, &Qcow2Task{offset: uint64(i), taskFunc: taskFunc})
+	}
+	aio_task_pool_wait_all(aio)
+	assert.LessOrEqual(t, maxBusy, int32(2))
+	assert.Nil(t, aio_task_pool_status(aio))
+}
+
+func Test_aio_fragmented_requests(t *testing.T) {
+	var filename = "/tmp/test_aio_fragmented.qcow2"
+	const clusters = 32
+	os.Remove(filename)
+
+	err := Blk_Create_Opts(filename, &CreateOptions{Size: 4 * 1048576})
+	assert.Nil(t, err)
+	root, err := Blk_Open_Opts(filename, &OpenOptions{Workers: 4, QueueDepth: 2}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, root.bs.opaque.(*BDRVQcow2State).AioWorkers.Workers())
+
+	//allocate the clusters backwards, so that a request over them is split per cluster
+	for i := clusters - 1; i >= 0; i-- {
+		buf := bytes.Repeat([]byte{byte(i)}, DEFAULT_CLUSTER_SIZE)
+		_, err = Blk_Pwrite(root, uint64(i*DEFAULT_CLUSTER_SIZE), buf, DEFAULT_CLUSTER_SIZE, 0)
+		assert.Nil(t, err)
+	}
+
+	expected := make([]byte, clusters*DEFAULT_CLUSTER_SIZE)
+	for i := range expected {
+		expected[i] = byte(i / DEFAULT_CLUSTER_SIZE)
+	}
+	buf := make([]byte, len(expected))
+	_, err = Blk_Pread(root, 0, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+
+	//an unaligned write over the fragmented clusters and the unallocated ones after them
+	for i := range expected {
+		expected[i] = byte(i*7 + 1)
+	}
+	_, err = Blk_Pwrite(root, 1000, expected, uint64(len(expected)), 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pread(root, 1000, buf, uint64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+
+	res, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Corruptions)
+	assert.Equal(t, 0, res.Leaks)
+	Blk_Close(root)
+	os.Remove(filename)
+}
+
+func Test_aio_cow_read_in_worker(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "cow_base.qcow2")
+	var filename = filepath.Join(dir, "cow_overlay.qcow2")
+
+	err := Blk_Create_Opts(basefile, &CreateOptions{Size: 4 * 1048576})
+	assert.Nil(t, err)
+	base, err := Blk_Open_Opts(basefile, &OpenOptions{}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	expected := bytes.Repeat([]byte{0x5a}, DEFAULT_CLUSTER_SIZE)
+	_, err = Blk_Pwrite(base, 0, expected, DEFAULT_CLUSTER_SIZE, 0)
+	assert.Nil(t, err)
+	Blk_Close(base)
+
+	//the first subcluster is allocated, the others are read from the backing file
+	err = Blk_Create_Opts(filename, &CreateOptions{Size: 4 * 1048576, Subcluster: true, BackingFile: basefile})
+	assert.Nil(t, err)
+	root, err := Blk_Open_Opts(filename, &OpenOptions{Workers: 1, QueueDepth: 1}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	copy(expected, bytes.Repeat([]byte{0xa5}, int(s.SubclusterSize)))
+	_, err = Blk_Pwrite(root, 0, expected, s.SubclusterSize, 0)
+	assert.Nil(t, err)
+
+	//the COW read of both parts runs in the only worker of the image
+	buf := make([]byte, DEFAULT_CLUSTER_SIZE)
+	done := make(chan error, 1)
+	aio := aio_task_pool_new(s.AioWorkers, 1)
+	aio_task_pool_start_task(aio, &Qcow2Task{taskFunc: func(task *Qcow2Task) error {
+		var qiov QEMUIOVector
+		qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), DEFAULT_CLUSTER_SIZE)
+		err := do_perform_cow_read(root.bs, 0, 0, &qiov)
+		done <- err
+		return err
+	}})
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+		assert.Equal(t, expected, buf)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "the COW read waits for the workers it runs in")
+		return
+	}
+	aio_task_pool_wait_all(aio)
+	Blk_Close(root)
+}
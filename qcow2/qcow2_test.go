@@ -1,6 +1,7 @@
 package qcow2
 
 import (
+	"context"
 	"os"
 	"testing"
 	"unsafe"
@@ -45,13 +46,13 @@ func Test_qcow2_simple(t *testing.T) {
 	//check cache
 	cluster1Ref, err := qcow2_get_refcount(bs, 0)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster1Ref, uint16(1))
+	assert.Equal(t, cluster1Ref, uint64(1))
 	cluster4Ref, err := qcow2_get_refcount(bs, 3)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster4Ref, uint16(1))
+	assert.Equal(t, cluster4Ref, uint64(1))
 	cluster5Ref, err := qcow2_get_refcount(bs, 4)
 	assert.Nil(t, err)
-	assert.Equal(t, cluster5Ref, uint16(0))
+	assert.Equal(t, cluster5Ref, uint64(0))
 
 	//flush the cache
 	qcow2_cache_flush(bs, s.RefcountBlockCache)
@@ -102,13 +103,13 @@ func Test_qcow2_write_read(t *testing.T) {
 	bytes := uint64(len(buf))
 	var qiov QEMUIOVector
 	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
-	err = qcow2_pwritev_part(bs, 123, bytes, &qiov, 0, 0)
+	err = qcow2_pwritev_part(context.Background(), bs, 123, bytes, &qiov, 0, 0)
 	assert.Nil(t, err)
 
 	bufOut := make([]byte, bytes)
 	var qiovOut QEMUIOVector
 	qemu_iovec_init_buf(&qiovOut, unsafe.Pointer(&bufOut[0]), bytes)
-	err = qcow2_preadv_part(bs, 123, bytes, &qiovOut, 0, 0)
+	err = qcow2_preadv_part(context.Background(), bs, 123, bytes, &qiovOut, 0, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, "this is a test", string(bufOut))
 
@@ -144,7 +145,7 @@ func Test_qcow2_backup_write_read(t *testing.T) {
 	bytes := uint64(len(buf))
 	var qiov QEMUIOVector
 	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
-	err = qcow2_pwritev_part(bs, 123, bytes, &qiov, 0, 0)
+	err = qcow2_pwritev_part(context.Background(), bs, 123, bytes, &qiov, 0, 0)
 	assert.Nil(t, err)
 	//close base
 	qcow2_close(bs)
@@ -172,7 +173,7 @@ func Test_qcow2_backup_write_read(t *testing.T) {
 	bufOut := make([]byte, bytes)
 	var qiovOut QEMUIOVector
 	qemu_iovec_init_buf(&qiovOut, unsafe.Pointer(&bufOut[0]), bytes)
-	err = qcow2_preadv_part(bs, 123, bytes, &qiovOut, 0, 0)
+	err = qcow2_preadv_part(context.Background(), bs, 123, bytes, &qiovOut, 0, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, "this is a test", string(bufOut))
 
@@ -207,14 +208,14 @@ func Test_qcow2_write_read_zeros(t *testing.T) {
 	assert.NotNil(t, bs.Drv)
 
 	bytes := uint64(128)
-	err = qcow2_pwrite_zeroes(bs, 123, bytes, BDRV_REQ_ZERO_WRITE)
+	err = qcow2_pwrite_zeroes(context.Background(), bs, 123, bytes, BDRV_REQ_ZERO_WRITE)
 	assert.Nil(t, err)
 
 	//read from the overlay
 	bufOut := make([]byte, bytes)
 	var qiovOut QEMUIOVector
 	qemu_iovec_init_buf(&qiovOut, unsafe.Pointer(&bufOut[0]), bytes)
-	err = qcow2_preadv_part(bs, 123, bytes, &qiovOut, 0, 0)
+	err = qcow2_preadv_part(context.Background(), bs, 123, bytes, &qiovOut, 0, 0)
 	assert.Nil(t, err)
 	s := *(*string)(unsafe.Pointer(&bufOut[0]))
 	assert.Equal(t, "", s)
@@ -222,3 +223,55 @@ func Test_qcow2_write_read_zeros(t *testing.T) {
 	qcow2_close(bs)
 	os.Remove(filename)
 }
+
+func Test_qcow2_last_subcluster(t *testing.T) {
+	var filename = "/tmp/test_last_subcluster.qcow2"
+	os.Remove(filename)
+	err := Blk_Create(filename, map[string]any{OPT_SIZE: 1048576, OPT_FILENAME: filename,
+		OPT_FMT: "qcow2", OPT_SUBCLUSTER: true})
+	assert.Nil(t, err)
+	root, err := Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	bs := root.bs
+	s := bs.opaque.(*BDRVQcow2State)
+	cs, scs := uint64(s.ClusterSize), uint64(s.SubclusterSize)
+
+	//the zero flag of the last subcluster is the sign bit of the bitmap
+	assert.EqualValues(t, QCOW2_SUBCLUSTER_ZERO_PLAIN, qcow2_get_subcluster_type(bs, 0, 1<<63, 31))
+	assert.EqualValues(t, QCOW2_SUBCLUSTER_UNALLOCATED_PLAIN, qcow2_get_subcluster_type(bs, 0, 1<<63, 30))
+
+	buf := make([]byte, cs)
+	for i := range buf {
+		buf[i] = 0xaa
+	}
+	_, err = Blk_Pwrite(root, 0, buf, cs, 0)
+	assert.Nil(t, err)
+	_, err = Blk_Pwrite_Zeroes(root, cs-scs, scs, 0)
+	assert.Nil(t, err)
+
+	for _, c := range []struct {
+		offset uint64
+		scType QCow2SubclusterType
+	}{{0, QCOW2_SUBCLUSTER_NORMAL}, {cs - scs - 1, QCOW2_SUBCLUSTER_NORMAL},
+		{cs - scs, QCOW2_SUBCLUSTER_ZERO_ALLOC}} {
+		var hostOffset uint64
+		var scType QCow2SubclusterType
+		bytes := uint32(1)
+		s.Qlock()
+		err = qcow2_get_host_offset(bs, c.offset, &bytes, &hostOffset, &scType)
+		s.Qunlock()
+		assert.Nil(t, err)
+		assert.Equal(t, c.scType, scType, "offset %d", c.offset)
+	}
+
+	out := make([]byte, cs)
+	_, err = Blk_Pread(root, 0, out, cs)
+	assert.Nil(t, err)
+	assert.Equal(t, buf[:cs-scs], out[:cs-scs])
+	assert.Equal(t, make([]byte, scs), out[cs-scs:])
+	check, err := Blk_Check(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, check.Corruptions)
+	Blk_Close(root)
+	os.Remove(filename)
+}
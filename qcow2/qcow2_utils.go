@@ -101,6 +101,14 @@ func set_l2_bitmap(s *BDRVQcow2State, l2Slice unsafe.Pointer, idx uint32, bitmap
 	*(*uint64)(unsafe.Pointer(uintptr(l2Slice) + uintptr((idx+1)*uint32(SIZE_UINT64)))) = cpu_to_be64(bitmap)
 }
 
+// return the host offset and the size of the compressed data a compressed cluster descriptor refers to
+func qcow2_parse_compressed_l2_entry(s *BDRVQcow2State, l2Entry uint64) (uint64, uint64) {
+	coffset := l2Entry & s.ClusterOffsetMask
+	nbCsectors := ((l2Entry >> s.CsizeShift) & s.CsizeMask) + 1
+	csize := nbCsectors*QCOW2_COMPRESSED_SECTOR_SIZE - (coffset & (QCOW2_COMPRESSED_SECTOR_SIZE - 1))
+	return coffset, csize
+}
+
 func has_subclusters(s *BDRVQcow2State) bool {
 	return s.IncompatibleFeatures&QCOW2_INCOMPAT_EXTL2 > 0
 }
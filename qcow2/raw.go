@@ -22,6 +22,7 @@ SOFTWARE.
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -35,12 +36,14 @@ func newRawDriver() *BlockDriver {
 		bdrv_close:           raw_close,
 		bdrv_flush_to_disk:   raw_flush_to_disk,
 		bdrv_getlength:       raw_getlength,
+		bdrv_truncate:        raw_truncate,
 		bdrv_preadv:          raw_preadv,
 		bdrv_pwritev:         raw_pwritev,
 		bdrv_block_status:    raw_block_status,
 		bdrv_pwrite_zeroes:   raw_pwrite_zeroes,
 		bdrv_copy_range_from: raw_copy_range_from,
 		bdrv_copy_range_to:   raw_copy_range_to,
+		bdrv_measure:         raw_measure,
 	}
 }
 
@@ -73,6 +76,13 @@ func raw_create(filename string, options map[string]any) error {
 		return fmt.Errorf("failed to open %s, err: %v", filename, err)
 	}
 	defer file.Close()
+
+	//the file is sparse, it reads as zeroes up to the size
+	if val, ok := options[OPT_SIZE]; ok {
+		if err = file.Truncate(int64(interface2uint64(val))); err != nil {
+			return fmt.Errorf("failed to truncate %s, err: %v", filename, err)
+		}
+	}
 	return nil
 }
 
@@ -91,16 +101,30 @@ func raw_open(filename string, options map[string]any, flags int) (*BlockDriverS
 		return nil, fmt.Errorf("failed to open %s, err: %v", filename, err)
 	}
 
+	//io_uring if requested, the synchronous syscalls if it's not available
+	var ring *IoUring
+	if flags&BDRV_O_IO_URING > 0 {
+		entries := uint64(QCOW2_AIO_QUEUE_DEPTH)
+		if val, ok := options[OPT_AIO_QUEUE_DEPTH]; ok && interface2uint64(val) > 0 {
+			entries = interface2uint64(val)
+		}
+		if ring, err = newIoUring(file, uint32(entries)); err != nil && err != ERR_ENOTSUP {
+			file.Close()
+			return nil, fmt.Errorf("failed to set up io_uring for %s, err: %v", filename, err)
+		}
+	}
+
 	//initiate the BlockDriverState struct
 	bs := &BlockDriverState{
 		filename: filename,
 		opaque: &BDRVRawState{
 			File: file,
+			Ring: ring,
 		},
 		current:             nil,
 		backing:             nil,
 		options:             make(map[string]any),
-		SupportedWriteFlags: 0,
+		SupportedWriteFlags: BDRV_REQ_FUA, /* written with RWF_DSYNC */
 		RequestAlignment:    DEFAULT_ALIGNMENT,
 		MaxTransfer:         DEFAULT_MAX_TRANSFER,
 		OpenFlags:           flags,
@@ -114,6 +138,11 @@ func raw_close(bs *BlockDriverState) {
 	if s == nil || s.File == nil {
 		return
 	}
+	//the ring accesses the file until it's closed
+	if s.Ring != nil {
+		s.Ring.close()
+		s.Ring = nil
+	}
 	s.File.Close()
 }
 
@@ -131,16 +160,15 @@ func raw_getlength(bs *BlockDriverState) (uint64, error) {
 	return uint64(info.Size()), nil
 }
 
-func raw_preadv(bs *BlockDriverState, offset uint64, bytes uint64,
+func raw_preadv(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
-	return raw_preadv_part(bs, offset, bytes, qiov, 0, flags)
+	return raw_preadv_part(ctx, bs, offset, bytes, qiov, 0, flags)
 }
 
-func raw_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
+func raw_preadv_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	var localQiov QEMUIOVector
-	var err error
 	s := bs.opaque.(*BDRVRawState)
 	if s == nil || s.File == nil {
 		return Err_NullObject
@@ -151,21 +179,24 @@ func raw_preadv_part(bs *BlockDriverState, offset uint64, bytes uint64,
 		qiov = &localQiov
 	}
 
-	//call physical read for the qiov buffer
-	ctx := context.Background()
-	_, err = preadv(ctx, s.File, qiov.iov, qiov.niov, offset)
+	//call physical read for the qiov buffer, the part beyond the end of the file reads as zeroes
+	n, err := preadv(ctx, s.File, s.Ring, qiov.iov, qiov.niov, offset)
+	if err == io.EOF || (err == nil && n < bytes) {
+		qemu_iovec_memset(qiov, n, 0, bytes-n)
+		err = nil
+	}
 	if qiov == &localQiov {
 		qemu_iovec_destroy(&localQiov)
 	}
 	return err
 }
 
-func raw_pwritev(bs *BlockDriverState, offset uint64, bytes uint64,
+func raw_pwritev(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error {
-	return raw_pwritev_part(bs, offset, bytes, qiov, 0, flags)
+	return raw_pwritev_part(ctx, bs, offset, bytes, qiov, 0, flags)
 }
 
-func raw_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
+func raw_pwritev_part(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error {
 
 	s := bs.opaque.(*BDRVRawState)
@@ -180,9 +211,12 @@ func raw_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 		qiov = &localQiov
 	}
 
-	//call physical read for the qiov buffer
-	ctx := context.Background()
-	_, err = pwritev(ctx, s.File, qiov.iov, qiov.niov, offset)
+	//call physical write for the qiov buffer
+	rwFlags := 0
+	if flags&BDRV_REQ_FUA > 0 {
+		rwFlags |= RWF_DSYNC
+	}
+	_, err = pwritev(ctx, s.File, s.Ring, qiov.iov, qiov.niov, offset, rwFlags)
 	if qiov == &localQiov {
 		qemu_iovec_destroy(&localQiov)
 	}
@@ -191,18 +225,40 @@ func raw_pwritev_part(bs *BlockDriverState, offset uint64, bytes uint64,
 
 func raw_flush_to_disk(bs *BlockDriverState) error {
 	s := bs.opaque.(*BDRVRawState)
-	return s.File.Sync()
+	return file_fsync(s.File, s.Ring)
 }
 
 func raw_block_status(bs *BlockDriverState, wantZero bool, offset uint64,
 	bytes uint64, pnum *uint64, tmap *uint64, file **BlockDriverState) (uint64, error) {
-	fmt.Println("[raw_block_status] no implementation")
-	return 0, nil
+	/* no allocation information, treat the whole range as data */
+	*pnum = bytes
+	*tmap = offset
+	*file = bs
+	return BDRV_BLOCK_DATA | BDRV_BLOCK_OFFSET_VALID, nil
 }
 
-func raw_pwrite_zeroes(bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
-	fmt.Println("[raw_pwrite_zeroes] no implementation")
-	return nil
+func raw_truncate(bs *BlockDriverState, offset uint64) error {
+	s := bs.opaque.(*BDRVRawState)
+
+	if s == nil || s.File == nil {
+		return Err_NullObject
+	}
+	return s.File.Truncate(int64(offset))
+}
+
+/*
+* zero the range with fallocate, ERR_ENOTSUP makes the caller fall back to writing
+* a buffer of zeroes if the platform or the file system can't.
+ */
+func raw_pwrite_zeroes(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error {
+	s := bs.opaque.(*BDRVRawState)
+	if s == nil || s.File == nil {
+		return Err_NullObject
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return file_fallocate(s.File, s.Ring, FALLOC_FL_ZERO_RANGE, offset, bytes)
 }
 
 func raw_copy_range_from(bs *BlockDriverState, src *BdrvChild, offset uint64,
@@ -218,3 +274,20 @@ func raw_copy_range_to(bs *BlockDriverState, src *BdrvChild, offset uint64,
 	fmt.Println("[raw_copy_range_to] no implementation")
 	return nil
 }
+
+func raw_measure(options map[string]any, inBs *BlockDriverState) (*BlockMeasureInfo, error) {
+
+	var required uint64
+	var err error
+	if inBs != nil {
+		if required, err = bdrv_getlength(inBs); err != nil {
+			return nil, err
+		}
+	} else if val, ok := options[OPT_SIZE]; ok {
+		required = round_up(interface2uint64(val), BDRV_SECTOR_SIZE)
+	}
+	return &BlockMeasureInfo{
+		Required:       required,
+		FullyAllocated: required,
+	}, nil
+}
@@ -1,6 +1,7 @@
 package qcow2
 
 import (
+	"context"
 	"os"
 	"testing"
 	"unsafe"
@@ -60,13 +61,13 @@ func Test_raw_write_read(t *testing.T) {
 	bytes := uint64(len(buf))
 	var qiov QEMUIOVector
 	qemu_iovec_init_buf(&qiov, unsafe.Pointer(&buf[0]), bytes)
-	err = raw_pwritev_part(bs, 123, bytes, &qiov, 0, 0)
+	err = raw_pwritev_part(context.Background(), bs, 123, bytes, &qiov, 0, 0)
 	assert.Nil(t, err)
 
 	bufOut := make([]byte, bytes)
 	var qiovOut QEMUIOVector
 	qemu_iovec_init_buf(&qiovOut, unsafe.Pointer(&bufOut[0]), bytes)
-	err = raw_preadv_part(bs, 123, bytes, &qiovOut, 0, 0)
+	err = raw_preadv_part(context.Background(), bs, 123, bytes, &qiovOut, 0, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, "this is a test", string(bufOut))
 
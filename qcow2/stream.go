@@ -0,0 +1,176 @@
+package qcow2
+
+/*
+Copyright (c) 2023 Yunpeng Deng
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+/*
+* copy every range which is unallocated in the top image but allocated
+* in one of the images between the top and the base into the top image,
+* then make the base the new backing file of the top image.
+* an empty base means to flatten the whole backing chain.
+ */
+func Blk_Stream(root *BdrvChild, base string, progress ProgressFunc) error {
+
+	var baseBs *BlockDriverState
+	if root == nil || root.bs == nil {
+		return Err_NullObject
+	}
+	if err := blk_inc_in_flight(context.Background(), root); err != nil {
+		return err
+	}
+	if base != "" {
+		if baseBs = bdrv_find_backing_image(root.bs, base); baseBs == nil {
+			blk_dec_in_flight(root)
+			return fmt.Errorf("can not find '%s' in the backing chain", base)
+		}
+	}
+	err := bdrv_stream(root, baseBs, progress)
+	blk_dec_in_flight(root)
+	if err != nil {
+		return err
+	}
+
+	/* the reads follow the backing links, the chain is switched while none is in flight */
+	if err = bdrv_drained_begin_exclusive(root.bs); err != nil {
+		return err
+	}
+	defer bdrv_drained_end_exclusive(root.bs)
+	return bdrv_drop_intermediate(root.bs, baseBs)
+}
+
+func bdrv_stream(child *BdrvChild, base *BlockDriverState, progress ProgressFunc) error {
+
+	bs := child.bs
+	var baseOverlay, p *BlockDriverState
+	var length, offset, n uint64
+	var ret uint64
+	var depth int
+	var err error
+
+	if bs.OpenFlags&BDRV_O_RDWR == 0 {
+		return Err_NoWritePerm
+	}
+	if bdrv_cow_bs(bs) == base {
+		/* nothing to stream */
+		return nil
+	}
+	/* the image right above the base, which is the last one to stream from */
+	for p = bs; bdrv_cow_bs(p) != base; p = bdrv_cow_bs(p) {
+		baseOverlay = bdrv_cow_bs(p)
+	}
+
+	if length, err = bdrv_getlength(bs); err != nil {
+		return err
+	}
+
+	for offset = 0; offset < length; offset += n {
+		copy := false
+
+		if ret, err = bdrv_is_allocated(bs, offset, STREAM_CHUNK, &n); err != nil {
+			return err
+		}
+		if ret == 0 {
+			/* Copy if allocated in the intermediate images. */
+			if depth, err = bdrv_is_allocated_above(bdrv_cow_bs(bs), baseOverlay, true,
+				offset, n, &n); err != nil {
+				return err
+			}
+			/* Finish early if end of backing file has been reached */
+			if depth == 0 && n == 0 {
+				n = length - offset
+			}
+			copy = depth > 0
+		}
+		if copy {
+			/* copy-on-read the range without handing the data to anyone */
+			if err = bdrv_preadv_part(context.Background(), child, offset, n, nil, 0,
+				BDRV_REQ_COPY_ON_READ|BDRV_REQ_PREFETCH); err != nil {
+				return err
+			}
+		}
+		if progress != nil {
+			progress(offset+n, length)
+		}
+	}
+	return nil
+}
+
+/*
+* rewrite the backing file of the top image to the base, then drop all
+* the intermediate images between them. The image must be drained.
+ */
+func bdrv_drop_intermediate(top *BlockDriverState, base *BlockDriverState) error {
+
+	var baseOverlay *BlockDriverState
+	var baseChild *BdrvChild
+	var backingFile, backingFmt string
+	var err error
+
+	if bdrv_cow_bs(top) == base {
+		return nil
+	}
+	for p := top; bdrv_cow_bs(p) != base; p = bdrv_cow_bs(p) {
+		if bdrv_cow_bs(p) == nil {
+			/* another stream dropped the base meanwhile */
+			return fmt.Errorf("can not find '%s' in the backing chain", base.filename)
+		}
+		baseOverlay = bdrv_cow_bs(p)
+	}
+	if base != nil {
+		baseChild = baseOverlay.backing
+		backingFile = baseChild.name
+		backingFmt = base.Drv.FormatName
+	}
+
+	if err = bdrv_flush(top); err != nil {
+		return err
+	}
+	if err = bdrv_change_backing_file(top, backingFile, backingFmt); err != nil {
+		return err
+	}
+
+	/* detach the base before closing the intermediate images */
+	baseOverlay.backing = nil
+	bdrv_close(top.backing.bs)
+	top.backing = nil
+	if baseChild != nil {
+		bdrv_link_backing(top, baseChild, backingFile)
+	}
+	return nil
+}
+
+func bdrv_find_backing_image(bs *BlockDriverState, backingFile string) *BlockDriverState {
+
+	absPath, _ := filepath.Abs(backingFile)
+	for child := bdrv_cow_child(bs); child != nil; child = bdrv_cow_child(child.bs) {
+		if child.name == backingFile || child.bs.filename == backingFile {
+			return child.bs
+		}
+		if path, err := filepath.Abs(child.name); err == nil && path == absPath {
+			return child.bs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepare_stream_chain(t *testing.T, basefile string, midfile string, topfile string) {
+	var err error
+	var root *BdrvChild
+
+	files := []string{basefile, midfile, topfile}
+	texts := []string{"this is the base", "this is the middle", "this is the top"}
+	for i, filename := range files {
+		var create_opts = map[string]any{
+			OPT_SIZE:     4 * 1048576,
+			OPT_FILENAME: filename,
+			OPT_FMT:      "qcow2",
+		}
+		if i > 0 {
+			create_opts[OPT_BACKING] = files[i-1]
+			create_opts[OPT_BACKING_FILE_FMT] = "qcow2"
+		}
+		err = Blk_Create(filename, create_opts)
+		assert.Nil(t, err)
+		root, err = Blk_Open(filename, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+		assert.Nil(t, err)
+		buf := ([]byte)(texts[i])
+		_, err = Blk_Pwrite(root, uint64(i)*1048576+123, buf, uint64(len(buf)), 0)
+		assert.Nil(t, err)
+		Blk_Close(root)
+	}
+}
+
+func check_stream_chain(t *testing.T, root *BdrvChild) {
+	texts := []string{"this is the base", "this is the middle", "this is the top"}
+	for i, text := range texts {
+		bufOut := make([]byte, len(text))
+		_, err := Blk_Pread(root, uint64(i)*1048576+123, bufOut, uint64(len(text)))
+		assert.Nil(t, err)
+		assert.Equal(t, text, string(bufOut))
+	}
+}
+
+func Test_stream_full(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+	var lastProgress, total uint64
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = Blk_Stream(root, "", func(current uint64, t uint64) {
+		lastProgress = current
+		total = t
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4*1048576), total)
+	assert.Equal(t, total, lastProgress)
+	assert.Nil(t, root.bs.backing)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+
+	//the flattened image no longer depends on its backing files
+	os.Remove(basefile)
+	os.Remove(midfile)
+	root, err = Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Nil(t, root.bs.backing)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+
+}
+
+func Test_stream_base(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = Blk_Stream(root, filepath.Join(dir, "not_in_chain.qcow2"), nil)
+	assert.NotNil(t, err)
+	err = Blk_Stream(root, basefile, nil)
+	assert.Nil(t, err)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+
+	//the middle image has been dropped from the chain
+	os.Remove(midfile)
+	root, err = Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.NotNil(t, root.bs.backing)
+	assert.Equal(t, basefile, root.bs.backing.name)
+	assert.Nil(t, root.bs.backing.bs.backing)
+	check_stream_chain(t, root)
+
+	//the base data is still not copied
+	var pnum uint64
+	ret, err := bdrv_is_allocated(root.bs, 123, 512, &pnum)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), ret)
+	Blk_Close(root)
+
+}
+
+func Test_stream_unknown_extension(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+	var ext = QCowUnknownExtension{Magic: 0x12345678, Data: []byte("an unknown extension")}
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	s.UnknownHeaderExts = append(s.UnknownHeaderExts, ext)
+	err = qcow2_update_header(root.bs)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	//the header rewrite of the stream keeps the extension
+	root, err = Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, []QCowUnknownExtension{ext}, s.UnknownHeaderExts)
+	err = Blk_Stream(root, basefile, nil)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s = root.bs.opaque.(*BDRVQcow2State)
+	assert.Equal(t, []QCowUnknownExtension{ext}, s.UnknownHeaderExts)
+	assert.Equal(t, "qcow2", s.ImageBackingFormat)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+
+}
+
+func Test_stream_backing_file_offset(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	//move the backing file name next to the header extensions as qemu places it
+	f, err := os.OpenFile(topfile, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], 4096)
+	_, err = f.WriteAt([]byte(midfile), 4096)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(make([]byte, len(midfile)), BACKING_FILE_OFFSET)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(offset[:], 8)
+	assert.Nil(t, err)
+	f.Close()
+
+	//the header rewrite keeps the backing file name
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	err = qcow2_update_header(root.bs)
+	assert.Nil(t, err)
+	Blk_Close(root)
+
+	root, err = Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	assert.Equal(t, midfile, root.bs.backingFile)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+
+}
+
+func Test_stream_concurrent_reads(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	//the readers go through the backing links while the chain is switched
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				check_stream_chain(t, root)
+			}
+		}()
+	}
+	err = Blk_Stream(root, basefile, nil)
+	assert.Nil(t, err)
+	err = Blk_Stream(root, "", nil)
+	assert.Nil(t, err)
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, root.bs.backing)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+}
+
+func Test_stream_change_backing_file_fail(t *testing.T) {
+	dir := t.TempDir()
+	var basefile = filepath.Join(dir, "stream_base.qcow2")
+	var midfile = filepath.Join(dir, "stream_mid.qcow2")
+	var topfile = filepath.Join(dir, "stream_top.qcow2")
+
+	prepare_stream_chain(t, basefile, midfile, topfile)
+
+	root, err := Blk_Open(topfile, map[string]any{OPT_FMT: "qcow2"}, BDRV_O_RDWR)
+	assert.Nil(t, err)
+	s := root.bs.opaque.(*BDRVQcow2State)
+	header := *root.bs.current.header
+
+	//the extensions don't fit before the backing file name, nothing is changed
+	s.UnknownHeaderExts = []QCowUnknownExtension{{Magic: 0x12345678, Data: make([]byte, BACKING_FILE_OFFSET)}}
+	err = bdrv_change_backing_file(root.bs, basefile, "raw")
+	assert.Equal(t, ERR_ENOSPC, err)
+	assert.Equal(t, header, *root.bs.current.header)
+	assert.Equal(t, midfile, root.bs.backingFile)
+	assert.Equal(t, "qcow2", s.ImageBackingFormat)
+
+	s.UnknownHeaderExts = nil
+	err = Blk_Stream(root, basefile, nil)
+	assert.Nil(t, err)
+	check_stream_chain(t, root)
+	Blk_Close(root)
+}
@@ -21,7 +21,9 @@ SOFTWARE.
 
 import (
 	"container/list"
+	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"sync"
 	"unsafe"
@@ -62,6 +64,7 @@ type QCowHeader struct {
 
 type BDRVRawState struct {
 	File      *os.File
+	Ring      *IoUring /* nil unless opened with BDRV_O_IO_URING and io_uring is available */
 	OpenFlags int
 	BufAlign  uint64
 
@@ -79,8 +82,13 @@ type BDRVQcow2State struct {
 	L1Size            uint32
 	RefcountBlockBits uint32
 	RefcountBlockSize uint32
+	RefcountOrder     uint32
+	RefcountMax       uint64
 
 	ClusterOffsetMask uint64
+	CsizeShift        uint32 //the position of the sector count in a compressed cluster descriptor
+	CsizeMask         uint64
+	CompressionType   uint8
 	L1TableOffset     uint64
 	L1Table           []uint64
 
@@ -95,7 +103,7 @@ type BDRVQcow2State struct {
 	FreeClusterIndex      uint64
 	QcowVersion           int
 
-	FreeByteOffset uint64 //not used
+	FreeByteOffset uint64 //the next free byte for the compressed clusters, 0 if a new cluster is needed
 	Lock           *sync.Mutex
 	Flags          int //not used
 
@@ -116,11 +124,21 @@ type BDRVQcow2State struct {
 
 	DataFile *BdrvChild
 
+	ImageDataFile      string
+	ImageBackingFormat string
+	UnknownHeaderExts  []QCowUnknownExtension
+
 	CacheDiscards      bool
 	DiscardPassthrough [QCOW2_DISCARD_MAX]bool
 
-	AioTaskList    *SignalList
-	AioTaskRoutine AioTaskRoutineFunc
+	Snapshots          []QCowSnapshot
+	SnapshotsOffset    uint64
+	SnapshotsSize      uint64
+	OverlapCheck       Qcow2MetadataOverlap
+	SignaledCorruption bool
+	CorruptionReason   string //why the image was marked corrupt while it's open
+
+	AioWorkers *AioWorkerPool /* run the tasks of the split requests */
 
 	/* The following fields are only valid for version >= 3 */
 	IncompatibleFeatures uint64
@@ -155,6 +173,8 @@ type QCowL2Meta struct {
 	/** Pointer to next L2Meta of the same write request */
 	Next         *QCowL2Meta
 	NextInFlight *list.Element
+	/* closed once the allocation is linked or aborted, overlapping allocations wait for it */
+	DependentRequests chan struct{}
 }
 
 type Qcow2COWRegion struct {
@@ -208,8 +228,8 @@ type BdrvRequestPadding struct {
 	LocalQiov  QEMUIOVector
 }
 
-type Get_Refcount_Func func(refcountArray unsafe.Pointer, index uint64) uint16
-type Set_Refcount_Func func(refcountArray unsafe.Pointer, index uint64, value uint16)
+type Get_Refcount_Func func(refcountArray unsafe.Pointer, index uint64) uint64
+type Set_Refcount_Func func(refcountArray unsafe.Pointer, index uint64, value uint64)
 
 type BlockDriverState struct {
 	opaque      any
@@ -221,7 +241,9 @@ type BlockDriverState struct {
 	//static configuration
 	RequestAlignment  uint32
 	PdiscardAlignment uint32
-	MaxTransfer       uint32
+	//the alignment of the zero writes, Max_WRITE_ZEROS if not set
+	PwriteZeroesAlignment uint32
+	MaxTransfer           uint32
 	//statistic information
 	InFlight            uint64
 	SupportedWriteFlags uint64
@@ -229,8 +251,37 @@ type BlockDriverState struct {
 	SupportedZeroFlags  uint64
 	OpenFlags           int /* flags used to open the file, re-used for re-open */
 	TotalSectors        uint64
+	DetectZeroes        string /* off, on or unmap, writes of zeroes are turned into zero writes unless off */
 	InheritsFrom        *BlockDriverState
 	Drv                 *BlockDriver
+	//the requests in flight are counted in InFlight as well, the image refuses new ones once closing
+	inFlightLock sync.Mutex
+	inFlightCond *sync.Cond
+	closing      bool
+	//the image is drained or paused, the requests of the user wait until it drops to zero
+	quiesceCounter int
+	//in-flight requests for the overlap detection, guarded by reqsLock
+	reqsLock            sync.Mutex
+	trackedRequests     list.List
+	serialisingInFlight int
+}
+
+/*
+ * A request in flight on a BlockDriverState, requests overlapping a serialising
+ * request wait until it ends, serialising requests wait for all overlapping ones.
+ */
+type BdrvTrackedRequest struct {
+	bs          *BlockDriverState
+	offset      uint64
+	bytes       uint64
+	isWrite     bool
+	serialising bool
+	/* the range to check for overlaps, it may be larger than the request */
+	overlapOffset uint64
+	overlapBytes  uint64
+	elem          *list.Element
+	done          chan struct{} /* closed when the request ends */
+	waitingFor    *BdrvTrackedRequest
 }
 
 type BdrvChild struct {
@@ -263,14 +314,20 @@ func (bs *BlockDriverState) Info(detail bool, pretty bool) string {
 	}
 	info.ClusterSize = 1 << bs.current.header.ClusterBits
 	info.RefcountBits = 1 << uint16(bs.current.header.RefcountOrder)
+	info.Compat = COMPAT_V3
+	if bs.current.header.Version == QCOW2_VERSION2 {
+		info.Compat = COMPAT_V2
+	}
 	info.ExtendedL2 = bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_EXTL2 > 0
+	info.Corrupt = bs.current.header.IncompatibleFeatures&QCOW2_INCOMPAT_CORRUPT > 0
 
 	//get backing chain
 	if bs.backing != nil {
 		getBackingChain(bs.backing, &info.BakcingFileChain)
 	}
+	s := bs.opaque.(*BDRVQcow2State)
+	info.CorruptReason = s.CorruptionReason
 	if has_data_file(bs) {
-		s := bs.opaque.(*BDRVQcow2State)
 		info.DataFile = s.DataFile.name
 	}
 
@@ -305,7 +362,7 @@ func scanRefcountTable(bs *BlockDriverState, stat *BlockStatistic) {
 			if p, err = load_refcount_block(bs, refcountBlockOffset); err != nil {
 				return
 			} else {
-				for j := uint64(0); j < DEFAULT_CLUSTER_SIZE/2; j++ {
+				for j := uint64(0); j < uint64(s.RefcountBlockSize); j++ {
 					if s.get_refcount(p, j) > 0 {
 						stat.TotalBlocks++
 					}
@@ -344,19 +401,22 @@ type Bdrv_Close_Func func(bs *BlockDriverState)
 type Bdrv_Create_Func func(filename string, options map[string]any) error
 type Bdrv_Block_Status_Func func(bs *BlockDriverState, want_zero bool, offset uint64, bytes uint64,
 	pnum *uint64, tmap *uint64, file **BlockDriverState) (uint64, error)
-type Bdrv_Pwritev_Func func(bs *BlockDriverState, offset uint64, bytes uint64,
+type Bdrv_Pwritev_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error
-type Bdrv_Preadv_Func func(bs *BlockDriverState, offset uint64, bytes uint64,
+type Bdrv_Preadv_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, flags BdrvRequestFlags) error
-type Bdrv_Pwritev_Part_Func func(bs *BlockDriverState, offset uint64, bytes uint64,
+type Bdrv_Pwritev_Part_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error
-type Bdrv_Preadv_Part_Func func(bs *BlockDriverState, offset uint64, bytes uint64,
+type Bdrv_Pwritev_Compressed_Part_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
+	qiov *QEMUIOVector, qiovOffset uint64) error
+type Bdrv_Preadv_Part_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64,
 	qiov *QEMUIOVector, qiovOffset uint64, flags BdrvRequestFlags) error
 type Bdrv_Flush_Func func(bs *BlockDriverState) error
 type Bdrv_Flush_To_Os_Func func(bs *BlockDriverState) error
 type Bdrv_Flush_To_Disk_Func func(bs *BlockDriverState) error
-type Bdrv_Pwrite_Zeroes_Func func(bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error
+type Bdrv_Pwrite_Zeroes_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64, flags BdrvRequestFlags) error
 type Bdrv_Getlength_Func func(bs *BlockDriverState) (uint64, error)
+type Bdrv_Truncate_Func func(bs *BlockDriverState, offset uint64) error
 
 type Bdrv_Copy_Range_From_Func func(bs *BlockDriverState, src *BdrvChild, srcOffset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
@@ -364,7 +424,16 @@ type Bdrv_Copy_Range_From_Func func(bs *BlockDriverState, src *BdrvChild, srcOff
 type Bdrv_Copy_Range_To_Func func(bs *BlockDriverState, src *BdrvChild, srcOffset uint64,
 	dst *BdrvChild, dstOffset uint64, bytes uint64,
 	readFlags BdrvRequestFlags, writeFlags BdrvRequestFlags) error
-type Bdrv_Pdiscard_Func func(bs *BlockDriverState, offset uint64, bytes uint64) error
+type Bdrv_Pdiscard_Func func(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64) error
+type Bdrv_Change_Backing_File_Func func(bs *BlockDriverState, backingFile string, backingFmt string) error
+type Bdrv_Check_Func func(bs *BlockDriverState, res *BlockCheckResult, fix BdrvCheckMode) error
+type Bdrv_Amend_Options_Func func(bs *BlockDriverState, options map[string]any, progress ProgressFunc) error
+type Bdrv_Measure_Func func(options map[string]any, inBs *BlockDriverState) (*BlockMeasureInfo, error)
+type Bdrv_Sparsify_Func func(bs *BlockDriverState, progress ProgressFunc) (*BlockSparsifyResult, error)
+type Bdrv_Compact_Func func(bs *BlockDriverState, opts *BlockCompactOptions, progress ProgressFunc) (*BlockCompactResult, error)
+
+// progress callback of the long running jobs, e.g. stream
+type ProgressFunc func(current uint64, total uint64)
 
 type BlockDriver struct {
 	FormatName     string
@@ -385,9 +454,19 @@ type BlockDriver struct {
 	bdrv_flush_to_disk   Bdrv_Flush_To_Disk_Func
 	bdrv_pwrite_zeroes   Bdrv_Pwrite_Zeroes_Func
 	bdrv_getlength       Bdrv_Getlength_Func
+	bdrv_truncate        Bdrv_Truncate_Func
 	bdrv_copy_range_from Bdrv_Copy_Range_From_Func //for convert copy
 	bdrv_copy_range_to   Bdrv_Copy_Range_To_Func   //for convert copy
 	bdrv_pdiscard        Bdrv_Pdiscard_Func
+
+	bdrv_change_backing_file Bdrv_Change_Backing_File_Func
+	bdrv_check               Bdrv_Check_Func
+	bdrv_measure             Bdrv_Measure_Func
+	bdrv_amend_options       Bdrv_Amend_Options_Func
+	bdrv_compact             Bdrv_Compact_Func
+	bdrv_sparsify            Bdrv_Sparsify_Func
+
+	bdrv_pwritev_compressed_part Bdrv_Pwritev_Compressed_Part_Func //writes whole clusters compressed
 }
 
 type BlockInfo struct {
@@ -397,7 +476,11 @@ type BlockInfo struct {
 	DiskSize     uint64 `json:"disk size"`
 	ClusterSize  uint32 `json:"cluster size"`
 	RefcountBits uint16 `json:"refcount bits"`
+	Compat       string `json:"compat"`
 	ExtendedL2   bool   `json:"extend l2"`
+	Corrupt      bool   `json:"corrupt"`
+	//the corruption found since the image was opened
+	CorruptReason string `json:"corrupt reason,omitempty"`
 	//backing chain
 	BakcingFileChain []string        `json:"backing chain"`
 	DataFile         string          `json:"data file,omitempty"`
@@ -435,3 +518,110 @@ type QCowExtension struct {
 	Magic  uint32
 	Length uint32
 }
+
+// a header extension this library doesn't know, kept to be written back unchanged
+type QCowUnknownExtension struct {
+	Magic uint32
+	Data  []byte
+}
+
+// the fixed part of an entry in the snapshot table
+type QCowSnapshotHeader struct {
+	L1TableOffset uint64
+	L1Size        uint32
+	IdStrSize     uint16
+	NameSize      uint16
+	DateSec       uint32
+	DateNsec      uint32
+	VmClockNsec   uint64
+	VmStateSize   uint32
+	ExtraDataSize uint32
+}
+
+type QCowSnapshot struct {
+	L1TableOffset uint64
+	L1Size        uint32
+}
+
+type BlockCheckResult struct {
+	Filename           string   `json:"filename"`
+	Format             string   `json:"format"`
+	CheckErrors        int      `json:"check errors"`
+	Corruptions        int      `json:"corruptions"`
+	Leaks              int      `json:"leaks"`
+	CorruptionsFixed   int      `json:"corruptions fixed"`
+	LeaksFixed         int      `json:"leaks fixed"`
+	ImageEndOffset     uint64   `json:"image end offset"`
+	TotalClusters      uint64   `json:"total clusters"`
+	AllocatedClusters  uint64   `json:"allocated clusters"`
+	FragmentedClusters uint64   `json:"fragmented clusters"`
+	Messages           []string `json:"messages,omitempty"`
+}
+
+func (res *BlockCheckResult) report(format string, args ...any) {
+	res.Messages = append(res.Messages, fmt.Sprintf(format, args...))
+}
+
+// an extent of the guest visible content sharing the same allocation state
+type BlockMapEntry struct {
+	Start     uint64 `json:"start"`
+	Length    uint64 `json:"length"`
+	Depth     int    `json:"depth"` //the depth in the backing chain, 0 for the top image
+	Present   bool   `json:"present"`
+	Zero      bool   `json:"zero"`
+	Data      bool   `json:"data"`
+	Offset    uint64 `json:"offset"` //the host offset in Filename, only valid if HasOffset
+	HasOffset bool   `json:"-"`
+	Filename  string `json:"filename,omitempty"`
+}
+
+// the host offset is only emitted if it is valid
+func (e BlockMapEntry) MarshalJSON() ([]byte, error) {
+	type entry BlockMapEntry
+	var offset *uint64
+	if e.HasOffset {
+		offset = &e.Offset
+	}
+	return json.Marshal(struct {
+		entry
+		Offset *uint64 `json:"offset,omitempty"`
+	}{entry(e), offset})
+}
+
+// the host size needed by an image
+type BlockMeasureInfo struct {
+	Required       uint64 `json:"required"`        //the size required for the image with its data
+	FullyAllocated uint64 `json:"fully allocated"` //the size required for the fully allocated image
+}
+
+// the options of converting an image into a newly created image
+type BlockConvertOptions struct {
+	TargetHasBacking bool //the target has a backing file with the same content as the source's backing chain
+	Readers          int  //the number of goroutines reading the source, 1 if not set
+	Writers          int  //the number of goroutines writing the target, 1 if not set
+	InOrder          bool //the target is written in the guest offset order by a single writer, which keeps the host allocation sequential
+	Compress         bool //the data clusters of the target are written compressed, the target must be a qcow2 image
+}
+
+// the options of compacting an image
+type BlockCompactOptions struct {
+	Reorder bool //rewrite the clusters in the guest offset order, so guest-contiguous ranges become host-contiguous
+}
+
+type BlockCompactResult struct {
+	MovedClusters uint64 `json:"moved clusters"`
+	OldSize       uint64 `json:"old size"` //the host size before compacting
+	NewSize       uint64 `json:"new size"` //the host size after compacting
+}
+
+type BlockSparsifyResult struct {
+	ZeroedBytes   uint64 `json:"zeroed bytes"`   //the guest bytes turned into zero clusters or subclusters
+	FreedClusters uint64 `json:"freed clusters"` //the host clusters no longer used
+}
+
+type BlockCompareResult struct {
+	Identical    bool   `json:"identical"`
+	Offset       uint64 `json:"offset"` //the first offset which differs, only valid if not identical
+	SizeMismatch bool   `json:"size mismatch"`
+	Message      string `json:"message"`
+}
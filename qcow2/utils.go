@@ -56,6 +56,16 @@ func be64_to_cpu(val uint64) uint64 {
 	return *(*uint64)(unsafe.Pointer(&dst[0]))
 }
 
+func cpu_to_be32(val uint32) uint32 {
+	return binary.BigEndian.Uint32(int_to_bytes32(val))
+}
+
+func be32_to_cpu(val uint32) uint32 {
+	dst := [4]byte{}
+	binary.BigEndian.PutUint32(dst[:], val)
+	return *(*uint32)(unsafe.Pointer(&dst[0]))
+}
+
 func cpu_to_be16(val uint16) uint16 {
 	return binary.BigEndian.Uint16(int_to_bytes16(val))
 }
@@ -75,6 +85,15 @@ func int_to_bytes64(val uint64) []byte {
 	return buf
 }
 
+func int_to_bytes32(val uint32) []byte {
+	buf := make([]uint8, 4)
+	for i := 0; i < 4; i++ {
+		buf[i] = uint8(val & 0xff)
+		val = val >> 8
+	}
+	return buf
+}
+
 func int_to_bytes16(val uint16) []byte {
 	buf := make([]uint8, 2)
 	for i := 0; i < 2; i++ {
@@ -110,6 +129,10 @@ func round_down[V uint64 | uint32 | int | int32 | int64](n, m V) V {
 	return n / m * m
 }
 
+func div_round_up[V uint64 | uint32 | int | int32 | int64](n, d V) V {
+	return (n + d - 1) / d
+}
+
 func max[V uint64 | uint32 | int | int32 | int64](vars ...V) V {
 	if len(vars) == 0 {
 		return 0
@@ -136,6 +159,15 @@ func min[V uint64 | uint32 | int | int32 | int64](vars ...V) V {
 	return min
 }
 
+/*
+ * Checks if the ranges [first1, first1+len1) and [first2, first2+len2) overlap
+ */
+func ranges_overlap(first1 uint64, len1 uint64, first2 uint64, len2 uint64) bool {
+	last1 := first1 + len1 - 1
+	last2 := first2 + len2 - 1
+	return !(last2 < first1 || last1 < first2)
+}
+
 /*
  * Checks if a buffer is all zeroes
  */
@@ -165,6 +197,10 @@ func interface2uint64(i interface{}) uint64 {
 		return uint64(i.(int))
 	case uint:
 		return uint64(i.(uint))
+	case int8:
+		return uint64(i.(int8))
+	case uint8:
+		return uint64(i.(uint8))
 	case int16:
 		return uint64(i.(int16))
 	case uint16: